@@ -2,17 +2,144 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
+	"errors"
 	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"k8s-tunnel/pkg/gateway"
 	"k8s-tunnel/pkg/log"
+	"k8s-tunnel/pkg/transport"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 )
 
-func init()  {
+func init() {
 	log.LogInit("server", logrus.DebugLevel)
 }
 
 func main() {
-	gw := NewGateway()
+	opt := &gateway.Option{}
+	var caCertFile, caKeyFile, tokensFile, usedTokensFile, revocationsFile, registryFile, adminTokenFile, webhookSecret, transports string
+	var webhooks []string
 
-	ctx := context.Background()
-	_ = gw.Serve(ctx)
-}
\ No newline at end of file
+	cmd := &cobra.Command{
+		Use: "",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+
+			names, err := transport.ParseNames(transports)
+			if err != nil {
+				return err
+			}
+			opt.Transports = names
+			if caCertFile != "" {
+				ca, err := gateway.LoadOrCreateCA(caCertFile, caKeyFile)
+				if err != nil {
+					return err
+				}
+				opt.CA = ca
+			}
+			if tokensFile != "" {
+				// 已用的 token 必须持久化, 否则重启后可以再次使用
+				if usedTokensFile == "" {
+					return errors.New("--used-tokens is required with --bootstrap-tokens-file")
+				}
+				tokens, err := gateway.LoadBootstrapTokens(tokensFile)
+				if err != nil {
+					return err
+				}
+				used, err := gateway.LoadUsedTokens(usedTokensFile)
+				if err != nil {
+					return err
+				}
+				opt.BootstrapTokens, opt.UsedTokens = tokens, used
+			}
+			if adminTokenFile != "" {
+				b, err := os.ReadFile(adminTokenFile)
+				if err != nil {
+					return err
+				}
+				token := strings.TrimSpace(string(b))
+				if token == "" {
+					return errors.New("--admin-token-file is empty")
+				}
+				opt.AuthenticateAdmin = bearerAuth(token)
+			}
+			if revocationsFile != "" {
+				revocations, err := gateway.LoadRevocations(revocationsFile)
+				if err != nil {
+					return err
+				}
+				opt.Revocations = revocations
+			}
+			if registryFile != "" {
+				registry, err := gateway.OpenRegistry(registryFile)
+				if err != nil {
+					return err
+				}
+				defer registry.Close()
+				opt.Registry = registry
+			}
+			for _, u := range webhooks {
+				opt.Webhooks = append(opt.Webhooks, gateway.Webhook{URL: u, Secret: webhookSecret})
+			}
+
+			return gateway.NewGateway(opt).Serve(ctx)
+		},
+	}
+
+	flags := cmd.Flags()
+	flags.StringVar(&opt.Addr, "addr", gateway.DefaultAddr, "listen address")
+	flags.StringVar(&transports, "transports", "websocket,http2,raw", "transports agents are allowed to connect with, raw requires --ca-cert")
+	flags.DurationVar(&opt.RequestTimeout, "request-timeout", 0, "time to wait for an agent response, 0 means no limit")
+	flags.DurationVar(&opt.OfflineGracePeriod, "offline-grace-period", 0, "time to hold proxy requests while an offline agent reconnects, 0 responds 503 immediately")
+	flags.IntVar(&opt.MaxPendingRequests, "max-pending-requests", gateway.DefaultMaxPendingRequests, "max requests per agent held during the offline grace period")
+	flags.DurationVar(&opt.CacheTTL, "cache-ttl", 0, "cache discovery responses for this long, OpenAPI documents for 10m, 0 disables the cache")
+	flags.IntVar(&opt.FanoutConcurrency, "fanout-concurrency", gateway.DefaultFanoutConcurrency, "max agents queried in parallel by a fan-out request")
+	flags.DurationVar(&opt.FanoutTimeout, "fanout-timeout", gateway.DefaultFanoutTimeout, "per-agent timeout of a fan-out request")
+	flags.StringVar(&caCertFile, "ca-cert", "", "certificate of the built-in CA, generated if not exist; enables https and agent client certificates")
+	flags.StringVar(&caKeyFile, "ca-key", "ca.key", "private key of the built-in CA")
+	flags.StringSliceVar(&opt.TLSHosts, "tls-hosts", gateway.DefaultTLSHosts, "host names and ips of the gateway serving certificate")
+	flags.DurationVar(&opt.AgentCertTTL, "agent-cert-ttl", gateway.DefaultAgentCertTTL, "lifetime of agent client certificates, renewed automatically")
+	flags.StringVar(&tokensFile, "bootstrap-tokens-file", "", "file of one-time tokens agents use to get their first certificate, one id.secret=agentName per line, empty agentName allows any agent")
+	flags.StringVar(&usedTokensFile, "used-tokens", "", "file to persist ids of used bootstrap tokens, required with --bootstrap-tokens-file")
+	flags.StringVar(&revocationsFile, "revocations", "", "file to persist revoked agents, tokens and certificate serials, empty keeps them in memory")
+	flags.DurationVar(&opt.RevalidateInterval, "revalidate-interval", gateway.DefaultRevalidateInterval, "interval to recheck revocation and certificate expiry of connected agents")
+	flags.StringVar(&adminTokenFile, "admin-token-file", "", "file holding the bearer token of the admin api (revocations, events, registry), the admin api is disabled without it")
+	flags.StringVar(&registryFile, "registry", "", "database file recording every registered agent and its connection history, empty disables it")
+	flags.StringSliceVar(&webhooks, "webhook", nil, "urls to post agent events to, repeatable")
+	flags.StringVar(&webhookSecret, "webhook-secret", "", "secret to sign webhook bodies with HMAC-SHA256, empty disables signing")
+	flags.IntVar(&opt.FlapThreshold, "flap-threshold", gateway.DefaultFlapThreshold, "registrations within --flap-window that mark an agent as flapping")
+	flags.DurationVar(&opt.FlapWindow, "flap-window", gateway.DefaultFlapWindow, "window to count agent registrations for flapping detection")
+	flags.DurationVar(&opt.PingLatencyThreshold, "ping-latency-threshold", gateway.DefaultPingLatencyThreshold, "ping round trip time above which a ping.degraded event is emitted")
+	rateLimitFlags(flags, &opt.AgentRateLimit, "agent", "per agent")
+	rateLimitFlags(flags, &opt.UserRateLimit, "user", "per user")
+	rateLimitFlags(flags, &opt.AgentUserRateLimit, "agent-user", "per agent and user")
+	flags.DurationVar(&opt.ShutdownTimeout, "shutdown-timeout", gateway.DefaultShutdownTimeout, "time to drain in-flight requests and notify agents on shutdown")
+
+	if err := cmd.Execute(); err != nil {
+		os.Exit(1)
+	}
+}
+
+func rateLimitFlags(flags *pflag.FlagSet, limit *gateway.RateLimit, prefix, desc string) {
+	flags.Float64Var(&limit.QPS, prefix+"-qps", 0, "proxy requests per second "+desc+", 0 means no limit")
+	flags.IntVar(&limit.Burst, prefix+"-burst", 0, "burst of proxy requests "+desc+", defaults to qps")
+	flags.IntVar(&limit.MaxInFlight, prefix+"-max-inflight", 0, "max in-flight proxy requests "+desc+", 0 means no limit")
+}
+
+// bearerAuth 管理接口的认证, 要求 Authorization: Bearer <token>
+func bearerAuth(token string) func(req *http.Request) error {
+	expect := []byte("Bearer " + token)
+	return func(req *http.Request) error {
+		if subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), expect) != 1 {
+			return errors.New("invalid admin token")
+		}
+		return nil
+	}
+}
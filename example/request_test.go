@@ -1,8 +1,8 @@
 package example
 
 import (
-	"fmt"
-	"io/ioutil"
+	"encoding/json"
+	"k8s-tunnel/pkg/tunneltest"
 	"net/http"
 	"net/url"
 	"testing"
@@ -11,16 +11,20 @@ import (
 
 // 通过中心端，请求远端接口
 func TestRequest(t *testing.T) {
-	simpleClientRequest()
-}
+	h := tunneltest.New(t, nil)
+	h.StartAgent("huawei")
 
-func simpleClientRequest() {
-	// after server，agent run
+	echo := simpleClientRequest(t, h.GatewayHost())
+	if echo.Method != http.MethodGet || echo.Path != "/test/hello" {
+		t.Fatalf("upstream got %s %s", echo.Method, echo.Path)
+	}
+}
 
+func simpleClientRequest(t *testing.T, gatewayHost string) *tunneltest.EchoResponse {
 	u := &url.URL{}
 	u.Scheme = "http"
 	// host 和 /proxies/huawei 是tunnel server 的path;
-	u.Host = "127.0.0.1:9991"
+	u.Host = gatewayHost
 	u.Path = "/proxies/huawei"
 	// 反向代理端的接口path
 	u.Path += "/test/hello"
@@ -32,13 +36,17 @@ func simpleClientRequest() {
 	}
 	resp, err := client.Do(req)
 	if err != nil {
-		panic(err)
+		t.Fatal(err)
 	}
 	defer resp.Body.Close()
 
-	b, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expect 200, got %d", resp.StatusCode)
+	}
+	echo := &tunneltest.EchoResponse{}
+	if err = json.NewDecoder(resp.Body).Decode(echo); err != nil {
+		t.Fatal(err)
+	}
 
-	fmt.Println(string(b))
+	return echo
 }
-
-
@@ -0,0 +1,637 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+	"k8s-tunnel/pkg/e2e"
+	"k8s-tunnel/pkg/protocol"
+	"k8s-tunnel/pkg/transport"
+	"k8s-tunnel/pkg/utils"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// server 断开连接， client要定时去重新建立连接
+
+type Agent struct {
+	AgentName   string
+	GatewayHost string
+	handler     http.Handler
+	opt         Option
+
+	mu       sync.RWMutex
+	gateways []*gatewayConn // 按优先级排列
+	cache    *cacheHandler
+	sem      chan struct{}    // MaxConcurrency
+	sched    *scheduler       // 为空时不限制带宽
+	certs    *certManager     // 为空时不使用 tls
+	replay   *e2e.ReplayGuard // E2EKey 不为空时拒绝重放的加密请求
+
+	renewOnce sync.Once
+	draining  int32 // 下线中, 新的请求直接返回 503
+
+	// 响应的压缩统计
+	rawBytes  int64
+	wireBytes int64
+}
+
+type Option struct {
+	AgentName   string
+	GatewayHost string // websocket 服务端
+	// GatewayHosts 按优先级排列的多个 gateway, 不为空时忽略 GatewayHost
+	GatewayHosts []string
+	// GatewayMode 多个 gateway 的注册方式, 默认 GatewayModeAllActive
+	GatewayMode GatewayMode
+	// Transports 按顺序尝试的传输方式, 默认 transport.Supported. 失败后降级到下一个
+	Transports []transport.Name
+	// Proxy 连接 gateway 使用的 HTTP 代理, 为空时按 HTTPS_PROXY/HTTP_PROXY/NO_PROXY 环境变量
+	Proxy *Proxy
+
+	// Handler 处理网关转发过来的请求, 为空时按 Kubeconfig 反向代理到 apiserver
+	Handler    http.Handler
+	Kubeconfig string // 为空时使用 in-cluster 配置
+
+	// CacheResources 用 informer 缓存的资源, 如 v1/pods, apps/v1/deployments,
+	// 满足 resourceVersion 语义的 LIST/GET 直接由缓存响应
+	CacheResources []string
+
+	// Policy 本地访问控制, 为空时放行所有请求
+	Policy *Policy
+	// Redaction 响应返回 gateway 前的脱敏规则, 为空时不处理
+	Redaction *Redaction
+
+	// E2EKey 端到端加密的私钥, 公钥在注册时发布给 gateway, 为空时不接受加密请求
+	E2EKey *e2e.PrivateKey
+	// RequireE2E 拒绝未加密的请求, agent 自身的元数据采集不受影响
+	RequireE2E bool
+
+	// CACert gateway 内置 CA 的证书 (PEM), 不为空时使用 wss 并以 CA 签发的客户端证书注册
+	CACert []byte
+	// CertDir 保存证书和私钥的目录, 为空时只保存在内存中, 重启后需要新的 bootstrap token
+	CertDir string
+	// BootstrapToken 没有可用证书时向 gateway 申请证书的一次性 token
+	BootstrapToken string
+
+	// ReconnectInterval 断线后重连的间隔, 默认 utils.PingPeriod
+	ReconnectInterval time.Duration
+
+	// 协议协商, 为空时使用 protocol 包的默认值
+	Features     []protocol.Feature
+	MaxFrameSize int64
+	HelloTimeout time.Duration
+
+	// DisableCompression 不协商 permessage-deflate 压缩
+	DisableCompression bool
+	// CompressionThreshold 小于该大小的响应不压缩, 默认 protocol.DefaultCompressionThreshold
+	CompressionThreshold int
+
+	// MaxConcurrency 同时处理的最大请求数, 超过后返回 429, 0 表示不限制
+	MaxConcurrency int
+
+	// Shaping 回写响应的带宽限制和优先级调度, 为空时不限制
+	Shaping *Shaping
+
+	// Labels 上报给 gateway 的标签, 如 env, region, team
+	Labels map[string]string
+	// MetadataInterval 刷新元数据的间隔, 默认 DefaultMetadataInterval
+	MetadataInterval time.Duration
+
+	// DrainTimeout 退出时等待进行中的请求完成的时间, 默认 DefaultDrainTimeout
+	DrainTimeout time.Duration
+
+	// HealthAddr 本地健康检查服务的监听地址, 如 :8081, 为空时不启动
+	HealthAddr string
+
+	// hooks
+	OnConnect    func()
+	OnDisconnect func(err error)
+}
+
+func NewAgent(opt *Option) *Agent {
+	a := &Agent{
+		AgentName: opt.AgentName,
+		handler:   opt.Handler,
+		opt:       *opt,
+	}
+	if len(a.opt.GatewayHosts) == 0 {
+		a.opt.GatewayHosts = []string{a.opt.GatewayHost}
+	}
+	if a.opt.GatewayMode == "" {
+		a.opt.GatewayMode = GatewayModeAllActive
+	}
+	a.GatewayHost = a.opt.GatewayHosts[0]
+	a.gateways = newGatewayConns(a.opt.GatewayHosts)
+	if len(a.opt.Transports) == 0 {
+		a.opt.Transports = transport.Supported
+	}
+	if a.opt.ReconnectInterval <= 0 {
+		a.opt.ReconnectInterval = utils.PingPeriod
+	}
+	if a.opt.HelloTimeout <= 0 {
+		a.opt.HelloTimeout = DefaultHelloTimeout
+	}
+	if a.opt.MetadataInterval <= 0 {
+		a.opt.MetadataInterval = DefaultMetadataInterval
+	}
+	if a.opt.DrainTimeout <= 0 {
+		a.opt.DrainTimeout = DefaultDrainTimeout
+	}
+	if a.opt.CompressionThreshold <= 0 {
+		a.opt.CompressionThreshold = protocol.DefaultCompressionThreshold
+	}
+	if a.opt.MaxFrameSize <= 0 {
+		a.opt.MaxFrameSize = protocol.DefaultMaxFrameSize
+	}
+	if a.opt.MaxConcurrency > 0 {
+		a.sem = make(chan struct{}, a.opt.MaxConcurrency)
+	}
+	if a.opt.E2EKey != nil {
+		a.replay = e2e.NewReplayGuard(0)
+	}
+
+	return a
+}
+
+// Serve 注册到网关并处理请求, 断线后自动重连, 直到 ctx 结束
+func (a *Agent) Serve(ctx context.Context) error {
+	if a.opt.GatewayMode != GatewayModeAllActive && a.opt.GatewayMode != GatewayModePriority {
+		return fmt.Errorf("unknown gateway mode %q", a.opt.GatewayMode)
+	}
+	if a.opt.RequireE2E && a.opt.E2EKey == nil {
+		return errors.New("RequireE2E needs an E2EKey")
+	}
+	if len(a.opt.CACert) > 0 {
+		certs, err := newCertManager(&a.opt, a.dialContext)
+		if err != nil {
+			return err
+		}
+		a.certs = certs
+	}
+	if a.opt.E2EKey != nil {
+		logrus.Infof("end-to-end encryption public key: %s", a.opt.E2EKey.Public())
+	}
+	// 请求不随 ctx 取消, 退出时先等待进行中的请求完成, 超时后才取消
+	reqCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+
+	if a.opt.Shaping != nil && a.opt.Shaping.BandwidthLimit > 0 {
+		sched, err := newScheduler(a.opt.Shaping)
+		if err != nil {
+			return err
+		}
+		a.sched = sched
+		// 下线时进行中的响应仍然需要调度
+		go sched.run(reqCtx)
+	}
+	if a.handler == nil || len(a.opt.CacheResources) > 0 {
+		config, err := GetRestConfig(a.opt.Kubeconfig)
+		if err != nil {
+			return err
+		}
+		if a.handler == nil {
+			if a.handler, err = K8sReverseProxyHandler(config); err != nil {
+				return err
+			}
+		}
+		if len(a.opt.CacheResources) > 0 {
+			ch, err := newCacheHandler(ctx, config, a.opt.CacheResources, a.handler)
+			if err != nil {
+				return err
+			}
+			a.mu.Lock()
+			a.cache = ch
+			a.handler = ch
+			a.mu.Unlock()
+		}
+	}
+	if a.opt.HealthAddr != "" {
+		if err := a.serveHealth(ctx); err != nil {
+			return err
+		}
+	}
+
+	// 每个 gateway 独立重连, 全部退出后返回第一个错误
+	var (
+		wg   sync.WaitGroup
+		once sync.Once
+		ret  error
+	)
+	for _, g := range a.gateways {
+		wg.Add(1)
+		go func(g *gatewayConn) {
+			defer wg.Done()
+			if err := a.serveGateway(ctx, reqCtx, g); err != nil {
+				once.Do(func() { ret = err })
+			}
+		}(g)
+	}
+	wg.Wait()
+	for _, g := range a.gateways {
+		if dialer := g.Dialer(); dialer != nil {
+			dialer.Close()
+		}
+	}
+	logrus.Debugf("agent exit.")
+
+	return ret
+}
+
+// 建立一次连接并处理请求, 连接断开后返回. ctx 结束时等待进行中的请求完成后再断开
+func (a *Agent) run(ctx, reqCtx context.Context, g *gatewayConn) error {
+	g.setState(GatewayConnecting, nil)
+	if err := a.connect(ctx, g); err != nil {
+		return err
+	}
+	logrus.Debugf("dial %s success", g.host)
+	if a.opt.OnConnect != nil {
+		a.opt.OnConnect()
+	}
+	g.setState(GatewayRegistered, nil)
+	a.preempt(g)
+
+	connCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	conn := g.Conn()
+	g.pingHandler()
+	go g.sendPing(connCtx)
+	go func() {
+		<-connCtx.Done()
+		if ctx.Err() != nil {
+			atomic.StoreInt32(&a.draining, 1)
+			a.drain(g, reasonShuttingDown)
+		}
+		_ = conn.Close()
+	}()
+	if g.Session().Has(protocol.FeatureMetadata) {
+		go a.reportMetadata(connCtx, g)
+	}
+
+	var err error
+	for err == nil {
+		err = a.handleRequest(reqCtx, g)
+	}
+	if a.opt.OnDisconnect != nil {
+		a.opt.OnDisconnect(err)
+	}
+
+	return err
+}
+
+func (a *Agent) handleRequest(ctx context.Context, g *gatewayConn) error {
+	conn := g.Conn()
+	messageType, message, err := conn.ReadMessage()
+	if err != nil {
+		return err
+	}
+	switch messageType {
+	case websocket.BinaryMessage:
+		return nil
+	case websocket.CloseMessage:
+		return nil
+	case websocket.PingMessage:
+		return nil
+	case websocket.PongMessage:
+		return nil
+	}
+
+	if len(message) > 0 && message[0] == '{' {
+		a.handleMessage(g, message)
+		return nil
+	}
+
+	// 下线中或超过并发限制时仍然建立响应连接, 直接返回 503 或 429, 避免 gateway 一直等待
+	var reject apierrors.APIStatus
+	acquired := false
+	switch {
+	case atomic.LoadInt32(&a.draining) == 1:
+		reject = apierrors.NewServiceUnavailable(fmt.Sprintf("agent %s is shutting down", a.AgentName))
+	case a.sem != nil:
+		select {
+		case a.sem <- struct{}{}:
+			acquired = true
+		default:
+			reject = apierrors.NewTooManyRequests(
+				fmt.Sprintf("agent %s is handling %d requests", a.AgentName, a.opt.MaxConcurrency), 1)
+		}
+	}
+
+	g.inflight.Add()
+	go func(requestID string) {
+		defer g.inflight.Done()
+		if acquired {
+			defer func() { <-a.sem }()
+		}
+		logrus.Debugf("agent get requestID: %s from %s", requestID, g.host)
+		if err := a.response(ctx, g, requestID, reject); err != nil {
+			logrus.Errorf("response error. requestID:%s, err:%v", requestID, err)
+		}
+	}(string(message))
+
+	return nil
+}
+
+// Session 优先级最高的 gateway 最近一次注册时协商的结果
+func (a *Agent) Session() *protocol.Session {
+	for _, g := range a.gateways {
+		if session := g.Session(); session != nil {
+			return session
+		}
+	}
+	return nil
+}
+
+// GetConn 优先级最高的已注册 gateway 的连接
+func (a *Agent) GetConn() transport.Conn {
+	for _, g := range a.gateways {
+		if g.State() == GatewayRegistered {
+			return g.Conn()
+		}
+	}
+	return nil
+}
+
+func (g *gatewayConn) sendPing(ctx context.Context) {
+	conn := g.Conn()
+	ticker := time.NewTicker(utils.PingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(utils.PingPeriod+time.Second)); err != nil {
+				logrus.Errorf("ping %s error: %v", g.host, err)
+				// 关闭连接, 由 serveGateway 重连
+				_ = conn.Close()
+				return
+			}
+			// ping 通，即可设置write deadline
+			_ = conn.SetWriteDeadline(time.Now().Add(31 * time.Second))
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (a *Agent) Close(ctx context.Context) {
+	for _, g := range a.gateways {
+		if conn := g.Conn(); conn != nil {
+			_ = conn.Close()
+		}
+	}
+}
+
+// 处理ping消息
+func (g *gatewayConn) pingHandler() {
+	conn := g.Conn()
+	conn.SetPingHandler(func(appData string) error {
+		return conn.WriteControl(websocket.PongMessage, nil, time.Now().Add(utils.WriteWait))
+	})
+}
+
+func (a *Agent) connect(ctx context.Context, g *gatewayConn) error {
+	if a.certs != nil {
+		if err := a.certs.ensure(ctx); err != nil {
+			return err
+		}
+		a.renewOnce.Do(func() { go a.certs.run(ctx, a.opt.ReconnectInterval) })
+	}
+
+	// 代理由 dialContext 处理, 以便支持认证钩子和自定义的 CONNECT 头.
+	// 每次注册使用新的 dialer, 续期后的证书在新的 HTTP/2 连接上生效
+	dialer := &transport.Dialer{
+		TLSClientConfig: a.tlsConfig(),
+		NetDialContext:  a.dialContext,
+	}
+	path := fmt.Sprintf("/agents/%s/register", a.AgentName)
+	conn, err := a.dialRegister(ctx, g, dialer, a.wsURL(g.host, path))
+	if err != nil {
+		dialer.Close()
+		return fmt.Errorf("register invalid. err:%v", err)
+	}
+
+	// 握手前按本端的最大帧长度限制, 握手后按协商的结果
+	conn.SetReadLimit(a.opt.MaxFrameSize)
+	session, err := a.handshake(conn)
+	if err != nil {
+		_ = conn.Close()
+		dialer.Close()
+		return err
+	}
+	conn.SetReadLimit(session.MaxFrameSize)
+	g.mu.Lock()
+	old := g.dialer
+	g.conn, g.dialer, g.transport, g.session = conn, dialer, transport.Of(conn), session
+	g.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	logrus.Infof("registered to %s, transport:%s, protocol:%d, gateway version:%s, features:%v",
+		g.host, transport.Of(conn), session.ProtocolVersion, session.PeerVersion, session.Features)
+
+	return nil
+}
+
+// response 处理一个请求, reject 不为空时不访问上游, 直接返回该错误
+func (a *Agent) response(ctx context.Context, g *gatewayConn, requestID string, reject apierrors.APIStatus) error {
+	path := fmt.Sprintf("/agents/%s/response", a.AgentName)
+
+	header := http.Header{}
+	header.Add(utils.HttpRequestIdHeader, requestID)
+
+	// 响应连接回到转发请求的 gateway
+	session := g.Session()
+	conn, counter, err := a.dialResponse(ctx, g, session, a.wsURL(g.host, path), header)
+	if err != nil {
+		return err
+	}
+	closed := make(chan struct{})
+	defer func() {
+		if err == nil {
+			waitClosed(closed)
+		}
+		if err = conn.Close(); err != nil {
+			logrus.Errorf("response conn close error. err:%v", err)
+			return
+		}
+	}()
+	logrus.Debugf("start response conn, requestID:%s", requestID)
+
+	// get k8s request
+	var (
+		req *http.Request // k8s request
+	)
+	{
+		req, err = a.parseK8sRequest(conn, session.MaxFrameSize)
+		if err != nil {
+			return err
+		}
+	}
+
+	// gateway 读完响应或客户端断开时关闭响应连接, 此时取消请求, watch 不会一直占用上游.
+	// agent 退出时不取消, 由 gateway 在 tunnel 断开后返回 503
+	reqCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		defer close(closed)
+		defer cancel()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	req = req.WithContext(reqCtx)
+
+	// write
+	var (
+		rw  http.ResponseWriter
+		buf = &bytes.Buffer{}
+	)
+	{
+		rw = NewResponseWriter(buf)
+		rw.Header().Set(utils.HttpRequestIdHeader, requestID)
+	}
+
+	var exchange *e2e.Exchange // 不为空时响应需要加密
+	if e2e.IsSealed(req.Header) && a.opt.E2EKey != nil {
+		inner, ex, err := e2e.OpenRequest(a.opt.E2EKey, req)
+		if err == nil {
+			err = a.replay.Check(ex)
+		}
+		if err != nil {
+			// 无法解密时也无法加密响应, 只能返回明文错误. 重放的请求同样不响应密文, 攻击者拿不到新的响应
+			logrus.Errorf("open sealed request error. requestID:%s, err:%v", requestID, err)
+			message := "can not open end-to-end encrypted request"
+			if errors.Is(err, e2e.ErrReplay) {
+				message = "end-to-end encrypted request expired or replayed"
+			}
+			writeStatus(rw, apierrors.NewBadRequest(message))
+			return a.writeBuffered(ctx, conn, counter, req, session, buf.Bytes())
+		}
+		inner.URL.Path = a.trimPath(inner.URL.Path)
+		req, exchange = inner.WithContext(reqCtx), ex
+	}
+
+	// 明文响应边处理边发送, watch 和 logs -f 不必等到上游结束; 密文需要整体加密, 仍然缓冲
+	var sw *streamWriter
+	if session.Has(protocol.FeatureStreaming) && exchange == nil {
+		sw = a.newStreamWriter(ctx, conn, counter, req, session)
+		rw = NewResponseWriter(sw)
+		rw.Header().Set(utils.HttpRequestIdHeader, requestID)
+	}
+
+	switch {
+	case a.opt.RequireE2E && exchange == nil:
+		writeStatus(rw, apierrors.NewForbidden(schema.GroupResource{}, "",
+			fmt.Errorf("agent %s only accepts end-to-end encrypted requests", a.AgentName)))
+	case reject != nil:
+		writeStatus(rw, reject)
+	case a.checkPolicy(rw, req):
+		a.serve(rw, req)
+	}
+	// handler 没有写任何内容时补上状态行
+	rw.WriteHeader(http.StatusOK)
+
+	if sw != nil {
+		err = sw.Close()
+		logrus.Debugf("agent write back k8s request, requestID:%s", requestID)
+		return err
+	}
+
+	if exchange != nil {
+		sealed := exchange.SealResponse(buf.Bytes())
+		buf = &bytes.Buffer{}
+		rw = NewResponseWriter(buf)
+		rw.Header().Set(utils.HttpRequestIdHeader, requestID)
+		rw.Header().Set("Content-Type", e2e.ContentType)
+		_, _ = rw.Write(sealed)
+	}
+
+	if maxFrameSize := session.MaxFrameSize; int64(buf.Len()) > maxFrameSize {
+		logrus.Errorf("response exceeds max frame size %d, requestID:%s", maxFrameSize, requestID)
+		buf.Reset()
+		rw = NewResponseWriter(buf)
+		rw.Header().Set(utils.HttpRequestIdHeader, requestID)
+		rw.WriteHeader(http.StatusBadGateway)
+		_, _ = fmt.Fprintf(rw, "response exceeds max frame size %d", maxFrameSize)
+	}
+	err = a.writeBuffered(ctx, conn, counter, req, session, buf.Bytes())
+
+	logrus.Debugf("agent write back k8s request, requestID:%s", requestID)
+	return err
+}
+
+// newStreamWriter 每个消息都按 writeResponse 压缩和调度
+func (a *Agent) newStreamWriter(ctx context.Context, conn transport.Conn, counter *countingConn, req *http.Request, session *protocol.Session) *streamWriter {
+	size := streamMessageSize
+	if int64(size) > session.MaxFrameSize {
+		size = int(session.MaxFrameSize)
+	}
+
+	return &streamWriter{
+		send: func(b []byte) error {
+			return a.writeResponse(ctx, conn, counter, req, b)
+		},
+		end: func() error {
+			return conn.WriteMessage(websocket.BinaryMessage, nil)
+		},
+		size: size,
+	}
+}
+
+// writeBuffered 用一个消息写出整个响应, 协商了 streaming 时再发送结束消息
+func (a *Agent) writeBuffered(ctx context.Context, conn transport.Conn, counter *countingConn, req *http.Request, session *protocol.Session, b []byte) error {
+	if err := a.writeResponse(ctx, conn, counter, req, b); err != nil {
+		return err
+	}
+	if session.Has(protocol.FeatureStreaming) {
+		return conn.WriteMessage(websocket.BinaryMessage, nil)
+	}
+
+	return nil
+}
+
+// waitClosed 等待 gateway 读完响应后关闭响应连接. 在此之前请求仍算作进行中,
+// 否则 drain 可能在 gateway 拿到响应前就断开注册连接
+func waitClosed(closed <-chan struct{}) {
+	select {
+	case <-closed:
+	case <-time.After(utils.CloseGracePeriod):
+	}
+}
+
+func (a *Agent) parseK8sRequest(onceConn transport.Conn, maxFrameSize int64) (*http.Request, error) {
+	onceConn.SetReadLimit(maxFrameSize)
+	typ, message, err := onceConn.ReadMessage()
+	if err != nil {
+		logrus.Errorf("conn ReadMessage error. err:%v", err)
+		return nil, err
+	}
+	if typ != websocket.BinaryMessage {
+		return nil, fmt.Errorf("type is not binary")
+	}
+
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(message)))
+	if err != nil {
+		logrus.Errorf("ReadRequest error. err:%v", err)
+		return nil, err
+	}
+	req.URL.Path = a.trimPath(req.URL.Path)
+	logrus.Debugf("agent get reqest requestID:%s, path:%s", req.Header.Get(utils.HttpRequestIdHeader), req.URL.Path)
+	return req, nil
+}
+
+func (a *Agent) trimPath(path string) string {
+	return strings.TrimPrefix(path, "/proxies/"+a.AgentName)
+}
@@ -0,0 +1,260 @@
+package agent_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"k8s-tunnel/pkg/agent"
+	"k8s-tunnel/pkg/protocol"
+	"k8s-tunnel/pkg/tunneltest"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func get(t *testing.T, url string) (*http.Response, []byte) {
+	t.Helper()
+
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp, b
+}
+
+func TestAgent(t *testing.T) {
+	t.Run("#request", func(t *testing.T) {
+		h := tunneltest.New(t, nil)
+		a := h.StartAgent("huawei")
+		if a.Session() == nil || a.Session().ProtocolVersion != protocol.Version {
+			t.Fatalf("unexpected session %+v", a.Session())
+		}
+
+		resp, b := get(t, h.URL("huawei", "/test/hello?a=1"))
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status %d, body %s", resp.StatusCode, b)
+		}
+
+		echo := &tunneltest.EchoResponse{}
+		if err := json.Unmarshal(b, echo); err != nil {
+			t.Fatal(err)
+		}
+		if echo.Path != "/test/hello" || echo.Query != "a=1" {
+			t.Fatalf("unexpected upstream request %+v", echo)
+		}
+	})
+
+	t.Run("#post body", func(t *testing.T) {
+		h := tunneltest.New(t, nil)
+		h.StartAgent("huawei")
+
+		resp, err := http.Post(h.URL("huawei", "/apis"), "application/json", strings.NewReader(`{"kind":"Pod"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		echo := &tunneltest.EchoResponse{}
+		if err = json.NewDecoder(resp.Body).Decode(echo); err != nil {
+			t.Fatal(err)
+		}
+		if echo.Method != http.MethodPost || echo.Body != `{"kind":"Pod"}` {
+			t.Fatalf("unexpected upstream request %+v", echo)
+		}
+	})
+
+	t.Run("#multi agents", func(t *testing.T) {
+		h := tunneltest.New(t, &tunneltest.Option{})
+		for _, name := range []string{"a", "b", "c"} {
+			h.StartAgent(name)
+		}
+
+		for _, name := range []string{"a", "b", "c"} {
+			if resp, b := get(t, h.URL(name, "/ping")); resp.StatusCode != http.StatusOK {
+				t.Fatalf("%s: status %d, body %s", name, resp.StatusCode, b)
+			}
+		}
+	})
+
+	t.Run("#upstream error", func(t *testing.T) {
+		h := tunneltest.New(t, &tunneltest.Option{
+			Upstream: func(string) http.Handler {
+				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					http.Error(w, "boom", http.StatusInternalServerError)
+				})
+			},
+		})
+		h.StartAgent("huawei")
+
+		resp, b := get(t, h.URL("huawei", "/"))
+		if resp.StatusCode != http.StatusInternalServerError || strings.TrimSpace(string(b)) != "boom" {
+			t.Fatalf("status %d, body %s", resp.StatusCode, b)
+		}
+	})
+
+	t.Run("#handler without WriteHeader", func(t *testing.T) {
+		h := tunneltest.New(t, &tunneltest.Option{
+			AgentOption: func(opt *agent.Option) {
+				opt.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					_, _ = w.Write([]byte("hello"))
+				})
+			},
+		})
+		h.StartAgent("huawei")
+
+		resp, b := get(t, h.URL("huawei", "/"))
+		if resp.StatusCode != http.StatusOK || string(b) != "hello" {
+			t.Fatalf("status %d, body %s", resp.StatusCode, b)
+		}
+	})
+
+	t.Run("#max concurrency", func(t *testing.T) {
+		entered, release := make(chan struct{}), make(chan struct{})
+		h := tunneltest.New(t, &tunneltest.Option{
+			AgentOption: func(opt *agent.Option) {
+				opt.MaxConcurrency = 1
+				opt.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					if r.URL.Path == "/block" {
+						close(entered)
+						<-release
+					}
+					_, _ = w.Write([]byte("ok"))
+				})
+			},
+		})
+		h.StartAgent("huawei")
+
+		done := make(chan int)
+		go func() {
+			resp, _ := http.Get(h.URL("huawei", "/block"))
+			if resp != nil {
+				resp.Body.Close()
+				done <- resp.StatusCode
+			}
+			close(done)
+		}()
+		<-entered
+
+		resp, b := get(t, h.URL("huawei", "/"))
+		if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "1" {
+			t.Fatalf("status %d, header %v, body %s", resp.StatusCode, resp.Header, b)
+		}
+
+		close(release)
+		if code := <-done; code != http.StatusOK {
+			t.Fatalf("status %d", code)
+		}
+		if resp, b = get(t, h.URL("huawei", "/")); resp.StatusCode != http.StatusOK {
+			t.Fatalf("status %d, body %s", resp.StatusCode, b)
+		}
+	})
+
+	t.Run("#bandwidth limit", func(t *testing.T) {
+		body := strings.Repeat("x", 128<<10)
+		h := tunneltest.New(t, &tunneltest.Option{
+			AgentOption: func(opt *agent.Option) {
+				opt.Shaping = &agent.Shaping{BandwidthLimit: 64 << 10, ChunkSize: 16 << 10}
+				opt.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					_, _ = w.Write([]byte(body))
+				})
+			},
+		})
+		h.StartAgent("huawei")
+
+		start := time.Now()
+		resp, b := get(t, h.URL("huawei", "/"))
+		if resp.StatusCode != http.StatusOK || string(b) != body {
+			t.Fatalf("status %d, body length %d", resp.StatusCode, len(b))
+		}
+		// 第一秒的突发之后按 64KB/s 发送
+		if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+			t.Fatalf("expect response throttled, took %s", elapsed)
+		}
+	})
+
+	t.Run("#watch ahead of bulk list", func(t *testing.T) {
+		body := strings.Repeat("x", 192<<10)
+		listing := make(chan struct{})
+		h := tunneltest.New(t, &tunneltest.Option{
+			AgentOption: func(opt *agent.Option) {
+				opt.Shaping = &agent.Shaping{
+					BandwidthLimit: 64 << 10,
+					ChunkSize:      16 << 10,
+					Rules:          []agent.PriorityRule{{Class: agent.PriorityBulk, Path: `^/api/v1/configmaps$`}},
+				}
+				opt.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					switch r.URL.Path {
+					case "/api/v1/pods":
+						w.Header().Set("Content-Type", "application/json")
+						_, _ = w.Write([]byte(`{"type":"ADDED","object":{}}` + "\n"))
+						w.(http.Flusher).Flush()
+						<-r.Context().Done()
+					case "/api/v1/configmaps":
+						close(listing)
+						_, _ = w.Write([]byte(body))
+					}
+				})
+			},
+		})
+		h.StartAgent("huawei")
+
+		start := time.Now()
+		listed := make(chan time.Duration, 1)
+		go func() {
+			resp, b := get(t, h.URL("huawei", "/api/v1/configmaps"))
+			if resp.StatusCode != http.StatusOK || string(b) != body {
+				t.Errorf("status %d, body length %d", resp.StatusCode, len(b))
+			}
+			listed <- time.Since(start)
+		}()
+		<-listing
+		time.Sleep(100 * time.Millisecond)
+
+		// watch 事件在 bulk 响应发完之前就送达
+		if event := firstEvent(t, h.URL("huawei", "/api/v1/pods?watch=true")); event.Type != "ADDED" {
+			t.Fatalf("unexpected event %+v", event)
+		}
+		select {
+		case elapsed := <-listed:
+			t.Fatalf("list finished before watch event, took %s", elapsed)
+		default:
+		}
+		// bulk 响应仍然限速
+		if elapsed := <-listed; elapsed < 900*time.Millisecond {
+			t.Fatalf("expect list throttled, took %s", elapsed)
+		}
+	})
+
+	t.Run("#reconnect after agent restart", func(t *testing.T) {
+		h := tunneltest.New(t, nil)
+		h.StartAgent("huawei")
+		h.StopAgent("huawei")
+		h.StartAgent("huawei")
+
+		if resp, b := get(t, h.URL("huawei", "/")); resp.StatusCode != http.StatusOK {
+			t.Fatalf("status %d, body %s", resp.StatusCode, b)
+		}
+	})
+
+	t.Run("#reconnect after gateway restart", func(t *testing.T) {
+		h := tunneltest.New(t, nil)
+		h.StartAgent("huawei")
+
+		h.StopGateway()
+		h.StartGateway()
+		if err := h.WaitForAgent("huawei", tunneltest.DefaultWaitTimeout); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp, b := get(t, h.URL("huawei", "/")); resp.StatusCode != http.StatusOK {
+			t.Fatalf("status %d, body %s", resp.StatusCode, b)
+		}
+	})
+}
@@ -0,0 +1,303 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// CacheHeader 从 informer 缓存返回的响应会带上该 header
+const CacheHeader = "X-K8s-Tunnel-Cache"
+
+// CacheStats informer 缓存的命中统计, 只统计配置了缓存的资源
+type CacheStats struct {
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+}
+
+type cachedResource struct {
+	gvr        schema.GroupVersionResource
+	kind       string
+	namespaced bool
+	informer   cache.SharedIndexInformer
+}
+
+// cacheHandler 用 informer 缓存响应 LIST/GET, 不满足 resourceVersion 语义的请求交给 next
+type cacheHandler struct {
+	next      http.Handler
+	resources map[schema.GroupVersionResource]*cachedResource
+
+	hits   int64
+	misses int64
+}
+
+// ParseCacheResource 解析 v1/pods, apps/v1/deployments 格式的资源
+func ParseCacheResource(s string) (schema.GroupVersionResource, error) {
+	parts := strings.Split(strings.Trim(s, "/"), "/")
+	switch len(parts) {
+	case 2:
+		return schema.GroupVersionResource{Version: parts[0], Resource: parts[1]}, nil
+	case 3:
+		return schema.GroupVersionResource{Group: parts[0], Version: parts[1], Resource: parts[2]}, nil
+	}
+	return schema.GroupVersionResource{}, fmt.Errorf("invalid cache resource %q, expect [group/]version/resource", s)
+}
+
+// newCacheHandler 为 resources 启动 informer, ctx 结束后停止
+func newCacheHandler(ctx context.Context, config *rest.Config, resources []string, next http.Handler) (*cacheHandler, error) {
+	dc, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	client, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(client, 0)
+
+	h := &cacheHandler{next: next, resources: map[schema.GroupVersionResource]*cachedResource{}}
+	for _, s := range resources {
+		gvr, err := ParseCacheResource(s)
+		if err != nil {
+			return nil, err
+		}
+		list, err := dc.ServerResourcesForGroupVersion(gvr.GroupVersion().String())
+		if err != nil {
+			return nil, err
+		}
+
+		var found *metav1.APIResource
+		for i := range list.APIResources {
+			if list.APIResources[i].Name == gvr.Resource {
+				found = &list.APIResources[i]
+			}
+		}
+		if found == nil {
+			return nil, fmt.Errorf("resource %s not found", s)
+		}
+
+		h.resources[gvr] = &cachedResource{
+			gvr:        gvr,
+			kind:       found.Kind,
+			namespaced: found.Namespaced,
+			informer:   factory.ForResource(gvr).Informer(),
+		}
+	}
+	factory.Start(ctx.Done())
+
+	return h, nil
+}
+
+// Stats 当前的命中统计
+func (h *cacheHandler) Stats() CacheStats {
+	return CacheStats{
+		Hits:   atomic.LoadInt64(&h.hits),
+		Misses: atomic.LoadInt64(&h.misses),
+	}
+}
+
+func (h *cacheHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	res, namespace, name, ok := h.match(r)
+	if !ok {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+	if !cacheServable(r, res.informer) {
+		atomic.AddInt64(&h.misses, 1)
+		h.next.ServeHTTP(w, r)
+		return
+	}
+
+	var v interface{}
+	if name != "" {
+		key := name
+		if namespace != "" {
+			key = namespace + "/" + name
+		}
+		obj, exists, err := res.informer.GetIndexer().GetByKey(key)
+		if err != nil || !exists {
+			// 缓存中没有时交给 apiserver 返回准确的错误
+			atomic.AddInt64(&h.misses, 1)
+			h.next.ServeHTTP(w, r)
+			return
+		}
+		v = obj
+	} else {
+		list, err := listFromCache(res, namespace, r.URL.Query().Get("labelSelector"))
+		if err != nil {
+			writeStatus(w, apierrors.NewBadRequest(err.Error()))
+			return
+		}
+		v = list
+	}
+
+	atomic.AddInt64(&h.hits, 1)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(CacheHeader, "HIT")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// match 解析 /api/v1/[namespaces/{ns}/]{resource}[/{name}], 只匹配配置了缓存的资源
+func (h *cacheHandler) match(r *http.Request) (res *cachedResource, namespace, name string, ok bool) {
+	if r.Method != http.MethodGet {
+		return nil, "", "", false
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	gvr := schema.GroupVersionResource{}
+	switch {
+	case len(parts) >= 3 && parts[0] == "api":
+		gvr.Version, parts = parts[1], parts[2:]
+	case len(parts) >= 4 && parts[0] == "apis":
+		gvr.Group, gvr.Version, parts = parts[1], parts[2], parts[3:]
+	default:
+		return nil, "", "", false
+	}
+	if len(parts) >= 3 && parts[0] == "namespaces" {
+		namespace, parts = parts[1], parts[2:]
+	}
+	// 子资源不走缓存
+	if len(parts) > 2 {
+		return nil, "", "", false
+	}
+	gvr.Resource = parts[0]
+	if len(parts) == 2 {
+		name = parts[1]
+	}
+
+	res, ok = h.resources[gvr]
+	if !ok || (namespace != "" && !res.namespaced) {
+		return nil, "", "", false
+	}
+
+	return res, namespace, name, true
+}
+
+// cacheServable 判断请求能否由缓存响应:
+//   - 带 Authorization 或 Impersonate-* 的请求按调用方身份鉴权, 必须交给 apiserver
+//   - resourceVersion 为空表示要求最新数据, 必须读 apiserver
+//   - resourceVersion=0 接受任意版本, 和 apiserver 的 watch cache 一样忽略 limit
+//   - resourceVersion=N 只有缓存不旧于 N 时才能响应, Exact 匹配不走缓存
+//   - watch, continue, fieldSelector, Table 和 protobuf 格式不走缓存
+func cacheServable(r *http.Request, informer cache.SharedIndexInformer) bool {
+	if !informer.HasSynced() {
+		return false
+	}
+	if r.Header.Get("Authorization") != "" {
+		return false
+	}
+	for k := range r.Header {
+		if strings.HasPrefix(k, "Impersonate-") {
+			return false
+		}
+	}
+	if accept := r.Header.Get("Accept"); accept != "" &&
+		(strings.Contains(accept, "as=") || !strings.Contains(accept, "json") && !strings.Contains(accept, "*/*")) {
+		return false
+	}
+
+	q := r.URL.Query()
+	if w := q.Get("watch"); w == "true" || w == "1" {
+		return false
+	}
+	if q.Get("continue") != "" || q.Get("fieldSelector") != "" {
+		return false
+	}
+
+	rv := q.Get("resourceVersion")
+	switch {
+	case rv == "":
+		return false
+	case rv == "0":
+		return true
+	case q.Get("resourceVersionMatch") == string(metav1.ResourceVersionMatchExact):
+		return false
+	}
+	if q.Get("limit") != "" {
+		return false
+	}
+
+	want, err := strconv.ParseUint(rv, 10, 64)
+	if err != nil {
+		return false
+	}
+	have, err := strconv.ParseUint(informer.LastSyncResourceVersion(), 10, 64)
+	if err != nil {
+		return false
+	}
+	return have >= want
+}
+
+func listFromCache(res *cachedResource, namespace, labelSelector string) (*unstructured.UnstructuredList, error) {
+	selector, err := labels.Parse(labelSelector)
+	if err != nil {
+		return nil, err
+	}
+
+	list := &unstructured.UnstructuredList{}
+	list.SetAPIVersion(res.gvr.GroupVersion().String())
+	list.SetKind(res.kind + "List")
+	list.SetResourceVersion(res.informer.LastSyncResourceVersion())
+
+	for _, item := range res.informer.GetIndexer().List() {
+		obj, ok := item.(*unstructured.Unstructured)
+		if !ok {
+			continue
+		}
+		if namespace != "" && obj.GetNamespace() != namespace {
+			continue
+		}
+		if !selector.Matches(labels.Set(obj.GetLabels())) {
+			continue
+		}
+		list.Items = append(list.Items, *obj)
+	}
+	sort.Slice(list.Items, func(i, j int) bool {
+		a, b := list.Items[i], list.Items[j]
+		if a.GetNamespace() != b.GetNamespace() {
+			return a.GetNamespace() < b.GetNamespace()
+		}
+		return a.GetName() < b.GetName()
+	})
+
+	return list, nil
+}
+
+func writeStatus(w http.ResponseWriter, err apierrors.APIStatus) {
+	status := err.Status()
+	status.TypeMeta = metav1.TypeMeta{Kind: "Status", APIVersion: "v1"}
+
+	w.Header().Set("Content-Type", "application/json")
+	if status.Details != nil && status.Details.RetryAfterSeconds > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(status.Details.RetryAfterSeconds)))
+	}
+	w.WriteHeader(int(status.Code))
+	_ = json.NewEncoder(w).Encode(&status)
+}
+
+// CacheStats informer 缓存的命中统计, 未开启缓存时为零值
+func (a *Agent) CacheStats() CacheStats {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if a.cache == nil {
+		return CacheStats{}
+	}
+	return a.cache.Stats()
+}
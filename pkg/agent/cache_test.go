@@ -0,0 +1,157 @@
+package agent_test
+
+import (
+	"fmt"
+	"k8s-tunnel/pkg/agent"
+	"k8s-tunnel/pkg/tunneltest"
+	"k8s-tunnel/pkg/tunneltest/fakeapiserver"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func startCachedAgent(t *testing.T) (*tunneltest.Harness, *fakeapiserver.Server, *tunneltest.Agent) {
+	s := newAPIServer(t)
+	kubeconfig, err := s.WriteKubeconfig(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := tunneltest.New(t, &tunneltest.Option{
+		APIServer: s,
+		AgentOption: func(opt *agent.Option) {
+			opt.Kubeconfig = kubeconfig
+			opt.CacheResources = []string{"v1/pods"}
+		},
+	})
+	a := h.StartAgent("huawei")
+
+	// 等待 informer 同步
+	deadline := time.Now().Add(tunneltest.DefaultWaitTimeout)
+	for {
+		resp, _ := get(t, h.URL("huawei", "/api/v1/pods?resourceVersion=0"))
+		if resp.Header.Get(agent.CacheHeader) == "HIT" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("informer cache not synced")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return h, s, a
+}
+
+// 不含 informer 的 watch 请求
+func podRequests(s *fakeapiserver.Server) int {
+	n := 0
+	for _, r := range s.Requests() {
+		if strings.HasSuffix(r.Path, "/pods") && !strings.Contains(r.Query, "watch") {
+			n++
+		}
+	}
+	return n
+}
+
+func listPods(t *testing.T, url string) (*unstructured.UnstructuredList, bool) {
+	t.Helper()
+
+	resp, b := get(t, url)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d, body %s", resp.StatusCode, b)
+	}
+	list := &unstructured.UnstructuredList{}
+	if err := list.UnmarshalJSON(b); err != nil {
+		t.Fatal(err)
+	}
+
+	return list, resp.Header.Get(agent.CacheHeader) == "HIT"
+}
+
+func TestInformerCache(t *testing.T) {
+	t.Run("#list from cache", func(t *testing.T) {
+		h, s, a := startCachedAgent(t)
+		before := podRequests(s)
+		stats := a.CacheStats()
+
+		list, hit := listPods(t, h.URL("huawei", "/api/v1/namespaces/default/pods?resourceVersion=0"))
+		if !hit || list.GetKind() != "PodList" || len(list.Items) != 1 || list.Items[0].GetName() != "nginx" {
+			t.Fatalf("unexpected list %+v, hit %v", list, hit)
+		}
+		if podRequests(s) != before {
+			t.Fatal("cached list should not reach the apiserver")
+		}
+		if n := a.CacheStats().Hits - stats.Hits; n != 1 {
+			t.Fatalf("expect 1 hit, got %d", n)
+		}
+
+		// watch 同步新对象
+		if err := s.Add(fakeapiserver.Object("v1", "Pod", "default", "redis")); err != nil {
+			t.Fatal(err)
+		}
+		deadline := time.Now().Add(tunneltest.DefaultWaitTimeout)
+		for {
+			list, _ = listPods(t, h.URL("huawei", "/api/v1/pods?resourceVersion=0"))
+			if len(list.Items) == 2 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("new pod not synced, %+v", list.Items)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		resp, b := get(t, h.URL("huawei", "/api/v1/namespaces/default/pods/redis?resourceVersion=0"))
+		if resp.StatusCode != http.StatusOK || resp.Header.Get(agent.CacheHeader) != "HIT" {
+			t.Fatalf("status %d, body %s", resp.StatusCode, b)
+		}
+	})
+
+	t.Run("#resourceVersion semantics", func(t *testing.T) {
+		h, s, a := startCachedAgent(t)
+		rv := s.ResourceVersion()
+		stats := a.CacheStats()
+
+		for query, expect := range map[string]bool{
+			"":                            false, // 最新数据
+			"resourceVersion=" + rv:       true,
+			"resourceVersion=" + rv + "0": false, // 缓存比要求的旧
+			"resourceVersion=" + rv + "&resourceVersionMatch=Exact": false,
+			"resourceVersion=0&fieldSelector=metadata.name%3Dnginx": false,
+			"resourceVersion=0&labelSelector=app%3Dweb":             true,
+		} {
+			list, hit := listPods(t, h.URL("huawei", "/api/v1/pods?"+query))
+			if hit != expect {
+				t.Fatalf("%q: expect hit %v, got %v", query, expect, hit)
+			}
+			if expect && list.GetResourceVersion() == "" {
+				t.Fatalf("%q: resourceVersion missing", query)
+			}
+		}
+
+		if n := a.CacheStats().Hits - stats.Hits; n != 2 {
+			t.Fatalf("expect 2 hits, got %d", n)
+		}
+		if n := a.CacheStats().Misses - stats.Misses; n != 4 {
+			t.Fatalf("expect 4 misses, got %d", n)
+		}
+	})
+
+	t.Run("#caller credentials bypass", func(t *testing.T) {
+		h, _, _ := startCachedAgent(t)
+
+		for _, header := range []string{"Authorization", "Impersonate-User"} {
+			req, _ := http.NewRequest(http.MethodGet, h.URL("huawei", "/api/v1/pods?resourceVersion=0"), nil)
+			req.Header.Set(header, fmt.Sprintf("Bearer %s", fakeapiserver.DefaultToken))
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.Header.Get(agent.CacheHeader) != "" {
+				t.Fatalf("%s: expect bypass", header)
+			}
+		}
+	})
+}
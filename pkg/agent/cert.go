@@ -0,0 +1,282 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	agentCertFile = "agent.crt"
+	agentKeyFile  = "agent.key"
+)
+
+// certManager 向 gateway 内置 CA 申请客户端证书, 并在剩余有效期过去 2/3 时续期
+type certManager struct {
+	agentName    string
+	gatewayHosts []string // 依次尝试, 直到申请成功
+	dir          string   // 为空时证书只保存在内存中
+	token        string
+	roots        *x509.CertPool
+	dial         func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	ensureMu sync.Mutex // 多个 gateway 同时注册时 bootstrap token 只使用一次
+
+	mu         sync.RWMutex
+	cert       *tls.Certificate
+	renewAfter time.Time
+}
+
+func newCertManager(opt *Option, dial func(ctx context.Context, network, addr string) (net.Conn, error)) (*certManager, error) {
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(opt.CACert) {
+		return nil, errors.New("invalid CACert, expect PEM encoded certificates")
+	}
+
+	m := &certManager{
+		agentName:    opt.AgentName,
+		gatewayHosts: opt.GatewayHosts,
+		dir:          opt.CertDir,
+		token:        opt.BootstrapToken,
+		roots:        roots,
+		dial:         dial,
+	}
+	if m.dir != "" {
+		cert, err := tls.LoadX509KeyPair(filepath.Join(m.dir, agentCertFile), filepath.Join(m.dir, agentKeyFile))
+		if err == nil {
+			cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		}
+		switch {
+		case err == nil:
+			m.setCertificate(&cert, cert.Leaf.NotBefore)
+		case !os.IsNotExist(err):
+			// 证书损坏时重新用 bootstrap token 申请
+			logrus.Warnf("load agent certificate from %s error. err:%v", m.dir, err)
+		}
+	}
+
+	return m, nil
+}
+
+// Certificate 当前使用的客户端证书
+func (m *certManager) Certificate() *tls.Certificate {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.cert
+}
+
+// TLSConfig 每次握手时取最新的证书, 续期后新建立的连接自动使用新证书
+func (m *certManager) TLSConfig() *tls.Config {
+	return &tls.Config{
+		RootCAs:    m.roots,
+		MinVersion: tls.VersionTLS12,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			// 过期的证书会导致握手失败, 此时不发送证书, 以便改用 bootstrap token
+			if m.valid() {
+				return m.Certificate(), nil
+			}
+			return &tls.Certificate{}, nil
+		},
+	}
+}
+
+// valid 证书存在且未过期
+func (m *certManager) valid() bool {
+	cert := m.Certificate()
+	return cert != nil && time.Now().Before(cert.Leaf.NotAfter)
+}
+
+// setCertificate 从 since 开始剩余有效期过去 2/3 时续期,
+// gateway 签发时会把 NotBefore 提前以容忍时钟偏差, 所以新证书以收到的时间为准
+func (m *certManager) setCertificate(cert *tls.Certificate, since time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.cert = cert
+	m.renewAfter = since.Add(cert.Leaf.NotAfter.Sub(since) * 2 / 3)
+}
+
+func (m *certManager) renewAt() time.Time {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.renewAfter
+}
+
+// ensure 没有可用的证书时使用 bootstrap token 申请
+func (m *certManager) ensure(ctx context.Context) error {
+	m.ensureMu.Lock()
+	defer m.ensureMu.Unlock()
+
+	if m.valid() {
+		return nil
+	}
+	if m.token == "" {
+		return errors.New("no valid agent certificate and no bootstrap token")
+	}
+
+	if err := m.request(ctx, m.token); err != nil {
+		return fmt.Errorf("bootstrap certificate error. err:%v", err)
+	}
+	// token 只能使用一次
+	m.token = ""
+
+	return nil
+}
+
+// run 定时续期, 失败后每隔 retry 重试, 直到 ctx 结束
+func (m *certManager) run(ctx context.Context, retry time.Duration) {
+	for {
+		wait := time.Until(m.renewAt())
+		if wait < 0 {
+			wait = 0
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return
+		}
+
+		for {
+			err := m.request(ctx, "")
+			if err == nil {
+				break
+			}
+			logrus.Errorf("renew certificate error. err:%v", err)
+			select {
+			case <-time.After(retry):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// request 生成新的私钥和 CSR 并提交给 gateway, token 为空时用当前证书认证
+func (m *certManager) request(ctx context.Context, token string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: m.agentName},
+	}, key)
+	if err != nil {
+		return err
+	}
+	csr := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+
+	var b []byte
+	for _, host := range m.gatewayHosts {
+		if b, err = m.post(ctx, host, csr, token); err == nil {
+			break
+		}
+		logrus.Warnf("request certificate from %s error. err:%v", host, err)
+	}
+	if err != nil {
+		return err
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return errors.New("invalid certificate from gateway")
+	}
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+
+	if m.dir != "" {
+		if err = writeFileAtomic(filepath.Join(m.dir, agentKeyFile), keyPEM, 0600); err != nil {
+			return err
+		}
+		if err = writeFileAtomic(filepath.Join(m.dir, agentCertFile), b, 0644); err != nil {
+			return err
+		}
+	}
+
+	m.setCertificate(&tls.Certificate{Certificate: [][]byte{leaf.Raw}, PrivateKey: key, Leaf: leaf}, time.Now())
+	logrus.Infof("got agent certificate, serial:%s, expires:%s", leaf.SerialNumber, leaf.NotAfter)
+
+	return nil
+}
+
+// post 向一个 gateway 提交 CSR, 返回签发的证书
+func (m *certManager) post(ctx context.Context, host string, csr []byte, token string) ([]byte, error) {
+	u := fmt.Sprintf("https://%s/agents/%s/certificate", host, m.agentName)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(csr))
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{DialContext: m.dial, TLSClientConfig: m.TLSConfig(), DisableKeepAlives: true},
+		Timeout:   30 * time.Second,
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d: %s", resp.StatusCode, bytes.TrimSpace(b))
+	}
+
+	return b, nil
+}
+
+// writeFileAtomic 先写临时文件再重命名, 避免进程中断时留下不完整的证书
+func writeFileAtomic(path string, b []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// tlsConfig 开启 CA 时连接 gateway 的 tls 配置, 否则为 nil
+func (a *Agent) tlsConfig() *tls.Config {
+	if a.certs == nil {
+		return nil
+	}
+	return a.certs.TLSConfig()
+}
+
+// wsURL 开启 CA 时使用 wss
+func (a *Agent) wsURL(host, path string) string {
+	u := url.URL{Scheme: "ws", Host: host, Path: path}
+	if a.certs != nil {
+		u.Scheme = "wss"
+	}
+	return u.String()
+}
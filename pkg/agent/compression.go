@@ -0,0 +1,100 @@
+package agent
+
+import (
+	"context"
+	"github.com/gorilla/websocket"
+	"k8s-tunnel/pkg/protocol"
+	"k8s-tunnel/pkg/transport"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// CompressionStats 响应连接上写出的原始字节数和实际发送的字节数
+type CompressionStats struct {
+	RawBytes  int64 `json:"rawBytes"`
+	WireBytes int64 `json:"wireBytes"`
+}
+
+// Ratio 压缩比, 没有数据时为 0
+func (s CompressionStats) Ratio() float64 {
+	if s.WireBytes == 0 {
+		return 0
+	}
+	return float64(s.RawBytes) / float64(s.WireBytes)
+}
+
+// CompressionStats 响应的压缩统计. 只有 websocket 传输会压缩, 其他传输方式的响应不计入
+func (a *Agent) CompressionStats() CompressionStats {
+	return CompressionStats{
+		RawBytes:  atomic.LoadInt64(&a.rawBytes),
+		WireBytes: atomic.LoadInt64(&a.wireBytes),
+	}
+}
+
+// countingConn 统计实际写到网络上的字节数
+type countingConn struct {
+	net.Conn
+	written int64
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.written, int64(n))
+	return n, err
+}
+
+// dialResponse 用注册连接的传输方式建立响应连接. websocket 协商了压缩时开启 permessage-deflate,
+// 其他传输方式不压缩, 也不统计网络上的字节数, counter 为空
+func (a *Agent) dialResponse(ctx context.Context, g *gatewayConn, session *protocol.Session, u string, header http.Header) (transport.Conn, *countingConn, error) {
+	if name := g.Transport(); name != transport.WebSocket {
+		conn, _, err := g.Dialer().DialContext(ctx, name, u, header)
+		return conn, nil, err
+	}
+
+	var counter *countingConn
+	dialer := &websocket.Dialer{
+		HandshakeTimeout:  websocket.DefaultDialer.HandshakeTimeout,
+		EnableCompression: session.Has(protocol.FeatureCompression),
+		TLSClientConfig:   a.tlsConfig(),
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := a.dialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			counter = &countingConn{Conn: conn}
+			return counter, nil
+		},
+	}
+
+	conn, _, err := dialer.DialContext(ctx, u, header)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return conn, counter, nil
+}
+
+// writeResponse 超过阈值的响应才压缩, 并记录压缩前后的大小. counter 为空时不是 websocket, 不压缩也不统计
+func (a *Agent) writeResponse(ctx context.Context, conn transport.Conn, counter *countingConn, req *http.Request, b []byte) error {
+	var before int64
+	if counter != nil {
+		conn.EnableWriteCompression(len(b) >= a.opt.CompressionThreshold)
+		before = atomic.LoadInt64(&counter.written)
+	}
+
+	var err error
+	if a.sched != nil {
+		err = a.shapedWriteMessage(ctx, conn, a.sched.classify(req), b)
+	} else {
+		err = conn.WriteMessage(websocket.BinaryMessage, b)
+	}
+	if err != nil || counter == nil {
+		return err
+	}
+
+	atomic.AddInt64(&a.rawBytes, int64(len(b)))
+	atomic.AddInt64(&a.wireBytes, atomic.LoadInt64(&counter.written)-before)
+
+	return nil
+}
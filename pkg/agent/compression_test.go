@@ -0,0 +1,103 @@
+package agent_test
+
+import (
+	"k8s-tunnel/pkg/agent"
+	"k8s-tunnel/pkg/protocol"
+	"k8s-tunnel/pkg/transport"
+	"k8s-tunnel/pkg/tunneltest"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func compressionHarness(t *testing.T, body string, configure func(opt *agent.Option)) *tunneltest.Harness {
+	return tunneltest.New(t, &tunneltest.Option{
+		AgentOption: func(opt *agent.Option) {
+			opt.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte(body))
+			})
+			configure(opt)
+		},
+	})
+}
+
+// 响应写完后才会更新统计, 等待其反映到 Stats 中
+func waitCompressionStats(t *testing.T, a *tunneltest.Agent, minRaw int64) agent.CompressionStats {
+	t.Helper()
+
+	deadline := time.Now().Add(tunneltest.DefaultWaitTimeout)
+	for {
+		stats := a.CompressionStats()
+		if stats.RawBytes >= minRaw {
+			return stats
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("compression stats not updated: %+v", stats)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	body := strings.Repeat(`{"metadata":{"name":"nginx","namespace":"default"}},`, 2000)
+
+	t.Run("#negotiated", func(t *testing.T) {
+		h := compressionHarness(t, body, func(opt *agent.Option) {})
+		a := h.StartAgent("huawei")
+		if !a.Session().Has(protocol.FeatureCompression) {
+			t.Fatalf("compression not negotiated: %+v", a.Session())
+		}
+
+		if resp, b := get(t, h.URL("huawei", "/")); resp.StatusCode != http.StatusOK || string(b) != body {
+			t.Fatalf("status %d, body length %d", resp.StatusCode, len(b))
+		}
+		if stats := waitCompressionStats(t, a, int64(len(body))); stats.Ratio() < 5 {
+			t.Fatalf("expect compressed response, stats %+v", stats)
+		}
+	})
+
+	t.Run("#below threshold", func(t *testing.T) {
+		h := compressionHarness(t, body, func(opt *agent.Option) { opt.CompressionThreshold = 1 << 20 })
+		a := h.StartAgent("huawei")
+
+		get(t, h.URL("huawei", "/"))
+		if stats := waitCompressionStats(t, a, int64(len(body))); stats.Ratio() > 1 {
+			t.Fatalf("expect uncompressed response, stats %+v", stats)
+		}
+	})
+
+	t.Run("#disabled", func(t *testing.T) {
+		h := compressionHarness(t, body, func(opt *agent.Option) { opt.DisableCompression = true })
+		a := h.StartAgent("huawei")
+		if a.Session().Has(protocol.FeatureCompression) {
+			t.Fatalf("compression negotiated: %+v", a.Session())
+		}
+
+		if resp, b := get(t, h.URL("huawei", "/")); resp.StatusCode != http.StatusOK || string(b) != body {
+			t.Fatalf("status %d, body length %d", resp.StatusCode, len(b))
+		}
+		if stats := waitCompressionStats(t, a, int64(len(body))); stats.Ratio() > 1 {
+			t.Fatalf("expect uncompressed response, stats %+v", stats)
+		}
+	})
+
+	t.Run("#non-websocket transport", func(t *testing.T) {
+		h := compressionHarness(t, body, func(opt *agent.Option) { opt.Transports = []transport.Name{transport.HTTP2} })
+		a := h.StartAgent("huawei")
+		if a.Session().Has(protocol.FeatureCompression) {
+			t.Fatalf("compression negotiated on %s: %+v", transport.HTTP2, a.Session())
+		}
+		if tunnel, _ := h.Gateway.Tunnel("huawei"); tunnel.Session.Has(protocol.FeatureCompression) {
+			t.Fatalf("gateway negotiated compression on %s: %+v", transport.HTTP2, tunnel.Session)
+		}
+
+		if resp, b := get(t, h.URL("huawei", "/")); resp.StatusCode != http.StatusOK || string(b) != body {
+			t.Fatalf("status %d, body length %d", resp.StatusCode, len(b))
+		}
+		// http2 不压缩, 不计入统计
+		if stats := a.CompressionStats(); stats != (agent.CompressionStats{}) {
+			t.Fatalf("expect no stats on %s, got %+v", transport.HTTP2, stats)
+		}
+	})
+}
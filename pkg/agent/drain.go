@@ -0,0 +1,48 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+	"k8s-tunnel/pkg/protocol"
+	"sync/atomic"
+	"time"
+)
+
+const DefaultDrainTimeout = 10 * time.Second
+
+// 退出时关闭连接的原因
+const reasonShuttingDown = "agent shutting down"
+
+// handleMessage 处理 gateway 发来的控制消息
+func (a *Agent) handleMessage(g *gatewayConn, message []byte) {
+	msg := &protocol.Message{}
+	if err := json.Unmarshal(message, msg); err != nil {
+		logrus.Errorf("invalid message from gateway %s. err:%v", g.host, err)
+		return
+	}
+
+	switch msg.Type {
+	case protocol.MessageGoAway:
+		// 进行中的请求仍在当前连接上完成, gateway 关闭连接后立即重连
+		logrus.Infof("gateway %s is going away", g.host)
+		atomic.StoreInt32(&g.goaway, 1)
+	default:
+		logrus.Warnf("unknown message type %s from gateway %s", msg.Type, g.host)
+	}
+}
+
+// drain 等待该 gateway 转发来的请求完成或 DrainTimeout 后通知 gateway 断开
+func (a *Agent) drain(g *gatewayConn, reason string) {
+	logrus.Infof("draining %s, %d requests in flight", g.host, g.inflight.Count())
+
+	ctx, cancel := context.WithTimeout(context.Background(), a.opt.DrainTimeout)
+	defer cancel()
+	if !g.inflight.Wait(ctx) {
+		logrus.Warnf("drain %s timeout, %d requests still in flight", g.host, g.inflight.Count())
+	}
+
+	msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, reason)
+	_ = g.Conn().WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+}
@@ -0,0 +1,140 @@
+package agent_test
+
+import (
+	"context"
+	"k8s-tunnel/pkg/agent"
+	"k8s-tunnel/pkg/gateway"
+	"k8s-tunnel/pkg/tunneltest"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDrain(t *testing.T) {
+	t.Run("#finish in flight", func(t *testing.T) {
+		release := make(chan struct{})
+		h := tunneltest.New(t, &tunneltest.Option{
+			Upstream: func(string) http.Handler {
+				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					if r.URL.Path == "/slow" {
+						<-release
+					}
+					_, _ = w.Write([]byte("done"))
+				})
+			},
+		})
+		h.StartAgent("huawei")
+
+		bodyCh := make(chan string, 1)
+		go func() {
+			_, b := get(t, h.URL("huawei", "/slow"))
+			bodyCh <- string(b)
+		}()
+		time.Sleep(100 * time.Millisecond)
+
+		stopped := make(chan struct{})
+		go func() {
+			defer close(stopped)
+			h.StopAgent("huawei")
+		}()
+		time.Sleep(100 * time.Millisecond)
+
+		// 仍然注册着, 但不再接受新的请求
+		if resp, b := get(t, h.URL("huawei", "/")); resp.StatusCode != http.StatusServiceUnavailable || !strings.Contains(string(b), "shutting down") {
+			t.Fatalf("new request during drain: %d %s", resp.StatusCode, b)
+		}
+
+		close(release)
+		if body := <-bodyCh; body != "done" {
+			t.Fatalf("in-flight request got %q", body)
+		}
+		<-stopped
+	})
+
+	t.Run("#finish in flight with shaping", func(t *testing.T) {
+		body := strings.Repeat("x", 32<<10)
+		release := make(chan struct{})
+		h := tunneltest.New(t, &tunneltest.Option{
+			AgentOption: func(opt *agent.Option) {
+				opt.DrainTimeout = 3 * time.Second
+				opt.Shaping = &agent.Shaping{BandwidthLimit: 64 << 10, ChunkSize: 16 << 10}
+				opt.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					if r.URL.Path == "/slow" {
+						<-release
+					}
+					_, _ = w.Write([]byte(body))
+				})
+			},
+		})
+		h.StartAgent("huawei")
+
+		bodyCh := make(chan string, 1)
+		go func() {
+			_, b := get(t, h.URL("huawei", "/slow"))
+			bodyCh <- string(b)
+		}()
+		time.Sleep(100 * time.Millisecond)
+
+		stopped := make(chan struct{})
+		go func() {
+			defer close(stopped)
+			h.StopAgent("huawei")
+		}()
+		time.Sleep(100 * time.Millisecond)
+
+		// agent 退出后响应仍然要经过带宽调度
+		start := time.Now()
+		close(release)
+		if b := <-bodyCh; b != body {
+			t.Fatalf("in-flight request got %d bytes", len(b))
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Fatalf("response blocked for %s", elapsed)
+		}
+		<-stopped
+	})
+
+	t.Run("#goaway", func(t *testing.T) {
+		var (
+			mu        sync.Mutex
+			registers []time.Time
+		)
+		h := tunneltest.New(t, &tunneltest.Option{
+			Gateway: &gateway.Option{Authenticate: func(req *http.Request) error {
+				if strings.HasSuffix(req.URL.Path, "/register") {
+					mu.Lock()
+					registers = append(registers, time.Now())
+					mu.Unlock()
+				}
+				return nil
+			}},
+			// 收到 goaway 后不等待重连间隔
+			AgentOption: func(opt *agent.Option) { opt.ReconnectInterval = time.Minute },
+		})
+		h.StartAgent("huawei")
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		h.Gateway.Drain(ctx)
+		drained := time.Now()
+
+		deadline := time.Now().Add(tunneltest.DefaultWaitTimeout)
+		for {
+			mu.Lock()
+			n := len(registers)
+			mu.Unlock()
+			if n == 2 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("agent did not reconnect after goaway, %d registrations", n)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if since := registers[1].Sub(drained); since > time.Second {
+			t.Fatalf("reconnected %s after goaway", since)
+		}
+	})
+}
@@ -0,0 +1,166 @@
+package agent_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"k8s-tunnel/pkg/agent"
+	"k8s-tunnel/pkg/e2e"
+	"k8s-tunnel/pkg/gateway"
+	"k8s-tunnel/pkg/protocol"
+	"k8s-tunnel/pkg/tunneltest"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// sealedClient 从 gateway 获取 agent 的公钥, 返回加密请求的 client
+func sealedClient(t *testing.T, h *tunneltest.Harness, agentName string) *http.Client {
+	t.Helper()
+
+	resp, b := get(t, "http://"+h.GatewayHost()+"/agents/"+agentName)
+	info := &gateway.AgentInfo{}
+	if err := json.Unmarshal(b, info); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("get agent: %d %s", resp.StatusCode, b)
+	}
+	pub, err := e2e.ParsePublicKey(info.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &http.Client{Transport: &e2e.Transport{AgentName: agentName, PublicKey: pub}}
+}
+
+// recordingTransport 记录最后一个发给 gateway 的密文
+type recordingTransport struct {
+	sealed []byte
+}
+
+func (r *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	b, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	r.sealed = b
+	req.Body = ioutil.NopCloser(bytes.NewReader(b))
+
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestE2E(t *testing.T) {
+	key, err := e2e.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("#round trip", func(t *testing.T) {
+		var (
+			mu   sync.Mutex
+			seen []string // gateway 看到的请求
+		)
+		h := tunneltest.New(t, &tunneltest.Option{
+			Gateway: &gateway.Option{Authenticate: func(req *http.Request) error {
+				mu.Lock()
+				defer mu.Unlock()
+				seen = append(seen, req.Method+" "+req.URL.String()+" "+req.Header.Get("X-Secret"))
+				return nil
+			}},
+			AgentOption: func(opt *agent.Option) { opt.E2EKey = key },
+		})
+		a := h.StartAgent("huawei")
+		if !a.Session().Has(protocol.FeatureE2E) {
+			t.Fatalf("e2e not negotiated: %+v", a.Session())
+		}
+		client := sealedClient(t, h, "huawei")
+
+		req, _ := http.NewRequest(http.MethodPut, h.URL("huawei", "/api/v1/namespaces/default/secrets/db?dryRun=All"), strings.NewReader("password"))
+		req.Header.Set("X-Secret", "token")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+
+		echo := &tunneltest.EchoResponse{}
+		if err = json.Unmarshal(b, echo); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("status %d, body %s", resp.StatusCode, b)
+		}
+		if echo.Method != http.MethodPut || echo.Path != "/api/v1/namespaces/default/secrets/db" ||
+			echo.Query != "dryRun=All" || echo.Body != "password" || echo.Header.Get("X-Secret") != "token" {
+			t.Fatalf("unexpected upstream request %+v", echo)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		for _, s := range seen {
+			if strings.Contains(s, "secrets") || strings.Contains(s, "token") {
+				t.Fatalf("gateway saw plaintext: %s", s)
+			}
+		}
+	})
+
+	t.Run("#require e2e", func(t *testing.T) {
+		h := tunneltest.New(t, &tunneltest.Option{
+			AgentOption: func(opt *agent.Option) { opt.E2EKey, opt.RequireE2E = key, true },
+		})
+		h.StartAgent("huawei")
+
+		if resp, b := get(t, h.URL("huawei", "/api/v1/pods")); resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("expect plain request forbidden, status %d, body %s", resp.StatusCode, b)
+		}
+		resp, err := sealedClient(t, h, "huawei").Get(h.URL("huawei", "/api/v1/pods"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("#replay rejected", func(t *testing.T) {
+		h := tunneltest.New(t, &tunneltest.Option{
+			AgentOption: func(opt *agent.Option) { opt.E2EKey = key },
+		})
+		h.StartAgent("huawei")
+		client := sealedClient(t, h, "huawei")
+		recorder := &recordingTransport{}
+		client.Transport.(*e2e.Transport).Base = recorder
+
+		resp, err := client.Get(h.URL("huawei", "/api/v1/secrets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status %d", resp.StatusCode)
+		}
+
+		// gateway 重发记录下的密文
+		resp, err = http.Post(h.URL("huawei", ""), e2e.ContentType, bytes.NewReader(recorder.sealed))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if b, _ := ioutil.ReadAll(resp.Body); resp.StatusCode != http.StatusBadRequest || e2e.IsSealed(resp.Header) {
+			t.Fatalf("expect replay rejected, status %d, body %s", resp.StatusCode, b)
+		}
+	})
+
+	t.Run("#not supported", func(t *testing.T) {
+		h := tunneltest.New(t, nil)
+		h.StartAgent("huawei")
+
+		client := &http.Client{Transport: &e2e.Transport{AgentName: "huawei", PublicKey: key.Public()}}
+		resp, err := client.Get(h.URL("huawei", "/api/v1/pods"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expect 400, got %d", resp.StatusCode)
+		}
+	})
+}
@@ -0,0 +1,253 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"k8s-tunnel/pkg/protocol"
+	"k8s-tunnel/pkg/transport"
+	"k8s-tunnel/pkg/utils"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// GatewayMode 配置了多个 gateway 时的注册方式
+type GatewayMode string
+
+const (
+	// GatewayModeAllActive 同时注册到所有 gateway, 任意一个转发来的请求都会处理
+	GatewayModeAllActive GatewayMode = "all-active"
+	// GatewayModePriority 只注册到可用的优先级最高的 gateway, 前面的 gateway 恢复后切回
+	GatewayModePriority GatewayMode = "priority"
+)
+
+// GatewayState 与单个 gateway 的连接状态
+type GatewayState string
+
+const (
+	GatewayConnecting   GatewayState = "connecting"
+	GatewayRegistered   GatewayState = "registered"
+	GatewayDisconnected GatewayState = "disconnected"
+	// GatewayStandby priority 模式下有优先级更高的 gateway 可用, 暂不注册
+	GatewayStandby GatewayState = "standby"
+)
+
+// 被优先级更高的 gateway 取代时关闭连接的原因
+const reasonPreempted = "preempted by higher priority gateway"
+
+var errPreempted = errors.New(reasonPreempted)
+
+// GatewayStatus 单个 gateway 的连接状态
+type GatewayStatus struct {
+	Host     string       `json:"host"`
+	Priority int          `json:"priority"` // GatewayHosts 中的下标, 越小越优先
+	State    GatewayState `json:"state"`
+	Since    time.Time    `json:"since"`    // 进入当前状态的时间
+	Failures int          `json:"failures"` // 连续断线或注册失败的次数
+	// Transport 最近一次注册成功使用的传输方式
+	Transport transport.Name `json:"transport,omitempty"`
+	Error     string         `json:"error,omitempty"`
+}
+
+// gatewayConn 与一个 gateway 的注册连接及其状态
+type gatewayConn struct {
+	host     string
+	priority int
+
+	mu        sync.RWMutex
+	conn      transport.Conn
+	transport transport.Name    // 最近一次注册成功的传输方式
+	dialer    *transport.Dialer // 本次注册使用的 dialer, 响应连接复用其 HTTP/2 连接
+	session   *protocol.Session
+	state     GatewayState
+	since     time.Time
+	failures  int
+	lastErr   error
+
+	writeMu   sync.Mutex     // 注册连接上的写操作
+	goaway    int32          // gateway 通知即将下线, 断开后立即重连
+	preempted int32          // 被优先级更高的 gateway 取代
+	inflight  utils.Inflight // 该 gateway 转发来的进行中的请求数
+}
+
+func newGatewayConns(hosts []string) []*gatewayConn {
+	gateways := make([]*gatewayConn, 0, len(hosts))
+	for i, host := range hosts {
+		gateways = append(gateways, &gatewayConn{
+			host:     host,
+			priority: i,
+			state:    GatewayConnecting,
+			since:    time.Now(),
+		})
+	}
+	return gateways
+}
+
+func (g *gatewayConn) Conn() transport.Conn {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	return g.conn
+}
+
+func (g *gatewayConn) Transport() transport.Name {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	return g.transport
+}
+
+func (g *gatewayConn) Dialer() *transport.Dialer {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	return g.dialer
+}
+
+func (g *gatewayConn) Session() *protocol.Session {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	return g.session
+}
+
+func (g *gatewayConn) State() GatewayState {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	return g.state
+}
+
+func (g *gatewayConn) setState(state GatewayState, err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	switch state {
+	case GatewayRegistered:
+		g.failures = 0
+	case GatewayDisconnected:
+		g.failures++
+	}
+	if g.state != state {
+		g.since = time.Now()
+	}
+	g.state, g.lastErr = state, err
+}
+
+func (g *gatewayConn) status() GatewayStatus {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	s := GatewayStatus{Host: g.host, Priority: g.priority, State: g.state, Since: g.since, Failures: g.failures, Transport: g.transport}
+	if g.lastErr != nil {
+		s.Error = g.lastErr.Error()
+	}
+	return s
+}
+
+func (g *gatewayConn) writeJSON(v interface{}) error {
+	g.writeMu.Lock()
+	defer g.writeMu.Unlock()
+
+	conn := g.Conn()
+	_ = conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+	return conn.WriteJSON(v)
+}
+
+// Gateways 每个 gateway 的连接状态, 按优先级排列
+func (a *Agent) Gateways() []GatewayStatus {
+	ret := make([]GatewayStatus, 0, len(a.gateways))
+	for _, g := range a.gateways {
+		ret = append(ret, g.status())
+	}
+	return ret
+}
+
+// serveGateway 维持到一个 gateway 的注册, 断线后自动重连, 直到 ctx 结束
+func (a *Agent) serveGateway(ctx, reqCtx context.Context, g *gatewayConn) error {
+	for {
+		if !a.preferred(g) {
+			g.setState(GatewayStandby, nil)
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(a.opt.ReconnectInterval):
+			}
+			continue
+		}
+
+		err := a.run(ctx, reqCtx, g)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if atomic.CompareAndSwapInt32(&g.preempted, 1, 0) {
+			logrus.Infof("disconnected from %s, %s", g.host, reasonPreempted)
+			continue
+		}
+		g.setState(GatewayDisconnected, err)
+		// 协议不兼容时重连也没有意义
+		if errors.Is(err, protocol.ErrIncompatible) {
+			return err
+		}
+		logrus.Errorf("agent disconnected from %s. err:%v", g.host, err)
+		// gateway 主动下线, 立即重连, 不可用时由其他 gateway 接替
+		if atomic.CompareAndSwapInt32(&g.goaway, 1, 0) {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(a.opt.ReconnectInterval):
+		}
+	}
+}
+
+// preferred priority 模式下只有优先级更高的 gateway 都连接失败时才注册
+func (a *Agent) preferred(g *gatewayConn) bool {
+	if a.opt.GatewayMode != GatewayModePriority {
+		return true
+	}
+	for _, other := range a.gateways[:g.priority] {
+		if other.State() != GatewayDisconnected {
+			return false
+		}
+	}
+	return true
+}
+
+// preempt priority 模式下注册成功后, 断开优先级更低的 gateway, 进行中的请求完成后再断开
+func (a *Agent) preempt(g *gatewayConn) {
+	if a.opt.GatewayMode != GatewayModePriority {
+		return
+	}
+	for _, other := range a.gateways[g.priority+1:] {
+		if other.State() != GatewayRegistered || !atomic.CompareAndSwapInt32(&other.preempted, 0, 1) {
+			continue
+		}
+		logrus.Infof("registered to %s, leaving %s", g.host, other.host)
+		go func(other *gatewayConn) {
+			a.drain(other, reasonPreempted)
+			_ = other.Conn().Close()
+		}(other)
+	}
+}
+
+// registeredErr 没有注册到任何 gateway 时返回各 gateway 的状态
+func (a *Agent) registeredErr() error {
+	var states []string
+	for _, s := range a.Gateways() {
+		if s.State == GatewayRegistered {
+			return nil
+		}
+		state := fmt.Sprintf("%s %s", s.Host, s.State)
+		if s.Error != "" {
+			state += ": " + s.Error
+		}
+		states = append(states, state)
+	}
+	return fmt.Errorf("not registered to any gateway (%s)", strings.Join(states, "; "))
+}
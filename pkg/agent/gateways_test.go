@@ -0,0 +1,80 @@
+package agent_test
+
+import (
+	"k8s-tunnel/pkg/agent"
+	"k8s-tunnel/pkg/tunneltest"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestGateways(t *testing.T) {
+	t.Run("#all active", func(t *testing.T) {
+		backup := tunneltest.New(t, nil)
+		h := tunneltest.New(t, &tunneltest.Option{AgentOption: func(opt *agent.Option) {
+			opt.GatewayHosts = []string{opt.GatewayHost, backup.GatewayHost()}
+		}})
+		a := h.StartAgent("huawei")
+		if err := backup.WaitForAgent("huawei", tunneltest.DefaultWaitTimeout); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, url := range []string{h.URL("huawei", "/ping"), backup.URL("huawei", "/ping")} {
+			if resp, b := get(t, url); resp.StatusCode != http.StatusOK {
+				t.Fatalf("%s: %d %s", url, resp.StatusCode, b)
+			}
+		}
+
+		// 一个 gateway 下线不影响另一个
+		h.StopGateway()
+		if resp, b := get(t, backup.URL("huawei", "/ping")); resp.StatusCode != http.StatusOK {
+			t.Fatalf("%d %s", resp.StatusCode, b)
+		}
+		deadline := time.Now().Add(tunneltest.DefaultWaitTimeout)
+		for {
+			gateways := a.Gateways()
+			if gateways[0].State == agent.GatewayDisconnected && gateways[1].State == agent.GatewayRegistered {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("unexpected gateways %+v", gateways)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+
+	t.Run("#priority", func(t *testing.T) {
+		backup := tunneltest.New(t, nil)
+		h := tunneltest.New(t, &tunneltest.Option{AgentOption: func(opt *agent.Option) {
+			opt.GatewayHosts = []string{opt.GatewayHost, backup.GatewayHost()}
+			opt.GatewayMode = agent.GatewayModePriority
+		}})
+		a := h.StartAgent("huawei")
+
+		time.Sleep(3 * tunneltest.DefaultReconnectInterval)
+		if _, ok := backup.Gateway.Tunnel("huawei"); ok {
+			t.Fatal("registered to backup gateway while primary is available")
+		}
+		if state := a.Gateways()[1].State; state != agent.GatewayStandby {
+			t.Fatalf("backup gateway %s", state)
+		}
+
+		// 主 gateway 下线后切到备用
+		h.StopGateway()
+		if err := backup.WaitForAgent("huawei", tunneltest.DefaultWaitTimeout); err != nil {
+			t.Fatal(err)
+		}
+		if resp, b := get(t, backup.URL("huawei", "/ping")); resp.StatusCode != http.StatusOK {
+			t.Fatalf("%d %s", resp.StatusCode, b)
+		}
+
+		// 主 gateway 恢复后切回
+		h.StartGateway()
+		if err := h.WaitForAgent("huawei", tunneltest.DefaultWaitTimeout); err != nil {
+			t.Fatal(err)
+		}
+		if err := backup.WaitForAgentGone("huawei", tunneltest.DefaultWaitTimeout); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
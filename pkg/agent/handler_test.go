@@ -0,0 +1,160 @@
+package agent_test
+
+import (
+	"encoding/json"
+	"k8s-tunnel/pkg/agent"
+	"k8s-tunnel/pkg/tunneltest"
+	"k8s-tunnel/pkg/tunneltest/fakeapiserver"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/rest"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// firstEvent 读取 watch 的第一个事件, 上游不会结束, 只能在流式转发时读到
+func firstEvent(t *testing.T, url string) *metav1.WatchEvent {
+	t.Helper()
+
+	client := &http.Client{Timeout: tunneltest.DefaultWaitTimeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	event := &metav1.WatchEvent{}
+	if err = json.NewDecoder(resp.Body).Decode(event); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d, err %v", resp.StatusCode, err)
+	}
+
+	return event
+}
+
+func newAPIServer(t *testing.T) *fakeapiserver.Server {
+	s := fakeapiserver.New(nil)
+	t.Cleanup(s.Close)
+
+	pod := &unstructured.Unstructured{}
+	pod.SetAPIVersion("v1")
+	pod.SetKind("Pod")
+	pod.SetNamespace("default")
+	pod.SetName("nginx")
+	if err := s.Add(pod); err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+func TestK8sReverseProxyHandler(t *testing.T) {
+	t.Run("#list pods", func(t *testing.T) {
+		s := newAPIServer(t)
+		h := tunneltest.New(t, &tunneltest.Option{APIServer: s})
+		h.StartAgent("huawei")
+
+		resp, b := get(t, h.URL("huawei", "/api/v1/namespaces/default/pods"))
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status %d, body %s", resp.StatusCode, b)
+		}
+		list := &unstructured.UnstructuredList{}
+		if err := list.UnmarshalJSON(b); err != nil {
+			t.Fatal(err)
+		}
+		if len(list.Items) != 1 || list.Items[0].GetName() != "nginx" {
+			t.Fatalf("unexpected list %s", b)
+		}
+
+		last, _ := s.LastRequest()
+		if last.Header.Get("Authorization") != "Bearer "+fakeapiserver.DefaultToken {
+			t.Fatalf("agent credentials not used, header %v", last.Header)
+		}
+	})
+
+	t.Run("#impersonation", func(t *testing.T) {
+		s := newAPIServer(t)
+		config := s.Config()
+		config.Impersonate = rest.ImpersonationConfig{UserName: "alice", Groups: []string{"dev"}}
+		handler, err := agent.K8sReverseProxyHandler(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := tunneltest.New(t, &tunneltest.Option{
+			AgentOption: func(opt *agent.Option) { opt.Handler = handler },
+		})
+		h.StartAgent("huawei")
+
+		if resp, b := get(t, h.URL("huawei", "/api/v1/namespaces/default/pods/nginx")); resp.StatusCode != http.StatusOK {
+			t.Fatalf("status %d, body %s", resp.StatusCode, b)
+		}
+
+		last, _ := s.LastRequest()
+		if last.Header.Get("Impersonate-User") != "alice" || last.Header.Get("Impersonate-Group") != "dev" {
+			t.Fatalf("impersonation headers missing, header %v", last.Header)
+		}
+	})
+
+	t.Run("#status error", func(t *testing.T) {
+		h := tunneltest.New(t, &tunneltest.Option{APIServer: newAPIServer(t)})
+		h.StartAgent("huawei")
+
+		resp, b := get(t, h.URL("huawei", "/api/v1/namespaces/default/pods/missing"))
+		if resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("status %d, body %s", resp.StatusCode, b)
+		}
+		status := &metav1.Status{}
+		if err := json.Unmarshal(b, status); err != nil {
+			t.Fatal(err)
+		}
+		if status.Reason != metav1.StatusReasonNotFound {
+			t.Fatalf("unexpected status %+v", status)
+		}
+	})
+
+	t.Run("#watch", func(t *testing.T) {
+		h := tunneltest.New(t, &tunneltest.Option{APIServer: newAPIServer(t)})
+		h.StartAgent("huawei")
+
+		resp, b := get(t, h.URL("huawei", "/api/v1/namespaces/default/pods?watch=true&timeoutSeconds=1"))
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status %d, body %s", resp.StatusCode, b)
+		}
+		event := &metav1.WatchEvent{}
+		if err := json.NewDecoder(strings.NewReader(string(b))).Decode(event); err != nil {
+			t.Fatal(err)
+		}
+		if event.Type != "ADDED" || !strings.Contains(string(event.Object.Raw), `"nginx"`) {
+			t.Fatalf("unexpected event %s", b)
+		}
+	})
+
+	t.Run("#watch event before upstream ends", func(t *testing.T) {
+		h := tunneltest.New(t, &tunneltest.Option{APIServer: newAPIServer(t)})
+		h.StartAgent("huawei")
+
+		event := firstEvent(t, h.URL("huawei", "/api/v1/namespaces/default/pods?watch=true"))
+		if event.Type != "ADDED" || !strings.Contains(string(event.Object.Raw), `"nginx"`) {
+			t.Fatalf("unexpected event %+v", event)
+		}
+	})
+
+	t.Run("#kubeconfig", func(t *testing.T) {
+		s := newAPIServer(t)
+		kubeconfig, err := s.WriteKubeconfig(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := tunneltest.New(t, &tunneltest.Option{
+			AgentOption: func(opt *agent.Option) {
+				opt.Handler = nil
+				opt.Kubeconfig = kubeconfig
+			},
+		})
+		h.StartAgent("huawei")
+
+		if resp, b := get(t, h.URL("huawei", "/version")); resp.StatusCode != http.StatusOK {
+			t.Fatalf("status %d, body %s", resp.StatusCode, b)
+		}
+	})
+}
@@ -0,0 +1,52 @@
+package agent
+
+import (
+	"fmt"
+	"k8s-tunnel/pkg/protocol"
+	"k8s-tunnel/pkg/transport"
+	"time"
+)
+
+const DefaultHelloTimeout = 10 * time.Second
+
+// handshake 注册连接建立后发送 Hello, 并根据 gateway 的回复确定协议
+func (a *Agent) handshake(conn transport.Conn) (*protocol.Session, error) {
+	local := protocol.NewHello(a.features(transport.Of(conn)), a.opt.MaxFrameSize)
+	if a.opt.E2EKey != nil {
+		local.PublicKey = a.opt.E2EKey.Public().String()
+	}
+
+	_ = conn.SetWriteDeadline(time.Now().Add(a.opt.HelloTimeout))
+	if err := conn.WriteJSON(local); err != nil {
+		return nil, fmt.Errorf("send hello error. err:%v", err)
+	}
+	_ = conn.SetWriteDeadline(time.Time{})
+
+	_ = conn.SetReadDeadline(time.Now().Add(a.opt.HelloTimeout))
+	ack := &protocol.HelloAck{}
+	if err := conn.ReadJSON(ack); err != nil {
+		return nil, fmt.Errorf("read hello ack error, gateway may not support protocol negotiation. err:%v", err)
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	return protocol.SessionFromAck(local, ack)
+}
+
+// features 本端支持的特性, 关闭压缩、传输方式不是 websocket 或没有配置 E2EKey 时对应特性不参与协商
+func (a *Agent) features(name transport.Name) []protocol.Feature {
+	features := a.opt.Features
+	if len(features) == 0 {
+		features = protocol.SupportedFeatures
+	}
+
+	// 不能为 nil, 否则 NewHello 会使用 SupportedFeatures
+	ret := []protocol.Feature{}
+	for _, f := range features {
+		if f == protocol.FeatureCompression && (a.opt.DisableCompression || name != transport.WebSocket) ||
+			f == protocol.FeatureE2E && a.opt.E2EKey == nil {
+			continue
+		}
+		ret = append(ret, f)
+	}
+	return ret
+}
@@ -0,0 +1,78 @@
+package agent_test
+
+import (
+	"context"
+	"errors"
+	"github.com/gorilla/websocket"
+	"k8s-tunnel/pkg/agent"
+	"k8s-tunnel/pkg/protocol"
+	"k8s-tunnel/pkg/tunneltest"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandshake(t *testing.T) {
+	t.Run("#refused by gateway", func(t *testing.T) {
+		// 只会拒绝协商的 gateway
+		gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			_, _, _ = conn.ReadMessage()
+			_ = conn.WriteJSON(protocol.Ack(protocol.NewHello(nil, 0), nil, errors.New("agent too old")))
+		}))
+		defer gw.Close()
+
+		a := agent.NewAgent(&agent.Option{
+			AgentName:         "huawei",
+			GatewayHost:       strings.TrimPrefix(gw.URL, "http://"),
+			Handler:           http.NotFoundHandler(),
+			ReconnectInterval: 10 * time.Millisecond,
+		})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := a.Serve(ctx); !errors.Is(err, protocol.ErrIncompatible) {
+			t.Fatalf("expect ErrIncompatible, got %v", err)
+		}
+	})
+
+	t.Run("#max frame size", func(t *testing.T) {
+		upstream := func(string) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte(strings.Repeat("x", 4096)))
+			})
+		}
+		h := tunneltest.New(t, &tunneltest.Option{
+			Upstream:    upstream,
+			AgentOption: func(opt *agent.Option) { opt.MaxFrameSize = 1024 },
+		})
+		a := h.StartAgent("huawei")
+		if a.Session().MaxFrameSize != 1024 {
+			t.Fatalf("unexpected session %+v", a.Session())
+		}
+
+		// 分成多个消息发送, 不受单个消息大小的限制
+		if resp, b := get(t, h.URL("huawei", "/")); resp.StatusCode != http.StatusOK || len(b) != 4096 {
+			t.Fatalf("status %d, body length %d", resp.StatusCode, len(b))
+		}
+
+		// 没有协商 streaming 时整个响应是一个消息
+		h = tunneltest.New(t, &tunneltest.Option{
+			Upstream: upstream,
+			AgentOption: func(opt *agent.Option) {
+				opt.MaxFrameSize = 1024
+				opt.Features = []protocol.Feature{protocol.FeatureMetadata}
+			},
+		})
+		h.StartAgent("huawei")
+		if resp, b := get(t, h.URL("huawei", "/")); resp.StatusCode != http.StatusBadGateway {
+			t.Fatalf("status %d, body %s", resp.StatusCode, b)
+		}
+	})
+}
@@ -0,0 +1,77 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"k8s-tunnel/pkg/health"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+// upstreamHealthPath 检查上游 apiserver 的路径, 所有版本的 apiserver 都支持
+const upstreamHealthPath = "/healthz"
+
+// HealthHandler 本地健康检查: /livez 进程存活, /readyz 至少注册到一个 gateway 且上游可达, /healthz 两者都检查
+func (a *Agent) HealthHandler() http.Handler {
+	registered := health.Check{Name: "registered", Check: func(context.Context) error {
+		return a.registeredErr()
+	}}
+	upstream := health.Check{Name: "upstream", Check: a.checkUpstream}
+
+	mux := http.NewServeMux()
+	mux.Handle("/livez", health.Handler("livez", health.Ping))
+	mux.Handle("/readyz", health.Handler("readyz", health.Ping, registered, upstream))
+	mux.Handle("/healthz", health.Handler("healthz", health.Ping, registered, upstream))
+
+	return mux
+}
+
+// checkUpstream 通过 handler 访问上游, 与代理的请求使用同样的凭证
+func (a *Agent) checkUpstream(ctx context.Context) error {
+	a.mu.RLock()
+	handler := a.handler
+	a.mu.RUnlock()
+	if handler == nil {
+		return errors.New("upstream handler is not ready")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, upstreamHealthPath, nil)
+	if err != nil {
+		return err
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		return fmt.Errorf("GET %s: status %d", upstreamHealthPath, rec.Code)
+	}
+
+	return nil
+}
+
+// serveHealth 在 HealthAddr 上提供健康检查, 直到 ctx 结束
+func (a *Agent) serveHealth(ctx context.Context) error {
+	ln, err := net.Listen("tcp", a.opt.HealthAddr)
+	if err != nil {
+		return fmt.Errorf("listen health address %s: %v", a.opt.HealthAddr, err)
+	}
+
+	server := &http.Server{Handler: a.HealthHandler()}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+	go func() {
+		logrus.Infof("health server listen on %s", ln.Addr())
+		if err := server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			logrus.Errorf("health server error. err:%v", err)
+		}
+	}()
+
+	return nil
+}
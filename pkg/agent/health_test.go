@@ -0,0 +1,55 @@
+package agent_test
+
+import (
+	"k8s-tunnel/pkg/agent"
+	"k8s-tunnel/pkg/tunneltest"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHealth(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	_ = ln.Close()
+
+	h := tunneltest.New(t, &tunneltest.Option{AgentOption: func(opt *agent.Option) {
+		opt.HealthAddr = addr
+	}})
+	a := h.StartAgent("huawei")
+	base := "http://" + addr
+
+	for _, path := range []string{"/livez", "/readyz", "/healthz"} {
+		if resp, b := get(t, base+path); resp.StatusCode != http.StatusOK || string(b) != "ok" {
+			t.Fatalf("%s: %d %s", path, resp.StatusCode, b)
+		}
+	}
+
+	// 上游不可达
+	a.Upstream.Close()
+	if resp, b := get(t, base+"/readyz"); resp.StatusCode != http.StatusServiceUnavailable || !strings.Contains(string(b), "[-]upstream failed") {
+		t.Fatalf("%d %s", resp.StatusCode, b)
+	}
+
+	// gateway 断开后未注册, 进程仍然存活
+	h.StopGateway()
+	deadline := time.Now().Add(tunneltest.DefaultWaitTimeout)
+	for {
+		resp, b := get(t, base+"/readyz?exclude=upstream")
+		if resp.StatusCode == http.StatusServiceUnavailable && strings.Contains(string(b), "[-]registered failed") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d %s", resp.StatusCode, b)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if resp, _ := get(t, base+"/livez"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("livez %d", resp.StatusCode)
+	}
+}
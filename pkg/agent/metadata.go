@@ -0,0 +1,99 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"k8s-tunnel/pkg/protocol"
+	"k8s-tunnel/pkg/version"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+const DefaultMetadataInterval = time.Minute
+
+// reportMetadata 注册成功后立即上报一次元数据, 之后定时刷新
+func (a *Agent) reportMetadata(ctx context.Context, g *gatewayConn) {
+	ticker := time.NewTicker(a.opt.MetadataInterval)
+	defer ticker.Stop()
+
+	for {
+		msg := &protocol.Message{Type: protocol.MessageMetadata, Metadata: a.collectMetadata(ctx)}
+		if err := g.writeJSON(msg); err != nil {
+			logrus.Errorf("report metadata to %s error. err:%v", g.host, err)
+			return
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// collectMetadata 通过 handler 访问 apiserver 获取集群信息, 获取失败的字段留空
+func (a *Agent) collectMetadata(ctx context.Context) *protocol.Metadata {
+	md := &protocol.Metadata{
+		Labels:       a.opt.Labels,
+		AgentVersion: version.Version,
+		UpdatedAt:    time.Now(),
+	}
+
+	var serverVersion struct {
+		GitVersion string `json:"gitVersion"`
+	}
+	if err := a.getJSON(ctx, "/version", &serverVersion); err != nil {
+		logrus.Debugf("get kubernetes version error. err:%v", err)
+		md.UpstreamError = err.Error()
+	}
+	md.KubernetesVersion = serverVersion.GitVersion
+
+	var nodes struct {
+		Metadata struct {
+			RemainingItemCount *int64 `json:"remainingItemCount"`
+		} `json:"metadata"`
+		Items []json.RawMessage `json:"items"`
+	}
+	if err := a.getJSON(ctx, "/api/v1/nodes?limit=500", &nodes); err != nil {
+		logrus.Debugf("list nodes error. err:%v", err)
+	}
+	md.NodeCount = len(nodes.Items)
+	if nodes.Metadata.RemainingItemCount != nil {
+		md.NodeCount += int(*nodes.Metadata.RemainingItemCount)
+	}
+
+	var namespace struct {
+		Metadata struct {
+			UID string `json:"uid"`
+		} `json:"metadata"`
+	}
+	if err := a.getJSON(ctx, "/api/v1/namespaces/kube-system", &namespace); err != nil {
+		logrus.Debugf("get kube-system namespace error. err:%v", err)
+	}
+	md.ClusterUID = namespace.Metadata.UID
+
+	stats := a.CacheStats()
+	md.CacheHits, md.CacheMisses = stats.Hits, stats.Misses
+	md.CompressionRatio = a.CompressionStats().Ratio()
+
+	return md
+}
+
+func (a *Agent) getJSON(ctx context.Context, path string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	rec := httptest.NewRecorder()
+	a.handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		return fmt.Errorf("GET %s: status %d", path, rec.Code)
+	}
+
+	return json.Unmarshal(rec.Body.Bytes(), v)
+}
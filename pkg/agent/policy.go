@@ -0,0 +1,266 @@
+package agent
+
+import (
+	"fmt"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"net/http"
+	"os"
+	"sigs.k8s.io/yaml"
+	"strings"
+)
+
+type PolicyAction string
+
+const (
+	PolicyAllow PolicyAction = "allow"
+	PolicyDeny  PolicyAction = "deny"
+
+	policyAll = "*"
+)
+
+// Policy agent 本地的访问控制, 在转发给 apiserver 之前执行, 即使 gateway 被攻破集群也能自己控制暴露范围
+//
+//	readOnly: true
+//	rules:
+//	- action: deny
+//	  resources: ["secrets"]
+//	- action: deny
+//	  resources: ["pods"]
+//	  subresources: ["exec", "attach"]
+//
+// 规则按顺序匹配, 第一条匹配的规则生效, 都不匹配时使用 default, 默认 allow
+type Policy struct {
+	// ReadOnly 只允许 get, list, watch, 优先于 rules
+	ReadOnly bool         `json:"readOnly,omitempty"`
+	Default  PolicyAction `json:"default,omitempty"`
+	Rules    []PolicyRule `json:"rules,omitempty"`
+}
+
+// PolicyRule 字段为空时匹配任意值, * 同样表示任意值, core group 用 "" 表示
+type PolicyRule struct {
+	Action       PolicyAction `json:"action"`
+	Verbs        []string     `json:"verbs,omitempty"`
+	APIGroups    []string     `json:"apiGroups,omitempty"`
+	Resources    []string     `json:"resources,omitempty"`
+	Subresources []string     `json:"subresources,omitempty"`
+	Namespaces   []string     `json:"namespaces,omitempty"`
+	// NonResourceURLs 匹配 /version, /healthz 等非资源请求, 以 * 结尾时按前缀匹配
+	NonResourceURLs []string `json:"nonResourceURLs,omitempty"`
+}
+
+// RequestAttributes 从请求中解析出的 kubernetes 鉴权属性
+type RequestAttributes struct {
+	Verb        string
+	APIGroup    string
+	Resource    string
+	Subresource string
+	Namespace   string
+	Name        string
+	Path        string
+	IsResource  bool
+}
+
+// LoadPolicy 读取 yaml 或 json 格式的策略文件
+func LoadPolicy(path string) (*Policy, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Policy{}
+	if err = yaml.UnmarshalStrict(b, p); err != nil {
+		return nil, fmt.Errorf("parse policy %s: %v", path, err)
+	}
+	if err = p.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid policy %s: %v", path, err)
+	}
+
+	return p, nil
+}
+
+func (p *Policy) Validate() error {
+	switch p.Default {
+	case "", PolicyAllow, PolicyDeny:
+	default:
+		return fmt.Errorf("unknown default action %q", p.Default)
+	}
+	for i, rule := range p.Rules {
+		if rule.Action != PolicyAllow && rule.Action != PolicyDeny {
+			return fmt.Errorf("rules[%d]: unknown action %q", i, rule.Action)
+		}
+		if len(rule.NonResourceURLs) > 0 && (len(rule.APIGroups) > 0 || len(rule.Resources) > 0 ||
+			len(rule.Subresources) > 0 || len(rule.Namespaces) > 0) {
+			return fmt.Errorf("rules[%d]: nonResourceURLs can not be used with resource fields", i)
+		}
+	}
+
+	return nil
+}
+
+// Allowed 判断请求是否允许, 不允许时返回原因
+func (p *Policy) Allowed(attrs *RequestAttributes) (bool, string) {
+	if p.ReadOnly && !isReadOnlyVerb(attrs.Verb) {
+		return false, "agent is read-only"
+	}
+
+	for i, rule := range p.Rules {
+		if !rule.matches(attrs) {
+			continue
+		}
+		if rule.Action == PolicyDeny {
+			return false, fmt.Sprintf("denied by agent policy rule %d", i)
+		}
+		return true, ""
+	}
+
+	if p.Default == PolicyDeny {
+		return false, "not allowed by agent policy"
+	}
+	return true, ""
+}
+
+func (r *PolicyRule) matches(attrs *RequestAttributes) bool {
+	if !matchAny(r.Verbs, attrs.Verb) {
+		return false
+	}
+
+	if !attrs.IsResource {
+		if len(r.APIGroups) > 0 || len(r.Resources) > 0 || len(r.Subresources) > 0 || len(r.Namespaces) > 0 {
+			return false
+		}
+		return matchURL(r.NonResourceURLs, attrs.Path)
+	}
+	if len(r.NonResourceURLs) > 0 {
+		return false
+	}
+
+	return matchAny(r.APIGroups, attrs.APIGroup) &&
+		matchAny(r.Resources, attrs.Resource) &&
+		matchAny(r.Subresources, attrs.Subresource) &&
+		matchAny(r.Namespaces, attrs.Namespace)
+}
+
+func matchAny(list []string, v string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, s := range list {
+		if s == policyAll || s == v {
+			return true
+		}
+	}
+	return false
+}
+
+func matchURL(list []string, path string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, s := range list {
+		if s == path || strings.HasSuffix(s, policyAll) && strings.HasPrefix(path, strings.TrimSuffix(s, policyAll)) {
+			return true
+		}
+	}
+	return false
+}
+
+func isReadOnlyVerb(verb string) bool {
+	switch verb {
+	case "get", "list", "watch":
+		return true
+	}
+	return false
+}
+
+// NewRequestAttributes 按 apiserver 的规则解析请求路径和方法
+func NewRequestAttributes(r *http.Request) *RequestAttributes {
+	attrs := &RequestAttributes{Path: r.URL.Path}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) >= 3 && parts[0] == "api":
+		parts = parts[2:]
+	case len(parts) >= 4 && parts[0] == "apis":
+		attrs.APIGroup, parts = parts[1], parts[3:]
+	default:
+		// 非资源请求和 discovery
+		attrs.Verb = strings.ToLower(r.Method)
+		if attrs.Verb == "head" {
+			attrs.Verb = "get"
+		}
+		return attrs
+	}
+	attrs.IsResource = true
+
+	// /namespaces/{ns}/{resource} 是 namespace 下的资源, /namespaces/{name}[/{sub}] 是 namespace 本身
+	if len(parts) >= 3 && parts[0] == "namespaces" && !isNamespaceSubresource(parts[2]) {
+		attrs.Namespace, parts = parts[1], parts[2:]
+	}
+	attrs.Resource = parts[0]
+	if len(parts) > 1 {
+		attrs.Name = parts[1]
+	}
+	if len(parts) > 2 {
+		attrs.Subresource = strings.Join(parts[2:], "/")
+	}
+	if attrs.Resource == "namespaces" && attrs.Name != "" {
+		attrs.Namespace = attrs.Name
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		attrs.Verb = "get"
+		if attrs.Name == "" {
+			attrs.Verb = "list"
+		}
+		if w := r.URL.Query().Get("watch"); w == "true" || w == "1" {
+			attrs.Verb = "watch"
+		}
+	case http.MethodPost:
+		attrs.Verb = "create"
+	case http.MethodPut:
+		attrs.Verb = "update"
+	case http.MethodPatch:
+		attrs.Verb = "patch"
+	case http.MethodDelete:
+		attrs.Verb = "delete"
+		if attrs.Name == "" {
+			attrs.Verb = "deletecollection"
+		}
+	default:
+		attrs.Verb = strings.ToLower(r.Method)
+	}
+
+	return attrs
+}
+
+// namespace 自身的子资源
+func isNamespaceSubresource(s string) bool {
+	return s == "status" || s == "finalize"
+}
+
+// checkPolicy 不允许的请求直接返回 kubernetes Forbidden, 返回 false
+func (a *Agent) checkPolicy(w http.ResponseWriter, r *http.Request) bool {
+	if a.opt.Policy == nil {
+		return true
+	}
+
+	attrs := NewRequestAttributes(r)
+	allowed, reason := a.opt.Policy.Allowed(attrs)
+	if allowed {
+		return true
+	}
+
+	gr := schema.GroupResource{Group: attrs.APIGroup, Resource: attrs.Resource}
+	if attrs.Subresource != "" {
+		gr.Resource += "/" + attrs.Subresource
+	}
+	name := attrs.Name
+	if !attrs.IsResource {
+		name = attrs.Path
+	}
+	writeStatus(w, apierrors.NewForbidden(gr, name, fmt.Errorf("%s: %s", attrs.Verb, reason)))
+
+	return false
+}
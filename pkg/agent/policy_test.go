@@ -0,0 +1,137 @@
+package agent_test
+
+import (
+	"encoding/json"
+	"k8s-tunnel/pkg/agent"
+	"k8s-tunnel/pkg/tunneltest"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const policyYAML = `
+rules:
+- action: deny
+  resources: ["secrets"]
+- action: deny
+  resources: ["pods"]
+  subresources: ["exec", "attach"]
+- action: deny
+  verbs: ["delete", "deletecollection"]
+  namespaces: ["kube-system"]
+- action: deny
+  nonResourceURLs: ["/debug/*"]
+`
+
+func loadPolicy(t *testing.T, content string) *agent.Policy {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := agent.LoadPolicy(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return p
+}
+
+func TestPolicy(t *testing.T) {
+	t.Run("#rules", func(t *testing.T) {
+		p := loadPolicy(t, policyYAML)
+
+		for _, c := range []struct {
+			method, path string
+			allowed      bool
+		}{
+			{http.MethodGet, "/api/v1/namespaces/default/pods", true},
+			{http.MethodGet, "/api/v1/namespaces/default/secrets", false},
+			{http.MethodGet, "/api/v1/secrets?watch=true", false},
+			{http.MethodPost, "/api/v1/namespaces/default/pods/nginx/exec", false},
+			{http.MethodGet, "/api/v1/namespaces/default/pods/nginx/log", true},
+			{http.MethodDelete, "/apis/apps/v1/namespaces/kube-system/deployments/coredns", false},
+			{http.MethodDelete, "/api/v1/namespaces/kube-system", false},
+			{http.MethodDelete, "/apis/apps/v1/namespaces/default/deployments/web", true},
+			{http.MethodGet, "/debug/pprof/heap", false},
+			{http.MethodGet, "/version", true},
+		} {
+			attrs := agent.NewRequestAttributes(httptest.NewRequest(c.method, c.path, nil))
+			if allowed, reason := p.Allowed(attrs); allowed != c.allowed {
+				t.Fatalf("%s %s: expect allowed %v, got %v (%s), attrs %+v", c.method, c.path, c.allowed, allowed, reason, attrs)
+			}
+		}
+	})
+
+	t.Run("#read only", func(t *testing.T) {
+		p := loadPolicy(t, "readOnly: true\ndefault: deny\nrules:\n- action: allow\n  apiGroups: [\"\", apps]\n")
+
+		for _, c := range []struct {
+			method, path string
+			allowed      bool
+		}{
+			{http.MethodGet, "/apis/apps/v1/deployments", true},
+			{http.MethodGet, "/apis/batch/v1/jobs", false},
+			{http.MethodPatch, "/apis/apps/v1/namespaces/default/deployments/web", false},
+			{http.MethodPost, "/api/v1/namespaces/default/configmaps", false},
+		} {
+			attrs := agent.NewRequestAttributes(httptest.NewRequest(c.method, c.path, nil))
+			if allowed, _ := p.Allowed(attrs); allowed != c.allowed {
+				t.Fatalf("%s %s: expect allowed %v", c.method, c.path, c.allowed)
+			}
+		}
+	})
+
+	t.Run("#invalid", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "policy.yaml")
+		for _, content := range []string{
+			"rules:\n- action: reject\n",
+			"rule:\n- action: deny\n",
+			"rules:\n- action: deny\n  resources: [pods]\n  nonResourceURLs: [/version]\n",
+		} {
+			if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := agent.LoadPolicy(path); err == nil {
+				t.Fatalf("expect error for %q", content)
+			}
+		}
+	})
+
+	t.Run("#forbidden", func(t *testing.T) {
+		s := newAPIServer(t)
+		h := tunneltest.New(t, &tunneltest.Option{
+			APIServer: s,
+			AgentOption: func(opt *agent.Option) {
+				opt.Policy = &agent.Policy{Rules: []agent.PolicyRule{{Action: agent.PolicyDeny, Resources: []string{"secrets"}}}}
+			},
+		})
+		h.StartAgent("huawei")
+		before := len(s.Requests())
+
+		resp, b := get(t, h.URL("huawei", "/api/v1/namespaces/default/secrets/token"))
+		if resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("status %d, body %s", resp.StatusCode, b)
+		}
+		status := &metav1.Status{}
+		if err := json.Unmarshal(b, status); err != nil {
+			t.Fatal(err)
+		}
+		if status.Reason != metav1.StatusReasonForbidden || status.Details.Kind != "secrets" || status.Details.Name != "token" {
+			t.Fatalf("unexpected status %+v", status)
+		}
+		for _, r := range s.Requests()[before:] {
+			if r.Path == "/api/v1/namespaces/default/secrets/token" {
+				t.Fatal("denied request reached the apiserver")
+			}
+		}
+
+		if resp, b = get(t, h.URL("huawei", "/api/v1/namespaces/default/pods")); resp.StatusCode != http.StatusOK {
+			t.Fatalf("status %d, body %s", resp.StatusCode, b)
+		}
+	})
+}
@@ -0,0 +1,103 @@
+package agent_test
+
+import (
+	"encoding/base64"
+	"k8s-tunnel/pkg/agent"
+	"k8s-tunnel/pkg/tunneltest"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// 代理对回环地址不生效, agent 通过这个域名连接 gateway, 由代理改写为实际地址
+const proxiedGateway = "gateway.test:80"
+
+func proxyHarness(t *testing.T, proxyOpt *tunneltest.ProxyOption, setup func(opt *agent.Option, proxy *tunneltest.Proxy)) *tunneltest.Proxy {
+	t.Helper()
+
+	var proxy *tunneltest.Proxy
+	h := tunneltest.New(t, &tunneltest.Option{AgentOption: func(opt *agent.Option) {
+		opt.GatewayHost = proxiedGateway
+		setup(opt, proxy)
+	}})
+	proxyOpt.Hosts = map[string]string{proxiedGateway: h.GatewayHost()}
+	proxy = tunneltest.NewProxy(t, proxyOpt)
+	h.StartAgent("huawei")
+
+	if resp, b := get(t, h.URL("huawei", "/ping")); resp.StatusCode != http.StatusOK {
+		t.Fatalf("%d %s", resp.StatusCode, b)
+	}
+	return proxy
+}
+
+func TestProxy(t *testing.T) {
+	t.Run("#explicit proxy", func(t *testing.T) {
+		proxy := proxyHarness(t, &tunneltest.ProxyOption{}, func(opt *agent.Option, proxy *tunneltest.Proxy) {
+			opt.Proxy = &agent.Proxy{URL: proxy.URL(), Header: http.Header{"X-Tenant": {"huawei"}}}
+		})
+
+		// 注册连接和响应连接都经过代理
+		requests := proxy.Requests()
+		if len(requests) < 2 {
+			t.Fatalf("expect register and response through proxy, got %d CONNECT", len(requests))
+		}
+		for _, req := range requests {
+			if req.Host != proxiedGateway || req.Header.Get("X-Tenant") != "huawei" {
+				t.Fatalf("unexpected CONNECT %s %v", req.Host, req.Header)
+			}
+		}
+	})
+
+	t.Run("#environment", func(t *testing.T) {
+		proxy := proxyHarness(t, &tunneltest.ProxyOption{}, func(opt *agent.Option, proxy *tunneltest.Proxy) {
+			t.Setenv("HTTP_PROXY", proxy.URL())
+			t.Setenv("NO_PROXY", "")
+			t.Setenv("no_proxy", "")
+		})
+
+		if len(proxy.Requests()) == 0 {
+			t.Fatal("HTTP_PROXY not used")
+		}
+	})
+
+	t.Run("#basic auth", func(t *testing.T) {
+		expect := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:secret"))
+		proxyHarness(t, &tunneltest.ProxyOption{
+			Authenticate: func(req *http.Request, round int) string {
+				if req.Header.Get("Proxy-Authorization") != expect {
+					return `Basic realm="proxy"`
+				}
+				return ""
+			},
+		}, func(opt *agent.Option, proxy *tunneltest.Proxy) {
+			opt.Proxy = &agent.Proxy{URL: strings.Replace(proxy.URL(), "http://", "http://user:secret@", 1)}
+		})
+	})
+
+	t.Run("#connection based auth", func(t *testing.T) {
+		// 类似 NTLM: 第一轮协商得到 challenge, 第二轮必须在同一个连接上回应
+		proxy := proxyHarness(t, &tunneltest.ProxyOption{
+			Authenticate: func(req *http.Request, round int) string {
+				switch auth := req.Header.Get("Proxy-Authorization"); {
+				case round == 0 && auth == "Test negotiate":
+					return "Test nonce"
+				case round == 1 && auth == "Test nonce-response":
+					return ""
+				default:
+					return "Test"
+				}
+			},
+		}, func(opt *agent.Option, proxy *tunneltest.Proxy) {
+			opt.Proxy = &agent.Proxy{URL: proxy.URL(), Auth: agent.ProxyAuthFunc(func(challenge []string) (string, error) {
+				if challenge == nil {
+					return "Test negotiate", nil
+				}
+				return challenge[0] + "-response", nil
+			})}
+		})
+
+		if requests := proxy.Requests(); len(requests)%2 != 0 {
+			t.Fatalf("expect two rounds per tunnel, got %d CONNECT", len(requests))
+		}
+	})
+}
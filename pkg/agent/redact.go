@@ -0,0 +1,409 @@
+package agent
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net/http"
+	"os"
+	"sigs.k8s.io/yaml"
+	"strconv"
+	"strings"
+)
+
+// RedactedValue 替换敏感字段的值, Secret 的 data 会替换为它的 base64 编码
+const RedactedValue = "***"
+
+// Redaction 响应离开集群前的脱敏规则, 对 json 格式的对象, List, Table 和 watch 事件流生效
+//
+//	secretData: true
+//	dropManagedFields: true
+//	rules:
+//	- resources: ["configmaps"]
+//	  paths: ["{.data.*}"]
+//	- resources: ["pods", "deployments"]
+//	  paths: ["{.spec.containers[*].env[*].value}", "{.spec.template.spec.containers[*].env[*].value}"]
+type Redaction struct {
+	// SecretData 屏蔽 Secret 的 data, stringData 和 last-applied-configuration
+	SecretData        bool            `json:"secretData,omitempty"`
+	DropManagedFields bool            `json:"dropManagedFields,omitempty"`
+	Rules             []RedactionRule `json:"rules,omitempty"`
+}
+
+// RedactionRule 按请求的资源匹配, paths 支持 .field, ['field'], [n], [*] 和 .* 组成的 JSONPath 子集
+type RedactionRule struct {
+	APIGroups []string `json:"apiGroups,omitempty"`
+	Resources []string `json:"resources,omitempty"`
+	Paths     []string `json:"paths"`
+}
+
+const lastAppliedAnnotation = "kubectl.kubernetes.io/last-applied-configuration"
+
+// LoadRedaction 读取 yaml 或 json 格式的脱敏规则
+func LoadRedaction(path string) (*Redaction, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Redaction{}
+	if err = yaml.UnmarshalStrict(b, r); err != nil {
+		return nil, fmt.Errorf("parse redaction %s: %v", path, err)
+	}
+	if err = r.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid redaction %s: %v", path, err)
+	}
+
+	return r, nil
+}
+
+// Validate 检查所有 path 能否解析
+func (r *Redaction) Validate() error {
+	for i, rule := range r.Rules {
+		for _, p := range rule.Paths {
+			if _, err := parseRedactPath(p); err != nil {
+				return fmt.Errorf("rules[%d]: %v", i, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// parseRedactPath 把 {.spec.containers[*].env[*].value} 解析为 [spec containers * env * value]
+func parseRedactPath(path string) ([]string, error) {
+	p := strings.TrimSpace(path)
+	p = strings.TrimSuffix(strings.TrimPrefix(p, "{"), "}")
+
+	var segments []string
+	for len(p) > 0 {
+		switch {
+		case strings.HasPrefix(p, "['"):
+			end := strings.Index(p, "']")
+			if end < 0 {
+				return nil, fmt.Errorf("invalid path %q: unterminated quote", path)
+			}
+			segments, p = append(segments, p[2:end]), p[end+2:]
+		case p[0] == '[':
+			end := strings.IndexByte(p, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("invalid path %q: unterminated bracket", path)
+			}
+			idx := p[1:end]
+			if _, err := strconv.Atoi(idx); err != nil && idx != "*" {
+				return nil, fmt.Errorf("invalid path %q: bad index %q", path, idx)
+			}
+			segments, p = append(segments, idx), p[end+1:]
+		case p[0] == '.':
+			p = p[1:]
+			end := strings.IndexAny(p, ".[")
+			if end < 0 {
+				end = len(p)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("invalid path %q: empty field", path)
+			}
+			segments, p = append(segments, p[:end]), p[end:]
+		default:
+			return nil, fmt.Errorf("invalid path %q", path)
+		}
+	}
+	if len(segments) == 0 {
+		return nil, fmt.Errorf("empty path %q", path)
+	}
+
+	return segments, nil
+}
+
+// pathsFor 返回匹配请求资源的 path, 无法解析的 path 忽略
+func (r *Redaction) pathsFor(attrs *RequestAttributes) [][]string {
+	var paths [][]string
+	for _, rule := range r.Rules {
+		if !matchAny(rule.APIGroups, attrs.APIGroup) || !matchAny(rule.Resources, attrs.Resource) {
+			continue
+		}
+		for _, p := range rule.Paths {
+			if segments, err := parseRedactPath(p); err == nil {
+				paths = append(paths, segments)
+			}
+		}
+	}
+
+	return paths
+}
+
+// redactValue 处理一个顶层 json 值: 对象, List, Table 或 watch 事件.
+// apiserver 返回的 List 中的元素没有 kind, 所以是否是 Secret 由请求的资源或 List 的 kind 决定
+func (r *Redaction) redactValue(v interface{}, paths [][]string, secret bool) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	// watch 事件 {"type": "ADDED", "object": {...}}
+	if obj, ok := m["object"].(map[string]interface{}); ok && len(m) <= 2 {
+		if _, ok = m["type"].(string); ok {
+			r.redactValue(obj, paths, secret)
+			return
+		}
+	}
+
+	if items, ok := m["items"].([]interface{}); ok {
+		itemSecret := secret || m["kind"] == "SecretList"
+		for _, item := range items {
+			r.redactValue(item, paths, itemSecret)
+		}
+	}
+	if m["kind"] == "Table" {
+		if rows, ok := m["rows"].([]interface{}); ok {
+			for _, row := range rows {
+				if rm, ok := row.(map[string]interface{}); ok {
+					r.redactValue(rm["object"], paths, secret)
+				}
+			}
+		}
+	}
+
+	r.redactObject(m, paths, secret || m["kind"] == "Secret")
+}
+
+func (r *Redaction) redactObject(obj map[string]interface{}, paths [][]string, secret bool) {
+	metadata, _ := obj["metadata"].(map[string]interface{})
+	if r.DropManagedFields && metadata != nil {
+		delete(metadata, "managedFields")
+	}
+
+	if r.SecretData && secret {
+		if data, ok := obj["data"].(map[string]interface{}); ok {
+			masked := base64.StdEncoding.EncodeToString([]byte(RedactedValue))
+			for k := range data {
+				data[k] = masked
+			}
+		}
+		if data, ok := obj["stringData"].(map[string]interface{}); ok {
+			for k := range data {
+				data[k] = RedactedValue
+			}
+		}
+		if annotations, ok := metadata["annotations"].(map[string]interface{}); ok {
+			if _, ok = annotations[lastAppliedAnnotation]; ok {
+				annotations[lastAppliedAnnotation] = RedactedValue
+			}
+		}
+	}
+
+	for _, segments := range paths {
+		redactPath(obj, segments)
+	}
+}
+
+// redactPath 把 segments 指向的所有值替换为 RedactedValue, 不存在的路径忽略
+func redactPath(v interface{}, segments []string) {
+	if len(segments) == 0 {
+		return
+	}
+	seg, last := segments[0], len(segments) == 1
+
+	switch node := v.(type) {
+	case map[string]interface{}:
+		if seg == "*" {
+			for k := range node {
+				if last {
+					node[k] = RedactedValue
+				} else {
+					redactPath(node[k], segments[1:])
+				}
+			}
+			return
+		}
+		child, ok := node[seg]
+		if !ok {
+			return
+		}
+		if last {
+			node[seg] = RedactedValue
+			return
+		}
+		redactPath(child, segments[1:])
+	case []interface{}:
+		for i := range node {
+			if seg != "*" && seg != strconv.Itoa(i) {
+				continue
+			}
+			if last {
+				node[i] = RedactedValue
+			} else {
+				redactPath(node[i], segments[1:])
+			}
+		}
+	}
+}
+
+// prepareRedaction 让 apiserver 返回未压缩的 json, 否则无法脱敏. 保留 json 的 Accept 参数, 如 kubectl 请求的 as=Table
+func prepareRedaction(req *http.Request) {
+	req.Header.Del("Accept-Encoding")
+
+	var accepts []string
+	for _, accept := range strings.Split(req.Header.Get("Accept"), ",") {
+		if accept = strings.TrimSpace(accept); isJSON(accept) {
+			accepts = append(accepts, accept)
+		}
+	}
+	if len(accepts) == 0 {
+		accepts = []string{"application/json"}
+	}
+	req.Header.Set("Accept", strings.Join(accepts, ","))
+}
+
+func isJSON(mediaType string) bool {
+	return strings.TrimSpace(strings.SplitN(mediaType, ";", 2)[0]) == "application/json"
+}
+
+// redactWriter 用流式 decoder 逐个解析响应中的顶层 json 值, 脱敏后再写出, 因此同样适用于 watch 事件流.
+// 无法脱敏的响应不会透传, 而是返回 500 Status
+type redactWriter struct {
+	http.ResponseWriter
+	redaction *Redaction
+	paths     [][]string
+	secret    bool // 请求的是 core 组的 secrets
+	watch     bool
+
+	statusCode int  // 上游的状态码, 等到第一个 json 值脱敏后才写出
+	started    bool // 已经写出了 header
+	refused    bool // 不是 json 响应, 丢弃上游的内容
+	pw         *io.PipeWriter
+	done       chan struct{}
+}
+
+func newRedactWriter(w http.ResponseWriter, r *Redaction, attrs *RequestAttributes) *redactWriter {
+	return &redactWriter{
+		ResponseWriter: w,
+		redaction:      r,
+		paths:          r.pathsFor(attrs),
+		secret:         attrs.APIGroup == "" && attrs.Resource == "secrets",
+		watch:          attrs.Verb == "watch",
+	}
+}
+
+func (w *redactWriter) WriteHeader(statusCode int) {
+	if w.statusCode == 0 {
+		w.statusCode = statusCode
+	}
+}
+
+func (w *redactWriter) Write(b []byte) (int, error) {
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusOK
+	}
+	if w.pw == nil && !w.refused {
+		if ct := w.Header().Get("Content-Type"); !isJSON(ct) {
+			w.refused = true
+			w.fail(fmt.Errorf("unexpected content type %q", ct))
+		} else {
+			// 脱敏后长度会变化
+			w.Header().Del("Content-Length")
+
+			pr, pw := io.Pipe()
+			w.pw, w.done = pw, make(chan struct{})
+			go w.redact(pr)
+		}
+	}
+	if w.refused {
+		return len(b), nil
+	}
+
+	return w.pw.Write(b)
+}
+
+func (w *redactWriter) writeHeader() {
+	if !w.started {
+		w.started = true
+		w.ResponseWriter.WriteHeader(w.statusCode)
+	}
+}
+
+// fail 不再输出上游剩余的内容. 还没有写出 header 时返回 500 Status,
+// 否则追加一个 Status, watch 则追加一个 ERROR 事件, 客户端据此知道响应不完整
+func (w *redactWriter) fail(err error) {
+	statusErr := apierrors.NewInternalError(fmt.Errorf("can not redact response: %v", err))
+	if !w.started {
+		w.started = true
+		w.Header().Del("Content-Length")
+		w.Header().Del("Content-Encoding")
+		writeStatus(w.ResponseWriter, statusErr)
+		return
+	}
+
+	status := statusErr.Status()
+	status.TypeMeta = metav1.TypeMeta{Kind: "Status", APIVersion: "v1"}
+	var v interface{} = &status
+	if w.watch {
+		v = map[string]interface{}{"type": "ERROR", "object": &status}
+	}
+	_ = json.NewEncoder(w.ResponseWriter).Encode(v)
+}
+
+func (w *redactWriter) redact(pr *io.PipeReader) {
+	defer close(w.done)
+
+	dec := json.NewDecoder(pr)
+	dec.UseNumber()
+	for {
+		var v interface{}
+		if err := dec.Decode(&v); err != nil {
+			if err != io.EOF {
+				w.fail(err)
+			}
+			_ = pr.CloseWithError(err)
+			return
+		}
+
+		w.redaction.redactValue(v, w.paths, w.secret)
+		b, err := json.Marshal(v)
+		if err == nil {
+			w.writeHeader()
+			_, err = w.ResponseWriter.Write(append(b, '\n'))
+		}
+		// watch 事件脱敏后立即发送, 不等后续事件
+		if fl, ok := w.ResponseWriter.(http.Flusher); ok && err == nil && w.watch {
+			fl.Flush()
+		}
+		if err != nil {
+			_ = pr.CloseWithError(err)
+			return
+		}
+	}
+}
+
+// Close 等待剩余的内容输出完, 没有 body 的响应在这里写出 header
+func (w *redactWriter) Close() {
+	if w.pw != nil {
+		_ = w.pw.Close()
+		<-w.done
+	}
+	if w.statusCode != 0 {
+		w.writeHeader()
+	}
+}
+
+// serve 开启脱敏时包装 ResponseWriter
+func (a *Agent) serve(rw http.ResponseWriter, req *http.Request) {
+	if a.opt.Redaction == nil {
+		a.handler.ServeHTTP(rw, req)
+		return
+	}
+
+	attrs := NewRequestAttributes(req)
+	if !attrs.IsResource {
+		a.handler.ServeHTTP(rw, req)
+		return
+	}
+
+	prepareRedaction(req)
+	w := newRedactWriter(rw, a.opt.Redaction, attrs)
+	a.handler.ServeHTTP(w, req)
+	w.Close()
+}
@@ -0,0 +1,237 @@
+package agent_test
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"k8s-tunnel/pkg/agent"
+	"k8s-tunnel/pkg/tunneltest"
+	"k8s-tunnel/pkg/tunneltest/fakeapiserver"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var maskedSecret = base64.StdEncoding.EncodeToString([]byte(agent.RedactedValue))
+
+func startRedactedAgent(t *testing.T) *tunneltest.Harness {
+	s := newAPIServer(t)
+
+	secret := fakeapiserver.Object("v1", "Secret", "default", "token")
+	secret.Object["data"] = map[string]interface{}{"password": base64.StdEncoding.EncodeToString([]byte("hunter2"))}
+	secret.SetAnnotations(map[string]string{"kubectl.kubernetes.io/last-applied-configuration": `{"data":{"password":"aHVudGVyMg=="}}`})
+	secret.SetManagedFields([]metav1.ManagedFieldsEntry{{Manager: "kubectl", Operation: metav1.ManagedFieldsOperationApply}})
+	cm := fakeapiserver.Object("v1", "ConfigMap", "default", "app")
+	cm.Object["data"] = map[string]interface{}{"dsn": "postgres://user:pass@db"}
+	for _, obj := range []*unstructured.Unstructured{secret, cm} {
+		if err := s.Add(obj); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h := tunneltest.New(t, &tunneltest.Option{
+		APIServer: s,
+		AgentOption: func(opt *agent.Option) {
+			opt.Redaction = &agent.Redaction{
+				SecretData:        true,
+				DropManagedFields: true,
+				Rules:             []agent.RedactionRule{{Resources: []string{"configmaps"}, Paths: []string{"{.data.*}"}}},
+			}
+		},
+	})
+	h.StartAgent("huawei")
+
+	return h
+}
+
+func assertSecretRedacted(t *testing.T, obj map[string]interface{}) {
+	t.Helper()
+
+	u := &unstructured.Unstructured{Object: obj}
+	data, _, _ := unstructured.NestedStringMap(obj, "data")
+	if data["password"] != maskedSecret {
+		t.Fatalf("secret data not redacted: %v", data)
+	}
+	if v := u.GetAnnotations()["kubectl.kubernetes.io/last-applied-configuration"]; v != agent.RedactedValue {
+		t.Fatalf("last-applied-configuration not redacted: %s", v)
+	}
+	if len(u.GetManagedFields()) != 0 {
+		t.Fatalf("managedFields not dropped: %v", u.GetManagedFields())
+	}
+}
+
+// secretUpstream 按 contentType 返回 body, contentType 为空时根据 Accept 返回 yaml 或 json
+func secretUpstream(contentType, body string) func(string) http.Handler {
+	return func(string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/api/v1/namespaces/default/secrets/token" {
+				http.NotFound(w, r)
+				return
+			}
+			ct, b := contentType, body
+			if ct == "" {
+				ct, b = "application/json", `{"kind":"Secret","apiVersion":"v1","data":{"password":"aHVudGVyMg=="}}`
+				if strings.Contains(r.Header.Get("Accept"), "yaml") {
+					ct, b = "application/yaml", "kind: Secret\napiVersion: v1\ndata:\n  password: aHVudGVyMg==\n"
+				}
+			}
+			w.Header().Set("Content-Type", ct)
+			_, _ = w.Write([]byte(b))
+		})
+	}
+}
+
+func TestRedaction(t *testing.T) {
+	t.Run("#get and list", func(t *testing.T) {
+		h := startRedactedAgent(t)
+
+		resp, b := get(t, h.URL("huawei", "/api/v1/namespaces/default/secrets/token"))
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status %d, body %s", resp.StatusCode, b)
+		}
+		obj := map[string]interface{}{}
+		if err := json.Unmarshal(b, &obj); err != nil {
+			t.Fatal(err)
+		}
+		assertSecretRedacted(t, obj)
+
+		resp, b = get(t, h.URL("huawei", "/api/v1/secrets"))
+		list := &unstructured.UnstructuredList{}
+		if err := list.UnmarshalJSON(b); err != nil || len(list.Items) != 1 {
+			t.Fatalf("unexpected list %s, err %v", b, err)
+		}
+		assertSecretRedacted(t, list.Items[0].Object)
+
+		_, b = get(t, h.URL("huawei", "/api/v1/namespaces/default/configmaps/app"))
+		if strings.Contains(string(b), "postgres") || !strings.Contains(string(b), `"dsn":"***"`) {
+			t.Fatalf("configmap not redacted: %s", b)
+		}
+	})
+
+	t.Run("#list items without kind", func(t *testing.T) {
+		h := startRedactedAgent(t)
+
+		for _, path := range []string{"/api/v1/secrets", "/api/v1/namespaces/default/secrets"} {
+			resp, b := get(t, h.URL("huawei", path))
+			list := struct {
+				Kind  string                   `json:"kind"`
+				Items []map[string]interface{} `json:"items"`
+			}{}
+			if err := json.Unmarshal(b, &list); err != nil || resp.StatusCode != http.StatusOK || len(list.Items) != 1 {
+				t.Fatalf("status %d, body %s, err %v", resp.StatusCode, b, err)
+			}
+			if _, ok := list.Items[0]["kind"]; ok || list.Kind != "SecretList" {
+				t.Fatalf("expect items without kind like apiserver: %s", b)
+			}
+			assertSecretRedacted(t, list.Items[0])
+		}
+	})
+
+	t.Run("#watch", func(t *testing.T) {
+		h := startRedactedAgent(t)
+
+		resp, b := get(t, h.URL("huawei", "/api/v1/namespaces/default/secrets?watch=true&timeoutSeconds=1"))
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status %d, body %s", resp.StatusCode, b)
+		}
+		dec := json.NewDecoder(strings.NewReader(string(b)))
+		event := &metav1.WatchEvent{}
+		if err := dec.Decode(event); err != nil {
+			t.Fatal(err)
+		}
+		obj := map[string]interface{}{}
+		if err := json.Unmarshal(event.Object.Raw, &obj); err != nil {
+			t.Fatal(err)
+		}
+		assertSecretRedacted(t, obj)
+	})
+
+	t.Run("#watch event before upstream ends", func(t *testing.T) {
+		h := startRedactedAgent(t)
+
+		event := firstEvent(t, h.URL("huawei", "/api/v1/namespaces/default/secrets?watch=true"))
+		obj := map[string]interface{}{}
+		if err := json.Unmarshal(event.Object.Raw, &obj); err != nil {
+			t.Fatal(err)
+		}
+		assertSecretRedacted(t, obj)
+	})
+
+	t.Run("#accept forced to json", func(t *testing.T) {
+		h := tunneltest.New(t, &tunneltest.Option{
+			Upstream:    secretUpstream("", ""),
+			AgentOption: func(opt *agent.Option) { opt.Redaction = &agent.Redaction{SecretData: true} },
+		})
+		h.StartAgent("huawei")
+
+		req, _ := http.NewRequest(http.MethodGet, h.URL("huawei", "/api/v1/namespaces/default/secrets/token"), nil)
+		req.Header.Set("Accept", "application/yaml")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		obj := map[string]interface{}{}
+		if err = json.NewDecoder(resp.Body).Decode(&obj); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("status %d, err %v", resp.StatusCode, err)
+		}
+		if data, _, _ := unstructured.NestedStringMap(obj, "data"); data["password"] != maskedSecret {
+			t.Fatalf("secret data not redacted: %v", obj)
+		}
+	})
+
+	for _, c := range []struct {
+		name     string
+		upstream func(string) http.Handler
+		code     int // 已经写出了第一个对象时只能追加 Status
+	}{
+		{"#yaml refused", secretUpstream("application/yaml", "kind: Secret\ndata:\n  password: aHVudGVyMg==\n"), http.StatusInternalServerError},
+		{"#malformed json", secretUpstream("application/json", `{"kind":"Secret","data":{"password":"aHVudGVyMg=="}`), http.StatusInternalServerError},
+		{"#trailing garbage", secretUpstream("application/json", `{"kind":"Status"} password: aHVudGVyMg==`), http.StatusOK},
+	} {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			h := tunneltest.New(t, &tunneltest.Option{
+				Upstream:    c.upstream,
+				AgentOption: func(opt *agent.Option) { opt.Redaction = &agent.Redaction{SecretData: true} },
+			})
+			h.StartAgent("huawei")
+
+			resp, b := get(t, h.URL("huawei", "/api/v1/namespaces/default/secrets/token"))
+			if resp.StatusCode != c.code || strings.Contains(string(b), "aHVudGVyMg==") {
+				t.Fatalf("status %d, body %s", resp.StatusCode, b)
+			}
+			dec := json.NewDecoder(strings.NewReader(string(b)))
+			status := &metav1.Status{}
+			for dec.More() {
+				if err := dec.Decode(status); err != nil {
+					t.Fatalf("body %s, err %v", b, err)
+				}
+			}
+			if status.Reason != metav1.StatusReasonInternalError {
+				t.Fatalf("expect InternalError status at the end, got %s", b)
+			}
+		})
+	}
+
+	t.Run("#non json untouched", func(t *testing.T) {
+		h := startRedactedAgent(t)
+
+		if resp, b := get(t, h.URL("huawei", "/healthz")); resp.StatusCode != http.StatusOK || string(b) != "ok" {
+			t.Fatalf("status %d, body %s", resp.StatusCode, b)
+		}
+	})
+
+	t.Run("#invalid path", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "redaction.yaml")
+		if err := os.WriteFile(path, []byte("rules:\n- paths: [\"{.spec.containers[x]}\"]\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := agent.LoadRedaction(path); err == nil {
+			t.Fatal("expect error")
+		}
+	})
+}
@@ -0,0 +1,116 @@
+package agent
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+func NewResponseWriter(w io.Writer) http.ResponseWriter {
+	return &respWriter{header: http.Header{}, w: w}
+}
+
+type respWriter struct {
+	header      http.Header
+	w           io.Writer
+	statusCode  int
+	wroteHeader bool
+}
+
+func (f *respWriter) StatusCode() int {
+	return f.statusCode
+}
+
+func (f *respWriter) Header() http.Header {
+	return f.header
+}
+
+func (f *respWriter) WriteHeader(statusCode int) {
+	if f.wroteHeader {
+		return
+	}
+	f.wroteHeader = true
+	f.statusCode = statusCode
+
+	text := http.StatusText(statusCode)
+	if text == "" {
+		text = "status code " + strconv.Itoa(statusCode)
+	}
+
+	_, _ = fmt.Fprintf(f.w, "HTTP/1.1 %03d %s\r\n", statusCode, text)
+	_ = f.header.WriteSubset(f.w, map[string]bool{})
+	_, _ = io.WriteString(f.w, "\r\n")
+}
+
+func (f *respWriter) Write(bytes []byte) (int, error) {
+	// 与 net/http 一致, 未显式 WriteHeader 时默认 200
+	if !f.wroteHeader {
+		f.WriteHeader(http.StatusOK)
+	}
+	n, err := f.w.Write(bytes)
+	if err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// Flush 底层 writer 支持时立即发送已经写入的内容, 供反向代理在 watch 事件和日志行之后调用
+func (f *respWriter) Flush() {
+	fl, ok := f.w.(http.Flusher)
+	if !ok {
+		return
+	}
+	if !f.wroteHeader {
+		f.WriteHeader(http.StatusOK)
+	}
+	fl.Flush()
+}
+
+// streamMessageSize 没有 Flush 时攒够该大小就发送一个消息, 不超过协商的 MaxFrameSize
+const streamMessageSize = 1 << 20
+
+// streamWriter 把响应拆成多个消息发送, Flush 或攒够 size 时发送一个, Close 时以空消息结束.
+// 发送失败后不再发送, 之后的 Write 都返回该错误
+type streamWriter struct {
+	send func(b []byte) error
+	end  func() error
+	size int
+	buf  bytes.Buffer
+	err  error
+}
+
+func (w *streamWriter) Write(b []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.buf.Write(b)
+	for w.err == nil && w.buf.Len() >= w.size {
+		w.err = w.send(w.buf.Next(w.size))
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	return len(b), nil
+}
+
+func (w *streamWriter) Flush() {
+	if w.err != nil || w.buf.Len() == 0 {
+		return
+	}
+	w.err = w.send(w.buf.Bytes())
+	w.buf.Reset()
+}
+
+// Close 发送剩余内容和结束消息
+func (w *streamWriter) Close() error {
+	w.Flush()
+	if w.err == nil {
+		w.err = w.end()
+	}
+
+	return w.err
+}
@@ -0,0 +1,261 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"golang.org/x/time/rate"
+	"io"
+	"k8s-tunnel/pkg/transport"
+	"net/http"
+	"regexp"
+	"sync"
+)
+
+type PriorityClass string
+
+const (
+	PriorityInteractive PriorityClass = "interactive"
+	PriorityWatch       PriorityClass = "watch"
+	PriorityBulk        PriorityClass = "bulk"
+
+	DefaultChunkSize = 32 << 10
+)
+
+// 调度顺序
+var priorityClasses = []PriorityClass{PriorityInteractive, PriorityWatch, PriorityBulk}
+
+// DefaultPriorityWeights 每轮调度中各优先级最多连续发送的块数
+var DefaultPriorityWeights = map[PriorityClass]int{
+	PriorityInteractive: 8,
+	PriorityWatch:       4,
+	PriorityBulk:        1,
+}
+
+// DefaultPriorityRules 日志视为 bulk, 不匹配任何规则时 watch 请求为 watch, 其余为 interactive
+var DefaultPriorityRules = []PriorityRule{
+	{Class: PriorityBulk, Path: `/pods/[^/]+/log$`},
+}
+
+// PriorityRule 按请求路径 (正则) 和方法划分优先级, 按顺序匹配
+type PriorityRule struct {
+	Class   PriorityClass `json:"class"`
+	Path    string        `json:"path"`
+	Methods []string      `json:"methods,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// Shaping 限制 agent 回写给 gateway 的带宽, 并在多个请求之间按优先级加权轮转
+type Shaping struct {
+	// BandwidthLimit 每秒字节数, 0 表示不限制, 此时也不做调度
+	BandwidthLimit int64
+	// ChunkSize 每次调度发送的字节数, 默认 DefaultChunkSize
+	ChunkSize int
+	// Weights 为空时使用 DefaultPriorityWeights
+	Weights map[PriorityClass]int
+	// Rules 为空时使用 DefaultPriorityRules
+	Rules []PriorityRule
+}
+
+// scheduler 所有请求的响应共享 tunnel 的带宽, 每发送一块都要先拿到令牌
+type scheduler struct {
+	limiter   *rate.Limiter
+	chunkSize int
+	weights   map[PriorityClass]int
+	rules     []PriorityRule
+
+	mu     sync.Mutex
+	queues map[PriorityClass][]*chunkGrant
+	wake   chan struct{}
+}
+
+type chunkGrant struct {
+	n  int
+	ch chan struct{}
+}
+
+func newScheduler(opt *Shaping) (*scheduler, error) {
+	s := &scheduler{
+		chunkSize: opt.ChunkSize,
+		weights:   opt.Weights,
+		rules:     opt.Rules,
+		queues:    map[PriorityClass][]*chunkGrant{},
+		wake:      make(chan struct{}, 1),
+	}
+	if s.chunkSize <= 0 {
+		s.chunkSize = DefaultChunkSize
+	}
+	if len(s.weights) == 0 {
+		s.weights = DefaultPriorityWeights
+	}
+	if len(s.rules) == 0 {
+		s.rules = DefaultPriorityRules
+	}
+
+	rules := make([]PriorityRule, len(s.rules))
+	for i, rule := range s.rules {
+		if _, ok := DefaultPriorityWeights[rule.Class]; !ok {
+			return nil, fmt.Errorf("priority rule %d: unknown class %q", i, rule.Class)
+		}
+		re, err := regexp.Compile(rule.Path)
+		if err != nil {
+			return nil, fmt.Errorf("priority rule %d: %v", i, err)
+		}
+		rule.re = re
+		rules[i] = rule
+	}
+	s.rules = rules
+
+	burst := s.chunkSize
+	if int64(burst) < opt.BandwidthLimit {
+		burst = int(opt.BandwidthLimit)
+	}
+	s.limiter = rate.NewLimiter(rate.Limit(opt.BandwidthLimit), burst)
+
+	return s, nil
+}
+
+// classify 返回请求的优先级
+func (s *scheduler) classify(req *http.Request) PriorityClass {
+	for _, rule := range s.rules {
+		if rule.re.MatchString(req.URL.Path) && (len(rule.Methods) == 0 || matchMethod(rule.Methods, req.Method)) {
+			return rule.Class
+		}
+	}
+	if w := req.URL.Query().Get("watch"); w == "true" || w == "1" {
+		return PriorityWatch
+	}
+
+	return PriorityInteractive
+}
+
+func matchMethod(methods []string, method string) bool {
+	for _, m := range methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// acquire 排队等待发送 n 字节
+func (s *scheduler) acquire(ctx context.Context, class PriorityClass, n int) error {
+	g := &chunkGrant{n: n, ch: make(chan struct{})}
+
+	s.mu.Lock()
+	s.queues[class] = append(s.queues[class], g)
+	s.mu.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+
+	select {
+	case <-g.ch:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		// 可能已经被调度
+		select {
+		case <-g.ch:
+			return nil
+		default:
+		}
+		s.remove(class, g)
+		return ctx.Err()
+	}
+}
+
+// 调用方需持有锁
+func (s *scheduler) remove(class PriorityClass, g *chunkGrant) {
+	queue := s.queues[class]
+	for i, c := range queue {
+		if c == g {
+			s.queues[class] = append(queue[:i], queue[i+1:]...)
+			return
+		}
+	}
+}
+
+// run 加权轮转: 每个优先级一轮最多连续发送 weight 块, 同一优先级内按排队顺序
+func (s *scheduler) run(ctx context.Context) {
+	credits := map[PriorityClass]int{}
+	for {
+		g := s.next(credits)
+		if g == nil {
+			select {
+			case <-s.wake:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		if err := s.limiter.WaitN(ctx, g.n); err != nil {
+			return
+		}
+		close(g.ch)
+	}
+}
+
+func (s *scheduler) next(credits map[PriorityClass]int) *chunkGrant {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for round := 0; round < 2; round++ {
+		for _, class := range priorityClasses {
+			queue := s.queues[class]
+			if len(queue) == 0 || credits[class] <= 0 {
+				continue
+			}
+			credits[class]--
+			s.queues[class] = queue[1:]
+			return queue[0]
+		}
+		// 所有有数据的优先级都用完了本轮额度, 开始新的一轮
+		for _, class := range priorityClasses {
+			credits[class] = s.weights[class]
+			if credits[class] <= 0 {
+				credits[class] = 1
+			}
+		}
+	}
+
+	return nil
+}
+
+// shapedWrite 按 chunkSize 分块写入, 每块都经过调度
+func (s *scheduler) shapedWrite(ctx context.Context, class PriorityClass, w io.Writer, b []byte) error {
+	for len(b) > 0 {
+		n := s.chunkSize
+		if n > len(b) {
+			n = len(b)
+		}
+		if err := s.acquire(ctx, class, n); err != nil {
+			return err
+		}
+		if _, err := w.Write(b[:n]); err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+
+	return nil
+}
+
+// shapedWriteMessage 分块写入一个消息. 流式响应的每个消息都单独排队, watch 事件不必等 bulk 响应发完
+func (a *Agent) shapedWriteMessage(ctx context.Context, conn transport.Conn, class PriorityClass, b []byte) error {
+	w, err := conn.NextWriter(websocket.BinaryMessage)
+	if err != nil {
+		return err
+	}
+	if err = a.sched.shapedWrite(ctx, class, w, b); err != nil {
+		_ = w.Close()
+		return err
+	}
+
+	return w.Close()
+}
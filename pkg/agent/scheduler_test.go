@@ -0,0 +1,68 @@
+package agent
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestScheduler(t *testing.T) {
+	t.Run("#weighted round robin", func(t *testing.T) {
+		s, err := newScheduler(&Shaping{
+			BandwidthLimit: 1 << 30,
+			Weights:        map[PriorityClass]int{PriorityInteractive: 2, PriorityBulk: 1},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 3; i++ {
+			for _, class := range []PriorityClass{PriorityBulk, PriorityInteractive} {
+				s.queues[class] = append(s.queues[class], &chunkGrant{n: 1, ch: make(chan struct{})})
+			}
+		}
+		grants := map[*chunkGrant]PriorityClass{}
+		for class, queue := range s.queues {
+			for _, g := range queue {
+				grants[g] = class
+			}
+		}
+
+		var order []PriorityClass
+		credits := map[PriorityClass]int{}
+		for g := s.next(credits); g != nil; g = s.next(credits) {
+			order = append(order, grants[g])
+		}
+
+		expect := []PriorityClass{PriorityInteractive, PriorityInteractive, PriorityBulk, PriorityInteractive, PriorityBulk, PriorityBulk}
+		if len(order) != len(expect) {
+			t.Fatalf("unexpected order %v", order)
+		}
+		for i := range expect {
+			if order[i] != expect[i] {
+				t.Fatalf("unexpected order %v", order)
+			}
+		}
+	})
+
+	t.Run("#classify", func(t *testing.T) {
+		s, err := newScheduler(&Shaping{BandwidthLimit: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for path, class := range map[string]PriorityClass{
+			"/api/v1/namespaces/default/pods/nginx/log":    PriorityBulk,
+			"/api/v1/namespaces/default/pods?watch=true":   PriorityWatch,
+			"/api/v1/namespaces/default/pods/nginx":        PriorityInteractive,
+			"/api/v1/namespaces/default/pods/nginx/status": PriorityInteractive,
+		} {
+			if c := s.classify(httptest.NewRequest("GET", path, nil)); c != class {
+				t.Fatalf("%s: expect %s, got %s", path, class, c)
+			}
+		}
+
+		if _, err = newScheduler(&Shaping{BandwidthLimit: 1, Rules: []PriorityRule{{Class: "urgent", Path: "/"}}}); err == nil {
+			t.Fatal("expect unknown class error")
+		}
+	})
+}
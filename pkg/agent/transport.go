@@ -0,0 +1,73 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"k8s-tunnel/pkg/protocol"
+	"k8s-tunnel/pkg/transport"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// dialRegister 建立注册连接. 先尝试上次成功的传输方式, 连接或握手失败后按 Option.Transports 的顺序降级,
+// gateway 回复 426 时跳过其不允许的传输方式
+func (a *Agent) dialRegister(ctx context.Context, g *gatewayConn, dialer *transport.Dialer, u string) (transport.Conn, error) {
+	var (
+		accepted []transport.Name // 为空时表示 gateway 还没有告知
+		errs     []string
+	)
+	// 告知 gateway 会先发送 Hello
+	header := http.Header{}
+	header.Set(protocol.ProtocolHeader, strconv.Itoa(protocol.Version))
+	for _, name := range a.transportOrder(g) {
+		if len(accepted) > 0 && !transport.Allowed(accepted, name) {
+			continue
+		}
+		conn, resp, err := dialer.DialContext(ctx, name, u, header)
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+		// gateway 回复了其他状态码说明传输方式可用, 如认证失败或下线中, 换传输方式也没有意义
+		if resp != nil && resp.StatusCode != http.StatusUpgradeRequired {
+			return nil, fmt.Errorf("%s: %v, status:%d", name, err, resp.StatusCode)
+		}
+		if resp != nil {
+			accepted = acceptedTransports(resp.Header)
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if len(errs) == 0 {
+		return nil, fmt.Errorf("no transport in %v is accepted by gateway, expect one of %v", a.opt.Transports, accepted)
+	}
+	return nil, errors.New(strings.Join(errs, "; "))
+}
+
+func (a *Agent) transportOrder(g *gatewayConn) []transport.Name {
+	last := g.Transport()
+	if last == "" {
+		return a.opt.Transports
+	}
+	names := []transport.Name{last}
+	for _, name := range a.opt.Transports {
+		if name != last {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// acceptedTransports 忽略不认识的传输方式, gateway 可能比 agent 新
+func acceptedTransports(header http.Header) []transport.Name {
+	var names []transport.Name
+	for _, s := range strings.Split(header.Get(transport.AcceptHeader), ",") {
+		if name := transport.Name(strings.TrimSpace(s)); transport.Allowed(transport.Supported, name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,110 @@
+package agent_test
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"k8s-tunnel/pkg/agent"
+	"k8s-tunnel/pkg/gateway"
+	"k8s-tunnel/pkg/transport"
+	"k8s-tunnel/pkg/tunneltest"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// expectTransport 请求经过 agent 转发, 且注册和响应连接使用 name
+func expectTransport(t *testing.T, h *tunneltest.Harness, a *tunneltest.Agent, client *http.Client, name transport.Name) {
+	t.Helper()
+
+	if tunnel, ok := h.Gateway.Tunnel("huawei"); !ok || tunnel.Transport != name {
+		t.Fatalf("expect tunnel over %s, got %+v", name, tunnel)
+	}
+	// gateway 先于 agent 记录注册结果
+	deadline := time.Now().Add(tunneltest.DefaultWaitTimeout)
+	for status := a.Gateways()[0]; status.State != agent.GatewayRegistered || status.Transport != name; status = a.Gateways()[0] {
+		if time.Now().After(deadline) {
+			t.Fatalf("expect agent over %s, got %+v", name, status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get(h.URL("huawei", "/hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || len(b) == 0 {
+			t.Fatalf("status %d, body %q", resp.StatusCode, b)
+		}
+	}
+}
+
+// tlsHarness 开启 CA 的 gateway, agent 只使用 transports, 返回信任该 CA 的 client
+func tlsHarness(t *testing.T, gatewayTransports, transports []transport.Name) (*tunneltest.Harness, *http.Client) {
+	t.Helper()
+
+	ca, err := gateway.NewCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := tunneltest.New(t, &tunneltest.Option{
+		Gateway: &gateway.Option{
+			CA:              ca,
+			BootstrapTokens: map[string]string{"huawei.secret": "huawei"},
+			Transports:      gatewayTransports,
+		},
+		AgentOption: func(opt *agent.Option) {
+			opt.CACert = ca.CertPEM()
+			opt.BootstrapToken = "huawei.secret"
+			opt.Transports = transports
+		},
+	})
+	return h, &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: ca.Pool()}}}
+}
+
+func TestTransport(t *testing.T) {
+	for _, name := range []transport.Name{transport.WebSocket, transport.HTTP2} {
+		name := name
+		t.Run("#"+string(name), func(t *testing.T) {
+			h := tunneltest.New(t, &tunneltest.Option{
+				AgentOption: func(opt *agent.Option) { opt.Transports = []transport.Name{name} },
+			})
+			a := h.StartAgent("huawei")
+			expectTransport(t, h, a, http.DefaultClient, name)
+		})
+	}
+
+	for _, name := range transport.Supported {
+		name := name
+		t.Run("#"+string(name)+" tls", func(t *testing.T) {
+			h, client := tlsHarness(t, nil, []transport.Name{name})
+			a := h.StartAgent("huawei")
+			expectTransport(t, h, a, client, name)
+		})
+	}
+
+	t.Run("#raw without tls", func(t *testing.T) {
+		// raw 不加密, 没有 tls 时跳过 raw
+		h := tunneltest.New(t, &tunneltest.Option{
+			AgentOption: func(opt *agent.Option) { opt.Transports = []transport.Name{transport.Raw, transport.HTTP2} },
+		})
+		a := h.StartAgent("huawei")
+		expectTransport(t, h, a, http.DefaultClient, transport.HTTP2)
+	})
+
+	t.Run("#fallback", func(t *testing.T) {
+		h, client := tlsHarness(t, []transport.Name{transport.Raw}, nil)
+		a := h.StartAgent("huawei")
+		expectTransport(t, h, a, client, transport.Raw)
+
+		// gateway 重启后仍然使用 raw 重连
+		h.StopGateway()
+		h.StartGateway()
+		if err := h.WaitForAgent("huawei", tunneltest.DefaultWaitTimeout); err != nil {
+			t.Fatal(err)
+		}
+		expectTransport(t, h, a, client, transport.Raw)
+	})
+}
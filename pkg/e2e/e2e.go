@@ -0,0 +1,248 @@
+// Package e2e 客户端与 agent 之间的端到端加密, gateway 只转发密文
+//
+// 客户端为每个请求生成临时 X25519 密钥, 与 agent 的公钥协商出共享密钥,
+// 经 HKDF-SHA256 派生出请求和响应各自的 ChaCha20-Poly1305 密钥, 每个密钥只加密一条消息.
+// 整个 http 请求 (方法, 路径, header, body) 和响应都在密文中, gateway 只能看到 agent 名称和密文长度.
+// 请求的密文中带有发送时间, agent 用 ReplayGuard 拒绝过期或重放的请求.
+package e2e
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// ContentType 密文请求和响应的 Content-Type
+	ContentType = "application/vnd.k8s-tunnel.sealed"
+
+	KeySize = curve25519.PointSize
+
+	// v2 起请求明文前带有 8 字节的发送时间 (unix 纳秒), 与 v1 的密文互相无法解密
+	hkdfInfo = "k8s-tunnel e2e v2"
+
+	timestampSize = 8
+)
+
+var ErrDecrypt = errors.New("e2e: message authentication failed")
+
+type PublicKey [KeySize]byte
+
+func (k PublicKey) String() string {
+	return base64.StdEncoding.EncodeToString(k[:])
+}
+
+// ParsePublicKey 解析 base64 编码的公钥
+func ParsePublicKey(s string) (PublicKey, error) {
+	var k PublicKey
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return k, fmt.Errorf("invalid public key: %v", err)
+	}
+	if len(b) != KeySize {
+		return k, fmt.Errorf("invalid public key: expect %d bytes, got %d", KeySize, len(b))
+	}
+	copy(k[:], b)
+
+	return k, nil
+}
+
+type PrivateKey struct {
+	key [KeySize]byte
+	pub PublicKey
+}
+
+func GenerateKey() (*PrivateKey, error) {
+	var key [KeySize]byte
+	if _, err := io.ReadFull(rand.Reader, key[:]); err != nil {
+		return nil, err
+	}
+
+	return newPrivateKey(key[:])
+}
+
+func newPrivateKey(b []byte) (*PrivateKey, error) {
+	pub, err := curve25519.X25519(b, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	k := &PrivateKey{}
+	copy(k.key[:], b)
+	copy(k.pub[:], pub)
+
+	return k, nil
+}
+
+func (k *PrivateKey) Public() PublicKey {
+	return k.pub
+}
+
+// LoadOrGenerateKey 读取 base64 编码的私钥, 文件不存在时生成一个并以 0600 权限写入
+func LoadOrGenerateKey(path string) (*PrivateKey, error) {
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		k, err := GenerateKey()
+		if err != nil {
+			return nil, err
+		}
+		data := base64.StdEncoding.EncodeToString(k.key[:]) + "\n"
+		if err = os.WriteFile(path, []byte(data), 0600); err != nil {
+			return nil, err
+		}
+		return k, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil || len(raw) != KeySize {
+		return nil, fmt.Errorf("invalid private key %s", path)
+	}
+
+	return newPrivateKey(raw)
+}
+
+// Exchange 一次请求响应的密钥
+type Exchange struct {
+	requestKey  []byte
+	responseKey []byte
+
+	ephemeral PublicKey // 客户端的临时公钥, 每个请求不同
+	sentAt    time.Time // 客户端发送请求的时间, 只有 agent 一端有
+}
+
+func newExchange(shared []byte, ephemeral, recipient PublicKey) (*Exchange, error) {
+	salt := append(append([]byte{}, ephemeral[:]...), recipient[:]...)
+	keys := make([]byte, 2*chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte(hkdfInfo)), keys); err != nil {
+		return nil, err
+	}
+
+	return &Exchange{
+		requestKey:  keys[:chacha20poly1305.KeySize],
+		responseKey: keys[chacha20poly1305.KeySize:],
+		ephemeral:   ephemeral,
+	}, nil
+}
+
+// 每个密钥只使用一次, nonce 固定为 0
+func seal(key, plaintext []byte) []byte {
+	aead, _ := chacha20poly1305.New(key)
+	return aead.Seal(nil, make([]byte, aead.NonceSize()), plaintext, nil)
+}
+
+func open(key, ciphertext []byte) ([]byte, error) {
+	aead, _ := chacha20poly1305.New(key)
+	plaintext, err := aead.Open(nil, make([]byte, aead.NonceSize()), ciphertext, nil)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+
+	return plaintext, nil
+}
+
+// Seal 客户端加密一条消息, 返回 临时公钥 + 密文, 发送时间在密文中
+func Seal(recipient PublicKey, plaintext []byte) ([]byte, *Exchange, error) {
+	var ephemeral [KeySize]byte
+	if _, err := io.ReadFull(rand.Reader, ephemeral[:]); err != nil {
+		return nil, nil, err
+	}
+	ephemeralPub, err := curve25519.X25519(ephemeral[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, nil, err
+	}
+	shared, err := curve25519.X25519(ephemeral[:], recipient[:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var epk PublicKey
+	copy(epk[:], ephemeralPub)
+	ex, err := newExchange(shared, epk, recipient)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stamped := make([]byte, timestampSize, timestampSize+len(plaintext))
+	binary.BigEndian.PutUint64(stamped, uint64(time.Now().UnixNano()))
+	stamped = append(stamped, plaintext...)
+
+	return append(epk[:], seal(ex.requestKey, stamped)...), ex, nil
+}
+
+// Open agent 用私钥解密客户端的消息, 发送时间记录在 Exchange 中, 由 ReplayGuard 检查
+func Open(key *PrivateKey, sealed []byte) ([]byte, *Exchange, error) {
+	if len(sealed) < KeySize {
+		return nil, nil, ErrDecrypt
+	}
+	var epk PublicKey
+	copy(epk[:], sealed[:KeySize])
+
+	shared, err := curve25519.X25519(key.key[:], epk[:])
+	if err != nil {
+		return nil, nil, ErrDecrypt
+	}
+	ex, err := newExchange(shared, epk, key.pub)
+	if err != nil {
+		return nil, nil, err
+	}
+	plaintext, err := open(ex.requestKey, sealed[KeySize:])
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(plaintext) < timestampSize {
+		return nil, nil, ErrDecrypt
+	}
+	ex.sentAt = time.Unix(0, int64(binary.BigEndian.Uint64(plaintext)))
+
+	return plaintext[timestampSize:], ex, nil
+}
+
+// SealResponse agent 加密响应
+func (ex *Exchange) SealResponse(plaintext []byte) []byte {
+	return seal(ex.responseKey, plaintext)
+}
+
+// OpenResponse 客户端解密响应
+func (ex *Exchange) OpenResponse(sealed []byte) ([]byte, error) {
+	return open(ex.responseKey, sealed)
+}
+
+// IsSealed 请求或响应的 body 是否为密文
+func IsSealed(header http.Header) bool {
+	return strings.HasPrefix(header.Get("Content-Type"), ContentType)
+}
+
+// OpenRequest agent 解密并解析客户端的请求
+func OpenRequest(key *PrivateKey, req *http.Request) (*http.Request, *Exchange, error) {
+	sealed, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	plaintext, ex, err := Open(key, sealed)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	inner, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(plaintext)))
+	if err != nil {
+		return nil, nil, fmt.Errorf("e2e: parse request: %v", err)
+	}
+	inner = inner.WithContext(req.Context())
+
+	return inner, ex, nil
+}
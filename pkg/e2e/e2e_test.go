@@ -0,0 +1,150 @@
+package e2e_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"k8s-tunnel/pkg/e2e"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSeal(t *testing.T) {
+	key, err := e2e.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("#round trip", func(t *testing.T) {
+		sealed, client, err := e2e.Seal(key.Public(), []byte("GET /api/v1/secrets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(sealed, []byte("secrets")) {
+			t.Fatalf("plaintext leaked: %q", sealed)
+		}
+
+		plaintext, agent, err := e2e.Open(key, sealed)
+		if err != nil || string(plaintext) != "GET /api/v1/secrets" {
+			t.Fatalf("open request: %q, %v", plaintext, err)
+		}
+
+		resp, err := client.OpenResponse(agent.SealResponse([]byte("HTTP/1.1 200 OK")))
+		if err != nil || string(resp) != "HTTP/1.1 200 OK" {
+			t.Fatalf("open response: %q, %v", resp, err)
+		}
+		// 请求和响应使用不同的密钥
+		if _, err = client.OpenResponse(sealed[e2e.KeySize:]); !errors.Is(err, e2e.ErrDecrypt) {
+			t.Fatalf("expect ErrDecrypt, got %v", err)
+		}
+	})
+
+	t.Run("#wrong key", func(t *testing.T) {
+		other, _ := e2e.GenerateKey()
+		sealed, _, _ := e2e.Seal(other.Public(), []byte("hello"))
+		if _, _, err := e2e.Open(key, sealed); !errors.Is(err, e2e.ErrDecrypt) {
+			t.Fatalf("expect ErrDecrypt, got %v", err)
+		}
+	})
+
+	t.Run("#tampered", func(t *testing.T) {
+		sealed, _, _ := e2e.Seal(key.Public(), []byte("hello"))
+		sealed[len(sealed)-1] ^= 1
+		if _, _, err := e2e.Open(key, sealed); !errors.Is(err, e2e.ErrDecrypt) {
+			t.Fatalf("expect ErrDecrypt, got %v", err)
+		}
+	})
+
+	t.Run("#parse public key", func(t *testing.T) {
+		pub, err := e2e.ParsePublicKey(key.Public().String())
+		if err != nil || pub != key.Public() {
+			t.Fatalf("parse %s: %v, %v", key.Public(), pub, err)
+		}
+		if _, err = e2e.ParsePublicKey("aGVsbG8="); err == nil {
+			t.Fatal("expect error for short key")
+		}
+	})
+	t.Run("#replay", func(t *testing.T) {
+		guard := e2e.NewReplayGuard(0)
+		sealed, _, _ := e2e.Seal(key.Public(), []byte("hello"))
+
+		_, ex, err := e2e.Open(key, sealed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = guard.Check(ex); err != nil {
+			t.Fatalf("first request rejected: %v", err)
+		}
+		// gateway 原样重发同一个密文
+		if _, ex, err = e2e.Open(key, sealed); err != nil {
+			t.Fatal(err)
+		}
+		if err = guard.Check(ex); !errors.Is(err, e2e.ErrReplay) {
+			t.Fatalf("expect ErrReplay, got %v", err)
+		}
+	})
+
+	t.Run("#expired", func(t *testing.T) {
+		guard := e2e.NewReplayGuard(10 * time.Millisecond)
+		sealed, _, _ := e2e.Seal(key.Public(), []byte("hello"))
+		time.Sleep(20 * time.Millisecond)
+
+		_, ex, err := e2e.Open(key, sealed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = guard.Check(ex); !errors.Is(err, e2e.ErrReplay) {
+			t.Fatalf("expect ErrReplay, got %v", err)
+		}
+	})
+}
+
+func TestTransport(t *testing.T) {
+	key, err := e2e.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// gateway 不转发给 agent, 直接以明文响应
+	roundTrip := func(t *testing.T, code int, contentType, body string) (*http.Response, error) {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", contentType)
+			w.WriteHeader(code)
+			_, _ = io.WriteString(w, body)
+		}))
+		t.Cleanup(s.Close)
+
+		client := &http.Client{Transport: &e2e.Transport{AgentName: "huawei", PublicKey: key.Public()}}
+		return client.Get(s.URL + "/api/v1/secrets")
+	}
+
+	t.Run("#gateway status", func(t *testing.T) {
+		resp, err := roundTrip(t, http.StatusTooManyRequests, "application/json", `{"kind":"Status","code":429}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if b, _ := io.ReadAll(resp.Body); resp.StatusCode != http.StatusTooManyRequests || !bytes.Contains(b, []byte("Status")) {
+			t.Fatalf("status %d, body %s", resp.StatusCode, b)
+		}
+	})
+
+	t.Run("#unsealed response refused", func(t *testing.T) {
+		for _, c := range []struct {
+			code              int
+			contentType, body string
+		}{
+			{http.StatusOK, "application/json", `{"kind":"SecretList","items":[]}`},
+			{http.StatusOK, "application/json", `{"kind":"Status","code":200}`},
+			{http.StatusNotFound, "application/json", `{"kind":"Secret"}`},
+			{http.StatusBadGateway, "text/plain", "bad gateway"},
+		} {
+			if resp, err := roundTrip(t, c.code, c.contentType, c.body); err == nil {
+				resp.Body.Close()
+				t.Fatalf("%d %s: expect error, got status %d", c.code, c.body, resp.StatusCode)
+			}
+		}
+	})
+}
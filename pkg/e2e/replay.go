@@ -0,0 +1,69 @@
+package e2e
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// DefaultReplayWindow 请求发送时间与 agent 时间相差超过该值时拒绝, 也是记住临时公钥的时间
+const DefaultReplayWindow = 5 * time.Minute
+
+var ErrReplay = errors.New("e2e: request expired or replayed")
+
+// ReplayGuard agent 一端拒绝重放的请求. 发送时间超出窗口的请求直接拒绝,
+// 窗口内的请求按临时公钥去重, 每个临时公钥只能使用一次
+type ReplayGuard struct {
+	window time.Duration
+
+	mu        sync.Mutex
+	seen      map[PublicKey]time.Time // 临时公钥 -> 过期时间
+	lastPrune time.Time
+}
+
+// NewReplayGuard window 为 0 时使用 DefaultReplayWindow
+func NewReplayGuard(window time.Duration) *ReplayGuard {
+	if window <= 0 {
+		window = DefaultReplayWindow
+	}
+
+	return &ReplayGuard{
+		window:    window,
+		seen:      map[PublicKey]time.Time{},
+		lastPrune: time.Now(),
+	}
+}
+
+// Check 第一次见到窗口内的请求时返回 nil, 之后同一个请求返回 ErrReplay
+func (g *ReplayGuard) Check(ex *Exchange) error {
+	now := time.Now()
+	if d := now.Sub(ex.sentAt); d > g.window || d < -g.window {
+		return ErrReplay
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.prune(now)
+	if _, ok := g.seen[ex.ephemeral]; ok {
+		return ErrReplay
+	}
+	// 过期之前发送时间都还在窗口内, 需要一直记住
+	g.seen[ex.ephemeral] = ex.sentAt.Add(g.window)
+
+	return nil
+}
+
+// 调用方需持有锁
+func (g *ReplayGuard) prune(now time.Time) {
+	if now.Sub(g.lastPrune) < g.window {
+		return
+	}
+	g.lastPrune = now
+
+	for k, expire := range g.seen {
+		if now.After(expire) {
+			delete(g.seen, k)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package e2e
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// maxStatusSize gateway 返回的明文错误的最大长度
+const maxStatusSize = 64 << 10
+
+// Transport 客户端插件, 把发往 gateway 的请求整体加密后发给 agent, 再解密 agent 的响应
+//
+//	config.Wrap(func(rt http.RoundTripper) http.RoundTripper {
+//		return &e2e.Transport{Base: rt, AgentName: "huawei", PublicKey: key}
+//	})
+//
+// gateway 自己返回的错误 (认证失败, 限流, agent 离线等) 不是密文, 只有 4xx/5xx 的 Status 原样返回,
+// 其他明文响应可能是 gateway 伪造的, 返回错误.
+// agent 的公钥可以从 gateway 的 /agents/{agentName} 获取, 但不信任 gateway 时应通过其他渠道核对.
+type Transport struct {
+	Base      http.RoundTripper // 为空时使用 http.DefaultTransport
+	AgentName string
+	PublicKey PublicKey
+	// Header 以明文发给 gateway 的 header, 如 gateway 的认证信息, 原请求的 header 都在密文中
+	Header http.Header
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	plaintext := &bytes.Buffer{}
+	if err := req.Write(plaintext); err != nil {
+		return nil, err
+	}
+	sealed, ex, err := Seal(t.PublicKey, plaintext.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	u := *req.URL
+	u.Path, u.RawPath, u.RawQuery = "/proxies/"+t.AgentName, "", ""
+	outer, err := http.NewRequestWithContext(req.Context(), http.MethodPost, u.String(), bytes.NewReader(sealed))
+	if err != nil {
+		return nil, err
+	}
+	for k, vv := range t.Header {
+		outer.Header[k] = vv
+	}
+	outer.Header.Set("Content-Type", ContentType)
+
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	resp, err := base.RoundTrip(outer)
+	if err != nil {
+		return nil, err
+	}
+	if !IsSealed(resp.Header) {
+		return gatewayStatus(resp)
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	b, err = ex.OpenResponse(b)
+	if err != nil {
+		return nil, err
+	}
+	inner, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(b)), req)
+	if err != nil {
+		return nil, fmt.Errorf("e2e: parse response: %v", err)
+	}
+
+	return inner, nil
+}
+
+// gatewayStatus 只接受 gateway 以明文返回的错误 Status, 不能用来伪造成功的响应
+func gatewayStatus(resp *http.Response) (*http.Response, error) {
+	defer resp.Body.Close()
+
+	if resp.StatusCode < http.StatusBadRequest || !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		return nil, fmt.Errorf("e2e: unsealed response, status %d", resp.StatusCode)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxStatusSize+1))
+	if err != nil {
+		return nil, err
+	}
+	status := struct {
+		Kind string `json:"kind"`
+	}{}
+	if len(b) > maxStatusSize || json.Unmarshal(b, &status) != nil || status.Kind != "Status" {
+		return nil, fmt.Errorf("e2e: unsealed response, status %d", resp.StatusCode)
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(b))
+
+	return resp, nil
+}
@@ -0,0 +1,102 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"k8s-tunnel/pkg/protocol"
+	"k8s-tunnel/pkg/transport"
+	"k8s.io/apimachinery/pkg/labels"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// AgentInfo /agents 接口返回的 agent 信息
+type AgentInfo struct {
+	Name            string             `json:"name"`
+	ConnectedAt     time.Time          `json:"connectedAt"`
+	ProtocolVersion int                `json:"protocolVersion"`
+	Transport       transport.Name     `json:"transport"`
+	Features        []protocol.Feature `json:"features"`
+	PublicKey       string             `json:"publicKey,omitempty"` // 端到端加密的公钥
+	Metadata        protocol.Metadata  `json:"metadata"`
+}
+
+type AgentInfoList struct {
+	Items []*AgentInfo `json:"items"`
+}
+
+func (t *Tunnel) Info() *AgentInfo {
+	info := &AgentInfo{
+		Name:        t.Name,
+		ConnectedAt: t.ConnectedAt,
+		Transport:   t.Transport,
+		Metadata:    t.Metadata(),
+	}
+	if t.Session != nil {
+		info.ProtocolVersion = t.Session.ProtocolVersion
+		info.Features = t.Session.Features
+		if t.Session.Has(protocol.FeatureE2E) {
+			info.PublicKey = t.Session.PeerPublicKey
+		}
+	}
+
+	return info
+}
+
+// SelectTunnels 返回标签匹配 selector 的在线 tunnel, 按名称排序
+func (gw *Gateway) SelectTunnels(selector labels.Selector) []*Tunnel {
+	var tunnels []*Tunnel
+	for _, t := range gw.Tunnels() {
+		if selector.Matches(t.Labels()) {
+			tunnels = append(tunnels, t)
+		}
+	}
+	sort.Slice(tunnels, func(i, j int) bool { return tunnels[i].Name < tunnels[j].Name })
+
+	return tunnels
+}
+
+// GET /agents?labelSelector=env=prod
+func (gw *Gateway) listAgentsHandler(writer http.ResponseWriter, request *http.Request) {
+	if err := gw.authenticate(request); err != nil {
+		RESP(writer, NewStatusErr(http.StatusUnauthorized, err))
+		return
+	}
+
+	selector, err := labels.Parse(request.URL.Query().Get("labelSelector"))
+	if err != nil {
+		RESP(writer, NewStatusErr(http.StatusBadRequest, err))
+		return
+	}
+
+	list := &AgentInfoList{Items: []*AgentInfo{}}
+	for _, t := range gw.SelectTunnels(selector) {
+		list.Items = append(list.Items, t.Info())
+	}
+
+	writeJSON(writer, http.StatusOK, list)
+}
+
+// GET /agents/{agentName}
+func (gw *Gateway) getAgentHandler(writer http.ResponseWriter, request *http.Request) {
+	if err := gw.authenticate(request); err != nil {
+		RESP(writer, NewStatusErr(http.StatusUnauthorized, err))
+		return
+	}
+
+	tunnel, ok := gw.getTunnel(request)
+	if !ok {
+		RESP(writer, NewStatusErr(http.StatusNotFound, fmt.Errorf("agent %s not connected", mux.Vars(request)["agentName"])))
+		return
+	}
+
+	writeJSON(writer, http.StatusOK, tunnel.Info())
+}
+
+func writeJSON(rw http.ResponseWriter, code int, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rw.WriteHeader(code)
+	_ = json.NewEncoder(rw).Encode(v)
+}
@@ -0,0 +1,114 @@
+package gateway_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"k8s-tunnel/pkg/agent"
+	"k8s-tunnel/pkg/gateway"
+	"k8s-tunnel/pkg/tunneltest"
+	"k8s-tunnel/pkg/tunneltest/fakeapiserver"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func listAgents(t *testing.T, h *tunneltest.Harness, selector string) *gateway.AgentInfoList {
+	t.Helper()
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/agents?labelSelector=%s", h.GatewayHost(), selector))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	list := &gateway.AgentInfoList{}
+	if err = json.NewDecoder(resp.Body).Decode(list); err != nil {
+		t.Fatal(err)
+	}
+
+	return list
+}
+
+func waitNodeCount(t *testing.T, h *tunneltest.Harness, agentName string, count int) *gateway.Tunnel {
+	t.Helper()
+
+	deadline := time.Now().Add(tunneltest.DefaultWaitTimeout)
+	for {
+		tunnel, ok := h.Gateway.Tunnel(agentName)
+		if ok && tunnel.Metadata().NodeCount == count {
+			return tunnel
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("node count of %s not %d", agentName, count)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAgentAPI(t *testing.T) {
+	t.Run("#metadata", func(t *testing.T) {
+		s := fakeapiserver.New(nil)
+		defer s.Close()
+		for _, name := range []string{"node-1", "node-2"} {
+			if err := s.Add(fakeapiserver.Object("v1", "Node", "", name)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		h := tunneltest.New(t, &tunneltest.Option{
+			APIServer: s,
+			AgentOption: func(opt *agent.Option) {
+				opt.Labels = map[string]string{"env": opt.AgentName}
+				opt.MetadataInterval = 50 * time.Millisecond
+			},
+		})
+		h.StartAgent("prod")
+		h.StartAgent("dev")
+
+		md := waitNodeCount(t, h, "prod", 2).Metadata()
+		if md.KubernetesVersion == "" || md.ClusterUID == "" || md.AgentVersion == "" || md.Labels["env"] != "prod" {
+			t.Fatalf("unexpected metadata %+v", md)
+		}
+
+		// 定时刷新
+		if err := s.Add(fakeapiserver.Object("v1", "Node", "", "node-3")); err != nil {
+			t.Fatal(err)
+		}
+		waitNodeCount(t, h, "prod", 3)
+	})
+
+	t.Run("#label selector", func(t *testing.T) {
+		h := tunneltest.New(t, &tunneltest.Option{
+			AgentOption: func(opt *agent.Option) {
+				opt.Labels = map[string]string{"env": opt.AgentName, "team": "infra"}
+			},
+		})
+		h.StartAgent("prod")
+		h.StartAgent("dev")
+		for _, name := range []string{"prod", "dev"} {
+			if err := h.WaitForMetadata(name, tunneltest.DefaultWaitTimeout); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if list := listAgents(t, h, "team=infra"); len(list.Items) != 2 {
+			t.Fatalf("expect 2 agents, got %d", len(list.Items))
+		}
+		list := listAgents(t, h, "env=prod")
+		if len(list.Items) != 1 || list.Items[0].Name != "prod" {
+			t.Fatalf("unexpected agents %+v", list.Items)
+		}
+		if list = listAgents(t, h, "env=staging"); len(list.Items) != 0 {
+			t.Fatalf("expect no agents, got %d", len(list.Items))
+		}
+
+		resp, err := http.Get(fmt.Sprintf("http://%s/agents/nobody", h.GatewayHost()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("expect 404, got %d", resp.StatusCode)
+		}
+	})
+}
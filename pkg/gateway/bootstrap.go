@@ -0,0 +1,299 @@
+package gateway
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+	"io"
+	"k8s-tunnel/pkg/transport"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 证书签名请求的最大长度
+const maxCSRSize = 64 << 10
+
+// bootstrapTokens agent 首次注册申请证书用的一次性 token, 签发成功后失效
+type bootstrapTokens struct {
+	mu     sync.Mutex
+	tokens map[string]string // token: agentName, agentName 为空时可用于任意 agent
+	used   *UsedTokens
+}
+
+// sign 校验 token 并签发证书, 签发成功并记录 token 已使用后删除 token
+func (b *bootstrapTokens) sign(token, agentName string, fn func(tokenID string) (*x509.Certificate, error)) (*x509.Certificate, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	name, ok := b.tokens[token]
+	id := BootstrapTokenID(token)
+	if !ok || b.used.Has(id) {
+		return nil, errors.New("invalid or used bootstrap token")
+	}
+	if id == "" {
+		return nil, errors.New("bootstrap token must be in the form of id.secret")
+	}
+	if name != "" && name != agentName {
+		return nil, fmt.Errorf("bootstrap token is not issued for agent %s", agentName)
+	}
+
+	cert, err := fn(id)
+	if err != nil {
+		return nil, err
+	}
+	// 先记录再返回证书, 记录失败时 token 仍然可用
+	if err = b.used.Add(id, agentName); err != nil {
+		return nil, NewStatusErr(http.StatusInternalServerError, err)
+	}
+	delete(b.tokens, token)
+
+	return cert, nil
+}
+
+// UsedTokens 已签发过证书的 bootstrap token id, path 不为空时每次修改都写入文件
+type UsedTokens struct {
+	path string
+
+	mu  sync.RWMutex
+	ids map[string]string // token id: agentName
+}
+
+func NewUsedTokens() *UsedTokens {
+	return &UsedTokens{ids: map[string]string{}}
+}
+
+// LoadUsedTokens 读取 json 格式的已用 token, 文件不存在时为空, 之后的修改会写回该文件
+func LoadUsedTokens(path string) (*UsedTokens, error) {
+	u := NewUsedTokens()
+	u.path = path
+
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return u, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(b, &u.ids); err != nil {
+		return nil, fmt.Errorf("parse used tokens %s: %v", path, err)
+	}
+	if u.ids == nil {
+		u.ids = map[string]string{}
+	}
+
+	return u, nil
+}
+
+func (u *UsedTokens) Has(tokenID string) bool {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+
+	_, ok := u.ids[tokenID]
+	return ok
+}
+
+// Add 记录 token 已使用, 写入文件失败时回滚
+func (u *UsedTokens) Add(tokenID, agentName string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.ids[tokenID] = agentName
+	if err := u.save(); err != nil {
+		delete(u.ids, tokenID)
+		return err
+	}
+
+	return nil
+}
+
+// 调用方需持有锁
+func (u *UsedTokens) save() error {
+	if u.path == "" {
+		return nil
+	}
+
+	b, err := json.MarshalIndent(u.ids, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := u.path + ".tmp"
+	if err = os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, u.path)
+}
+
+// LoadBootstrapTokens 读取 token 文件, 每行一个 id.secret=agentName, agentName 可以为空, 忽略空行和 # 开头的注释
+func LoadBootstrapTokens(path string) (map[string]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := map[string]string{}
+	for i, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		token, agentName := line, ""
+		if j := strings.IndexByte(line, '='); j >= 0 {
+			token, agentName = strings.TrimSpace(line[:j]), strings.TrimSpace(line[j+1:])
+		}
+		if BootstrapTokenID(token) == "" || strings.HasSuffix(token, ".") {
+			return nil, fmt.Errorf("%s line %d: bootstrap token must be in the form of id.secret", path, i+1)
+		}
+		tokens[token] = agentName
+	}
+
+	return tokens, nil
+}
+
+// BootstrapTokenID token 的格式为 id.secret, id 会记录在签发的证书中
+func BootstrapTokenID(token string) string {
+	if i := strings.IndexByte(token, '.'); i > 0 {
+		return token[:i]
+	}
+	return ""
+}
+
+// TLSConfig 配置了 CA 时返回 gateway 的 tls 配置, 未配置时返回 nil.
+// 客户端证书是可选的, 只有 agent 的注册和响应连接要求 CA 签发的证书
+func (gw *Gateway) TLSConfig() (*tls.Config, error) {
+	if gw.opt.CA == nil {
+		return nil, nil
+	}
+
+	cert, err := gw.opt.CA.ServingCert(gw.opt.TLSHosts)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		ClientCAs:    gw.opt.CA.Pool(),
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   []string{"http/1.1"},
+	}
+	// HTTP/2 传输需要通过 ALPN 协商 h2, 其他传输方式使用 HTTP/1.1
+	if transport.Allowed(gw.opt.Transports, transport.HTTP2) {
+		config.NextProtos = []string{http2.NextProtoTLS, "http/1.1"}
+	}
+
+	return config, nil
+}
+
+// verifyAgentCert 校验 agent 的客户端证书. 证书链在 tls 握手时已经校验过, 这里检查归属, 有效期和吊销
+func (gw *Gateway) verifyAgentCert(request *http.Request, agentName string) (*x509.Certificate, error) {
+	if request.TLS == nil || len(request.TLS.PeerCertificates) == 0 {
+		return nil, errors.New("client certificate required")
+	}
+
+	cert := request.TLS.PeerCertificates[0]
+	if now := time.Now(); now.After(cert.NotAfter) || now.Before(cert.NotBefore) {
+		return nil, fmt.Errorf("certificate %s expired at %s", cert.SerialNumber, cert.NotAfter.Format(time.RFC3339))
+	}
+	if cert.Subject.CommonName != agentName {
+		return nil, fmt.Errorf("certificate is issued to %s, not %s", cert.Subject.CommonName, agentName)
+	}
+	if item, ok := gw.opt.Revocations.Match(agentName, cert); ok {
+		return nil, item.err()
+	}
+
+	return cert, nil
+}
+
+// authenticateAgent agent 的注册和响应连接, 配置了 CA 时还需要有效的客户端证书
+func (gw *Gateway) authenticateAgent(request *http.Request) (*x509.Certificate, error) {
+	if err := gw.authenticate(request); err != nil {
+		return nil, err
+	}
+	agentName := mux.Vars(request)["agentName"]
+	if gw.opt.CA == nil {
+		if item, ok := gw.opt.Revocations.Match(agentName, nil); ok {
+			return nil, item.err()
+		}
+		return nil, nil
+	}
+
+	return gw.verifyAgentCert(request, agentName)
+}
+
+// POST /agents/{agentName}/certificate
+//
+// body 为 PEM 格式的证书签名请求, 返回 PEM 格式的证书.
+// 首次申请使用 Authorization: Bearer <bootstrap token>, 续期使用当前仍有效的证书
+func (gw *Gateway) certificateHandler(writer http.ResponseWriter, request *http.Request) {
+	if gw.opt.CA == nil {
+		RESP(writer, NewStatusErr(http.StatusNotFound, errors.New("certificate authority is not enabled")))
+		return
+	}
+	agentName := mux.Vars(request)["agentName"]
+
+	b, err := io.ReadAll(io.LimitReader(request.Body, maxCSRSize))
+	if err != nil {
+		RESP(writer, NewStatusErr(http.StatusBadRequest, err))
+		return
+	}
+	csr, err := ParseCSR(b)
+	if err != nil {
+		RESP(writer, NewStatusErr(http.StatusBadRequest, err))
+		return
+	}
+
+	var cert *x509.Certificate
+	if request.TLS != nil && len(request.TLS.PeerCertificates) > 0 {
+		current, err := gw.verifyAgentCert(request, agentName)
+		if err != nil {
+			RESP(writer, NewStatusErr(http.StatusUnauthorized, err))
+			return
+		}
+		cert, err = gw.opt.CA.SignAgent(csr, agentName, TokenID(current), gw.opt.AgentCertTTL)
+		if err != nil {
+			RESP(writer, NewStatusErr(http.StatusBadRequest, err))
+			return
+		}
+		if tunnel, ok := gw.Tunnel(agentName); ok {
+			tunnel.renewCertificate(current, cert)
+		}
+		logrus.Infof("%s certificate renewed, serial:%s, expires:%s", agentName, cert.SerialNumber, cert.NotAfter)
+	} else {
+		token := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+		if token == "" {
+			RESP(writer, NewStatusErr(http.StatusUnauthorized, errors.New("bootstrap token or client certificate required")))
+			return
+		}
+		if item, ok := gw.opt.Revocations.Match(agentName, nil); ok {
+			RESP(writer, NewStatusErr(http.StatusForbidden, item.err()))
+			return
+		}
+		if id := BootstrapTokenID(token); id != "" && gw.opt.Revocations.TokenRevoked(id) {
+			RESP(writer, NewStatusErr(http.StatusForbidden, fmt.Errorf("bootstrap token %s has been revoked", id)))
+			return
+		}
+		cert, err = gw.bootstrap.sign(token, agentName, func(tokenID string) (*x509.Certificate, error) {
+			return gw.opt.CA.SignAgent(csr, agentName, tokenID, gw.opt.AgentCertTTL)
+		})
+		if err != nil {
+			RESP(writer, NewStatusErr(http.StatusUnauthorized, err))
+			return
+		}
+		logrus.Infof("%s bootstrapped with token %s, serial:%s, expires:%s",
+			agentName, TokenID(cert), cert.SerialNumber, cert.NotAfter)
+	}
+
+	writer.Header().Set("Content-Type", "application/x-pem-file")
+	writer.WriteHeader(http.StatusOK)
+	_ = pem.Encode(writer, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+}
@@ -0,0 +1,254 @@
+package gateway_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"k8s-tunnel/pkg/agent"
+	"k8s-tunnel/pkg/gateway"
+	"k8s-tunnel/pkg/tunneltest"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// caHarness 开启 CA 的 gateway, agentTokens 为各 agent 使用的 bootstrap token, 返回各 agent 的证书目录
+func caHarness(t *testing.T, ca *gateway.CA, opt *gateway.Option, agentTokens map[string]string) (*tunneltest.Harness, map[string]string) {
+	dirs := map[string]string{}
+	for name := range agentTokens {
+		dirs[name] = t.TempDir()
+	}
+	opt.CA = ca
+
+	h := tunneltest.New(t, &tunneltest.Option{
+		Gateway: opt,
+		AgentOption: func(opt *agent.Option) {
+			opt.CACert = ca.CertPEM()
+			opt.CertDir = dirs[opt.AgentName]
+			opt.BootstrapToken = agentTokens[opt.AgentName]
+		},
+	})
+
+	return h, dirs
+}
+
+func tlsClient(ca *gateway.CA) *http.Client {
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: ca.Pool()}}}
+}
+
+func postCSR(t *testing.T, client *http.Client, h *tunneltest.Harness, agentName, token string) int {
+	t.Helper()
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: agentName}}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+
+	req, _ := http.NewRequest(http.MethodPost, "https://"+h.GatewayHost()+"/agents/"+agentName+"/certificate", bytes.NewReader(csr))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode
+}
+
+// registerFails agent 在 timeout 内不能注册成功
+func registerFails(t *testing.T, h *tunneltest.Harness, opt *agent.Option) {
+	t.Helper()
+
+	opt.GatewayHost = h.GatewayHost()
+	opt.Handler = http.NotFoundHandler()
+	opt.ReconnectInterval = 50 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_ = agent.NewAgent(opt).Serve(ctx)
+
+	if _, ok := h.Gateway.Tunnel(opt.AgentName); ok {
+		t.Fatalf("agent %s should not be registered", opt.AgentName)
+	}
+}
+
+func readSerial(t *testing.T, dir string) string {
+	t.Helper()
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "agent.crt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(b)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert.SerialNumber.String()
+}
+
+func TestBootstrap(t *testing.T) {
+	ca, err := gateway.NewCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("#bootstrap", func(t *testing.T) {
+		h, dirs := caHarness(t, ca,
+			&gateway.Option{BootstrapTokens: map[string]string{"huawei.secret": "huawei", "any.secret": ""}},
+			map[string]string{"huawei": "huawei.secret"})
+		h.StartAgent("huawei")
+
+		tunnel, _ := h.Gateway.Tunnel("huawei")
+		if cert := tunnel.Certificate(); cert == nil || cert.Subject.CommonName != "huawei" || gateway.TokenID(cert) != "huawei" {
+			t.Fatalf("unexpected certificate %+v", cert)
+		}
+
+		client := tlsClient(ca)
+		resp, err := client.Get(h.URL("huawei", "/"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("proxy status %d", resp.StatusCode)
+		}
+
+		// 证书已保存, 重启后不再需要 token
+		h.StopAgent("huawei")
+		h.StartAgent("huawei")
+
+		// token 只能使用一次, 且只能用于指定的 agent
+		if code := postCSR(t, client, h, "huawei", "huawei.secret"); code != http.StatusUnauthorized {
+			t.Fatalf("used token: status %d", code)
+		}
+		if code := postCSR(t, client, h, "tencent", "unknown.secret"); code != http.StatusUnauthorized {
+			t.Fatalf("unknown token: status %d", code)
+		}
+		if code := postCSR(t, client, h, "tencent", ""); code != http.StatusUnauthorized {
+			t.Fatalf("no token: status %d", code)
+		}
+		if code := postCSR(t, client, h, "tencent", "any.secret"); code != http.StatusOK {
+			t.Fatalf("unbound token: status %d", code)
+		}
+
+		// 吊销后不能再注册
+		tunnel, _ = h.Gateway.Tunnel("huawei")
+		h.StopAgent("huawei")
+		if err = h.Gateway.RevokeCertificate(tunnel.Certificate().SerialNumber); err != nil {
+			t.Fatal(err)
+		}
+		registerFails(t, h, &agent.Option{AgentName: "huawei", CACert: ca.CertPEM(), CertDir: dirs["huawei"]})
+	})
+
+	t.Run("#used token persisted", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "used-tokens.json")
+		tokens := map[string]string{"huawei.secret": "huawei"}
+		client := tlsClient(ca)
+
+		// gateway 重启后重新加载同样的 token, 已用的 token 仍然不能再次使用
+		for i, expect := range []int{http.StatusOK, http.StatusUnauthorized} {
+			used, err := gateway.LoadUsedTokens(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			h := tunneltest.New(t, &tunneltest.Option{
+				Gateway: &gateway.Option{CA: ca, BootstrapTokens: tokens, UsedTokens: used},
+			})
+			if code := postCSR(t, client, h, "huawei", "huawei.secret"); code != expect {
+				t.Fatalf("start %d: expect %d, got %d", i, expect, code)
+			}
+			h.StopGateway()
+		}
+	})
+
+	t.Run("#tokens file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "tokens")
+		content := "# agent tokens\nhuawei.secret=huawei\n\nany.secret=\n"
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		tokens, err := gateway.LoadBootstrapTokens(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expect := map[string]string{"huawei.secret": "huawei", "any.secret": ""}; !reflect.DeepEqual(tokens, expect) {
+			t.Fatalf("expect %v, got %v", expect, tokens)
+		}
+
+		if err = ioutil.WriteFile(path, []byte("secret=huawei\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = gateway.LoadBootstrapTokens(path); err == nil {
+			t.Fatal("token without id should be rejected")
+		}
+	})
+
+	t.Run("#certificate required", func(t *testing.T) {
+		h, _ := caHarness(t, ca, &gateway.Option{}, nil)
+
+		registerFails(t, h, &agent.Option{AgentName: "huawei", CACert: ca.CertPEM()})
+
+		// 其他 CA 签发的证书在握手时就会被拒绝
+		other, _ := gateway.NewCA()
+		h2, dirs := caHarness(t, other,
+			&gateway.Option{BootstrapTokens: map[string]string{"huawei.secret": ""}},
+			map[string]string{"huawei": "huawei.secret"})
+		h2.StartAgent("huawei")
+		registerFails(t, h, &agent.Option{AgentName: "huawei", CACert: ca.CertPEM(), CertDir: dirs["huawei"]})
+	})
+
+	t.Run("#renew", func(t *testing.T) {
+		h, dirs := caHarness(t, ca,
+			&gateway.Option{
+				AgentCertTTL:       3 * time.Second,
+				RevalidateInterval: 50 * time.Millisecond,
+				BootstrapTokens:    map[string]string{"huawei.secret": "huawei"},
+			},
+			map[string]string{"huawei": "huawei.secret"})
+		h.StartAgent("huawei")
+
+		tunnel, _ := h.Gateway.Tunnel("huawei")
+		original := tunnel.Certificate()
+		first := original.SerialNumber.String()
+
+		// 剩余有效期过去 2/3 时续期
+		deadline := time.Now().Add(tunneltest.DefaultWaitTimeout)
+		for readSerial(t, dirs["huawei"]) == first {
+			if time.Now().After(deadline) {
+				t.Fatal("certificate not renewed")
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+
+		// 旧证书过期后连接仍然有效, 按续期的证书校验
+		time.Sleep(time.Until(original.NotAfter) + 200*time.Millisecond)
+		if current, ok := h.Gateway.Tunnel("huawei"); !ok || current != tunnel {
+			t.Fatal("tunnel closed after the original certificate expired")
+		}
+		if serial := tunnel.Certificate().SerialNumber.String(); serial != readSerial(t, dirs["huawei"]) {
+			t.Fatalf("tunnel certificate %s not swapped", serial)
+		}
+
+		// 用续期的证书重新注册
+		h.StopAgent("huawei")
+		h.StartAgent("huawei")
+		tunnel, _ = h.Gateway.Tunnel("huawei")
+		if serial := tunnel.Certificate().SerialNumber.String(); serial == first {
+			t.Fatalf("registered with expired certificate %s", serial)
+		}
+	})
+}
@@ -0,0 +1,227 @@
+package gateway
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultAgentCertTTL = 24 * time.Hour
+
+	caValidity = 10 * 365 * 24 * time.Hour
+	// 证书中记录签发时使用的 bootstrap token id, 续期时沿用
+	bootstrapTokenOU = "bootstrap-token:"
+)
+
+// DefaultTLSHosts gateway 服务端证书默认包含的地址
+var DefaultTLSHosts = []string{"localhost", "127.0.0.1"}
+
+// CA gateway 内置的证书签发机构, 为 agent 签发客户端证书, 为 gateway 签发服务端证书
+type CA struct {
+	Cert *x509.Certificate
+	key  crypto.Signer
+}
+
+// NewCA 生成一个只在内存中的自签名 CA
+func NewCA() (*CA, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "k8s-tunnel-ca"},
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CA{Cert: cert, key: key}, nil
+}
+
+// LoadOrCreateCA 读取 PEM 格式的 CA 证书和私钥, 文件不存在时生成并写入, 私钥权限为 0600
+func LoadOrCreateCA(certFile, keyFile string) (*CA, error) {
+	certPEM, err := os.ReadFile(certFile)
+	if os.IsNotExist(err) {
+		ca, err := NewCA()
+		if err != nil {
+			return nil, err
+		}
+		keyPEM, err := EncodePrivateKey(ca.key)
+		if err != nil {
+			return nil, err
+		}
+		if err = os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+			return nil, err
+		}
+		if err = os.WriteFile(certFile, ca.CertPEM(), 0644); err != nil {
+			return nil, err
+		}
+		return ca, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("load ca %s: %v", certFile, err)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok || !cert.IsCA {
+		return nil, fmt.Errorf("load ca %s: not a ca certificate", certFile)
+	}
+
+	return &CA{Cert: cert, key: key}, nil
+}
+
+func (ca *CA) CertPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Cert.Raw})
+}
+
+func (ca *CA) Pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Cert)
+	return pool
+}
+
+// SignAgent 为 agent 签发客户端证书, CN 固定为 agentName, 不使用 csr 中的 subject
+func (ca *CA) SignAgent(csr *x509.CertificateRequest, agentName, tokenID string, ttl time.Duration) (*x509.Certificate, error) {
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("invalid csr: %v", err)
+	}
+	if csr.Subject.CommonName != "" && csr.Subject.CommonName != agentName {
+		return nil, fmt.Errorf("csr common name %q does not match agent %s", csr.Subject.CommonName, agentName)
+	}
+
+	subject := pkix.Name{CommonName: agentName}
+	if tokenID != "" {
+		subject.OrganizationalUnit = []string{bootstrapTokenOU + tokenID}
+	}
+
+	return ca.sign(&x509.Certificate{
+		Subject:     subject,
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, csr.PublicKey, ttl)
+}
+
+// ServingCert 为 gateway 签发服务端证书, hosts 为空时使用 DefaultTLSHosts
+func (ca *CA) ServingCert(hosts []string) (tls.Certificate, error) {
+	if len(hosts) == 0 {
+		hosts = DefaultTLSHosts
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	tmpl := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: hosts[0]},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	cert, err := ca.sign(tmpl, key.Public(), caValidity)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.Certificate{Certificate: [][]byte{cert.Raw, ca.Cert.Raw}, PrivateKey: key, Leaf: cert}, nil
+}
+
+func (ca *CA) sign(tmpl *x509.Certificate, pub crypto.PublicKey, ttl time.Duration) (*x509.Certificate, error) {
+	serial, err := newSerial()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tmpl.SerialNumber = serial
+	tmpl.NotBefore = now.Add(-time.Minute) // 容忍少量时钟偏差
+	tmpl.NotAfter = now.Add(ttl)
+	if tmpl.NotAfter.After(ca.Cert.NotAfter) {
+		tmpl.NotAfter = ca.Cert.NotAfter
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.Cert, pub, ca.key)
+	if err != nil {
+		return nil, err
+	}
+
+	return x509.ParseCertificate(der)
+}
+
+// TokenID 签发证书时使用的 bootstrap token id
+func TokenID(cert *x509.Certificate) string {
+	for _, ou := range cert.Subject.OrganizationalUnit {
+		if strings.HasPrefix(ou, bootstrapTokenOU) {
+			return strings.TrimPrefix(ou, bootstrapTokenOU)
+		}
+	}
+	return ""
+}
+
+// EncodePrivateKey 编码为 PKCS#8 PEM
+func EncodePrivateKey(key crypto.Signer) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+func newSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// ParseCSR 解析 PEM 格式的证书签名请求
+func ParseCSR(b []byte) (*x509.CertificateRequest, error) {
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, errors.New("expect a PEM encoded CERTIFICATE REQUEST")
+	}
+	return x509.ParseCertificateRequest(block.Bytes)
+}
@@ -0,0 +1,199 @@
+package gateway
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"k8s-tunnel/pkg/utils"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// CacheHeader 代理响应中标记是否命中 gateway 缓存, HIT / MISS / REVALIDATED
+	CacheHeader = "X-K8s-Tunnel-Cache"
+
+	DefaultOpenAPICacheTTL = 10 * time.Minute
+)
+
+// CacheRule 路径前缀对应的缓存时间, 前缀以 / 结尾时匹配其下所有路径, 否则只匹配该路径
+type CacheRule struct {
+	Prefix string
+	TTL    time.Duration
+}
+
+// DefaultCacheRules discovery 和 OpenAPI, ttl 为 0 的规则使用 Option.CacheTTL
+var DefaultCacheRules = []CacheRule{
+	{Prefix: "/version"},
+	{Prefix: "/api"},
+	{Prefix: "/apis"},
+	{Prefix: "/openapi/", TTL: DefaultOpenAPICacheTTL},
+	{Prefix: "/swagger.json", TTL: DefaultOpenAPICacheTTL},
+}
+
+type cacheEntry struct {
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+// responseCache 挂在 tunnel 上, agent 重连后 tunnel 重建, 缓存自然失效
+type responseCache struct {
+	mu      sync.Mutex
+	entries map[string]*cacheEntry // cacheKey
+}
+
+func newResponseCache() *responseCache {
+	return &responseCache{entries: map[string]*cacheEntry{}}
+}
+
+func (c *responseCache) get(key string) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	return e, ok
+}
+
+func (c *responseCache) set(key string, e *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[key] = e
+}
+
+// cacheTTL 返回 path 的缓存时间, 0 表示不缓存
+func (gw *Gateway) cacheTTL(request *http.Request, path string) time.Duration {
+	if gw.opt.CacheTTL <= 0 || request.Method != http.MethodGet {
+		return 0
+	}
+	// 模拟其他用户的请求结果可能不同, 不走缓存
+	for k := range request.Header {
+		if strings.HasPrefix(k, "Impersonate-") {
+			return 0
+		}
+	}
+
+	for _, rule := range gw.opt.CacheRules {
+		if !matchCacheRule(rule.Prefix, path) {
+			continue
+		}
+		if rule.TTL > 0 {
+			return rule.TTL
+		}
+		return gw.opt.CacheTTL
+	}
+
+	return 0
+}
+
+func matchCacheRule(prefix, path string) bool {
+	if strings.HasSuffix(prefix, "/") {
+		return strings.HasPrefix(path, prefix)
+	}
+	if path == prefix {
+		return true
+	}
+
+	// /api 和 /apis 只缓存 group version 的 discovery, 不缓存资源
+	rest := strings.TrimPrefix(path, prefix+"/")
+	if rest == path {
+		return false
+	}
+	switch prefix {
+	case "/api":
+		return !strings.Contains(rest, "/")
+	case "/apis":
+		return strings.Count(rest, "/") <= 1
+	}
+	return false
+}
+
+// cachedRequest 在开启缓存时代理请求, 返回 false 表示请求不可缓存, 由调用方正常代理
+func (gw *Gateway) cachedRequest(writer http.ResponseWriter, request *http.Request, tunnel *Tunnel) bool {
+	path := strings.TrimPrefix(request.URL.Path, "/proxies/"+tunnel.Name)
+	ttl := gw.cacheTTL(request, path)
+	if ttl <= 0 {
+		return false
+	}
+
+	key := cacheKey(request, path)
+	cached, ok := tunnel.cache.get(key)
+	if ok && time.Now().Before(cached.expires) {
+		writeCached(writer, cached, "HIT")
+		return true
+	}
+	if ok {
+		if etag := cached.header.Get("ETag"); etag != "" {
+			request.Header.Set("If-None-Match", etag)
+		}
+	}
+
+	resp, err := tunnel.HandleRequest(request)
+	if err != nil {
+		if utils.IsBrokenPipe(err) {
+			tunnel.CloseWithReason(fmt.Sprintf("write error: %v", err))
+		}
+		gw.proxyErr(writer, request, err)
+		return true
+	}
+	defer resp.Body.Close()
+
+	if ok && resp.StatusCode == http.StatusNotModified {
+		entry := &cacheEntry{header: cached.header, body: cached.body, expires: time.Now().Add(ttl)}
+		tunnel.cache.set(key, entry)
+		writeCached(writer, entry, "REVALIDATED")
+		return true
+	}
+	if resp.StatusCode != http.StatusOK || !cacheable(resp.Header) {
+		writer.Header().Set(CacheHeader, "MISS")
+		gw.response(resp, writer)
+		return true
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		gw.proxyErr(writer, request, err)
+		return true
+	}
+	entry := &cacheEntry{header: resp.Header.Clone(), body: body, expires: time.Now().Add(ttl)}
+	tunnel.cache.set(key, entry)
+	writeCached(writer, entry, "MISS")
+
+	return true
+}
+
+// cacheKey 响应随 Accept 和 Accept-Encoding 变化; 不同调用方的结果可能不同, 按 Authorization 隔离,
+// 只保存摘要, 不把凭据留在内存中
+func cacheKey(request *http.Request, path string) string {
+	key := request.Method + " " + path + "?" + request.URL.RawQuery +
+		" " + request.Header.Get("Accept") + " " + request.Header.Get("Accept-Encoding")
+	if auth := request.Header.Get("Authorization"); auth != "" {
+		sum := sha256.Sum256([]byte(auth))
+		key += " " + hex.EncodeToString(sum[:])
+	}
+
+	return key
+}
+
+// 和具体用户相关的响应不缓存
+func cacheable(header http.Header) bool {
+	if header.Get("Set-Cookie") != "" {
+		return false
+	}
+	cc := strings.ToLower(header.Get("Cache-Control"))
+	return !strings.Contains(cc, "private") && !strings.Contains(cc, "no-store")
+}
+
+func writeCached(writer http.ResponseWriter, e *cacheEntry, status string) {
+	for k, vv := range e.header {
+		writer.Header()[k] = vv
+	}
+	writer.Header().Set(CacheHeader, status)
+	writer.WriteHeader(http.StatusOK)
+	_, _ = bytes.NewReader(e.body).WriteTo(writer)
+}
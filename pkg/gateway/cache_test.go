@@ -0,0 +1,172 @@
+package gateway_test
+
+import (
+	"io/ioutil"
+	"k8s-tunnel/pkg/gateway"
+	"k8s-tunnel/pkg/tunneltest"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 记录每个路径的请求次数, 支持 If-None-Match
+type countingUpstream struct {
+	mu     sync.Mutex
+	counts map[string]int
+	etags  int
+}
+
+func (u *countingUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u.mu.Lock()
+	u.counts[r.URL.Path]++
+	if r.Header.Get("If-None-Match") != "" {
+		u.etags++
+	}
+	u.mu.Unlock()
+
+	if r.Header.Get("If-None-Match") == `"v1"` {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("ETag", `"v1"`)
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write([]byte(`{"path":"` + r.URL.Path + `"}`))
+}
+
+func (u *countingUpstream) count(path string) int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.counts[path]
+}
+
+func cachedGet(t *testing.T, h *tunneltest.Harness, path string, header http.Header) string {
+	t.Helper()
+
+	req, _ := http.NewRequest(http.MethodGet, h.URL("cache", path), nil)
+	for k, vv := range header {
+		req.Header[k] = vv
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != `{"path":"`+path+`"}` {
+		t.Fatalf("unexpected response %d %s", resp.StatusCode, body)
+	}
+
+	return resp.Header.Get(gateway.CacheHeader)
+}
+
+func newCacheHarness(t *testing.T, ttl time.Duration) (*tunneltest.Harness, *countingUpstream) {
+	upstream := &countingUpstream{counts: map[string]int{}}
+	h := tunneltest.New(t, &tunneltest.Option{
+		Gateway:  &gateway.Option{CacheTTL: ttl},
+		Upstream: func(string) http.Handler { return upstream },
+	})
+	h.StartAgent("cache")
+
+	return h, upstream
+}
+
+func TestResponseCache(t *testing.T) {
+	t.Run("#discovery", func(t *testing.T) {
+		h, upstream := newCacheHarness(t, time.Minute)
+
+		for _, path := range []string{"/api", "/apis", "/api/v1", "/apis/apps/v1", "/openapi/v2"} {
+			if status := cachedGet(t, h, path, nil); status != "MISS" {
+				t.Fatalf("%s: expect MISS, got %s", path, status)
+			}
+			if status := cachedGet(t, h, path, nil); status != "HIT" {
+				t.Fatalf("%s: expect HIT, got %s", path, status)
+			}
+			if n := upstream.count(path); n != 1 {
+				t.Fatalf("%s: expect 1 upstream request, got %d", path, n)
+			}
+		}
+	})
+
+	t.Run("#resources not cached", func(t *testing.T) {
+		h, upstream := newCacheHarness(t, time.Minute)
+
+		for i := 0; i < 2; i++ {
+			if status := cachedGet(t, h, "/api/v1/pods", nil); status != "" {
+				t.Fatalf("expect no cache, got %s", status)
+			}
+		}
+		if n := upstream.count("/api/v1/pods"); n != 2 {
+			t.Fatalf("expect 2 upstream requests, got %d", n)
+		}
+	})
+
+	t.Run("#impersonation bypass", func(t *testing.T) {
+		h, upstream := newCacheHarness(t, time.Minute)
+
+		cachedGet(t, h, "/apis", nil)
+		header := http.Header{"Impersonate-User": []string{"alice"}}
+		if status := cachedGet(t, h, "/apis", header); status != "" {
+			t.Fatalf("expect bypass, got %s", status)
+		}
+		if n := upstream.count("/apis"); n != 2 {
+			t.Fatalf("expect 2 upstream requests, got %d", n)
+		}
+	})
+
+	t.Run("#keyed by caller and encoding", func(t *testing.T) {
+		h, upstream := newCacheHarness(t, time.Minute)
+
+		alice := http.Header{"Authorization": []string{"Bearer alice"}}
+		bob := http.Header{"Authorization": []string{"Bearer bob"}}
+		identity := http.Header{"Authorization": []string{"Bearer alice"}, "Accept-Encoding": []string{"identity"}}
+		for i, c := range []struct {
+			header http.Header
+			expect string
+		}{
+			{alice, "MISS"},
+			{alice, "HIT"},
+			{bob, "MISS"},
+			{identity, "MISS"},
+			{bob, "HIT"},
+		} {
+			if status := cachedGet(t, h, "/apis", c.header); status != c.expect {
+				t.Fatalf("request %d: expect %s, got %s", i, c.expect, status)
+			}
+		}
+		if n := upstream.count("/apis"); n != 3 {
+			t.Fatalf("expect 3 upstream requests, got %d", n)
+		}
+	})
+
+	t.Run("#etag revalidation", func(t *testing.T) {
+		h, upstream := newCacheHarness(t, 50*time.Millisecond)
+
+		cachedGet(t, h, "/apis", nil)
+		time.Sleep(100 * time.Millisecond)
+		if status := cachedGet(t, h, "/apis", nil); status != "REVALIDATED" {
+			t.Fatalf("expect REVALIDATED, got %s", status)
+		}
+		upstream.mu.Lock()
+		defer upstream.mu.Unlock()
+		if upstream.etags != 1 {
+			t.Fatalf("expect 1 conditional request, got %d", upstream.etags)
+		}
+	})
+
+	t.Run("#invalidated on reconnect", func(t *testing.T) {
+		h, upstream := newCacheHarness(t, time.Minute)
+
+		cachedGet(t, h, "/apis", nil)
+		h.StopAgent("cache")
+		h.StartAgent("cache")
+		if status := cachedGet(t, h, "/apis", nil); status != "MISS" {
+			t.Fatalf("expect MISS after reconnect, got %s", status)
+		}
+		if n := upstream.count("/apis"); n != 2 {
+			t.Fatalf("expect 2 upstream requests, got %d", n)
+		}
+	})
+}
@@ -0,0 +1,82 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+	"k8s-tunnel/pkg/protocol"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// 关闭 tunnel 时发给 agent 的原因
+const reasonShuttingDown = "gateway shutting down"
+
+var errDraining = errors.New("gateway is shutting down")
+
+// beginRequest 记录进行中的代理请求, 下线中返回 false. 先计数再检查状态, Drain 不会漏掉已经放行的请求
+func (gw *Gateway) beginRequest() (func(), bool) {
+	gw.inflight.Add()
+	done := gw.inflight.Done
+	if gw.Draining() {
+		done()
+		return nil, false
+	}
+
+	return done, true
+}
+
+// Draining 是否已经开始下线
+func (gw *Gateway) Draining() bool {
+	return atomic.LoadInt32(&gw.draining) == 1
+}
+
+// Drain 优雅下线: 拒绝新的代理请求和注册, 通知 agent 到其他 gateway 重新注册,
+// 等待进行中的请求完成, 最后关闭所有 tunnel. ctx 结束时不再等待
+func (gw *Gateway) Drain(ctx context.Context) {
+	if !atomic.CompareAndSwapInt32(&gw.draining, 0, 1) {
+		return
+	}
+	logrus.Infof("draining, %d requests in flight", gw.inflight.Count())
+
+	for _, t := range gw.Tunnels() {
+		if err := t.goAway(); err != nil {
+			logrus.Warnf("%s send goaway error. err:%v", t.Name, err)
+		}
+	}
+
+	if gw.inflight.Wait(ctx) {
+		logrus.Infof("all in-flight requests finished")
+	} else {
+		logrus.Warnf("drain timeout, %d requests still in flight", gw.inflight.Count())
+	}
+
+	for _, t := range gw.Tunnels() {
+		t.goingAway()
+	}
+}
+
+// goAway 通知 agent 不会再有新的请求, 旧版本的 agent 不支持时什么都不做
+func (t *Tunnel) goAway() error {
+	if !t.Session.Has(protocol.FeatureGoAway) {
+		return nil
+	}
+
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+
+	return t.conn.WriteJSON(&protocol.Message{Type: protocol.MessageGoAway})
+}
+
+// goingAway 发送 1001 关闭帧后关闭 tunnel, agent 收到后立即重连
+func (t *Tunnel) goingAway() {
+	msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, reasonShuttingDown)
+	_ = t.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	t.CloseWithReason(reasonShuttingDown)
+}
+
+func drainingErr() *StatusErr {
+	return NewStatusErr(http.StatusServiceUnavailable, errDraining).WithRetryAfter(time.Second)
+}
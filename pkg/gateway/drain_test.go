@@ -0,0 +1,97 @@
+package gateway_test
+
+import (
+	"context"
+	"k8s-tunnel/pkg/gateway"
+	"k8s-tunnel/pkg/tunneltest"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDrain(t *testing.T) {
+	t.Run("#wait in flight", func(t *testing.T) {
+		entered, release := make(chan struct{}, 1), make(chan struct{})
+		h := tunneltest.New(t, &tunneltest.Option{Upstream: blockingUpstream(entered, release)})
+		h.StartAgent("huawei")
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		events := h.Gateway.Subscribe(ctx)
+
+		codeCh := make(chan int, 1)
+		go func() {
+			resp, err := http.Get(h.URL("huawei", "/block"))
+			if err != nil {
+				codeCh <- 0
+				return
+			}
+			resp.Body.Close()
+			codeCh <- resp.StatusCode
+		}()
+		<-entered
+
+		drained := make(chan struct{})
+		go func() {
+			defer close(drained)
+			drainCtx, cancel := context.WithTimeout(context.Background(), tunneltest.DefaultWaitTimeout)
+			defer cancel()
+			h.Gateway.Drain(drainCtx)
+		}()
+		time.Sleep(100 * time.Millisecond)
+
+		// 新的请求和探针立即失败, 进行中的请求不受影响
+		if resp, b := getText(t, h.URL("huawei", "/")); resp != http.StatusServiceUnavailable || !strings.Contains(b, "shutting down") {
+			t.Fatalf("new request during drain: %d %s", resp, b)
+		}
+		if code, body := getText(t, "http://"+h.GatewayHost()+"/readyz"); code != http.StatusServiceUnavailable || !strings.Contains(body, "[-]shutdown failed") {
+			t.Fatalf("readyz during drain: %d %q", code, body)
+		}
+		select {
+		case <-drained:
+			t.Fatal("drain returned with requests in flight")
+		default:
+		}
+
+		close(release)
+		if code := <-codeCh; code != http.StatusOK {
+			t.Fatalf("in-flight request status %d", code)
+		}
+		<-drained
+		if event := waitEvent(t, events, gateway.EventTunnelClosed); event.Message != "gateway shutting down" {
+			t.Fatalf("unexpected close %+v", event)
+		}
+
+		// agent 不能再注册到下线中的 gateway
+		time.Sleep(5 * tunneltest.DefaultReconnectInterval)
+		if _, ok := h.Gateway.Tunnel("huawei"); ok {
+			t.Fatal("agent registered to draining gateway")
+		}
+	})
+
+	t.Run("#timeout", func(t *testing.T) {
+		entered, release := make(chan struct{}, 1), make(chan struct{})
+		defer close(release)
+		h := tunneltest.New(t, &tunneltest.Option{Upstream: blockingUpstream(entered, release)})
+		h.StartAgent("huawei")
+
+		go func() {
+			resp, err := http.Get(h.URL("huawei", "/block"))
+			if err == nil {
+				resp.Body.Close()
+			}
+		}()
+		<-entered
+
+		start := time.Now()
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		h.Gateway.Drain(ctx)
+		if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > time.Second {
+			t.Fatalf("drain returned after %s", elapsed)
+		}
+		if _, ok := h.Gateway.Tunnel("huawei"); ok {
+			t.Fatal("tunnel not closed after drain timeout")
+		}
+	})
+}
@@ -0,0 +1,333 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultWebhookRetries       = 3
+	DefaultWebhookRetryInterval = time.Second
+	DefaultWebhookTimeout       = 10 * time.Second
+	DefaultFlapThreshold        = 5
+	DefaultFlapWindow           = 5 * time.Minute
+	DefaultPingLatencyThreshold = time.Second
+
+	// webhook 请求头
+	EventHeader     = "X-K8s-Tunnel-Event"
+	DeliveryHeader  = "X-K8s-Tunnel-Delivery"
+	SignatureHeader = "X-K8s-Tunnel-Signature"
+
+	// 每个 SSE 订阅者缓存的事件数, 消费不及时的事件会被丢弃
+	subscriberBuffer = 64
+	// SSE 保活注释的间隔, 避免被中间代理断开
+	sseKeepAlive = 15 * time.Second
+)
+
+type EventType string
+
+const (
+	EventTunnelOpened  EventType = "tunnel.opened"
+	EventTunnelClosed  EventType = "tunnel.closed"
+	EventAgentFlapping EventType = "agent.flapping" // FlapWindow 内注册次数达到 FlapThreshold
+	EventPingDegraded  EventType = "ping.degraded"  // ping 延迟超过 PingLatencyThreshold
+	EventPingRecovered EventType = "ping.recovered" // ping 延迟恢复
+)
+
+type Event struct {
+	ID            string    `json:"id"`
+	Type          EventType `json:"type"`
+	Agent         string    `json:"agent"`
+	Time          time.Time `json:"time"`
+	Message       string    `json:"message,omitempty"`       // 关闭原因等说明
+	LatencyMillis float64   `json:"latencyMillis,omitempty"` // ping 延迟
+}
+
+// Webhook 接收事件的 http 地址, 事件以 json POST 发送, 失败后按指数退避重试
+type Webhook struct {
+	URL string `json:"url"`
+	// Secret 不为空时用 HMAC-SHA256 对 body 签名, 放在 SignatureHeader 中
+	Secret string `json:"secret,omitempty"`
+	// Events 订阅的事件类型, 为空时接收所有事件
+	Events []EventType `json:"events,omitempty"`
+}
+
+func (w *Webhook) accept(typ EventType) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, e := range w.Events {
+		if e == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// SignWebhook 返回 body 的签名, 格式为 sha256=<hex>, 接收方用同样的 secret 校验
+func SignWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// eventHub 把事件分发给 SSE 订阅者和 webhook
+type eventHub struct {
+	opt    *Option
+	client *http.Client
+
+	mu          sync.Mutex
+	subscribers map[chan Event]struct{}
+	opens       map[string][]time.Time // agentName: FlapWindow 内的注册时间
+	flapping    map[string]time.Time   // agentName: 上次发出 flapping 事件的时间
+}
+
+func newEventHub(opt *Option) *eventHub {
+	return &eventHub{
+		opt:         opt,
+		client:      &http.Client{Timeout: opt.WebhookTimeout},
+		subscribers: map[chan Event]struct{}{},
+		opens:       map[string][]time.Time{},
+		flapping:    map[string]time.Time{},
+	}
+}
+
+func (h *eventHub) publish(event Event) {
+	event.ID = uuid.New().String()
+	event.Time = time.Now()
+
+	h.mu.Lock()
+	for ch := range h.subscribers {
+		select {
+		case ch <- event:
+		default:
+			logrus.Warnf("event subscriber is too slow, drop event %s %s", event.Type, event.Agent)
+		}
+	}
+	h.mu.Unlock()
+
+	for i := range h.opt.Webhooks {
+		if webhook := h.opt.Webhooks[i]; webhook.accept(event.Type) {
+			go h.deliver(&webhook, event)
+		}
+	}
+}
+
+func (h *eventHub) subscribe() chan Event {
+	ch := make(chan Event, subscriberBuffer)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.subscribers[ch] = struct{}{}
+	return ch
+}
+
+func (h *eventHub) unsubscribe(ch chan Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.subscribers, ch)
+}
+
+// deliver 发送到 webhook, 网络错误, 5xx 和 429 时重试
+func (h *eventHub) deliver(webhook *Webhook, event Event) {
+	body, _ := json.Marshal(event)
+	interval := h.opt.WebhookRetryInterval
+
+	for attempt := 0; ; attempt++ {
+		err := h.post(webhook, event, body)
+		if err == nil {
+			return
+		}
+		if attempt >= h.opt.WebhookRetries {
+			logrus.Errorf("deliver event %s %s to %s failed, give up. err:%v", event.Type, event.Agent, webhook.URL, err)
+			return
+		}
+		logrus.Warnf("deliver event %s %s to %s error, retry in %s. err:%v", event.Type, event.Agent, webhook.URL, interval, err)
+		time.Sleep(interval)
+		interval *= 2
+	}
+}
+
+func (h *eventHub) post(webhook *Webhook, event Event, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, string(event.Type))
+	req.Header.Set(DeliveryHeader, event.ID)
+	if webhook.Secret != "" {
+		req.Header.Set(SignatureHeader, SignWebhook(webhook.Secret, body))
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		return fmt.Errorf("status %d", resp.StatusCode)
+	default:
+		// 其他 4xx 重试也不会成功
+		logrus.Errorf("deliver event %s %s to %s rejected, status %d", event.Type, event.Agent, webhook.URL, resp.StatusCode)
+		return nil
+	}
+}
+
+// opened 记录注册时间, FlapWindow 内注册次数达到 FlapThreshold 时返回 true, 每个窗口只报告一次
+func (h *eventHub) opened(agentName string, at time.Time) (int, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	since := at.Add(-h.opt.FlapWindow)
+	opens := append(h.opens[agentName], at)
+	for len(opens) > 0 && opens[0].Before(since) {
+		opens = opens[1:]
+	}
+	h.opens[agentName] = opens
+
+	if len(opens) < h.opt.FlapThreshold || h.flapping[agentName].After(since) {
+		return len(opens), false
+	}
+	h.flapping[agentName] = at
+
+	return len(opens), true
+}
+
+func (gw *Gateway) tunnelOpened(t *Tunnel) {
+	gw.events.publish(Event{Type: EventTunnelOpened, Agent: t.Name})
+
+	if count, ok := gw.events.opened(t.Name, t.ConnectedAt); ok {
+		logrus.Warnf("%s is flapping, registered %d times in %s", t.Name, count, gw.opt.FlapWindow)
+		gw.events.publish(Event{
+			Type:    EventAgentFlapping,
+			Agent:   t.Name,
+			Message: fmt.Sprintf("registered %d times in %s", count, gw.opt.FlapWindow),
+		})
+	}
+}
+
+func (gw *Gateway) tunnelClosed(t *Tunnel) {
+	gw.events.publish(Event{Type: EventTunnelClosed, Agent: t.Name, Message: t.CloseReason()})
+}
+
+// observeLatency 在 pong 中调用, 延迟越过阈值时发出事件
+func (t *Tunnel) observeLatency(latency time.Duration) {
+	t.latency.Store(latency)
+
+	threshold := t.gateway.opt.PingLatencyThreshold
+	degraded := latency > threshold
+	if degraded == t.degraded {
+		return
+	}
+	t.degraded = degraded
+
+	event := Event{Type: EventPingRecovered, Agent: t.Name, LatencyMillis: float64(latency) / float64(time.Millisecond)}
+	if degraded {
+		event.Type = EventPingDegraded
+		event.Message = fmt.Sprintf("ping latency %s exceeds %s", latency, threshold)
+		logrus.Warnf("%s %s", t.Name, event.Message)
+	}
+	t.gateway.events.publish(event)
+}
+
+// PingLatency 最近一次 ping 的往返时间, 还没有收到 pong 时为 0
+func (t *Tunnel) PingLatency() time.Duration {
+	latency, _ := t.latency.Load().(time.Duration)
+	return latency
+}
+
+// GET /events?agent=huawei&type=tunnel.opened,tunnel.closed
+//
+// server-sent events, 每个事件的 event 为类型, data 为 json
+func (gw *Gateway) eventsHandler(writer http.ResponseWriter, request *http.Request) {
+	if err := gw.authenticateAdmin(request); err != nil {
+		RESP(writer, NewStatusErr(http.StatusUnauthorized, err))
+		return
+	}
+	flusher, ok := writer.(http.Flusher)
+	if !ok {
+		RESP(writer, NewStatusErr(http.StatusInternalServerError, fmt.Errorf("streaming is not supported")))
+		return
+	}
+
+	query := request.URL.Query()
+	agentName := query.Get("agent")
+	filter := &Webhook{}
+	for _, typ := range strings.Split(query.Get("type"), ",") {
+		if typ != "" {
+			filter.Events = append(filter.Events, EventType(typ))
+		}
+	}
+
+	ch := gw.events.subscribe()
+	defer gw.events.unsubscribe(ch)
+
+	writer.Header().Set("Content-Type", "text/event-stream")
+	writer.Header().Set("Cache-Control", "no-cache")
+	writer.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ticker := time.NewTicker(sseKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case event := <-ch:
+			if agentName != "" && event.Agent != agentName || !filter.accept(event.Type) {
+				continue
+			}
+			data, _ := json.Marshal(event)
+			if _, err := fmt.Fprintf(writer, "id: %s\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if _, err := fmt.Fprint(writer, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case <-request.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// Subscribe 订阅 gateway 的事件, ctx 结束后关闭返回的 chan
+func (gw *Gateway) Subscribe(ctx context.Context) <-chan Event {
+	ch := gw.events.subscribe()
+	out := make(chan Event)
+	go func() {
+		defer close(out)
+		defer gw.events.unsubscribe(ch)
+		for {
+			select {
+			case event := <-ch:
+				select {
+				case out <- event:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out
+}
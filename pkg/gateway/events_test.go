@@ -0,0 +1,143 @@
+package gateway_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"k8s-tunnel/pkg/gateway"
+	"k8s-tunnel/pkg/tunneltest"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitEvent 等待类型为 typ 的事件, 忽略其他事件
+func waitEvent(t *testing.T, events <-chan gateway.Event, typ gateway.EventType) gateway.Event {
+	t.Helper()
+
+	timeout := time.After(tunneltest.DefaultWaitTimeout)
+	for {
+		select {
+		case event := <-events:
+			if event.Type == typ {
+				return event
+			}
+		case <-timeout:
+			t.Fatalf("no %s event", typ)
+		}
+	}
+}
+
+func TestEvents(t *testing.T) {
+	t.Run("#webhook", func(t *testing.T) {
+		var (
+			mu       sync.Mutex
+			attempts int
+		)
+		events := make(chan gateway.Event, 10)
+		webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			if r.Header.Get(gateway.SignatureHeader) != gateway.SignWebhook("secret", body) {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			// 第一次投递失败, 由重试送达
+			mu.Lock()
+			attempts++
+			first := attempts == 1
+			mu.Unlock()
+			if first {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+
+			event := gateway.Event{}
+			_ = json.Unmarshal(body, &event)
+			if event.ID != r.Header.Get(gateway.DeliveryHeader) || string(event.Type) != r.Header.Get(gateway.EventHeader) {
+				t.Errorf("unexpected headers %v for %+v", r.Header, event)
+			}
+			events <- event
+		}))
+		defer webhook.Close()
+
+		h := tunneltest.New(t, &tunneltest.Option{Gateway: &gateway.Option{
+			Webhooks: []gateway.Webhook{{
+				URL:    webhook.URL,
+				Secret: "secret",
+				Events: []gateway.EventType{gateway.EventTunnelOpened, gateway.EventTunnelClosed},
+			}},
+			WebhookRetryInterval: 10 * time.Millisecond,
+		}})
+		h.StartAgent("huawei")
+		if event := waitEvent(t, events, gateway.EventTunnelOpened); event.Agent != "huawei" {
+			t.Fatalf("unexpected event %+v", event)
+		}
+		h.StopAgent("huawei")
+		if event := waitEvent(t, events, gateway.EventTunnelClosed); event.Agent != "huawei" || event.Message == "" {
+			t.Fatalf("unexpected event %+v", event)
+		}
+	})
+
+	t.Run("#sse", func(t *testing.T) {
+		h := tunneltest.New(t, &tunneltest.Option{Gateway: &gateway.Option{AuthenticateAdmin: allowAdmin}})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+h.GatewayHost()+"/events?agent=huawei&type=tunnel.opened", nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+			t.Fatalf("content type %s", ct)
+		}
+
+		h.StartAgent("tencent")
+		h.StartAgent("huawei")
+
+		// 只收到过滤后的事件
+		var lines []string
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() && scanner.Text() != "" {
+			lines = append(lines, scanner.Text())
+		}
+		if len(lines) != 3 || lines[1] != "event: tunnel.opened" || !strings.HasPrefix(lines[2], "data: ") {
+			t.Fatalf("unexpected event %q", lines)
+		}
+		event := gateway.Event{}
+		if err = json.Unmarshal([]byte(strings.TrimPrefix(lines[2], "data: ")), &event); err != nil || event.Agent != "huawei" {
+			t.Fatalf("unexpected data %q, err:%v", lines[2], err)
+		}
+	})
+
+	t.Run("#flapping and latency", func(t *testing.T) {
+		h := tunneltest.New(t, &tunneltest.Option{Gateway: &gateway.Option{
+			FlapThreshold:        2,
+			PingInterval:         20 * time.Millisecond,
+			PingLatencyThreshold: time.Nanosecond,
+		}})
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		events := h.Gateway.Subscribe(ctx)
+
+		h.StartAgent("huawei")
+		h.StopAgent("huawei")
+		h.StartAgent("huawei")
+		if event := waitEvent(t, events, gateway.EventAgentFlapping); event.Agent != "huawei" {
+			t.Fatalf("unexpected event %+v", event)
+		}
+
+		if event := waitEvent(t, events, gateway.EventPingDegraded); event.LatencyMillis <= 0 {
+			t.Fatalf("unexpected event %+v", event)
+		}
+		tunnel, _ := h.Gateway.Tunnel("huawei")
+		if tunnel.PingLatency() <= 0 {
+			t.Fatal("ping latency not measured")
+		}
+	})
+}
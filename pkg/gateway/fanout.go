@@ -0,0 +1,255 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"k8s-tunnel/pkg/e2e"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultFanoutConcurrency = 10
+	DefaultFanoutTimeout     = 30 * time.Second
+
+	// ClusterAnnotation fan-out 结果中标记每个对象来自哪个集群
+	ClusterAnnotation = "k8s-tunnel.io/cluster"
+
+	fanoutPrefix = "/fanout"
+)
+
+// FanoutResult 单个集群的执行结果
+type FanoutResult struct {
+	Cluster string              `json:"cluster"`
+	Code    int                 `json:"code"`
+	Reason  metav1.StatusReason `json:"reason,omitempty"` // gateway 产生的错误的原因, 如 Timeout
+	Items   int                 `json:"items"`
+	Error   string              `json:"error,omitempty"`
+}
+
+// FanoutList 合并后的 List, clusters 中是每个集群的结果, 部分失败时也会返回成功的部分
+type FanoutList struct {
+	APIVersion string                   `json:"apiVersion"`
+	Kind       string                   `json:"kind"`
+	Metadata   map[string]interface{}   `json:"metadata"`
+	Items      []map[string]interface{} `json:"items"`
+	Clusters   []*FanoutResult          `json:"clusters"`
+}
+
+// GET /fanout/api/v1/pods?agentSelector=env=prod&fieldSelector=status.phase=Failed
+// 对所有匹配 agentSelector 的 agent 并发执行同一个只读请求, 合并返回
+func (gw *Gateway) fanoutHandler(writer http.ResponseWriter, request *http.Request) {
+	if err := gw.authenticate(request); err != nil {
+		RESPStatus(writer, NewStatusErr(http.StatusUnauthorized, err))
+		return
+	}
+	if request.Method != http.MethodGet {
+		RESPStatus(writer, NewStatusErr(http.StatusMethodNotAllowed, fmt.Errorf("fanout only supports GET")))
+		return
+	}
+	done, ok := gw.beginRequest()
+	if !ok {
+		RESPStatus(writer, drainingErr())
+		return
+	}
+	defer done()
+
+	query := request.URL.Query()
+	selector, err := labels.Parse(query.Get("agentSelector"))
+	if err != nil {
+		RESPStatus(writer, NewStatusErr(http.StatusBadRequest, err))
+		return
+	}
+	query.Del("agentSelector")
+	// 每个集群有各自的分页游标, 合并后无法继续翻页, 只支持一次返回全部结果
+	if limit := query.Get("limit"); (limit != "" && limit != "0") || query.Get("continue") != "" {
+		RESPStatus(writer, NewStatusErr(http.StatusBadRequest, errors.New("fanout does not support limit and continue")))
+		return
+	}
+	// 密文的响应无法合并
+	if e2e.IsSealed(request.Header) {
+		RESPStatus(writer, NewStatusErr(http.StatusBadRequest, errors.New("fanout does not support end-to-end encrypted requests")))
+		return
+	}
+
+	path := strings.TrimPrefix(request.URL.Path, fanoutPrefix)
+	if path == "" {
+		RESPStatus(writer, NewStatusErr(http.StatusBadRequest, fmt.Errorf("kubernetes api path is required")))
+		return
+	}
+
+	tunnels := gw.SelectTunnels(selector)
+	results := make([]*fanoutResponse, len(tunnels))
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, gw.opt.FanoutConcurrency)
+	for i, tunnel := range tunnels {
+		wg.Add(1)
+		go func(i int, tunnel *Tunnel) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			results[i] = gw.fanoutOne(request, tunnel, path, query.Encode())
+		}(i, tunnel)
+	}
+	wg.Wait()
+
+	list := mergeFanout(results)
+	code := http.StatusOK
+	if len(tunnels) > 0 && allFailed(list.Clusters) {
+		code = http.StatusBadGateway
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(code)
+	_ = json.NewEncoder(writer).Encode(list)
+}
+
+type fanoutResponse struct {
+	result *FanoutResult
+	body   map[string]interface{}
+}
+
+func (gw *Gateway) fanoutOne(request *http.Request, tunnel *Tunnel, path, rawQuery string) *fanoutResponse {
+	ret := &fanoutResponse{result: &FanoutResult{Cluster: tunnel.Name}}
+
+	release, statusErr := gw.limit(request, tunnel.Name)
+	if statusErr != nil {
+		ret.result.fail(statusErr)
+		return ret
+	}
+	defer release()
+
+	ctx, cancel := context.WithTimeout(request.Context(), gw.opt.FanoutTimeout)
+	defer cancel()
+
+	u := "/proxies/" + tunnel.Name + path
+	if rawQuery != "" {
+		u += "?" + rawQuery
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		ret.result.Error = err.Error()
+		return ret
+	}
+	req.Host = request.Host
+	// 与代理请求一样转发全部请求头, 包括 Impersonate-*
+	req.Header = request.Header.Clone()
+	// 合并需要解析未压缩的 json
+	req.Header.Set("Accept", "application/json")
+	req.Header.Del("Accept-Encoding")
+
+	resp, err := tunnel.HandleRequest(req)
+	if err != nil {
+		ret.result.fail(gw.fanoutErr(tunnel.Name, err))
+		return ret
+	}
+	defer resp.Body.Close()
+
+	ret.result.Code = resp.StatusCode
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		ret.result.Error = err.Error()
+		return ret
+	}
+
+	body := map[string]interface{}{}
+	if err = json.Unmarshal(b, &body); err != nil {
+		ret.result.Error = fmt.Sprintf("invalid json response: %v", err)
+		return ret
+	}
+	if resp.StatusCode/100 != 2 {
+		ret.result.Error = fmt.Sprintf("%v", body["message"])
+		return ret
+	}
+
+	ret.body = body
+	return ret
+}
+
+// fanoutErr 与 proxyErr 一样, 单个集群超时返回 504, 其他错误返回 503
+func (gw *Gateway) fanoutErr(agentName string, err error) *StatusErr {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return NewStatusErr(http.StatusGatewayTimeout,
+			fmt.Errorf("timeout waiting for agent %s after %s", agentName, gw.opt.FanoutTimeout))
+	}
+	return NewStatusErr(http.StatusServiceUnavailable, fmt.Errorf("agent %s unavailable: %v", agentName, err))
+}
+
+func (r *FanoutResult) fail(err *StatusErr) {
+	r.Code = err.Code
+	r.Reason = statusReason(err.Code)
+	r.Error = err.Msg
+}
+
+// mergeFanout 合并各集群返回的 List, 单个对象当作只有一个元素的 List
+func mergeFanout(responses []*fanoutResponse) *FanoutList {
+	list := &FanoutList{
+		APIVersion: "v1",
+		Kind:       "List",
+		Metadata:   map[string]interface{}{},
+		Items:      []map[string]interface{}{},
+		Clusters:   []*FanoutResult{},
+	}
+
+	for _, resp := range responses {
+		list.Clusters = append(list.Clusters, resp.result)
+		if resp.body == nil {
+			continue
+		}
+
+		var items []interface{}
+		if v, ok := resp.body["items"].([]interface{}); ok {
+			items = v
+			if kind, _ := resp.body["kind"].(string); kind != "" && list.Kind == "List" {
+				list.Kind = kind
+				list.APIVersion, _ = resp.body["apiVersion"].(string)
+			}
+		} else {
+			items = []interface{}{resp.body}
+		}
+
+		for _, item := range items {
+			obj, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			annotate(obj, resp.result.Cluster)
+			list.Items = append(list.Items, obj)
+		}
+		resp.result.Items = len(items)
+	}
+
+	return list
+}
+
+func annotate(obj map[string]interface{}, cluster string) {
+	metadata, ok := obj["metadata"].(map[string]interface{})
+	if !ok {
+		metadata = map[string]interface{}{}
+		obj["metadata"] = metadata
+	}
+	annotations, ok := metadata["annotations"].(map[string]interface{})
+	if !ok {
+		annotations = map[string]interface{}{}
+		metadata["annotations"] = annotations
+	}
+	annotations[ClusterAnnotation] = cluster
+}
+
+func allFailed(results []*FanoutResult) bool {
+	for _, r := range results {
+		if r.Error == "" {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,216 @@
+package gateway_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"k8s-tunnel/pkg/agent"
+	"k8s-tunnel/pkg/gateway"
+	"k8s-tunnel/pkg/tunneltest"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 每个集群返回一个以集群名命名的 pod, failed 集群返回 500
+func podListUpstream(inflight, maxInflight *int32) func(string) http.Handler {
+	return func(agentName string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// agent 上报元数据时也会请求 upstream, 只统计 fan-out 的请求
+			if r.URL.Path != "/api/v1/pods" {
+				http.NotFound(w, r)
+				return
+			}
+			if n := atomic.AddInt32(inflight, 1); n > atomic.LoadInt32(maxInflight) {
+				atomic.StoreInt32(maxInflight, n)
+			}
+			defer atomic.AddInt32(inflight, -1)
+			time.Sleep(20 * time.Millisecond)
+
+			w.Header().Set("Content-Type", "application/json")
+			if agentName == "failed" {
+				w.WriteHeader(http.StatusInternalServerError)
+				_, _ = w.Write([]byte(`{"kind":"Status","apiVersion":"v1","status":"Failure","message":"etcd down","code":500}`))
+				return
+			}
+			_, _ = fmt.Fprintf(w, `{"kind":"PodList","apiVersion":"v1","metadata":{"resourceVersion":"1"},"items":[{"metadata":{"name":"%s","namespace":"default"},"query":"%s"}]}`,
+				agentName, r.URL.RawQuery)
+		})
+	}
+}
+
+func fanout(t *testing.T, h *tunneltest.Harness, query string) (int, *gateway.FanoutList) {
+	t.Helper()
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/fanout/api/v1/pods?%s", h.GatewayHost(), query))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	list := &gateway.FanoutList{}
+	if err = json.NewDecoder(resp.Body).Decode(list); err != nil {
+		t.Fatal(err)
+	}
+
+	return resp.StatusCode, list
+}
+
+func TestFanout(t *testing.T) {
+	t.Run("#merge with partial failure", func(t *testing.T) {
+		var inflight, maxInflight int32
+		h := tunneltest.New(t, &tunneltest.Option{
+			Upstream: podListUpstream(&inflight, &maxInflight),
+			AgentOption: func(opt *agent.Option) {
+				opt.Labels = map[string]string{"env": "prod"}
+				if opt.AgentName == "dev" {
+					opt.Labels["env"] = "dev"
+				}
+			},
+		})
+		for _, name := range []string{"a", "b", "failed", "dev"} {
+			h.StartAgent(name)
+			if err := h.WaitForMetadata(name, tunneltest.DefaultWaitTimeout); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		code, list := fanout(t, h, "agentSelector=env%3Dprod&fieldSelector=status.phase%3DFailed")
+		if code != http.StatusOK || list.Kind != "PodList" {
+			t.Fatalf("status %d, kind %s", code, list.Kind)
+		}
+		if len(list.Items) != 2 {
+			t.Fatalf("expect 2 items, got %+v", list.Items)
+		}
+		for i, cluster := range []string{"a", "b"} {
+			item := list.Items[i]
+			annotations := item["metadata"].(map[string]interface{})["annotations"].(map[string]interface{})
+			if annotations[gateway.ClusterAnnotation] != cluster {
+				t.Fatalf("unexpected item %+v", item)
+			}
+			// agentSelector 不会转发给 apiserver
+			if item["query"] != "fieldSelector=status.phase%3DFailed" {
+				t.Fatalf("unexpected upstream query %v", item["query"])
+			}
+		}
+
+		if len(list.Clusters) != 3 {
+			t.Fatalf("expect 3 clusters, got %+v", list.Clusters)
+		}
+		failed := list.Clusters[2]
+		if failed.Cluster != "failed" || failed.Code != http.StatusInternalServerError || failed.Error != "etcd down" {
+			t.Fatalf("unexpected failure %+v", failed)
+		}
+	})
+
+	t.Run("#partial timeout", func(t *testing.T) {
+		var inflight, maxInflight int32
+		release := make(chan struct{})
+		defer close(release)
+		h := tunneltest.New(t, &tunneltest.Option{
+			Gateway: &gateway.Option{FanoutTimeout: 200 * time.Millisecond},
+			Upstream: func(agentName string) http.Handler {
+				pods := podListUpstream(&inflight, &maxInflight)(agentName)
+				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					if agentName == "slow" && r.URL.Path == "/api/v1/pods" {
+						<-release
+					}
+					pods.ServeHTTP(w, r)
+				})
+			},
+		})
+		h.StartAgent("a")
+		h.StartAgent("slow")
+
+		code, list := fanout(t, h, "")
+		if code != http.StatusOK || len(list.Items) != 1 || len(list.Clusters) != 2 {
+			t.Fatalf("status %d, items %d, clusters %+v", code, len(list.Items), list.Clusters)
+		}
+		slow := list.Clusters[1]
+		if slow.Cluster != "slow" || slow.Code != http.StatusGatewayTimeout || slow.Reason != metav1.StatusReasonTimeout {
+			t.Fatalf("unexpected timeout result %+v", slow)
+		}
+	})
+
+	t.Run("#concurrency limit", func(t *testing.T) {
+		var inflight, maxInflight int32
+		h := tunneltest.New(t, &tunneltest.Option{
+			Gateway:  &gateway.Option{FanoutConcurrency: 2},
+			Upstream: podListUpstream(&inflight, &maxInflight),
+		})
+		for i := 0; i < 6; i++ {
+			h.StartAgent(fmt.Sprintf("cluster-%d", i))
+		}
+
+		if code, list := fanout(t, h, ""); code != http.StatusOK || len(list.Items) != 6 {
+			t.Fatalf("status %d, items %d", code, len(list.Items))
+		}
+		if n := atomic.LoadInt32(&maxInflight); n > 2 {
+			t.Fatalf("expect at most 2 concurrent requests, got %d", n)
+		}
+	})
+
+	t.Run("#all failed", func(t *testing.T) {
+		var inflight, maxInflight int32
+		h := tunneltest.New(t, &tunneltest.Option{Upstream: podListUpstream(&inflight, &maxInflight)})
+		h.StartAgent("failed")
+
+		if code, list := fanout(t, h, ""); code != http.StatusBadGateway || len(list.Clusters) != 1 {
+			t.Fatalf("status %d, clusters %+v", code, list.Clusters)
+		}
+	})
+
+	t.Run("#headers forwarded", func(t *testing.T) {
+		headers := make(chan http.Header, 1)
+		h := tunneltest.New(t, &tunneltest.Option{
+			Upstream: func(agentName string) http.Handler {
+				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					if r.URL.Path == "/api/v1/pods" {
+						headers <- r.Header.Clone()
+					}
+					w.Header().Set("Content-Type", "application/json")
+					_, _ = w.Write([]byte(`{"kind":"PodList","apiVersion":"v1","items":[]}`))
+				})
+			},
+		})
+		h.StartAgent("a")
+
+		req, _ := http.NewRequest(http.MethodGet, "http://"+h.GatewayHost()+"/fanout/api/v1/pods", nil)
+		req.Header.Set("Authorization", "Bearer token")
+		req.Header.Set("Impersonate-User", "viewer")
+		req.Header.Add("Impersonate-Group", "readonly")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		// 与代理请求一样带上模拟身份, 否则会以 agent 的身份执行
+		got := <-headers
+		if got.Get("Authorization") != "Bearer token" || got.Get("Impersonate-User") != "viewer" || got.Get("Impersonate-Group") != "readonly" {
+			t.Fatalf("unexpected headers %v", got)
+		}
+	})
+
+	t.Run("#paging rejected", func(t *testing.T) {
+		var inflight, maxInflight int32
+		h := tunneltest.New(t, &tunneltest.Option{Upstream: podListUpstream(&inflight, &maxInflight)})
+		h.StartAgent("a")
+
+		for query, expect := range map[string]int{
+			"limit=10":       http.StatusBadRequest,
+			"continue=token": http.StatusBadRequest,
+			"limit=0":        http.StatusOK,
+		} {
+			resp, err := http.Get("http://" + h.GatewayHost() + "/fanout/api/v1/pods?" + query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != expect {
+				t.Fatalf("%s: expect %d, got %d", query, expect, resp.StatusCode)
+			}
+		}
+	})
+}
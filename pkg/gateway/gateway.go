@@ -0,0 +1,658 @@
+package gateway
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"io"
+	"k8s-tunnel/pkg/e2e"
+	"k8s-tunnel/pkg/protocol"
+	"k8s-tunnel/pkg/transport"
+	"k8s-tunnel/pkg/utils"
+	"net"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultAddr               = ":9991"
+	DefaultShutdownTimeout    = 3 * time.Second
+	DefaultMaxPendingRequests = 100
+)
+
+var errAgentOffline = errors.New("agent offline")
+
+type Option struct {
+	Addr            string        // 监听地址, 默认 DefaultAddr
+	ShutdownTimeout time.Duration // ctx 结束后等待进行中的请求完成 (Drain) 和 server.Shutdown 的时间
+	RequestTimeout  time.Duration // 代理请求等待 agent 响应的时间, 0 表示不限制
+
+	// Transports agent 连接允许的传输方式, 为空时允许 transport.Supported 中的全部
+	Transports []transport.Name
+
+	// 协议协商, 为空时使用 protocol 包的默认值
+	Features     []protocol.Feature
+	MaxFrameSize int64
+	HelloTimeout time.Duration // 等待 agent Hello 的时间
+
+	// CacheTTL 开启 discovery 和 OpenAPI 的响应缓存, 0 表示不缓存
+	CacheTTL time.Duration
+	// CacheRules 可缓存的路径, 为空时使用 DefaultCacheRules
+	CacheRules []CacheRule
+
+	// fan-out 查询的并发数和单个集群的超时时间
+	FanoutConcurrency int
+	FanoutTimeout     time.Duration
+
+	// OfflineGracePeriod agent 离线时代理请求最多等待其重连的时间, 0 表示立即返回 503
+	OfflineGracePeriod time.Duration
+	// MaxPendingRequests 每个 agent 离线等待中的最大请求数, 超过后直接返回 503
+	MaxPendingRequests int
+
+	// CA 不为空时 gateway 使用 CA 签发的证书提供 https, agent 需要用 CA 签发的客户端证书注册
+	CA *CA
+	// TLSHosts 服务端证书的域名和 ip, 默认 DefaultTLSHosts
+	TLSHosts []string
+	// AgentCertTTL agent 证书的有效期, 默认 DefaultAgentCertTTL, agent 会在过期前自动续期
+	AgentCertTTL time.Duration
+	// BootstrapTokens agent 首次申请证书用的一次性 token (id.secret): agentName, agentName 为空时不限制
+	BootstrapTokens map[string]string
+	// UsedTokens 已签发过证书的 bootstrap token id, 为空时只记录在内存中, 重启后同样的 token 可以再次使用
+	UsedTokens *UsedTokens
+
+	// Revocations 吊销列表, 为空时使用内存中的列表
+	Revocations *Revocations
+	// RevalidateInterval 重新校验已连接 agent 身份的间隔, 默认 DefaultRevalidateInterval
+	RevalidateInterval time.Duration
+
+	// Registry 持久化 agent 的注册和连接记录, 为空时不记录
+	Registry *Registry
+
+	// 事件通知, 除 webhook 外还可以通过 GET /events 订阅
+	Webhooks             []Webhook
+	WebhookRetries       int           // 默认 DefaultWebhookRetries
+	WebhookRetryInterval time.Duration // 第一次重试的间隔, 之后翻倍, 默认 DefaultWebhookRetryInterval
+	WebhookTimeout       time.Duration // 默认 DefaultWebhookTimeout
+	// FlapWindow 内注册 FlapThreshold 次认为 agent 在抖动, 默认 DefaultFlapThreshold, DefaultFlapWindow
+	FlapThreshold int
+	FlapWindow    time.Duration
+	// PingInterval gateway 向 agent 发送 ping 的间隔, 默认 utils.PingPeriod 的一半
+	PingInterval time.Duration
+	// PingLatencyThreshold ping 往返时间超过该值时发出 ping.degraded 事件, 默认 DefaultPingLatencyThreshold
+	PingLatencyThreshold time.Duration
+
+	// 按 agent, 用户, agent+用户 限流, 超过后返回 429
+	AgentRateLimit     RateLimit
+	UserRateLimit      RateLimit
+	AgentUserRateLimit RateLimit
+
+	// hooks
+	Authenticate      func(req *http.Request) error  // 为空时不做校验
+	AuthenticateAdmin func(req *http.Request) error  // 吊销等管理接口, 为空时使用 Authenticate, 都为空时不提供管理接口
+	User              func(req *http.Request) string // 认证后的请求方身份, 用于按用户限流, 为空时使用客户端 ip
+	OnTunnelOpen      func(t *Tunnel)
+	OnTunnelClose     func(t *Tunnel)
+}
+
+type Gateway struct {
+	opt       Option
+	tunnelMap sync.Map // agentName:Tunnel
+
+	mu      sync.Mutex
+	online  map[string]chan struct{} // agentName: 注册时关闭, 用于等待 agent 上线
+	pending map[string]int           // agentName: 等待上线的请求数
+
+	limiters  *rateLimiters
+	bootstrap *bootstrapTokens
+	events    *eventHub
+
+	draining int32          // Drain 后为 1
+	inflight utils.Inflight // 进行中的代理请求数
+}
+
+func NewGateway(opt *Option) *Gateway {
+	gw := &Gateway{
+		tunnelMap: sync.Map{},
+		online:    map[string]chan struct{}{},
+		pending:   map[string]int{},
+	}
+	if opt != nil {
+		gw.opt = *opt
+	}
+	if gw.opt.Addr == "" {
+		gw.opt.Addr = DefaultAddr
+	}
+	if gw.opt.ShutdownTimeout <= 0 {
+		gw.opt.ShutdownTimeout = DefaultShutdownTimeout
+	}
+	if gw.opt.HelloTimeout <= 0 {
+		gw.opt.HelloTimeout = DefaultHelloTimeout
+	}
+	if len(gw.opt.CacheRules) == 0 {
+		gw.opt.CacheRules = DefaultCacheRules
+	}
+	if gw.opt.FanoutConcurrency <= 0 {
+		gw.opt.FanoutConcurrency = DefaultFanoutConcurrency
+	}
+	if gw.opt.FanoutTimeout <= 0 {
+		gw.opt.FanoutTimeout = DefaultFanoutTimeout
+	}
+	if gw.opt.MaxPendingRequests <= 0 {
+		gw.opt.MaxPendingRequests = DefaultMaxPendingRequests
+	}
+	if gw.opt.Revocations == nil {
+		gw.opt.Revocations = NewRevocations()
+	}
+	if gw.opt.RevalidateInterval <= 0 {
+		gw.opt.RevalidateInterval = DefaultRevalidateInterval
+	}
+	if gw.opt.MaxFrameSize <= 0 {
+		gw.opt.MaxFrameSize = protocol.DefaultMaxFrameSize
+	}
+	if gw.opt.AgentCertTTL <= 0 {
+		gw.opt.AgentCertTTL = DefaultAgentCertTTL
+	}
+	if gw.opt.WebhookRetries <= 0 {
+		gw.opt.WebhookRetries = DefaultWebhookRetries
+	}
+	if gw.opt.WebhookRetryInterval <= 0 {
+		gw.opt.WebhookRetryInterval = DefaultWebhookRetryInterval
+	}
+	if gw.opt.WebhookTimeout <= 0 {
+		gw.opt.WebhookTimeout = DefaultWebhookTimeout
+	}
+	if gw.opt.FlapThreshold <= 0 {
+		gw.opt.FlapThreshold = DefaultFlapThreshold
+	}
+	if gw.opt.FlapWindow <= 0 {
+		gw.opt.FlapWindow = DefaultFlapWindow
+	}
+	if gw.opt.PingInterval <= 0 {
+		gw.opt.PingInterval = utils.PingPeriod / 2
+	}
+	if gw.opt.PingLatencyThreshold <= 0 {
+		gw.opt.PingLatencyThreshold = DefaultPingLatencyThreshold
+	}
+	if gw.opt.UsedTokens == nil {
+		gw.opt.UsedTokens = NewUsedTokens()
+	}
+	gw.limiters = newRateLimiters(&gw.opt)
+	gw.events = newEventHub(&gw.opt)
+	gw.bootstrap = &bootstrapTokens{tokens: map[string]string{}, used: gw.opt.UsedTokens}
+	for token, agentName := range gw.opt.BootstrapTokens {
+		gw.bootstrap.tokens[token] = agentName
+	}
+
+	return gw
+}
+
+// Serve 监听 Option.Addr, 直到 ctx 结束
+func (gw *Gateway) Serve(ctx context.Context) error {
+	ln, err := net.Listen("tcp", gw.opt.Addr)
+	if err != nil {
+		return err
+	}
+
+	return gw.ServeListener(ctx, ln)
+}
+
+// ServeListener 在给定的 listener 上提供服务, ctx 结束后优雅关闭
+func (gw *Gateway) ServeListener(ctx context.Context, ln net.Listener) error {
+	server := &http.Server{}
+	server.Handler = gw.Handler()
+	if err := http2.ConfigureServer(server, &http2.Server{}); err != nil {
+		return err
+	}
+
+	tlsConfig, err := gw.TLSConfig()
+	if err != nil {
+		return err
+	}
+	if tlsConfig != nil {
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		logrus.Infof("listen on %s, (%s, %s)", ln.Addr(), runtime.GOOS, runtime.GOARCH)
+		errCh <- server.Serve(ln)
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), gw.opt.ShutdownTimeout)
+	defer cancel()
+
+	gw.Drain(shutdownCtx)
+
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	logrus.Infof("server closed")
+
+	return nil
+}
+
+// Handler 在 NewRouter 的基础上支持明文的 HTTP/2 (h2c), 未开启 tls 时 agent 也可以使用 HTTP/2 传输
+func (gw *Gateway) Handler() http.Handler {
+	return h2c.NewHandler(gw.NewRouter(), &http2.Server{})
+}
+
+func (gw *Gateway) NewRouter() *mux.Router {
+	r := mux.NewRouter()
+	r.HandleFunc("/agents/{agentName}/register", gw.registerHandler)
+	r.PathPrefix("/proxies/{agentName}").HandlerFunc(gw.requestHandler)
+	r.HandleFunc("/agents/{agentName}/response", gw.responseHandler)
+	r.HandleFunc("/agents/{agentName}/certificate", gw.certificateHandler).Methods(http.MethodPost)
+	r.PathPrefix(fanoutPrefix + "/").HandlerFunc(gw.fanoutHandler)
+	r.HandleFunc("/agents", gw.listAgentsHandler).Methods(http.MethodGet)
+	r.HandleFunc("/agents/{agentName}", gw.getAgentHandler).Methods(http.MethodGet)
+	r.HandleFunc("/agents/{agentName}/healthz", gw.agentHealthHandler).Methods(http.MethodGet)
+	// 没有配置认证时不注册管理接口, 否则任何人都可以吊销 agent 或读取事件
+	if gw.opt.AuthenticateAdmin != nil || gw.opt.Authenticate != nil {
+		r.HandleFunc("/revocations", gw.revocationsHandler).Methods(http.MethodGet, http.MethodPost)
+		r.HandleFunc("/revocations/{kind}/{value}", gw.deleteRevocationHandler).Methods(http.MethodDelete)
+		r.HandleFunc("/events", gw.eventsHandler).Methods(http.MethodGet)
+		r.HandleFunc("/registry/agents", gw.listRecordsHandler).Methods(http.MethodGet)
+		r.HandleFunc("/registry/agents/{agentName}", gw.getRecordHandler).Methods(http.MethodGet)
+		r.HandleFunc("/registry/agents/{agentName}", gw.deleteRecordHandler).Methods(http.MethodDelete)
+	} else {
+		logrus.Warnf("admin api disabled, no authentication configured")
+	}
+	gw.installHealth(r)
+
+	return r
+}
+
+// Tunnel 返回 agentName 当前的 tunnel
+func (gw *Gateway) Tunnel(agentName string) (*Tunnel, bool) {
+	v, ok := gw.tunnelMap.Load(agentName)
+	if !ok {
+		return nil, false
+	}
+
+	return v.(*Tunnel), true
+}
+
+// Tunnels 返回当前所有在线的 tunnel
+func (gw *Gateway) Tunnels() []*Tunnel {
+	var tunnels []*Tunnel
+	gw.tunnelMap.Range(func(_, v interface{}) bool {
+		tunnels = append(tunnels, v.(*Tunnel))
+		return true
+	})
+
+	return tunnels
+}
+
+func (gw *Gateway) registerHandler(writer http.ResponseWriter, request *http.Request) {
+	cert, err := gw.authenticateAgent(request)
+	if err != nil {
+		RESP(writer, NewStatusErr(http.StatusUnauthorized, err))
+		return
+	}
+	// 下线中不再接受注册, agent 会重试到其他 gateway
+	if gw.Draining() {
+		RESP(writer, drainingErr())
+		return
+	}
+
+	agentName := mux.Vars(request)["agentName"]
+
+	upgrader := transport.Upgrader{
+		Transports: gw.opt.Transports,
+		WebSocket: websocket.Upgrader{
+			ReadBufferSize:   1024,
+			WriteBufferSize:  1024,
+			HandshakeTimeout: time.Second * 30,
+			CheckOrigin: func(r *http.Request) bool {
+				// 记得检查origin, 现在就统一返回
+				return true
+			},
+		},
+	}
+
+	conn, err := upgrader.Upgrade(writer, request)
+	if err != nil {
+		logrus.Errorf("%s register upgrade error. err:%v", agentName, err)
+		return
+	}
+	// HTTP/2 的连接依附于这个请求, 直到 tunnel 关闭
+	defer transport.Wait(conn)
+
+	// 握手前按本端的最大帧长度限制, 握手后按协商的结果
+	conn.SetReadLimit(gw.opt.MaxFrameSize)
+	session, err := gw.handshake(request, conn)
+	if err != nil {
+		logrus.Errorf("%s handshake error. err:%v", agentName, err)
+		_ = conn.Close()
+		return
+	}
+	conn.SetReadLimit(session.MaxFrameSize)
+
+	// agent 重启时旧连接可能还没被发现断开, 以新注册的为准
+	if old, ok := gw.getTunnel(request); ok {
+		logrus.Warnf("%s registered again, close old tunnel", agentName)
+		old.CloseWithReason("replaced by new registration")
+	}
+
+	tunnel := gw.initTunnel(agentName, conn, session, cert)
+
+	gw.tunnelMap.Store(agentName, tunnel)
+	gw.notifyOnline(agentName)
+	gw.tunnelOpened(tunnel)
+	if gw.opt.OnTunnelOpen != nil {
+		gw.opt.OnTunnelOpen(tunnel)
+	}
+
+	logrus.Infof("%s registerd, protocol:%d, version:%s, features:%v",
+		agentName, session.ProtocolVersion, session.PeerVersion, session.Features)
+}
+
+func (gw *Gateway) responseHandler(writer http.ResponseWriter, request *http.Request) {
+	if _, err := gw.authenticateAgent(request); err != nil {
+		RESP(writer, NewStatusErr(http.StatusUnauthorized, err))
+		return
+	}
+	upgrader := transport.Upgrader{
+		Transports: gw.opt.Transports,
+		WebSocket: websocket.Upgrader{
+			ReadBufferSize:   1024,
+			WriteBufferSize:  1024,
+			HandshakeTimeout: time.Second * 30,
+			CheckOrigin: func(r *http.Request) bool {
+				return true
+			},
+			// 只有 agent 协商了压缩时才会在握手中请求 permessage-deflate
+			EnableCompression: true,
+		},
+	}
+
+	requestID := request.Header.Get(utils.HttpRequestIdHeader)
+
+	onceConn, err := upgrader.Upgrade(writer, request)
+	if err != nil {
+		logrus.Errorf("response upgrade error. requestID:%s, err:%v", requestID, err)
+		return
+	}
+	defer transport.Wait(onceConn)
+	defer onceConn.Close()
+
+	logrus.Debugf("once conn comming, requestID:%s", requestID)
+
+	tunnel, ok := gw.getTunnel(request)
+	if !ok {
+		logrus.Errorf("cant't get tunnel, requestID:%s", requestID)
+		return
+	}
+	onceConn.SetReadLimit(tunnel.Session.MaxFrameSize)
+
+	rt, err := tunnel.GetRequestTransit(requestID)
+	if err != nil {
+		logrus.Errorf("get request transit error. err:%v", err)
+		return
+	}
+	logrus.Debugf("loading rt, requestID:%s", requestID)
+
+	// 请求一般很小, 只压缩较大的请求体, 密文无法压缩
+	onceConn.EnableWriteCompression(tunnel.Session.Has(protocol.FeatureCompression) &&
+		rt.request.ContentLength >= protocol.DefaultCompressionThreshold && !e2e.IsSealed(rt.request.Header))
+	if err = rt.Transit(onceConn); err != nil {
+		logrus.Errorf("transit error. requestID:%s, err:%v", requestID, err)
+		return
+	}
+
+	if tunnel.Session.Has(protocol.FeatureStreaming) {
+		err = rt.StreamResponse(onceConn)
+	} else {
+		err = rt.Response(onceConn)
+	}
+	if err != nil {
+		logrus.Errorf("response error. requestID:%s, err:%v", requestID, err)
+		return
+	}
+
+	tunnel.DeleteRequestTransit(requestID)
+}
+
+func (gw *Gateway) requestHandler(writer http.ResponseWriter, request *http.Request) {
+	if err := gw.authenticate(request); err != nil {
+		RESPStatus(writer, NewStatusErr(http.StatusUnauthorized, err))
+		return
+	}
+	done, ok := gw.beginRequest()
+	if !ok {
+		RESPStatus(writer, drainingErr())
+		return
+	}
+	defer done()
+
+	release, statusErr := gw.limit(request, mux.Vars(request)["agentName"])
+	if statusErr != nil {
+		RESPStatus(writer, statusErr)
+		return
+	}
+	defer release()
+
+	if gw.opt.RequestTimeout > 0 {
+		ctx, cancel := context.WithTimeout(request.Context(), gw.opt.RequestTimeout)
+		defer cancel()
+		request = request.WithContext(ctx)
+	}
+
+	tunnel, err := gw.waitTunnel(request.Context(), mux.Vars(request)["agentName"])
+	if err != nil {
+		gw.proxyErr(writer, request, err)
+		return
+	}
+
+	// 密文请求原样转发, gateway 不解析
+	if e2e.IsSealed(request.Header) && !tunnel.Session.Has(protocol.FeatureE2E) {
+		RESPStatus(writer, NewStatusErr(http.StatusBadRequest,
+			fmt.Errorf("agent %s does not accept end-to-end encrypted requests", tunnel.Name)))
+		return
+	}
+	if gw.cachedRequest(writer, request, tunnel) {
+		return
+	}
+
+	resp, err := tunnel.HandleRequest(request)
+	if err != nil {
+		if utils.IsBrokenPipe(err) {
+			tunnel.CloseWithReason(fmt.Sprintf("write error: %v", err))
+		}
+		gw.proxyErr(writer, request, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	gw.response(resp, writer)
+}
+
+// 代理请求失败时, 按 kubernetes 的语义返回错误, 便于客户端重试
+func (gw *Gateway) proxyErr(writer http.ResponseWriter, request *http.Request, err error) {
+	agentName := mux.Vars(request)["agentName"]
+
+	switch {
+	case err == errAgentOffline:
+		retryAfter := gw.opt.OfflineGracePeriod
+		if retryAfter < time.Second {
+			retryAfter = time.Second
+		}
+		RESPStatus(writer, NewStatusErr(http.StatusServiceUnavailable,
+			fmt.Errorf("agent %s is offline", agentName)).WithRetryAfter(retryAfter))
+	case err == context.DeadlineExceeded:
+		RESPStatus(writer, NewStatusErr(http.StatusGatewayTimeout,
+			fmt.Errorf("timeout waiting for agent %s after %s", agentName, gw.opt.RequestTimeout)).WithRetryAfter(time.Second))
+	case err == context.Canceled:
+		// 客户端已经断开
+		logrus.Debugf("client canceled request to agent %s", agentName)
+	default:
+		RESPStatus(writer, NewStatusErr(http.StatusServiceUnavailable,
+			fmt.Errorf("agent %s unavailable: %v", agentName, err)).WithRetryAfter(time.Second))
+	}
+}
+
+func (gw *Gateway) response(resp *http.Response, rw http.ResponseWriter) {
+	for k, vv := range resp.Header {
+		rw.Header()[k] = vv
+	}
+
+	rw.WriteHeader(resp.StatusCode)
+
+	// 长度未知的响应 (watch, logs -f) 每读到一段就发给客户端
+	var w io.Writer = rw
+	if flusher, ok := rw.(http.Flusher); ok && resp.ContentLength < 0 {
+		w = flushWriter{w: rw, flusher: flusher}
+	}
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		logrus.Errorf("copy response body error. err:%v", err)
+	}
+}
+
+type flushWriter struct {
+	w       io.Writer
+	flusher http.Flusher
+}
+
+func (f flushWriter) Write(b []byte) (int, error) {
+	n, err := f.w.Write(b)
+	f.flusher.Flush()
+	return n, err
+}
+
+func (gw *Gateway) authenticate(req *http.Request) error {
+	if gw.opt.Authenticate == nil {
+		return nil
+	}
+
+	return gw.opt.Authenticate(req)
+}
+
+func (gw *Gateway) initTunnel(agentName string, conn transport.Conn, session *protocol.Session, cert *x509.Certificate) *Tunnel {
+	tunnel := NewTunnel(agentName, conn, gw)
+	tunnel.Session = session
+	tunnel.cert = cert
+	gw.recordConnected(tunnel)
+
+	{ // handler
+		tunnel.PongHandler()
+		tunnel.CloseClientHandler()
+	}
+
+	go tunnel.SendPing()
+	go tunnel.Recv()
+	go tunnel.revalidate(gw.opt.RevalidateInterval)
+
+	return tunnel
+}
+
+// tunnel 关闭后从 map 中移除, 避免误删同名的新 tunnel
+func (gw *Gateway) removeTunnel(t *Tunnel) {
+	if v, ok := gw.tunnelMap.Load(t.Name); ok && v.(*Tunnel) == t {
+		gw.tunnelMap.Delete(t.Name)
+	}
+	gw.recordDisconnected(t)
+	gw.tunnelClosed(t)
+
+	if gw.opt.OnTunnelClose != nil {
+		gw.opt.OnTunnelClose(t)
+	}
+}
+
+// waitTunnel 获取 agent 的 tunnel, 开启 OfflineGracePeriod 时会等待 agent 重连
+func (gw *Gateway) waitTunnel(ctx context.Context, agentName string) (*Tunnel, error) {
+	if tunnel, ok := gw.Tunnel(agentName); ok {
+		return tunnel, nil
+	}
+	if gw.opt.OfflineGracePeriod <= 0 {
+		return nil, errAgentOffline
+	}
+
+	if !gw.acquirePending(agentName) {
+		return nil, errAgentOffline
+	}
+	defer gw.releasePending(agentName)
+
+	timer := time.NewTimer(gw.opt.OfflineGracePeriod)
+	defer timer.Stop()
+
+	logrus.Debugf("agent %s offline, waiting for reconnect", agentName)
+	for {
+		// 先拿到 chan 再检查, 避免错过注册通知
+		online := gw.onlineCh(agentName)
+		if tunnel, ok := gw.Tunnel(agentName); ok {
+			return tunnel, nil
+		}
+
+		select {
+		case <-online:
+		case <-timer.C:
+			return nil, errAgentOffline
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (gw *Gateway) onlineCh(agentName string) <-chan struct{} {
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+
+	ch, ok := gw.online[agentName]
+	if !ok {
+		ch = make(chan struct{})
+		gw.online[agentName] = ch
+	}
+
+	return ch
+}
+
+func (gw *Gateway) notifyOnline(agentName string) {
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+
+	if ch, ok := gw.online[agentName]; ok {
+		close(ch)
+		delete(gw.online, agentName)
+	}
+}
+
+func (gw *Gateway) acquirePending(agentName string) bool {
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+
+	if gw.pending[agentName] >= gw.opt.MaxPendingRequests {
+		return false
+	}
+	gw.pending[agentName]++
+
+	return true
+}
+
+func (gw *Gateway) releasePending(agentName string) {
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+
+	if gw.pending[agentName]--; gw.pending[agentName] <= 0 {
+		delete(gw.pending, agentName)
+		delete(gw.online, agentName)
+	}
+}
+
+func (gw *Gateway) getTunnel(request *http.Request) (*Tunnel, bool) {
+	return gw.Tunnel(mux.Vars(request)["agentName"])
+}
@@ -0,0 +1,223 @@
+package gateway_test
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"k8s-tunnel/pkg/agent"
+	"k8s-tunnel/pkg/gateway"
+	"k8s-tunnel/pkg/tunneltest"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func decodeStatus(t *testing.T, resp *http.Response) *metav1.Status {
+	t.Helper()
+
+	status := &metav1.Status{}
+	if err := json.NewDecoder(resp.Body).Decode(status); err != nil {
+		t.Fatal(err)
+	}
+
+	return status
+}
+
+func TestGateway(t *testing.T) {
+	t.Run("#unknown agent", func(t *testing.T) {
+		h := tunneltest.New(t, nil)
+
+		resp, err := http.Get(h.URL("nobody", "/"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode == http.StatusOK {
+			t.Fatalf("expect error status, got %d", resp.StatusCode)
+		}
+		status := decodeStatus(t, resp)
+		if status.Kind != "Status" || status.Code != int32(resp.StatusCode) {
+			t.Fatalf("unexpected status %+v", status)
+		}
+	})
+
+	t.Run("#agent offline", func(t *testing.T) {
+		h := tunneltest.New(t, nil)
+		h.StartAgent("huawei")
+		h.StopAgent("huawei")
+
+		resp, err := http.Get(h.URL("huawei", "/api"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		status := decodeStatus(t, resp)
+		if resp.StatusCode != http.StatusServiceUnavailable || status.Reason != metav1.StatusReasonServiceUnavailable {
+			t.Fatalf("status %d, %+v", resp.StatusCode, status)
+		}
+		if resp.Header.Get("Retry-After") == "" {
+			t.Fatalf("retry after missing, header %v", resp.Header)
+		}
+	})
+
+	t.Run("#agent disconnect in flight", func(t *testing.T) {
+		release := make(chan struct{})
+		h := tunneltest.New(t, &tunneltest.Option{
+			Upstream: func(string) http.Handler {
+				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					<-release
+				})
+			},
+			// 上游一直不返回, 不等待请求完成
+			AgentOption: func(opt *agent.Option) { opt.DrainTimeout = 100 * time.Millisecond },
+		})
+		defer close(release)
+		h.StartAgent("huawei")
+
+		errCh := make(chan error, 1)
+		codeCh := make(chan int, 1)
+		go func() {
+			resp, err := http.Get(h.URL("huawei", "/"))
+			if err != nil {
+				errCh <- err
+				return
+			}
+			resp.Body.Close()
+			codeCh <- resp.StatusCode
+		}()
+
+		time.Sleep(100 * time.Millisecond)
+		h.StopAgent("huawei")
+
+		select {
+		case code := <-codeCh:
+			if code != http.StatusServiceUnavailable {
+				t.Fatalf("expect 503, got %d", code)
+			}
+		case err := <-errCh:
+			t.Fatal(err)
+		case <-time.After(tunneltest.DefaultWaitTimeout):
+			t.Fatal("request not finished after agent disconnected")
+		}
+	})
+
+	t.Run("#offline grace period", func(t *testing.T) {
+		h := tunneltest.New(t, &tunneltest.Option{
+			Gateway: &gateway.Option{OfflineGracePeriod: 5 * time.Second},
+		})
+		h.StartAgent("huawei")
+		h.StopAgent("huawei")
+
+		codeCh := make(chan int, 1)
+		go func() {
+			resp, err := http.Get(h.URL("huawei", "/"))
+			if err != nil {
+				codeCh <- 0
+				return
+			}
+			resp.Body.Close()
+			codeCh <- resp.StatusCode
+		}()
+
+		time.Sleep(100 * time.Millisecond)
+		h.StartAgent("huawei")
+
+		if code := <-codeCh; code != http.StatusOK {
+			t.Fatalf("expect request held until agent reconnect, got %d", code)
+		}
+	})
+
+	t.Run("#offline grace period expired", func(t *testing.T) {
+		h := tunneltest.New(t, &tunneltest.Option{
+			Gateway: &gateway.Option{OfflineGracePeriod: 100 * time.Millisecond},
+		})
+
+		start := time.Now()
+		resp, err := http.Get(h.URL("huawei", "/"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusServiceUnavailable || time.Since(start) < 100*time.Millisecond {
+			t.Fatalf("status %d after %s", resp.StatusCode, time.Since(start))
+		}
+	})
+
+	t.Run("#timeout", func(t *testing.T) {
+		release := make(chan struct{})
+		h := tunneltest.New(t, &tunneltest.Option{
+			Gateway: &gateway.Option{RequestTimeout: 100 * time.Millisecond},
+			Upstream: func(string) http.Handler {
+				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					<-release
+				})
+			},
+		})
+		defer close(release)
+		h.StartAgent("huawei")
+
+		resp, err := http.Get(h.URL("huawei", "/api/v1/pods"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		status := decodeStatus(t, resp)
+		if resp.StatusCode != http.StatusGatewayTimeout || status.Reason != metav1.StatusReasonTimeout {
+			t.Fatalf("status %d, %+v", resp.StatusCode, status)
+		}
+		if resp.Header.Get("Retry-After") != "1" || status.Details == nil || status.Details.RetryAfterSeconds != 1 {
+			t.Fatalf("retry after missing, header %v, %+v", resp.Header, status.Details)
+		}
+	})
+
+	t.Run("#tunnel hooks", func(t *testing.T) {
+		var opened, closed int32
+		h := tunneltest.New(t, &tunneltest.Option{
+			Gateway: &gateway.Option{
+				OnTunnelOpen:  func(*gateway.Tunnel) { atomic.AddInt32(&opened, 1) },
+				OnTunnelClose: func(*gateway.Tunnel) { atomic.AddInt32(&closed, 1) },
+			},
+		})
+		h.StartAgent("huawei")
+		h.StopAgent("huawei")
+
+		if atomic.LoadInt32(&opened) != 1 || atomic.LoadInt32(&closed) != 1 {
+			t.Fatalf("opened %d, closed %d", opened, closed)
+		}
+	})
+
+	t.Run("#authenticate", func(t *testing.T) {
+		h := tunneltest.New(t, &tunneltest.Option{
+			Gateway: &gateway.Option{
+				Authenticate: func(req *http.Request) error {
+					if req.Header.Get("Authorization") == "" {
+						return errors.New("missing token")
+					}
+					return nil
+				},
+			},
+		})
+
+		resp, err := http.Get(h.URL("huawei", "/"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("status %d, body %s", resp.StatusCode, b)
+		}
+		status := &metav1.Status{}
+		if err = json.Unmarshal(b, status); err != nil || status.Reason != metav1.StatusReasonUnauthorized {
+			t.Fatalf("unexpected status %s", b)
+		}
+	})
+
+}
@@ -0,0 +1,82 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"k8s-tunnel/pkg/protocol"
+	"k8s-tunnel/pkg/transport"
+	"net/http"
+	"time"
+)
+
+const DefaultHelloTimeout = 10 * time.Second
+
+// handshake 注册连接升级后, 读取 agent 的 Hello 并回复协商结果.
+// 协商之前的老版本 agent 不发送 Hello, 直接使用版本 0 的会话
+func (gw *Gateway) handshake(request *http.Request, conn transport.Conn) (*protocol.Session, error) {
+	if request.Header.Get(protocol.ProtocolHeader) == "" {
+		return protocol.LegacySession(gw.opt.MaxFrameSize), nil
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(gw.opt.HelloTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	typ, message, err := conn.ReadMessage()
+	if err != nil {
+		return nil, fmt.Errorf("read hello error. err:%v", err)
+	}
+	if typ != websocket.TextMessage {
+		return nil, gw.refuse(conn, fmt.Errorf("%w: expect hello message", protocol.ErrIncompatible))
+	}
+
+	remote := &protocol.Hello{}
+	if err = json.Unmarshal(message, remote); err != nil {
+		return nil, gw.refuse(conn, fmt.Errorf("%w: invalid hello: %v", protocol.ErrIncompatible, err))
+	}
+
+	local := protocol.NewHello(gw.features(conn), gw.opt.MaxFrameSize)
+	session, err := protocol.Negotiate(local, remote)
+	if err != nil {
+		return nil, gw.refuse(conn, err)
+	}
+
+	_ = conn.SetWriteDeadline(time.Now().Add(gw.opt.HelloTimeout))
+	defer conn.SetWriteDeadline(time.Time{})
+	if err = conn.WriteJSON(protocol.Ack(local, session, nil)); err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// features 只有 websocket 支持压缩, 其他传输方式不参与压缩的协商
+func (gw *Gateway) features(conn transport.Conn) []protocol.Feature {
+	features := gw.opt.Features
+	if len(features) == 0 {
+		features = protocol.SupportedFeatures
+	}
+	if transport.Of(conn) == transport.WebSocket {
+		return features
+	}
+
+	// 不能为 nil, 否则 NewHello 会使用 SupportedFeatures
+	ret := []protocol.Feature{}
+	for _, f := range features {
+		if f != protocol.FeatureCompression {
+			ret = append(ret, f)
+		}
+	}
+	return ret
+}
+
+// refuse 告知 agent 拒绝的原因后关闭连接
+func (gw *Gateway) refuse(conn transport.Conn, err error) error {
+	local := protocol.NewHello(gw.features(conn), gw.opt.MaxFrameSize)
+	_ = conn.WriteJSON(protocol.Ack(local, nil, err))
+	_ = conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseProtocolError, "protocol negotiation failed"),
+		time.Now().Add(time.Second))
+
+	return err
+}
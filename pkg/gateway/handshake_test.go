@@ -0,0 +1,164 @@
+package gateway_test
+
+import (
+	"github.com/gorilla/websocket"
+	"io/ioutil"
+	"k8s-tunnel/pkg/gateway"
+	"k8s-tunnel/pkg/protocol"
+	"k8s-tunnel/pkg/tunneltest"
+	"k8s-tunnel/pkg/utils"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func dialRegister(t *testing.T, h *tunneltest.Harness, agentName string) *websocket.Conn {
+	t.Helper()
+
+	header := http.Header{}
+	header.Set(protocol.ProtocolHeader, strconv.Itoa(protocol.Version))
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+h.GatewayHost()+"/agents/"+agentName+"/register", header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+func TestHandshake(t *testing.T) {
+	t.Run("#negotiated session", func(t *testing.T) {
+		h := tunneltest.New(t, &tunneltest.Option{
+			Gateway: &gateway.Option{
+				Features:     []protocol.Feature{protocol.FeatureStreaming, protocol.FeatureCompression},
+				MaxFrameSize: 1 << 20,
+			},
+		})
+		conn := dialRegister(t, h, "huawei")
+
+		hello := protocol.NewHello([]protocol.Feature{protocol.FeatureCompression, protocol.FeatureTCP}, 2<<20)
+		if err := conn.WriteJSON(hello); err != nil {
+			t.Fatal(err)
+		}
+		ack := &protocol.HelloAck{}
+		if err := conn.ReadJSON(ack); err != nil {
+			t.Fatal(err)
+		}
+		if ack.Error != "" || ack.MaxFrameSize != 1<<20 || len(ack.Features) != 1 || ack.Features[0] != protocol.FeatureCompression {
+			t.Fatalf("unexpected ack %+v", ack)
+		}
+
+		if err := h.WaitForAgent("huawei", tunneltest.DefaultWaitTimeout); err != nil {
+			t.Fatal(err)
+		}
+		tunnel, _ := h.Gateway.Tunnel("huawei")
+		if !tunnel.Session.Has(protocol.FeatureCompression) || tunnel.Session.ProtocolVersion != protocol.Version {
+			t.Fatalf("unexpected session %+v", tunnel.Session)
+		}
+	})
+
+	t.Run("#incompatible version", func(t *testing.T) {
+		h := tunneltest.New(t, nil)
+		conn := dialRegister(t, h, "huawei")
+
+		hello := protocol.NewHello(nil, 0)
+		hello.ProtocolVersion, hello.MinProtocolVersion = protocol.Version+2, protocol.Version+1
+		if err := conn.WriteJSON(hello); err != nil {
+			t.Fatal(err)
+		}
+		ack := &protocol.HelloAck{}
+		if err := conn.ReadJSON(ack); err != nil {
+			t.Fatal(err)
+		}
+		if ack.Error == "" {
+			t.Fatalf("expect refused, got %+v", ack)
+		}
+
+		if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseProtocolError) {
+			t.Fatalf("expect protocol close, got %v", err)
+		}
+		if _, ok := h.Gateway.Tunnel("huawei"); ok {
+			t.Fatal("incompatible agent should not be registered")
+		}
+	})
+
+	t.Run("#pre-series agent", func(t *testing.T) {
+		h := tunneltest.New(t, nil)
+
+		// 协商之前的 agent: 注册后不发送 Hello, 收到 requestID 后建立响应连接返回响应
+		conn, _, err := websocket.DefaultDialer.Dial("ws://"+h.GatewayHost()+"/agents/huawei/register", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		go func() {
+			_, requestID, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			header := http.Header{}
+			header.Set(utils.HttpRequestIdHeader, string(requestID))
+			onceConn, _, err := websocket.DefaultDialer.Dial("ws://"+h.GatewayHost()+"/agents/huawei/response", header)
+			if err != nil {
+				return
+			}
+			defer onceConn.Close()
+			if _, _, err = onceConn.ReadMessage(); err != nil {
+				return
+			}
+			_ = onceConn.WriteMessage(websocket.BinaryMessage, []byte("HTTP/1.1 200 OK\r\nContent-Length: 6\r\n\r\nlegacy"))
+		}()
+
+		if err = h.WaitForAgent("huawei", tunneltest.DefaultWaitTimeout); err != nil {
+			t.Fatal(err)
+		}
+		tunnel, _ := h.Gateway.Tunnel("huawei")
+		if tunnel.Session.ProtocolVersion != 0 || len(tunnel.Session.Features) != 0 {
+			t.Fatalf("unexpected session %+v", tunnel.Session)
+		}
+
+		resp, err := http.Get(h.URL("huawei", "/api"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK || string(body) != "legacy" {
+			t.Fatalf("unexpected response %d %s", resp.StatusCode, body)
+		}
+	})
+
+	t.Run("#register read limit", func(t *testing.T) {
+		h := tunneltest.New(t, &tunneltest.Option{Gateway: &gateway.Option{MaxFrameSize: 1 << 10}})
+		conn := dialRegister(t, h, "huawei")
+
+		if err := conn.WriteJSON(protocol.NewHello(nil, 0)); err != nil {
+			t.Fatal(err)
+		}
+		ack := &protocol.HelloAck{}
+		if err := conn.ReadJSON(ack); err != nil || ack.Error != "" {
+			t.Fatalf("unexpected ack %+v, err %v", ack, err)
+		}
+		if err := h.WaitForAgent("huawei", tunneltest.DefaultWaitTimeout); err != nil {
+			t.Fatal(err)
+		}
+
+		// 注册连接上超过协商长度的消息会断开 tunnel
+		if err := conn.WriteMessage(websocket.TextMessage, make([]byte, 4<<10)); err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(tunneltest.DefaultWaitTimeout))
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+					t.Fatalf("expect close 1009, got %v", err)
+				}
+				break
+			}
+		}
+		if err := h.WaitForAgentGone("huawei", tunneltest.DefaultWaitTimeout); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
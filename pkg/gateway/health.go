@@ -0,0 +1,83 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"github.com/gorilla/mux"
+	"k8s-tunnel/pkg/health"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// 超过多少个 ping 周期没有收到 pong 认为 agent 不健康
+const missedPongs = 3
+
+// readyChecks gateway 就绪的检查项, 开启注册记录时检查数据库
+func (gw *Gateway) readyChecks() []health.Check {
+	checks := []health.Check{health.Ping, {Name: "shutdown", Check: func(context.Context) error {
+		if gw.Draining() {
+			return errDraining
+		}
+		return nil
+	}}}
+	if gw.opt.Registry != nil {
+		checks = append(checks, health.Check{Name: "registry", Check: func(context.Context) error {
+			return gw.opt.Registry.Ping()
+		}})
+	}
+
+	return checks
+}
+
+// installHealth 注册 /livez, /readyz 和 /healthz, 供 kubernetes 探针使用, 不需要认证
+func (gw *Gateway) installHealth(r *mux.Router) {
+	r.Handle("/livez", health.Handler("livez", health.Ping)).Methods(http.MethodGet)
+	r.Handle("/readyz", health.Handler("readyz", gw.readyChecks()...)).Methods(http.MethodGet)
+	r.Handle("/healthz", health.Handler("healthz", gw.readyChecks()...)).Methods(http.MethodGet)
+}
+
+// agentChecks agent 的健康检查: 已连接, pong 未超时, 上报的元数据中 apiserver 可达
+func (gw *Gateway) agentChecks(agentName string) []health.Check {
+	tunnel, ok := gw.Tunnel(agentName)
+	connected := health.Check{Name: "connected", Check: func(context.Context) error {
+		if !ok {
+			return fmt.Errorf("agent %s not connected", agentName)
+		}
+		return nil
+	}}
+	if !ok {
+		return []health.Check{connected}
+	}
+
+	ping := health.Check{Name: "ping", Check: func(context.Context) error {
+		last := tunnel.ConnectedAt
+		if pongAt := atomic.LoadInt64(&tunnel.pongAt); pongAt > 0 {
+			last = time.Unix(0, pongAt)
+		}
+		if since := time.Since(last); since > missedPongs*gw.opt.PingInterval {
+			return fmt.Errorf("no pong for %s", since.Truncate(time.Millisecond))
+		}
+		return nil
+	}}
+	upstream := health.Check{Name: "upstream", Check: func(context.Context) error {
+		// 未上报元数据时无法判断
+		if md := tunnel.Metadata(); md.UpstreamError != "" {
+			return fmt.Errorf("%s (reported at %s)", md.UpstreamError, md.UpdatedAt.Format(time.RFC3339))
+		}
+		return nil
+	}}
+
+	return []health.Check{connected, ping, upstream}
+}
+
+// GET /agents/{agentName}/healthz
+func (gw *Gateway) agentHealthHandler(writer http.ResponseWriter, request *http.Request) {
+	if err := gw.authenticate(request); err != nil {
+		RESP(writer, NewStatusErr(http.StatusUnauthorized, err))
+		return
+	}
+
+	agentName := mux.Vars(request)["agentName"]
+	health.Handler(agentName+" healthz", gw.agentChecks(agentName)...).ServeHTTP(writer, request)
+}
@@ -0,0 +1,79 @@
+package gateway_test
+
+import (
+	"io/ioutil"
+	"k8s-tunnel/pkg/gateway"
+	"k8s-tunnel/pkg/tunneltest"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func getText(t *testing.T, url string) (int, string) {
+	t.Helper()
+
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+
+	return resp.StatusCode, string(b)
+}
+
+func TestHealth(t *testing.T) {
+	t.Run("#gateway", func(t *testing.T) {
+		r := openRegistry(t, filepath.Join(t.TempDir(), "registry.db"))
+		h := tunneltest.New(t, &tunneltest.Option{Gateway: &gateway.Option{Registry: r}})
+		base := "http://" + h.GatewayHost()
+
+		for _, path := range []string{"/livez", "/readyz", "/healthz"} {
+			if code, body := getText(t, base+path); code != http.StatusOK || body != "ok" {
+				t.Fatalf("%s: %d %q", path, code, body)
+			}
+		}
+		if code, body := getText(t, base+"/readyz?verbose"); !strings.Contains(body, "[+]registry ok") {
+			t.Fatalf("%d %q", code, body)
+		}
+
+		// 数据库不可用时不再就绪, 但仍然存活
+		_ = r.Close()
+		if code, body := getText(t, base+"/readyz"); code != http.StatusServiceUnavailable || !strings.Contains(body, "[-]registry failed") {
+			t.Fatalf("%d %q", code, body)
+		}
+		if code, _ := getText(t, base+"/livez"); code != http.StatusOK {
+			t.Fatalf("livez %d", code)
+		}
+	})
+
+	t.Run("#agent", func(t *testing.T) {
+		h := tunneltest.New(t, &tunneltest.Option{
+			Upstream: func(agentName string) http.Handler {
+				if agentName == "tencent" {
+					return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+						w.WriteHeader(http.StatusInternalServerError)
+					})
+				}
+				return tunneltest.EchoHandler()
+			},
+		})
+		h.StartAgent("huawei")
+		h.StartAgent("tencent")
+		if err := h.WaitForMetadata("tencent", tunneltest.DefaultWaitTimeout); err != nil {
+			t.Fatal(err)
+		}
+		base := "http://" + h.GatewayHost() + "/agents/"
+
+		if code, body := getText(t, base+"huawei/healthz?verbose"); code != http.StatusOK || !strings.Contains(body, "[+]ping ok") {
+			t.Fatalf("%d %q", code, body)
+		}
+		if code, body := getText(t, base+"tencent/healthz"); code != http.StatusServiceUnavailable || !strings.Contains(body, "[-]upstream failed: GET /version: status 500") {
+			t.Fatalf("%d %q", code, body)
+		}
+		if code, body := getText(t, base+"unknown/healthz"); code != http.StatusServiceUnavailable || !strings.Contains(body, "[-]connected failed") {
+			t.Fatalf("%d %q", code, body)
+		}
+	})
+}
@@ -0,0 +1,204 @@
+package gateway
+
+import (
+	"fmt"
+	"golang.org/x/time/rate"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// 超过该时间没有请求的限流状态会被清理
+const limiterIdleTimeout = 10 * time.Minute
+
+// RateLimit 令牌桶限流和最大并发, 字段为 0 时不限制
+type RateLimit struct {
+	QPS         float64
+	Burst       int // 为 0 时取 QPS 向上取整
+	MaxInFlight int
+}
+
+func (l RateLimit) enabled() bool {
+	return l.QPS > 0 || l.MaxInFlight > 0
+}
+
+type limiterEntry struct {
+	limiter  *rate.Limiter
+	inflight int
+	lastSeen time.Time
+}
+
+// keyedLimiter 按 key (agent, 用户, agent+用户) 分别限流
+type keyedLimiter struct {
+	name  string
+	limit RateLimit
+
+	mu        sync.Mutex
+	entries   map[string]*limiterEntry
+	lastPrune time.Time
+}
+
+func newKeyedLimiter(name string, limit RateLimit) *keyedLimiter {
+	return &keyedLimiter{
+		name:      name,
+		limit:     limit,
+		entries:   map[string]*limiterEntry{},
+		lastPrune: time.Now(),
+	}
+}
+
+// limitGrant 通过一个维度的限流后占用的令牌和并发数
+type limitGrant struct {
+	kl   *keyedLimiter
+	e    *limiterEntry
+	r    *rate.Reservation // 不限 qps 时为空
+	at   time.Time         // 预留令牌的时间
+	once sync.Once
+}
+
+// release 请求结束后归还并发数, 令牌已经用掉
+func (g *limitGrant) release() {
+	g.once.Do(func() {
+		g.kl.mu.Lock()
+		defer g.kl.mu.Unlock()
+		g.e.inflight--
+	})
+}
+
+// cancel 后面的维度拒绝了请求, 同时归还令牌, 被拒绝的请求不占用其他维度的配额
+func (g *limitGrant) cancel() {
+	// 令牌在预留时立即生效, 按预留时间取消才能归还
+	if g.r != nil {
+		g.r.CancelAt(g.at)
+	}
+	g.release()
+}
+
+// acquire 成功时返回占用的配额, 被限流时返回需要等待的时间
+func (kl *keyedLimiter) acquire(key string) (*limitGrant, time.Duration, error) {
+	kl.mu.Lock()
+	defer kl.mu.Unlock()
+
+	now := time.Now()
+	kl.prune(now)
+
+	e, ok := kl.entries[key]
+	if !ok {
+		e = &limiterEntry{}
+		if kl.limit.QPS > 0 {
+			burst := kl.limit.Burst
+			if burst <= 0 {
+				burst = int(math.Ceil(kl.limit.QPS))
+			}
+			e.limiter = rate.NewLimiter(rate.Limit(kl.limit.QPS), burst)
+		}
+		kl.entries[key] = e
+	}
+	e.lastSeen = now
+
+	if kl.limit.MaxInFlight > 0 && e.inflight >= kl.limit.MaxInFlight {
+		return nil, time.Second, fmt.Errorf("too many in-flight requests for %s %s, limit %d", kl.name, key, kl.limit.MaxInFlight)
+	}
+	g := &limitGrant{kl: kl, e: e, at: now}
+	if e.limiter != nil {
+		r := e.limiter.ReserveN(now, 1)
+		if delay := r.DelayFrom(now); !r.OK() || delay > 0 {
+			r.CancelAt(now)
+			return nil, delay, fmt.Errorf("rate limit exceeded for %s %s, %g qps", kl.name, key, kl.limit.QPS)
+		}
+		g.r = r
+	}
+
+	e.inflight++
+	return g, 0, nil
+}
+
+// 调用方需持有锁
+func (kl *keyedLimiter) prune(now time.Time) {
+	if now.Sub(kl.lastPrune) < limiterIdleTimeout {
+		return
+	}
+	kl.lastPrune = now
+
+	for key, e := range kl.entries {
+		if e.inflight == 0 && now.Sub(e.lastSeen) > limiterIdleTimeout {
+			delete(kl.entries, key)
+		}
+	}
+}
+
+// rateLimiters 依次检查 agent, 用户, agent+用户 三个维度, 任一维度拒绝时归还之前维度的令牌
+type rateLimiters struct {
+	agent     *keyedLimiter
+	user      *keyedLimiter
+	agentUser *keyedLimiter
+}
+
+func newRateLimiters(opt *Option) *rateLimiters {
+	rl := &rateLimiters{}
+	if opt.AgentRateLimit.enabled() {
+		rl.agent = newKeyedLimiter("agent", opt.AgentRateLimit)
+	}
+	if opt.UserRateLimit.enabled() {
+		rl.user = newKeyedLimiter("user", opt.UserRateLimit)
+	}
+	if opt.AgentUserRateLimit.enabled() {
+		rl.agentUser = newKeyedLimiter("agent+user", opt.AgentUserRateLimit)
+	}
+
+	return rl
+}
+
+// limit 对请求限流, 被限流时返回 429 StatusErr, 成功后需调用 release
+func (gw *Gateway) limit(request *http.Request, agentName string) (func(), *StatusErr) {
+	user := gw.user(request)
+
+	var grants []*limitGrant
+	release := func() {
+		for _, g := range grants {
+			g.release()
+		}
+	}
+
+	for _, c := range []struct {
+		limiter *keyedLimiter
+		key     string
+	}{
+		{gw.limiters.agent, agentName},
+		{gw.limiters.user, user},
+		{gw.limiters.agentUser, agentName + "/" + user},
+	} {
+		if c.limiter == nil {
+			continue
+		}
+		g, retryAfter, err := c.limiter.acquire(c.key)
+		if err != nil {
+			for _, g := range grants {
+				g.cancel()
+			}
+			if retryAfter < time.Second {
+				retryAfter = time.Second
+			}
+			return nil, NewStatusErr(http.StatusTooManyRequests, err).WithRetryAfter(retryAfter)
+		}
+		grants = append(grants, g)
+	}
+
+	return release, nil
+}
+
+// user 请求方的身份. Impersonate-User 和 basic auth 用户名都由客户端填写, 未经校验不能作为身份,
+// 因此没有配置 Option.User 时按客户端 ip 限流
+func (gw *Gateway) user(request *http.Request) string {
+	if gw.opt.User != nil {
+		return gw.opt.User(request)
+	}
+
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return request.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,169 @@
+package gateway_test
+
+import (
+	"k8s-tunnel/pkg/gateway"
+	"k8s-tunnel/pkg/tunneltest"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// 请求 /block 时阻塞, 直到 release 被关闭
+func blockingUpstream(entered chan struct{}, release chan struct{}) func(string) http.Handler {
+	return func(string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/block" {
+				entered <- struct{}{}
+				<-release
+			}
+			_, _ = w.Write([]byte("ok"))
+		})
+	}
+}
+
+// userHeader 测试中由 Option.User 信任的身份 header, 代替认证的结果
+const userHeader = "X-Authenticated-User"
+
+func proxyGet(t *testing.T, url, user string) *http.Response {
+	t.Helper()
+
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	if user != "" {
+		req.Header.Set(userHeader, user)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp
+}
+
+func assertTooManyRequests(t *testing.T, resp *http.Response) {
+	t.Helper()
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("expect 429 with Retry-After, got %d %v", resp.StatusCode, resp.Header)
+	}
+	if status := decodeStatus(t, resp); status.Reason != "TooManyRequests" {
+		t.Fatalf("unexpected status %+v", status)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	t.Run("#agent qps", func(t *testing.T) {
+		h := tunneltest.New(t, &tunneltest.Option{
+			Gateway: &gateway.Option{AgentRateLimit: gateway.RateLimit{QPS: 0.1, Burst: 2}},
+		})
+		h.StartAgent("a")
+		h.StartAgent("b")
+
+		for i := 0; i < 2; i++ {
+			resp := proxyGet(t, h.URL("a", "/"), "")
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status %d", resp.StatusCode)
+			}
+		}
+		assertTooManyRequests(t, proxyGet(t, h.URL("a", "/"), ""))
+
+		// 其他 agent 不受影响
+		resp := proxyGet(t, h.URL("b", "/"), "")
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("#user max in-flight", func(t *testing.T) {
+		entered, release := make(chan struct{}, 2), make(chan struct{})
+		h := tunneltest.New(t, &tunneltest.Option{
+			Gateway: &gateway.Option{
+				AgentUserRateLimit: gateway.RateLimit{MaxInFlight: 1},
+				User:               func(req *http.Request) string { return req.Header.Get(userHeader) },
+			},
+			Upstream: blockingUpstream(entered, release),
+		})
+		h.StartAgent("a")
+
+		done := make(chan int)
+		go func() {
+			resp := proxyGet(t, h.URL("a", "/block"), "alice")
+			resp.Body.Close()
+			done <- resp.StatusCode
+		}()
+		select {
+		case <-entered:
+		case <-time.After(tunneltest.DefaultWaitTimeout):
+			t.Fatal("request not forwarded")
+		}
+
+		assertTooManyRequests(t, proxyGet(t, h.URL("a", "/"), "alice"))
+		resp := proxyGet(t, h.URL("a", "/"), "bob")
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("other user: status %d", resp.StatusCode)
+		}
+
+		close(release)
+		if code := <-done; code != http.StatusOK {
+			t.Fatalf("status %d", code)
+		}
+		// 请求结束后释放并发数
+		resp = proxyGet(t, h.URL("a", "/"), "alice")
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status %d after release", resp.StatusCode)
+		}
+	})
+
+	t.Run("#rejected request returns tokens", func(t *testing.T) {
+		h := tunneltest.New(t, &tunneltest.Option{
+			Gateway: &gateway.Option{
+				AgentRateLimit: gateway.RateLimit{QPS: 0.1, Burst: 2},
+				UserRateLimit:  gateway.RateLimit{QPS: 0.1, Burst: 1},
+				User:           func(req *http.Request) string { return req.Header.Get(userHeader) },
+			},
+		})
+		h.StartAgent("a")
+
+		resp := proxyGet(t, h.URL("a", "/"), "alice")
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status %d", resp.StatusCode)
+		}
+		// 被用户维度拒绝的请求不消耗 agent 维度的令牌
+		for i := 0; i < 3; i++ {
+			assertTooManyRequests(t, proxyGet(t, h.URL("a", "/"), "alice"))
+		}
+		resp = proxyGet(t, h.URL("a", "/"), "bob")
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("other user: status %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("#unverified identity ignored", func(t *testing.T) {
+		h := tunneltest.New(t, &tunneltest.Option{
+			Gateway: &gateway.Option{UserRateLimit: gateway.RateLimit{QPS: 0.1, Burst: 1}},
+		})
+		h.StartAgent("a")
+
+		resp := proxyGet(t, h.URL("a", "/"), "")
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status %d", resp.StatusCode)
+		}
+
+		// 没有配置 Option.User 时按客户端 ip 限流, 换一个 Impersonate-User 或 basic auth 用户名不能绕过
+		req, _ := http.NewRequest(http.MethodGet, h.URL("a", "/"), nil)
+		req.Header.Set("Impersonate-User", "bob")
+		req.SetBasicAuth("bob", "")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertTooManyRequests(t, resp)
+	})
+}
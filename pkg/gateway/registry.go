@@ -0,0 +1,331 @@
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+	"net/http"
+	"time"
+)
+
+// DefaultRegistryHistory 每个 agent 保留的连接记录数
+const DefaultRegistryHistory = 50
+
+// gateway 重启时仍处于连接状态的记录, 以此作为断开原因
+const reasonGatewayRestarted = "gateway restarted"
+
+var agentsBucket = []byte("agents")
+
+// Connection agent 的一次连接
+type Connection struct {
+	ConnectedAt     time.Time  `json:"connectedAt"`
+	DisconnectedAt  *time.Time `json:"disconnectedAt,omitempty"` // 为空表示仍在连接中
+	Reason          string     `json:"reason,omitempty"`         // 断开原因
+	RemoteAddr      string     `json:"remoteAddr,omitempty"`
+	Transport       string     `json:"transport,omitempty"`
+	ProtocolVersion int        `json:"protocolVersion,omitempty"`
+	AgentVersion    string     `json:"agentVersion,omitempty"`
+	CertSerial      string     `json:"certSerial,omitempty"`
+}
+
+// AgentRecord 持久化的 agent 注册记录
+type AgentRecord struct {
+	Name                 string       `json:"name"`
+	FirstSeen            time.Time    `json:"firstSeen"`
+	LastSeen             time.Time    `json:"lastSeen"` // 在线时为当前时间
+	Online               bool         `json:"online"`
+	LastDisconnectReason string       `json:"lastDisconnectReason,omitempty"` // 最近一次断开的原因
+	Connections          int          `json:"connections"`                    // 累计连接次数
+	History              []Connection `json:"history,omitempty"`              // 最近的连接, 新的在前
+}
+
+type AgentRecordList struct {
+	Items []*AgentRecord `json:"items"`
+}
+
+// Registry 基于 bolt 的 agent 注册记录, gateway 重启后仍然保留
+type Registry struct {
+	db         *bolt.DB
+	maxHistory int
+}
+
+// OpenRegistry 打开或创建 path 处的数据库, 上次未正常结束的连接记为 gateway 重启断开
+func OpenRegistry(path string) (*Registry, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open registry %s: %v", path, err)
+	}
+	r := &Registry{db: db, maxHistory: DefaultRegistryHistory}
+
+	now := time.Now()
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(agentsBucket)
+		if err != nil {
+			return err
+		}
+		return b.ForEach(func(k, v []byte) error {
+			record := &AgentRecord{}
+			if err := json.Unmarshal(v, record); err != nil {
+				return fmt.Errorf("invalid record %s: %v", k, err)
+			}
+			if !record.Online {
+				return nil
+			}
+			// 进程退出时来不及记录, 无法知道确切的断开时间
+			record.disconnect(func(c *Connection) bool { return c.DisconnectedAt == nil }, now, reasonGatewayRestarted)
+			return put(b, record)
+		})
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Ping 检查数据库是否可读
+func (r *Registry) Ping() error {
+	return r.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(agentsBucket) == nil {
+			return errors.New("agents bucket not found")
+		}
+		return nil
+	})
+}
+
+func (r *Registry) Close() error {
+	return r.db.Close()
+}
+
+// Get 返回 agent 的记录, 从未注册过时返回 false
+func (r *Registry) Get(agentName string) (*AgentRecord, bool, error) {
+	var record *AgentRecord
+	err := r.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(agentsBucket).Get([]byte(agentName))
+		if v == nil {
+			return nil
+		}
+		record = &AgentRecord{}
+		return json.Unmarshal(v, record)
+	})
+	if err != nil || record == nil {
+		return nil, false, err
+	}
+	record.seen()
+
+	return record, true, nil
+}
+
+// List 返回所有 agent 的记录, 按名称排序, 不包含连接历史
+func (r *Registry) List() (*AgentRecordList, error) {
+	list := &AgentRecordList{Items: []*AgentRecord{}}
+	err := r.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(agentsBucket).ForEach(func(k, v []byte) error {
+			record := &AgentRecord{}
+			if err := json.Unmarshal(v, record); err != nil {
+				return err
+			}
+			record.seen()
+			record.History = nil
+			list.Items = append(list.Items, record)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return list, nil
+}
+
+// Delete 删除 agent 的记录, 用于清理已下线的集群, 不存在时返回 false
+func (r *Registry) Delete(agentName string) (bool, error) {
+	found := false
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(agentsBucket)
+		if b.Get([]byte(agentName)) == nil {
+			return nil
+		}
+		found = true
+		return b.Delete([]byte(agentName))
+	})
+
+	return found, err
+}
+
+// connected 记录一次新的连接
+func (r *Registry) connected(t *Tunnel) error {
+	conn := Connection{ConnectedAt: t.ConnectedAt, RemoteAddr: t.conn.RemoteAddr().String(), Transport: string(t.Transport)}
+	if t.Session != nil {
+		conn.ProtocolVersion = t.Session.ProtocolVersion
+		conn.AgentVersion = t.Session.PeerVersion
+	}
+	if cert := t.Certificate(); cert != nil {
+		conn.CertSerial = cert.SerialNumber.String()
+	}
+
+	return r.update(t.Name, true, func(record *AgentRecord) {
+		if record.FirstSeen.IsZero() {
+			record.FirstSeen = t.ConnectedAt
+		}
+		record.LastSeen = t.ConnectedAt
+		record.Online = true
+		record.Connections++
+		record.History = append([]Connection{conn}, record.History...)
+		if len(record.History) > r.maxHistory {
+			record.History = record.History[:r.maxHistory]
+		}
+	})
+}
+
+// disconnected 记录 tunnel 断开的时间和原因
+func (r *Registry) disconnected(t *Tunnel) error {
+	// 连接期间记录可能被删除, 此时不再重建
+	return r.update(t.Name, false, func(record *AgentRecord) {
+		record.disconnect(func(c *Connection) bool { return c.ConnectedAt.Equal(t.ConnectedAt) }, time.Now(), t.CloseReason())
+	})
+}
+
+// update 修改 agent 的记录, 记录不存在且 create 为 false 时什么都不做
+func (r *Registry) update(agentName string, create bool, fn func(record *AgentRecord)) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(agentsBucket)
+		record := &AgentRecord{Name: agentName}
+		v := b.Get([]byte(agentName))
+		if v == nil && !create {
+			return nil
+		}
+		if v != nil {
+			if err := json.Unmarshal(v, record); err != nil {
+				return err
+			}
+		}
+		fn(record)
+		return put(b, record)
+	})
+}
+
+func put(b *bolt.Bucket, record *AgentRecord) error {
+	v, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(record.Name), v)
+}
+
+// disconnect 结束 match 的连接, 没有其他连接中的记录时标记为离线
+func (record *AgentRecord) disconnect(match func(c *Connection) bool, at time.Time, reason string) {
+	record.Online = false
+	for i := range record.History {
+		c := &record.History[i]
+		if c.DisconnectedAt == nil && match(c) {
+			c.DisconnectedAt = &at
+			c.Reason = reason
+			record.LastSeen = at
+			record.LastDisconnectReason = reason
+		} else if c.DisconnectedAt == nil {
+			// 重新注册时旧连接可能晚于新连接断开
+			record.Online = true
+		}
+	}
+}
+
+// seen 在线的 agent 最近一次出现的时间为当前时间
+func (record *AgentRecord) seen() {
+	if record.Online {
+		record.LastSeen = time.Now()
+	}
+}
+
+// recordConnected 和 recordDisconnected 在未开启注册记录时什么都不做, 写入失败只打日志, 不影响 tunnel.
+// recordConnected 需要在 tunnel 的读写协程启动前调用, 保证断开记录在连接记录之后
+func (gw *Gateway) recordConnected(t *Tunnel) {
+	if gw.opt.Registry == nil {
+		return
+	}
+	if err := gw.opt.Registry.connected(t); err != nil {
+		logrus.Errorf("%s record connection error. err:%v", t.Name, err)
+	}
+}
+
+func (gw *Gateway) recordDisconnected(t *Tunnel) {
+	if gw.opt.Registry == nil {
+		return
+	}
+	if err := gw.opt.Registry.disconnected(t); err != nil {
+		logrus.Errorf("%s record disconnection error. err:%v", t.Name, err)
+	}
+}
+
+func (gw *Gateway) registryEnabled(writer http.ResponseWriter, request *http.Request) bool {
+	if err := gw.authenticateAdmin(request); err != nil {
+		RESP(writer, NewStatusErr(http.StatusUnauthorized, err))
+		return false
+	}
+	if gw.opt.Registry == nil {
+		RESP(writer, NewStatusErr(http.StatusNotFound, errors.New("agent registry is not enabled")))
+		return false
+	}
+
+	return true
+}
+
+// GET /registry/agents
+func (gw *Gateway) listRecordsHandler(writer http.ResponseWriter, request *http.Request) {
+	if !gw.registryEnabled(writer, request) {
+		return
+	}
+
+	list, err := gw.opt.Registry.List()
+	if err != nil {
+		RESP(writer, NewStatusErr(http.StatusInternalServerError, err))
+		return
+	}
+
+	writeJSON(writer, http.StatusOK, list)
+}
+
+// GET /registry/agents/{agentName}
+func (gw *Gateway) getRecordHandler(writer http.ResponseWriter, request *http.Request) {
+	if !gw.registryEnabled(writer, request) {
+		return
+	}
+
+	agentName := mux.Vars(request)["agentName"]
+	record, ok, err := gw.opt.Registry.Get(agentName)
+	if err != nil {
+		RESP(writer, NewStatusErr(http.StatusInternalServerError, err))
+		return
+	}
+	if !ok {
+		RESP(writer, NewStatusErr(http.StatusNotFound, fmt.Errorf("agent %s has never registered", agentName)))
+		return
+	}
+
+	writeJSON(writer, http.StatusOK, record)
+}
+
+// DELETE /registry/agents/{agentName}
+func (gw *Gateway) deleteRecordHandler(writer http.ResponseWriter, request *http.Request) {
+	if !gw.registryEnabled(writer, request) {
+		return
+	}
+
+	agentName := mux.Vars(request)["agentName"]
+	ok, err := gw.opt.Registry.Delete(agentName)
+	if err != nil {
+		RESP(writer, NewStatusErr(http.StatusInternalServerError, err))
+		return
+	}
+	if !ok {
+		RESP(writer, NewStatusErr(http.StatusNotFound, fmt.Errorf("agent %s has never registered", agentName)))
+		return
+	}
+	logrus.Infof("deleted registry record of %s", agentName)
+
+	writer.WriteHeader(http.StatusNoContent)
+}
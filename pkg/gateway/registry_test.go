@@ -0,0 +1,121 @@
+package gateway_test
+
+import (
+	"encoding/json"
+	"k8s-tunnel/pkg/gateway"
+	"k8s-tunnel/pkg/tunneltest"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openRegistry(t *testing.T, path string) *gateway.Registry {
+	t.Helper()
+
+	r, err := gateway.OpenRegistry(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = r.Close() })
+
+	return r
+}
+
+// waitRecord 等待 agent 的记录满足 cond
+func waitRecord(t *testing.T, r *gateway.Registry, agentName string, cond func(record *gateway.AgentRecord) bool) *gateway.AgentRecord {
+	t.Helper()
+
+	deadline := time.Now().Add(tunneltest.DefaultWaitTimeout)
+	for {
+		record, ok, err := r.Get(agentName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok && cond(record) {
+			return record
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected record %+v", record)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	t.Run("#history", func(t *testing.T) {
+		r := openRegistry(t, filepath.Join(t.TempDir(), "registry.db"))
+		h := tunneltest.New(t, &tunneltest.Option{Gateway: &gateway.Option{Registry: r, AuthenticateAdmin: allowAdmin}})
+		h.StartAgent("huawei")
+		h.StopAgent("huawei")
+		waitRecord(t, r, "huawei", func(record *gateway.AgentRecord) bool { return !record.Online })
+		h.StartAgent("huawei")
+
+		resp, err := http.Get("http://" + h.GatewayHost() + "/registry/agents/huawei")
+		if err != nil {
+			t.Fatal(err)
+		}
+		record := &gateway.AgentRecord{}
+		_ = json.NewDecoder(resp.Body).Decode(record)
+		resp.Body.Close()
+		if !record.Online || record.Connections != 2 || len(record.History) != 2 {
+			t.Fatalf("unexpected record %+v", record)
+		}
+		if last := record.History[1]; last.DisconnectedAt == nil || last.Reason == "" || record.LastDisconnectReason != last.Reason {
+			t.Fatalf("unexpected disconnection %+v", last)
+		}
+		if current := record.History[0]; current.DisconnectedAt != nil || current.RemoteAddr == "" || current.ProtocolVersion == 0 {
+			t.Fatalf("unexpected connection %+v", current)
+		}
+		if record.FirstSeen.After(record.History[1].ConnectedAt) {
+			t.Fatalf("first seen %s after first connection", record.FirstSeen)
+		}
+
+		resp, err = http.Get("http://" + h.GatewayHost() + "/registry/agents")
+		if err != nil {
+			t.Fatal(err)
+		}
+		list := &gateway.AgentRecordList{}
+		_ = json.NewDecoder(resp.Body).Decode(list)
+		resp.Body.Close()
+		if len(list.Items) != 1 || list.Items[0].Name != "huawei" || list.Items[0].History != nil {
+			t.Fatalf("unexpected records %+v", list.Items)
+		}
+
+		// 从未注册过和已删除的都返回 404
+		if resp := adminRequest(t, http.MethodGet, "http://"+h.GatewayHost()+"/registry/agents/tencent", nil); resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("unknown agent status %d", resp.StatusCode)
+		}
+		if resp := adminRequest(t, http.MethodDelete, "http://"+h.GatewayHost()+"/registry/agents/huawei", nil); resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("delete status %d", resp.StatusCode)
+		}
+		h.StopAgent("huawei")
+		if _, ok, _ := r.Get("huawei"); ok {
+			t.Fatal("deleted record recreated on disconnect")
+		}
+	})
+
+	t.Run("#gateway restarted", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "registry.db")
+		r, err := gateway.OpenRegistry(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := tunneltest.New(t, &tunneltest.Option{Gateway: &gateway.Option{Registry: r}})
+		h.StartAgent("huawei")
+
+		// 模拟进程退出, 断开时来不及记录
+		_ = r.Close()
+		record := waitRecord(t, openRegistry(t, path), "huawei", func(record *gateway.AgentRecord) bool { return true })
+		if record.Online || record.LastDisconnectReason != "gateway restarted" || record.History[0].DisconnectedAt == nil {
+			t.Fatalf("unexpected record %+v", record)
+		}
+	})
+
+	t.Run("#disabled", func(t *testing.T) {
+		h := tunneltest.New(t, &tunneltest.Option{Gateway: &gateway.Option{AuthenticateAdmin: allowAdmin}})
+		if resp := adminRequest(t, http.MethodGet, "http://"+h.GatewayHost()+"/registry/agents", nil); resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("status %d", resp.StatusCode)
+		}
+	})
+}
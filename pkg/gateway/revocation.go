@@ -0,0 +1,332 @@
+package gateway
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"math/big"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const DefaultRevalidateInterval = time.Minute
+
+type RevocationKind string
+
+const (
+	RevokeAgent  RevocationKind = "agent"  // 按 agent 名称
+	RevokeToken  RevocationKind = "token"  // 按 bootstrap token id, 包括用它签发和续期的证书
+	RevokeSerial RevocationKind = "serial" // 按证书序列号 (十进制)
+)
+
+type Revocation struct {
+	Kind      RevocationKind `json:"kind"`
+	Value     string         `json:"value"`
+	Reason    string         `json:"reason,omitempty"`
+	RevokedAt time.Time      `json:"revokedAt"`
+}
+
+type RevocationList struct {
+	Items []Revocation `json:"items"`
+}
+
+func (r *Revocation) Validate() error {
+	switch r.Kind {
+	case RevokeAgent, RevokeToken:
+	case RevokeSerial:
+		if _, ok := new(big.Int).SetString(r.Value, 10); !ok {
+			return fmt.Errorf("invalid serial %q", r.Value)
+		}
+	default:
+		return fmt.Errorf("unknown revocation kind %q", r.Kind)
+	}
+	if r.Value == "" {
+		return errors.New("revocation value is empty")
+	}
+
+	return nil
+}
+
+// Revocations 吊销列表, path 不为空时每次修改都写入文件
+type Revocations struct {
+	path string
+
+	mu    sync.RWMutex
+	items map[RevocationKind]map[string]Revocation
+}
+
+func NewRevocations() *Revocations {
+	return &Revocations{items: map[RevocationKind]map[string]Revocation{}}
+}
+
+// LoadRevocations 读取 json 格式的吊销列表, 文件不存在时为空, 之后的修改会写回该文件
+func LoadRevocations(path string) (*Revocations, error) {
+	r := NewRevocations()
+	r.path = path
+
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	list := &RevocationList{}
+	if err = json.Unmarshal(b, list); err != nil {
+		return nil, fmt.Errorf("parse revocations %s: %v", path, err)
+	}
+	for _, item := range list.Items {
+		if err = item.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid revocations %s: %v", path, err)
+		}
+		r.set(item)
+	}
+
+	return r, nil
+}
+
+// 调用方需持有锁
+func (r *Revocations) set(item Revocation) {
+	if r.items[item.Kind] == nil {
+		r.items[item.Kind] = map[string]Revocation{}
+	}
+	r.items[item.Kind][item.Value] = item
+}
+
+// Add 添加吊销记录. 写文件失败时返回错误, 但记录仍然在内存中生效
+func (r *Revocations) Add(item Revocation) error {
+	if err := item.Validate(); err != nil {
+		return err
+	}
+	if item.RevokedAt.IsZero() {
+		item.RevokedAt = time.Now()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.set(item)
+	return r.save()
+}
+
+// Remove 撤销吊销, 不存在时返回 false
+func (r *Revocations) Remove(kind RevocationKind, value string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.items[kind][value]; !ok {
+		return false, nil
+	}
+	delete(r.items[kind], value)
+
+	return true, r.save()
+}
+
+func (r *Revocations) List() *RevocationList {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.list()
+}
+
+// 调用方需持有锁
+func (r *Revocations) list() *RevocationList {
+	list := &RevocationList{Items: []Revocation{}}
+	for _, items := range r.items {
+		for _, item := range items {
+			list.Items = append(list.Items, item)
+		}
+	}
+	sort.Slice(list.Items, func(i, j int) bool {
+		a, b := list.Items[i], list.Items[j]
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		return a.Value < b.Value
+	})
+
+	return list
+}
+
+// Match 返回命中的吊销记录, cert 为空时只检查 agent 名称
+func (r *Revocations) Match(agentName string, cert *x509.Certificate) (Revocation, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if item, ok := r.items[RevokeAgent][agentName]; ok {
+		return item, true
+	}
+	if cert == nil {
+		return Revocation{}, false
+	}
+	if item, ok := r.items[RevokeSerial][cert.SerialNumber.String()]; ok {
+		return item, true
+	}
+	if id := TokenID(cert); id != "" {
+		if item, ok := r.items[RevokeToken][id]; ok {
+			return item, true
+		}
+	}
+
+	return Revocation{}, false
+}
+
+// TokenRevoked bootstrap token 是否已被吊销
+func (r *Revocations) TokenRevoked(tokenID string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	_, ok := r.items[RevokeToken][tokenID]
+	return ok
+}
+
+// 调用方需持有锁
+func (r *Revocations) save() error {
+	if r.path == "" {
+		return nil
+	}
+
+	b, err := json.MarshalIndent(r.list(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := r.path + ".tmp"
+	if err = os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.path)
+}
+
+func (item Revocation) err() error {
+	if item.Reason != "" {
+		return fmt.Errorf("%s %s has been revoked: %s", item.Kind, item.Value, item.Reason)
+	}
+	return fmt.Errorf("%s %s has been revoked", item.Kind, item.Value)
+}
+
+// Revoke 添加吊销记录, 并立即关闭命中的 tunnel. 吊销记录没能持久化时同样关闭, 再返回错误
+func (gw *Gateway) Revoke(item Revocation) error {
+	if err := item.Validate(); err != nil {
+		return err
+	}
+	// Add 只在写文件时失败, 此时吊销已在内存中生效
+	err := gw.opt.Revocations.Add(item)
+	for _, t := range gw.Tunnels() {
+		if err := gw.validateTunnel(t); err != nil {
+			logrus.Warnf("%s close tunnel. err:%v", t.Name, err)
+			t.CloseWithReason(err.Error())
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("revoked until restart, save revocations error: %v", err)
+	}
+
+	return nil
+}
+
+// RevokeCertificate 吊销 agent 证书, 之后使用该证书的注册和续期都会被拒绝
+func (gw *Gateway) RevokeCertificate(serial *big.Int) error {
+	return gw.Revoke(Revocation{Kind: RevokeSerial, Value: serial.String()})
+}
+
+// validateTunnel 检查 tunnel 的身份是否仍然有效: 未被吊销, 证书未过期
+func (gw *Gateway) validateTunnel(t *Tunnel) error {
+	cert := t.Certificate()
+	if item, ok := gw.opt.Revocations.Match(t.Name, cert); ok {
+		return item.err()
+	}
+	if cert != nil && time.Now().After(cert.NotAfter) {
+		return fmt.Errorf("certificate %s expired at %s", cert.SerialNumber, cert.NotAfter.Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// revalidate 定期重新校验长连接的身份, 失效后关闭 tunnel, agent 需要用新的证书重新注册
+func (t *Tunnel) revalidate(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := t.gateway.validateTunnel(t); err != nil {
+				logrus.Warnf("%s revalidate failed, close tunnel. err:%v", t.Name, err)
+				t.CloseWithReason(err.Error())
+				return
+			}
+		case <-t.done:
+			return
+		}
+	}
+}
+
+func (gw *Gateway) authenticateAdmin(req *http.Request) error {
+	if gw.opt.AuthenticateAdmin != nil {
+		return gw.opt.AuthenticateAdmin(req)
+	}
+
+	return gw.authenticate(req)
+}
+
+// GET /revocations
+// POST /revocations
+func (gw *Gateway) revocationsHandler(writer http.ResponseWriter, request *http.Request) {
+	if err := gw.authenticateAdmin(request); err != nil {
+		RESP(writer, NewStatusErr(http.StatusUnauthorized, err))
+		return
+	}
+
+	if request.Method == http.MethodGet {
+		writeJSON(writer, http.StatusOK, gw.opt.Revocations.List())
+		return
+	}
+
+	item := Revocation{}
+	if err := json.NewDecoder(request.Body).Decode(&item); err != nil {
+		RESP(writer, NewStatusErr(http.StatusBadRequest, err))
+		return
+	}
+	if err := item.Validate(); err != nil {
+		RESP(writer, NewStatusErr(http.StatusBadRequest, err))
+		return
+	}
+	item.RevokedAt = time.Now()
+	if err := gw.Revoke(item); err != nil {
+		RESP(writer, NewStatusErr(http.StatusInternalServerError, err))
+		return
+	}
+	logrus.Infof("revoked %s %s, reason:%s", item.Kind, item.Value, item.Reason)
+
+	writeJSON(writer, http.StatusCreated, item)
+}
+
+// DELETE /revocations/{kind}/{value}
+func (gw *Gateway) deleteRevocationHandler(writer http.ResponseWriter, request *http.Request) {
+	if err := gw.authenticateAdmin(request); err != nil {
+		RESP(writer, NewStatusErr(http.StatusUnauthorized, err))
+		return
+	}
+
+	vars := mux.Vars(request)
+	ok, err := gw.opt.Revocations.Remove(RevocationKind(vars["kind"]), vars["value"])
+	if err != nil {
+		RESP(writer, NewStatusErr(http.StatusInternalServerError, err))
+		return
+	}
+	if !ok {
+		RESP(writer, NewStatusErr(http.StatusNotFound, fmt.Errorf("%s %s is not revoked", vars["kind"], vars["value"])))
+		return
+	}
+	logrus.Infof("unrevoked %s %s", vars["kind"], vars["value"])
+
+	writer.WriteHeader(http.StatusNoContent)
+}
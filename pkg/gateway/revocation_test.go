@@ -0,0 +1,161 @@
+package gateway_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"k8s-tunnel/pkg/gateway"
+	"k8s-tunnel/pkg/tunneltest"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func adminRequest(t *testing.T, method, url string, body interface{}) *http.Response {
+	t.Helper()
+
+	var b []byte
+	if body != nil {
+		b, _ = json.Marshal(body)
+	}
+	req, _ := http.NewRequest(method, url, bytes.NewReader(b))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	return resp
+}
+
+// allowAdmin 放行所有管理请求, 没有配置认证时不会注册管理接口
+func allowAdmin(*http.Request) error { return nil }
+
+func TestRevocation(t *testing.T) {
+	t.Run("#admin api", func(t *testing.T) {
+		h := tunneltest.New(t, &tunneltest.Option{Gateway: &gateway.Option{AuthenticateAdmin: allowAdmin}})
+		h.StartAgent("huawei")
+		base := "http://" + h.GatewayHost() + "/revocations"
+
+		revocation := gateway.Revocation{Kind: gateway.RevokeAgent, Value: "huawei", Reason: "compromised"}
+		if resp := adminRequest(t, http.MethodPost, base, revocation); resp.StatusCode != http.StatusCreated {
+			t.Fatalf("revoke status %d", resp.StatusCode)
+		}
+		// 立即关闭, 并拒绝重连
+		if _, ok := h.Gateway.Tunnel("huawei"); ok {
+			t.Fatal("revoked tunnel should be closed")
+		}
+		time.Sleep(5 * tunneltest.DefaultReconnectInterval)
+		if _, ok := h.Gateway.Tunnel("huawei"); ok {
+			t.Fatal("revoked agent reconnected")
+		}
+
+		resp, err := http.Get(base)
+		if err != nil {
+			t.Fatal(err)
+		}
+		list := &gateway.RevocationList{}
+		_ = json.NewDecoder(resp.Body).Decode(list)
+		resp.Body.Close()
+		if len(list.Items) != 1 || list.Items[0].Reason != "compromised" || list.Items[0].RevokedAt.IsZero() {
+			t.Fatalf("unexpected revocations %+v", list.Items)
+		}
+
+		if resp := adminRequest(t, http.MethodDelete, base+"/agent/huawei", nil); resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("unrevoke status %d", resp.StatusCode)
+		}
+		if err = h.WaitForAgent("huawei", tunneltest.DefaultWaitTimeout); err != nil {
+			t.Fatal(err)
+		}
+		if resp := adminRequest(t, http.MethodDelete, base+"/agent/huawei", nil); resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("unrevoke again status %d", resp.StatusCode)
+		}
+		if resp := adminRequest(t, http.MethodPost, base, gateway.Revocation{Kind: "user", Value: "x"}); resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("invalid revocation status %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("#admin api without authentication", func(t *testing.T) {
+		h := tunneltest.New(t, nil)
+		h.StartAgent("huawei")
+
+		revocation := gateway.Revocation{Kind: gateway.RevokeAgent, Value: "huawei"}
+		if resp := adminRequest(t, http.MethodPost, "http://"+h.GatewayHost()+"/revocations", revocation); resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("revoke status %d", resp.StatusCode)
+		}
+		if _, ok := h.Gateway.Tunnel("huawei"); !ok {
+			t.Fatal("tunnel closed by unauthenticated request")
+		}
+	})
+
+	t.Run("#persisted", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "revocations.json")
+		r, err := gateway.LoadRevocations(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, item := range []gateway.Revocation{
+			{Kind: gateway.RevokeSerial, Value: "12345"},
+			{Kind: gateway.RevokeToken, Value: "abcdef"},
+		} {
+			if err = r.Add(item); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err = r.Remove(gateway.RevokeToken, "abcdef"); err != nil {
+			t.Fatal(err)
+		}
+
+		r, err = gateway.LoadRevocations(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if items := r.List().Items; len(items) != 1 || items[0].Value != "12345" {
+			t.Fatalf("unexpected revocations %+v", items)
+		}
+	})
+
+	t.Run("#save failed", func(t *testing.T) {
+		// 所在目录不存在, 写文件必然失败
+		revocations, err := gateway.LoadRevocations(filepath.Join(t.TempDir(), "missing", "revocations.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := tunneltest.New(t, &tunneltest.Option{Gateway: &gateway.Option{Revocations: revocations}})
+		h.StartAgent("huawei")
+
+		if err = h.Gateway.Revoke(gateway.Revocation{Kind: gateway.RevokeAgent, Value: "huawei"}); err == nil {
+			t.Fatal("expected save error")
+		}
+		if _, ok := h.Gateway.Tunnel("huawei"); ok {
+			t.Fatal("revoked tunnel should be closed even if saving failed")
+		}
+	})
+
+	t.Run("#token and revalidate", func(t *testing.T) {
+		ca, err := gateway.NewCA()
+		if err != nil {
+			t.Fatal(err)
+		}
+		revocations := gateway.NewRevocations()
+		h, _ := caHarness(t, ca, &gateway.Option{
+			Revocations:        revocations,
+			RevalidateInterval: 50 * time.Millisecond,
+			BootstrapTokens:    map[string]string{"huawei.secret": "huawei", "huawei.another": ""},
+		}, map[string]string{"huawei": "huawei.secret"})
+		h.StartAgent("huawei")
+
+		// 直接修改列表, 由定期校验发现
+		if err = revocations.Add(gateway.Revocation{Kind: gateway.RevokeToken, Value: "huawei"}); err != nil {
+			t.Fatal(err)
+		}
+		if err = h.WaitForAgentGone("huawei", time.Second); err != nil {
+			t.Fatal(err)
+		}
+
+		// 同一 token id 不能再申请证书
+		if code := postCSR(t, tlsClient(ca), h, "tencent", "huawei.another"); code != http.StatusForbidden {
+			t.Fatalf("revoked token: status %d", code)
+		}
+	})
+}
@@ -0,0 +1,105 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+func NewStatusErr(code int, err error) *StatusErr {
+	if e, ok := err.(*StatusErr); ok {
+		return e
+	}
+	msg := ""
+	if err != nil {
+		msg = err.Error()
+	}
+	return &StatusErr{Code: code, Msg: msg, err: err}
+}
+
+type StatusErr struct {
+	Code int    `json:"code"`
+	Msg  string `json:"msg"`
+
+	// RetryAfter 大于 0 时返回 Retry-After, 客户端据此退避重试
+	RetryAfter time.Duration `json:"-"`
+
+	err error
+}
+
+func (se *StatusErr) Error() string {
+	return fmt.Sprintf("[%d] %+v", se.Code, se.err)
+}
+
+func (se *StatusErr) WithRetryAfter(d time.Duration) *StatusErr {
+	se.RetryAfter = d
+	return se
+}
+
+// K8sStatus 转换成 kubectl/client-go 能识别的 metav1.Status
+func (se *StatusErr) K8sStatus() *metav1.Status {
+	status := &metav1.Status{
+		TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+		Status:   metav1.StatusFailure,
+		Message:  se.Msg,
+		Reason:   statusReason(se.Code),
+		Code:     int32(se.Code),
+	}
+	if se.RetryAfter > 0 {
+		status.Details = &metav1.StatusDetails{RetryAfterSeconds: se.retryAfterSeconds()}
+	}
+
+	return status
+}
+
+func (se *StatusErr) retryAfterSeconds() int32 {
+	seconds := int32((se.RetryAfter + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return seconds
+}
+
+func statusReason(code int) metav1.StatusReason {
+	switch code {
+	case http.StatusUnauthorized:
+		return metav1.StatusReasonUnauthorized
+	case http.StatusForbidden:
+		return metav1.StatusReasonForbidden
+	case http.StatusNotFound:
+		return metav1.StatusReasonNotFound
+	case http.StatusConflict:
+		return metav1.StatusReasonConflict
+	case http.StatusGone:
+		return metav1.StatusReasonGone
+	case http.StatusTooManyRequests:
+		return metav1.StatusReasonTooManyRequests
+	case http.StatusInternalServerError:
+		return metav1.StatusReasonInternalError
+	case http.StatusServiceUnavailable:
+		return metav1.StatusReasonServiceUnavailable
+	case http.StatusGatewayTimeout:
+		return metav1.StatusReasonTimeout
+	}
+	return metav1.StatusReasonUnknown
+}
+
+// RESP agent 相关接口的错误返回
+func RESP(rw http.ResponseWriter, err *StatusErr) {
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rw.WriteHeader(err.Code)
+	_ = json.NewEncoder(rw).Encode(err)
+}
+
+// RESPStatus 代理路径上的错误返回, 以 metav1.Status 的形式返回给 kubernetes 客户端
+func RESPStatus(rw http.ResponseWriter, err *StatusErr) {
+	if err.RetryAfter > 0 {
+		rw.Header().Set("Retry-After", strconv.Itoa(int(err.retryAfterSeconds())))
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(err.Code)
+	_ = json.NewEncoder(rw).Encode(err.K8sStatus())
+}
@@ -0,0 +1,48 @@
+package gateway
+
+import (
+	"encoding/json"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRESPStatus(t *testing.T) {
+	t.Run("#service unavailable", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		RESPStatus(rec, NewStatusErr(http.StatusServiceUnavailable, ErrTunnelClosed).WithRetryAfter(1500*time.Millisecond))
+
+		if rec.Header().Get("Retry-After") != "2" {
+			t.Fatalf("unexpected Retry-After %q", rec.Header().Get("Retry-After"))
+		}
+
+		status := &metav1.Status{}
+		if err := json.Unmarshal(rec.Body.Bytes(), status); err != nil {
+			t.Fatal(err)
+		}
+		// client-go 按 reason 判断错误类型
+		err := &apierrors.StatusError{ErrStatus: *status}
+		if !apierrors.IsServiceUnavailable(err) {
+			t.Fatalf("unexpected status %+v", status)
+		}
+		if seconds, ok := apierrors.SuggestsClientDelay(err); !ok || seconds != 2 {
+			t.Fatalf("unexpected client delay %d", seconds)
+		}
+	})
+
+	t.Run("#forbidden", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		RESPStatus(rec, NewStatusErr(http.StatusForbidden, nil))
+
+		status := &metav1.Status{}
+		if err := json.Unmarshal(rec.Body.Bytes(), status); err != nil {
+			t.Fatal(err)
+		}
+		if !apierrors.IsForbidden(&apierrors.StatusError{ErrStatus: *status}) || status.Details != nil {
+			t.Fatalf("unexpected status %+v", status)
+		}
+	})
+}
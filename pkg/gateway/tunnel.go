@@ -0,0 +1,274 @@
+package gateway
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+	"k8s-tunnel/pkg/protocol"
+	"k8s-tunnel/pkg/transport"
+	"k8s-tunnel/pkg/utils"
+	"k8s.io/apimachinery/pkg/labels"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrTunnelClosed = errors.New("tunnel closed")
+
+type Tunnel struct {
+	Name    string
+	Session *protocol.Session // 注册时协商的结果
+	// Transport agent 注册使用的传输方式
+	Transport   transport.Name
+	conn        transport.Conn
+	gateway     *Gateway
+	done        chan struct{}
+	closeOnce   sync.Once
+	closeReason string     // 关闭原因, 关闭后只读
+	writeMu     sync.Mutex // 连接不支持并发写
+	requests    sync.Map   // requestID: *TunnelRequestTransit
+	cache       *responseCache
+
+	ConnectedAt time.Time
+	mu          sync.RWMutex
+	metadata    protocol.Metadata // agent 上报的元数据
+	cert        *x509.Certificate // agent 的客户端证书, 续期后更新
+
+	pingSentAt int64        // 最近一次 ping 的发送时间, UnixNano
+	pongAt     int64        // 最近一次收到 pong 的时间, UnixNano
+	latency    atomic.Value // time.Duration, 最近一次 ping 的往返时间
+	degraded   bool         // ping 延迟是否超过阈值, 只在 pong 中读写
+}
+
+func NewTunnel(agentName string, conn transport.Conn, gateway *Gateway) *Tunnel {
+	return &Tunnel{
+		Name:        agentName,
+		Transport:   transport.Of(conn),
+		conn:        conn,
+		gateway:     gateway,
+		done:        make(chan struct{}),
+		requests:    sync.Map{},
+		cache:       newResponseCache(),
+		ConnectedAt: time.Now(),
+	}
+}
+
+// Certificate agent 注册时使用的客户端证书, 连接期间续期后为新的证书. 未开启 CA 时为空
+func (t *Tunnel) Certificate() *x509.Certificate {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.cert
+}
+
+// renewCertificate 证书续期后, 之后的定期校验按新证书的有效期和序列号进行.
+// 只替换注册时或上一次续期的证书, 避免用其他连接上的证书覆盖
+func (t *Tunnel) renewCertificate(current, renewed *x509.Certificate) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.cert != nil && t.cert.SerialNumber.Cmp(current.SerialNumber) == 0 {
+		t.cert = renewed
+	}
+}
+
+// Metadata agent 最近一次上报的元数据
+func (t *Tunnel) Metadata() protocol.Metadata {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.metadata
+}
+
+func (t *Tunnel) Labels() labels.Set {
+	return labels.Set(t.Metadata().Labels)
+}
+
+func (t *Tunnel) setMetadata(md *protocol.Metadata) {
+	md.UpdatedAt = time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.metadata = *md
+}
+
+// Done tunnel 关闭后返回的 chan 会被关闭
+func (t *Tunnel) Done() <-chan struct{} {
+	return t.done
+}
+
+func (t *Tunnel) Recv() {
+	defer func() {
+		if r := recover(); r != nil {
+			logrus.Errorf("NextReader panic: %v", r)
+		}
+		t.Close()
+	}()
+
+	for {
+		select {
+		case <-t.done:
+			return
+		default:
+			// 读出错后 conn 不可再用, 直接关闭
+			typ, message, err := t.conn.ReadMessage()
+			if err != nil {
+				if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+					logrus.Errorf("recv message error. err:%v", err)
+				}
+				t.CloseWithReason(fmt.Sprintf("read error: %v", err))
+				return
+			}
+			if typ == websocket.TextMessage {
+				t.handleMessage(message)
+			}
+		}
+	}
+}
+
+// 处理 agent 发来的控制消息
+func (t *Tunnel) handleMessage(message []byte) {
+	msg := &protocol.Message{}
+	if err := json.Unmarshal(message, msg); err != nil {
+		logrus.Errorf("%s invalid message. err:%v", t.Name, err)
+		return
+	}
+
+	switch msg.Type {
+	case protocol.MessageMetadata:
+		if msg.Metadata != nil {
+			t.setMetadata(msg.Metadata)
+			logrus.Debugf("%s metadata updated: %+v", t.Name, msg.Metadata)
+		}
+	default:
+		logrus.Warnf("%s unknown message type %s", t.Name, msg.Type)
+	}
+}
+
+// 向客户端发送 ping
+// WriteControl 可以针对每种数据类型，进行设置write deadline
+func (t *Tunnel) SendPing() {
+	ticker := time.NewTicker(t.gateway.opt.PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			atomic.StoreInt64(&t.pingSentAt, time.Now().UnixNano())
+			if err := t.conn.WriteControl(websocket.PingMessage, []byte("ping ping ping"), time.Now().Add(utils.PingPeriod+time.Second)); err != nil {
+				logrus.Errorf("ping invalid: %v", err)
+				t.CloseWithReason(fmt.Sprintf("ping error: %v", err))
+				return
+			}
+			// ping 通，即可设置write deadline
+			_ = t.conn.SetWriteDeadline(time.Now().Add(utils.WriteWait))
+
+		case <-t.done:
+			return
+		}
+	}
+}
+
+// 处理客户端返回 pong
+func (t *Tunnel) PongHandler() {
+	t.conn.SetPongHandler(func(appData string) error {
+		atomic.StoreInt64(&t.pongAt, time.Now().UnixNano())
+		// 同时只有一个 ping 在途, 用发送时间计算往返时间
+		if sentAt := atomic.LoadInt64(&t.pingSentAt); sentAt > 0 {
+			t.observeLatency(time.Since(time.Unix(0, sentAt)))
+		}
+		return t.conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	})
+}
+
+// client close后的处理
+// nead read
+func (t *Tunnel) CloseClientHandler() {
+	t.conn.SetCloseHandler(func(code int, str string) error {
+		t.CloseWithReason(fmt.Sprintf("closed by agent: %d %s", code, str))
+		return nil
+	})
+}
+
+// 关闭主动连接
+func (t *Tunnel) Close() {
+	t.CloseWithReason("closed by gateway")
+}
+
+// CloseWithReason 关闭连接, 只有第一次调用的 reason 会被记录
+func (t *Tunnel) CloseWithReason(reason string) {
+	t.closeOnce.Do(func() {
+		t.closeReason = reason
+		// 当关闭的时候，让协程退出
+		close(t.done)
+		t.conn.Close()
+		t.gateway.removeTunnel(t)
+		logrus.Infof("%s tunnel closed, reason:%s", t.Name, reason)
+	})
+}
+
+// CloseReason tunnel 的关闭原因, 未关闭时为空
+func (t *Tunnel) CloseReason() string {
+	select {
+	case <-t.done:
+		return t.closeReason
+	default:
+		return ""
+	}
+}
+
+func (t *Tunnel) HandleRequest(req *http.Request) (*http.Response, error) {
+	var (
+		requestID = uuid.New().String()
+		rt        *TunnelRequestTransit
+	)
+	{
+		// requestID
+		req.Header.Add(utils.HttpRequestIdHeader, requestID)
+		rt = NewTunnelRequestTransit(requestID, req)
+		t.requests.Store(requestID, rt)
+	}
+
+	t.writeMu.Lock()
+	err := t.conn.WriteMessage(websocket.TextMessage, []byte(requestID))
+	t.writeMu.Unlock()
+	if err != nil {
+		logrus.Errorf("requestID:%s, path:%s, write error. err:%v", requestID, req.URL.Path, err)
+		t.DeleteRequestTransit(requestID)
+		return nil, err
+	}
+	logrus.Debugf("translate request, requestID:%s, path:%s", requestID, req.URL.Path)
+
+	select {
+	case resp, ok := <-rt.RESP:
+		if !ok {
+			return nil, fmt.Errorf("requestID:%s, agent response invalid", requestID)
+		}
+		logrus.Debugf("get response from agent, requestID:%s", requestID)
+		return resp, nil
+	case <-req.Context().Done():
+		t.DeleteRequestTransit(requestID)
+		return nil, req.Context().Err()
+	case <-t.done:
+		t.DeleteRequestTransit(requestID)
+		return nil, ErrTunnelClosed
+	}
+}
+
+func (t *Tunnel) GetRequestTransit(requestID string) (*TunnelRequestTransit, error) {
+	tr, ok := t.requests.Load(requestID)
+	if !ok {
+		return nil, fmt.Errorf("requestID:%s not exist", requestID)
+	}
+
+	return tr.(*TunnelRequestTransit), nil
+}
+
+func (t *Tunnel) DeleteRequestTransit(requestID string) {
+	t.requests.Delete(requestID)
+}
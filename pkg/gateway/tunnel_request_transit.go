@@ -0,0 +1,137 @@
+package gateway
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/gorilla/websocket"
+	"io"
+	"k8s-tunnel/pkg/transport"
+	"net/http"
+	"sync"
+)
+
+type TunnelRequestTransit struct {
+	requestID string
+	request   *http.Request
+	RESP      chan *http.Response
+}
+
+func NewTunnelRequestTransit(requestID string, req *http.Request) *TunnelRequestTransit {
+	return &TunnelRequestTransit{
+		requestID: requestID,
+		request:   req,
+		// 带缓冲, 请求方超时离开后 Response 不会阻塞
+		RESP: make(chan *http.Response, 1),
+	}
+}
+
+func (rt *TunnelRequestTransit) Transit(conn transport.Conn) error {
+	w, err := conn.NextWriter(websocket.BinaryMessage)
+
+	if err != nil {
+		return err
+	}
+
+	if err = rt.request.Write(w); err != nil {
+		return err
+	}
+
+	return w.Close()
+}
+
+func (rt *TunnelRequestTransit) Response(conn transport.Conn) error {
+	defer func() {
+		close(rt.RESP)
+	}()
+
+	_, message, err := conn.ReadMessage()
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewBuffer(message)), rt.request)
+	if err != nil {
+		return err
+	}
+
+	rt.RESP <- resp
+	return nil
+}
+
+// StreamResponse 协商了 streaming 时响应由多个消息组成, 以空消息结束.
+// 拿到 header 后就交给请求方, 直到响应结束, 请求方关闭 body 或离开才返回, 之后调用方关闭连接
+func (rt *TunnelRequestTransit) StreamResponse(conn transport.Conn) error {
+	defer func() {
+		close(rt.RESP)
+	}()
+
+	pr, pw := io.Pipe()
+	copied := make(chan error, 1)
+	go func() {
+		copied <- copyMessages(conn, pw)
+	}()
+	// 请求方在 header 到达之前离开时结束 ReadResponse
+	ctx := rt.request.Context()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = pr.CloseWithError(ctx.Err())
+		case <-stop:
+		}
+	}()
+
+	resp, err := http.ReadResponse(bufio.NewReader(pr), rt.request)
+	if err != nil {
+		_ = pr.CloseWithError(err)
+		return err
+	}
+	body := &streamBody{ReadCloser: resp.Body, pr: pr, closed: make(chan struct{})}
+	resp.Body = body
+	rt.RESP <- resp
+
+	select {
+	case err = <-copied:
+		return err
+	case <-body.closed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// copyMessages 把消息依次写入 pw, 读到空消息时结束
+func copyMessages(conn transport.Conn, pw *io.PipeWriter) error {
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			_ = pw.CloseWithError(err)
+			return err
+		}
+		if len(message) == 0 {
+			return pw.Close()
+		}
+		if _, err = pw.Write(message); err != nil {
+			return err
+		}
+	}
+}
+
+// streamBody 关闭时同时关闭管道, 不再读取剩余的消息
+type streamBody struct {
+	io.ReadCloser
+	pr     *io.PipeReader
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (b *streamBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() {
+		_ = b.pr.Close()
+		close(b.closed)
+	})
+
+	return err
+}
@@ -0,0 +1,64 @@
+package health
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// DefaultTimeout 单次检查的超时时间
+const DefaultTimeout = 5 * time.Second
+
+// Check 一项健康检查, 返回 nil 表示通过
+type Check struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+// Ping 总是通过的检查
+var Ping = Check{Name: "ping", Check: func(context.Context) error { return nil }}
+
+// Handler 按 kubernetes 的格式输出检查结果: 全部通过时返回 200 ok,
+// 否则返回 503 并列出每项结果. ?verbose 时总是列出, ?exclude=name 跳过指定的检查
+func Handler(name string, checks ...Check) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		query := request.URL.Query()
+		excluded := map[string]bool{}
+		for _, e := range query["exclude"] {
+			excluded[e] = true
+		}
+
+		ctx, cancel := context.WithTimeout(request.Context(), DefaultTimeout)
+		defer cancel()
+
+		var out bytes.Buffer
+		failed := false
+		for _, c := range checks {
+			if excluded[c.Name] {
+				fmt.Fprintf(&out, "[+]%s excluded: ok\n", c.Name)
+				continue
+			}
+			if err := c.Check(ctx); err != nil {
+				failed = true
+				fmt.Fprintf(&out, "[-]%s failed: %v\n", c.Name, err)
+				continue
+			}
+			fmt.Fprintf(&out, "[+]%s ok\n", c.Name)
+		}
+
+		writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		writer.Header().Set("X-Content-Type-Options", "nosniff")
+		if failed {
+			writer.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(writer, "%s%s check failed\n", out.String(), name)
+			return
+		}
+		if _, verbose := query["verbose"]; verbose {
+			fmt.Fprintf(writer, "%s%s check passed\n", out.String(), name)
+			return
+		}
+		fmt.Fprint(writer, "ok")
+	})
+}
@@ -0,0 +1,45 @@
+package health_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"k8s-tunnel/pkg/health"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func get(handler http.Handler, url string) (int, string) {
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url, nil))
+	b, _ := ioutil.ReadAll(rec.Body)
+
+	return rec.Code, string(b)
+}
+
+func TestHandler(t *testing.T) {
+	broken := health.Check{Name: "broken", Check: func(context.Context) error { return errors.New("boom") }}
+
+	t.Run("#ok", func(t *testing.T) {
+		h := health.Handler("readyz", health.Ping)
+		if code, body := get(h, "/readyz"); code != http.StatusOK || body != "ok" {
+			t.Fatalf("%d %q", code, body)
+		}
+		if code, body := get(h, "/readyz?verbose"); code != http.StatusOK || body != "[+]ping ok\nreadyz check passed\n" {
+			t.Fatalf("%d %q", code, body)
+		}
+	})
+
+	t.Run("#failed", func(t *testing.T) {
+		h := health.Handler("readyz", health.Ping, broken)
+		code, body := get(h, "/readyz")
+		if code != http.StatusServiceUnavailable || !strings.Contains(body, "[-]broken failed: boom\n") || !strings.Contains(body, "[+]ping ok\n") {
+			t.Fatalf("%d %q", code, body)
+		}
+		if code, body := get(h, "/readyz?exclude=broken"); code != http.StatusOK {
+			t.Fatalf("%d %q", code, body)
+		}
+	})
+}
@@ -0,0 +1,167 @@
+// Package protocol gateway 与 agent 之间的协议协商
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"k8s-tunnel/pkg/version"
+	"sort"
+)
+
+const (
+	// Version 当前协议版本, 修改线上格式时递增
+	Version = 1
+	// MinVersion 仍然兼容的最低协议版本
+	MinVersion = 1
+
+	DefaultMaxFrameSize int64 = 64 << 20
+	// DefaultCompressionThreshold 小于该大小的消息不压缩
+	DefaultCompressionThreshold = 1 << 10
+
+	// ProtocolHeader agent 在注册请求中携带本端的协议版本, 表示会先发送 Hello.
+	// 没有该头的是协商之前的老版本 agent, 不会发送 Hello
+	ProtocolHeader = "X-Tunnel-Protocol"
+)
+
+type Feature string
+
+const (
+	FeatureStreaming   Feature = "streaming" // 响应分成多个消息边处理边发送, 以空消息结束
+	FeatureUpgrade     Feature = "upgrade"
+	FeatureTCP         Feature = "tcp"
+	FeatureCompression Feature = "compression" // 请求和响应连接使用 permessage-deflate
+	FeatureMetadata    Feature = "metadata"    // agent 在注册连接上上报元数据
+	FeatureE2E         Feature = "e2e"         // agent 接受端到端加密的请求, 公钥在 Hello 中发布
+	FeatureGoAway      Feature = "goaway"      // gateway 下线前在注册连接上通知 agent
+)
+
+// SupportedFeatures 当前版本实现了的特性
+var SupportedFeatures = []Feature{FeatureMetadata, FeatureCompression, FeatureE2E, FeatureGoAway, FeatureStreaming}
+
+// ErrIncompatible 双方无法协商出共同的协议, 重试也不会成功
+var ErrIncompatible = errors.New("incompatible protocol")
+
+// Hello 注册连接建立后 agent 发送的第一条消息
+type Hello struct {
+	ProtocolVersion    int       `json:"protocolVersion"`
+	MinProtocolVersion int       `json:"minProtocolVersion"`
+	BuildVersion       string    `json:"buildVersion"`
+	Features           []Feature `json:"features"`
+	MaxFrameSize       int64     `json:"maxFrameSize"`
+	// PublicKey agent 用于端到端加密的 X25519 公钥, base64 编码
+	PublicKey string `json:"publicKey,omitempty"`
+}
+
+// HelloAck gateway 对 Hello 的回复, 成功时为协商后的结果
+type HelloAck struct {
+	Hello
+	Error string `json:"error,omitempty"`
+}
+
+// Session 协商后双方共同遵守的约定
+type Session struct {
+	ProtocolVersion int
+	PeerVersion     string // 对端的 build version
+	Features        []Feature
+	MaxFrameSize    int64
+	PeerPublicKey   string // 对端在 Hello 中发布的公钥
+}
+
+func (s *Session) Has(feature Feature) bool {
+	if s == nil {
+		return false
+	}
+	for _, f := range s.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// NewHello 本端的 Hello, features 为空时使用 SupportedFeatures
+func NewHello(features []Feature, maxFrameSize int64) *Hello {
+	if features == nil {
+		features = SupportedFeatures
+	}
+	if maxFrameSize <= 0 {
+		maxFrameSize = DefaultMaxFrameSize
+	}
+
+	return &Hello{
+		ProtocolVersion:    Version,
+		MinProtocolVersion: MinVersion,
+		BuildVersion:       version.Version,
+		Features:           features,
+		MaxFrameSize:       maxFrameSize,
+	}
+}
+
+// LegacySession 协商之前的老版本 agent 按版本 0 处理, 不启用任何特性
+func LegacySession(maxFrameSize int64) *Session {
+	if maxFrameSize <= 0 {
+		maxFrameSize = DefaultMaxFrameSize
+	}
+
+	return &Session{MaxFrameSize: maxFrameSize}
+}
+
+// Negotiate 取双方都支持的最高版本, 特性取交集, 帧大小取较小值
+func Negotiate(local, remote *Hello) (*Session, error) {
+	v := local.ProtocolVersion
+	if remote.ProtocolVersion < v {
+		v = remote.ProtocolVersion
+	}
+	if v < local.MinProtocolVersion || v < remote.MinProtocolVersion {
+		return nil, fmt.Errorf("%w: local supports %d-%d, remote supports %d-%d", ErrIncompatible,
+			local.MinProtocolVersion, local.ProtocolVersion, remote.MinProtocolVersion, remote.ProtocolVersion)
+	}
+
+	session := &Session{
+		ProtocolVersion: v,
+		PeerVersion:     remote.BuildVersion,
+		MaxFrameSize:    local.MaxFrameSize,
+		PeerPublicKey:   remote.PublicKey,
+	}
+	if remote.MaxFrameSize > 0 && remote.MaxFrameSize < session.MaxFrameSize {
+		session.MaxFrameSize = remote.MaxFrameSize
+	}
+
+	remoteFeatures := map[Feature]bool{}
+	for _, f := range remote.Features {
+		remoteFeatures[f] = true
+	}
+	for _, f := range local.Features {
+		if remoteFeatures[f] {
+			session.Features = append(session.Features, f)
+		}
+	}
+	sort.Slice(session.Features, func(i, j int) bool { return session.Features[i] < session.Features[j] })
+
+	return session, nil
+}
+
+// Ack 根据协商结果生成回复
+func Ack(local *Hello, session *Session, err error) *HelloAck {
+	if err != nil {
+		return &HelloAck{Hello: *local, Error: err.Error()}
+	}
+
+	return &HelloAck{Hello: Hello{
+		ProtocolVersion:    session.ProtocolVersion,
+		MinProtocolVersion: session.ProtocolVersion,
+		BuildVersion:       local.BuildVersion,
+		Features:           session.Features,
+		MaxFrameSize:       session.MaxFrameSize,
+	}}
+}
+
+// SessionFromAck agent 根据 gateway 的回复得到协商结果
+func SessionFromAck(local *Hello, ack *HelloAck) (*Session, error) {
+	if ack.Error != "" {
+		return nil, fmt.Errorf("%w: gateway refused: %s", ErrIncompatible, ack.Error)
+	}
+
+	// gateway 返回的已经是协商结果, 再校验一次确保本端也能接受
+	return Negotiate(local, &ack.Hello)
+}
@@ -0,0 +1,61 @@
+package protocol
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	t.Run("#negotiate down", func(t *testing.T) {
+		local := &Hello{ProtocolVersion: 3, MinProtocolVersion: 1, MaxFrameSize: 1024,
+			Features: []Feature{FeatureStreaming, FeatureCompression, FeatureTCP}}
+		remote := &Hello{ProtocolVersion: 2, MinProtocolVersion: 2, MaxFrameSize: 512, BuildVersion: "v0.1.0",
+			Features: []Feature{FeatureCompression, FeatureStreaming, FeatureUpgrade}}
+
+		session, err := Negotiate(local, remote)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect := &Session{
+			ProtocolVersion: 2,
+			PeerVersion:     "v0.1.0",
+			Features:        []Feature{FeatureCompression, FeatureStreaming},
+			MaxFrameSize:    512,
+		}
+		if !reflect.DeepEqual(session, expect) {
+			t.Fatalf("expect %+v, got %+v", expect, session)
+		}
+	})
+
+	t.Run("#incompatible", func(t *testing.T) {
+		local := &Hello{ProtocolVersion: 5, MinProtocolVersion: 4}
+		remote := &Hello{ProtocolVersion: 3, MinProtocolVersion: 1}
+
+		if _, err := Negotiate(local, remote); !errors.Is(err, ErrIncompatible) {
+			t.Fatalf("expect ErrIncompatible, got %v", err)
+		}
+	})
+
+	t.Run("#ack round trip", func(t *testing.T) {
+		gateway := NewHello([]Feature{FeatureStreaming}, 0)
+		agent := NewHello([]Feature{FeatureStreaming, FeatureTCP}, 1024)
+
+		session, err := Negotiate(gateway, agent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		agentSession, err := SessionFromAck(agent, Ack(gateway, session, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !agentSession.Has(FeatureStreaming) || agentSession.Has(FeatureTCP) || agentSession.MaxFrameSize != 1024 {
+			t.Fatalf("unexpected session %+v", agentSession)
+		}
+
+		refused := Ack(gateway, nil, errors.New("too old"))
+		if _, err = SessionFromAck(agent, refused); !errors.Is(err, ErrIncompatible) {
+			t.Fatalf("expect ErrIncompatible, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,32 @@
+package protocol
+
+import (
+	"time"
+)
+
+type MessageType string
+
+const (
+	MessageMetadata MessageType = "metadata" // agent -> gateway
+	MessageGoAway   MessageType = "goaway"   // gateway -> agent, gateway 即将下线, 不会再有新的请求
+)
+
+// Message 注册连接上的控制消息. gateway 发给 agent 的文本消息除此之外都是 requestID
+type Message struct {
+	Type     MessageType `json:"type"`
+	Metadata *Metadata   `json:"metadata,omitempty"`
+}
+
+// Metadata agent 及其所在集群的信息
+type Metadata struct {
+	Labels            map[string]string `json:"labels,omitempty"`
+	AgentVersion      string            `json:"agentVersion,omitempty"`
+	KubernetesVersion string            `json:"kubernetesVersion,omitempty"`
+	NodeCount         int               `json:"nodeCount"`
+	ClusterUID        string            `json:"clusterUID,omitempty"` // kube-system namespace 的 uid
+	CacheHits         int64             `json:"cacheHits,omitempty"`  // informer 缓存的命中次数
+	CacheMisses       int64             `json:"cacheMisses,omitempty"`
+	CompressionRatio  float64           `json:"compressionRatio,omitempty"` // 响应压缩前后的大小之比
+	UpstreamError     string            `json:"upstreamError,omitempty"`    // 访问 apiserver 失败的原因, 为空表示可达
+	UpdatedAt         time.Time         `json:"updatedAt"`
+}
@@ -0,0 +1,308 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"golang.org/x/net/http2"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultHandshakeTimeout 建立连接并完成握手的超时时间
+const DefaultHandshakeTimeout = 45 * time.Second
+
+// HTTP/2 连接的健康检查, 没有数据时定时 ping, 超时后关闭连接
+const (
+	http2ReadIdleTimeout = 30 * time.Second
+	http2PingTimeout     = 15 * time.Second
+)
+
+// Dialer 用指定的传输方式连接 gateway, 地址使用 ws 或 wss.
+// HTTP/2 的多个连接复用同一个 tcp 连接, 所以同一个 gateway 应该使用同一个 Dialer, 不再使用时调用 Close
+type Dialer struct {
+	TLSClientConfig  *tls.Config
+	NetDialContext   func(ctx context.Context, network, addr string) (net.Conn, error)
+	HandshakeTimeout time.Duration // 默认 DefaultHandshakeTimeout
+
+	mu     sync.Mutex
+	h2     *http2.Transport
+	h2c    *http2.Transport
+	closed bool
+}
+
+// Close 关闭空闲的 HTTP/2 连接, 进行中的流不受影响, 结束后再关闭其所在的连接
+func (d *Dialer) Close() {
+	d.mu.Lock()
+	d.closed = true
+	d.mu.Unlock()
+
+	d.closeIdle()
+}
+
+func (d *Dialer) closeIdle() {
+	d.mu.Lock()
+	transports := []*http2.Transport{d.h2, d.h2c}
+	d.mu.Unlock()
+
+	for _, t := range transports {
+		if t != nil {
+			t.CloseIdleConnections()
+		}
+	}
+}
+
+// streamClosed 流关闭时已经从连接上移除, Close 之后连接空闲时关闭
+func (d *Dialer) streamClosed() {
+	d.mu.Lock()
+	closed := d.closed
+	d.mu.Unlock()
+
+	if closed {
+		d.closeIdle()
+	}
+}
+
+// DialContext 返回的 *http.Response 只用于查看握手失败的原因, 如 AcceptHeader
+func (d *Dialer) DialContext(ctx context.Context, name Name, urlStr string, header http.Header) (Conn, *http.Response, error) {
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		return nil, nil, fmt.Errorf("transport: unsupported scheme %q", u.Scheme)
+	}
+
+	switch name {
+	case WebSocket:
+		dialer := &websocket.Dialer{
+			NetDialContext:   d.NetDialContext,
+			TLSClientConfig:  d.TLSClientConfig,
+			HandshakeTimeout: d.handshakeTimeout(),
+		}
+		return dialer.DialContext(ctx, urlStr, header)
+	case HTTP2:
+		return d.dialHTTP2(ctx, u, header)
+	case Raw:
+		return d.dialRaw(ctx, u, header)
+	}
+	return nil, nil, fmt.Errorf("%w: %q", ErrUnsupported, name)
+}
+
+func (d *Dialer) handshakeTimeout() time.Duration {
+	if d.HandshakeTimeout > 0 {
+		return d.HandshakeTimeout
+	}
+	return DefaultHandshakeTimeout
+}
+
+func (d *Dialer) netDial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if d.NetDialContext != nil {
+		return d.NetDialContext(ctx, network, addr)
+	}
+	return (&net.Dialer{}).DialContext(ctx, network, addr)
+}
+
+// dialHTTP2 发送一个请求体不结束的 POST, 收到 200 后请求体和响应体组成双向流
+func (d *Dialer) dialHTTP2(ctx context.Context, u *url.URL, header http.Header) (Conn, *http.Response, error) {
+	secure := u.Scheme == "wss"
+	target := httpURL(u)
+
+	// 流的生命周期不受 ctx 控制, 只有握手阶段受 ctx 和超时控制
+	streamCtx, cancel := context.WithCancel(context.Background())
+	pr, pw := io.Pipe()
+	req, err := http.NewRequestWithContext(streamCtx, http.MethodPost, target.String(), pr)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	req.Header = cloneHeader(header)
+	req.Header.Set(Header, string(HTTP2))
+
+	var (
+		mu          sync.Mutex
+		established bool
+	)
+	stop := make(chan struct{})
+	go func() {
+		timer := time.NewTimer(d.handshakeTimeout())
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+		case <-timer.C:
+		case <-stop:
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if !established {
+			cancel()
+		}
+	}()
+
+	resp, err := d.http2Transport(secure).RoundTrip(req)
+	mu.Lock()
+	established = err == nil && resp.StatusCode == http.StatusOK
+	mu.Unlock()
+	close(stop)
+
+	if err != nil {
+		cancel()
+		_ = pw.Close()
+		return nil, nil, err
+	}
+	if !established {
+		limitBody(resp)
+		cancel()
+		_ = pw.Close()
+		return nil, resp, websocket.ErrBadHandshake
+	}
+
+	s := &clientStream{body: resp.Body, pw: pw, cancel: cancel, onClose: d.streamClosed}
+	return newFramedConn(HTTP2, s, nil, addr(""), addr(u.Host)), resp, nil
+}
+
+func (d *Dialer) http2Transport(secure bool) *http2.Transport {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if secure {
+		if d.h2 == nil {
+			d.h2 = &http2.Transport{
+				TLSClientConfig: d.TLSClientConfig,
+				DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+					ctx, cancel := context.WithTimeout(context.Background(), d.handshakeTimeout())
+					defer cancel()
+					conn, err := d.netDial(ctx, network, addr)
+					if err != nil {
+						return nil, err
+					}
+					tlsConn := tls.Client(conn, cfg)
+					if err = tlsConn.HandshakeContext(ctx); err != nil {
+						_ = conn.Close()
+						return nil, err
+					}
+					if p := tlsConn.ConnectionState().NegotiatedProtocol; p != http2.NextProtoTLS {
+						_ = conn.Close()
+						return nil, fmt.Errorf("%w: gateway negotiated %q instead of h2", ErrUnsupported, p)
+					}
+					return tlsConn, nil
+				},
+				ReadIdleTimeout: http2ReadIdleTimeout,
+				PingTimeout:     http2PingTimeout,
+			}
+		}
+		return d.h2
+	}
+
+	// 未开启 tls 时使用 h2c, 直接发送 HTTP/2 的连接前言
+	if d.h2c == nil {
+		d.h2c = &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+				ctx, cancel := context.WithTimeout(context.Background(), d.handshakeTimeout())
+				defer cancel()
+				return d.netDial(ctx, network, addr)
+			},
+			ReadIdleTimeout: http2ReadIdleTimeout,
+			PingTimeout:     http2PingTimeout,
+		}
+	}
+	return d.h2c
+}
+
+// dialRaw 发送 HTTP/1.1 Upgrade 请求, 收到 101 后直接在 tls 连接上分帧. 分帧不加密, 不支持 ws
+func (d *Dialer) dialRaw(ctx context.Context, u *url.URL, header http.Header) (Conn, *http.Response, error) {
+	if u.Scheme != "wss" {
+		return nil, nil, fmt.Errorf("%w: %q requires tls", ErrUnsupported, Raw)
+	}
+	ctx, cancel := context.WithTimeout(ctx, d.handshakeTimeout())
+	defer cancel()
+
+	hostPort := u.Host
+	if u.Port() == "" {
+		hostPort = net.JoinHostPort(u.Hostname(), "443")
+	}
+
+	conn, err := d.netDial(ctx, "tcp", hostPort)
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg := d.TLSClientConfig.Clone()
+	if cfg == nil {
+		cfg = &tls.Config{}
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = u.Hostname()
+	}
+	cfg.NextProtos = []string{"http/1.1"}
+	tlsConn := tls.Client(conn, cfg)
+	if err = tlsConn.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+	conn = tlsConn
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, httpURL(u).String(), nil)
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+	req.Header = cloneHeader(header)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", RawProtocol)
+	if err = req.Write(conn); err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || !strings.EqualFold(resp.Header.Get("Upgrade"), RawProtocol) {
+		limitBody(resp)
+		_ = conn.Close()
+		return nil, resp, websocket.ErrBadHandshake
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	return newFramedConn(Raw, conn, br, conn.LocalAddr(), conn.RemoteAddr()), resp, nil
+}
+
+// limitBody 与 websocket 一样, 握手失败时保留响应体的前 1KB, 以便查看原因
+func limitBody(resp *http.Response) {
+	buf := make([]byte, 1024)
+	n, _ := io.ReadFull(resp.Body, buf)
+	_ = resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(buf[:n]))
+}
+
+func httpURL(u *url.URL) *url.URL {
+	ret := *u
+	ret.Scheme = "http"
+	if u.Scheme == "wss" {
+		ret.Scheme = "https"
+	}
+	return &ret
+}
+
+func cloneHeader(header http.Header) http.Header {
+	if header == nil {
+		return http.Header{}
+	}
+	return header.Clone()
+}
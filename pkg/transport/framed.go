@@ -0,0 +1,384 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// 帧格式: 1 字节的 FIN 标志和操作码 (与 websocket 相同), 4 字节大端的负载长度, 负载.
+// 一个消息可以分成多个帧, 控制帧可以插在分片之间, 控制帧的负载不超过 125 字节
+const (
+	finalBit          = 0x80
+	opcodeMask        = 0x0f
+	continuationFrame = 0
+	frameHeaderSize   = 5
+	maxControlPayload = 125
+
+	// 默认处理 ping 和 close 时回复的超时时间
+	controlWriteWait = time.Second
+
+	// DefaultReadLimit 没有调用 SetReadLimit 时消息的最大长度, 与协议默认的最大帧长度相同
+	DefaultReadLimit int64 = 64 << 20
+	// 负载按实际收到的数据增长, 不按对端声明的长度一次分配
+	initialPayloadSize = 64 << 10
+)
+
+var errProtocol = errors.New("transport: protocol error")
+
+// stream framedConn 的底层连接, 可以是 net.Conn 或 HTTP/2 的双向流
+type stream interface {
+	io.ReadWriteCloser
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
+// framedConn 在字节流上实现 Conn
+type framedConn struct {
+	name          Name
+	s             stream
+	br            *bufio.Reader
+	local, remote net.Addr
+
+	writeMu   sync.Mutex
+	closeSent bool // 已发送 close 帧, 之后不能再写
+
+	deadlineMu    sync.Mutex
+	writeDeadline time.Time // WriteControl 写完后恢复
+
+	// 只在读协程中使用
+	readLimit   int64 // 为 0 时使用 DefaultReadLimit
+	readErr     error
+	handlePing  func(appData string) error
+	handlePong  func(appData string) error
+	handleClose func(code int, text string) error
+}
+
+func newFramedConn(name Name, s stream, br *bufio.Reader, local, remote net.Addr) *framedConn {
+	if br == nil {
+		br = bufio.NewReader(s)
+	}
+	c := &framedConn{name: name, s: s, br: br, local: local, remote: remote}
+	c.SetPingHandler(nil)
+	c.SetPongHandler(nil)
+	c.SetCloseHandler(nil)
+
+	return c
+}
+
+// ReadMessage 读取下一个数据消息, 期间收到的控制帧交给对应的 handler. 出错后总是返回同一个错误
+func (c *framedConn) ReadMessage() (int, []byte, error) {
+	if c.readErr != nil {
+		return 0, nil, c.readErr
+	}
+	typ, p, err := c.readMessage()
+	if err != nil {
+		c.readErr = err
+	}
+	return typ, p, err
+}
+
+func (c *framedConn) readMessage() (int, []byte, error) {
+	var (
+		typ int
+		buf []byte
+	)
+	for {
+		op, fin, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch op {
+		case websocket.PingMessage:
+			if err = c.handlePing(string(payload)); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case websocket.PongMessage:
+			if err = c.handlePong(string(payload)); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case websocket.CloseMessage:
+			code, text := parseClose(payload)
+			if err = c.handleClose(code, text); err != nil {
+				return 0, nil, err
+			}
+			return 0, nil, &websocket.CloseError{Code: code, Text: text}
+		case websocket.TextMessage, websocket.BinaryMessage:
+			if typ != 0 {
+				return 0, nil, c.protocolErr("new message before the previous one finished")
+			}
+			typ = op
+		case continuationFrame:
+			if typ == 0 {
+				return 0, nil, c.protocolErr("continuation frame without a message")
+			}
+		}
+
+		if int64(len(buf)+len(payload)) > c.limit() {
+			c.closeWith(websocket.CloseMessageTooBig)
+			return 0, nil, websocket.ErrReadLimit
+		}
+		buf = append(buf, payload...)
+		if fin {
+			if buf == nil {
+				buf = []byte{}
+			}
+			return typ, buf, nil
+		}
+	}
+}
+
+// readFrame 读取一帧, 在读取负载前检查长度
+func (c *framedConn) readFrame() (int, bool, []byte, error) {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(c.br, header[:]); err != nil {
+		return 0, false, nil, abnormalClosure(err)
+	}
+	op, fin := int(header[0]&opcodeMask), header[0]&finalBit != 0
+	length := int64(binary.BigEndian.Uint32(header[1:]))
+
+	switch op {
+	case websocket.PingMessage, websocket.PongMessage, websocket.CloseMessage:
+		if !fin || length > maxControlPayload {
+			return 0, false, nil, c.protocolErr("invalid control frame")
+		}
+	case websocket.TextMessage, websocket.BinaryMessage, continuationFrame:
+		if length > c.limit() {
+			c.closeWith(websocket.CloseMessageTooBig)
+			return 0, false, nil, websocket.ErrReadLimit
+		}
+	default:
+		return 0, false, nil, c.protocolErr(fmt.Sprintf("unknown opcode %d", op))
+	}
+
+	payload := &bytes.Buffer{}
+	if length < initialPayloadSize {
+		payload.Grow(int(length))
+	} else {
+		payload.Grow(initialPayloadSize)
+	}
+	if _, err := io.CopyN(payload, c.br, length); err != nil {
+		return 0, false, nil, abnormalClosure(err)
+	}
+	return op, fin, payload.Bytes(), nil
+}
+
+func (c *framedConn) limit() int64 {
+	if c.readLimit > 0 {
+		return c.readLimit
+	}
+	return DefaultReadLimit
+}
+
+// abnormalClosure 与 websocket 一样, 连接意外断开时返回 1006
+func abnormalClosure(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return &websocket.CloseError{Code: websocket.CloseAbnormalClosure, Text: io.ErrUnexpectedEOF.Error()}
+	}
+	return err
+}
+
+func (c *framedConn) protocolErr(msg string) error {
+	c.closeWith(websocket.CloseProtocolError)
+	return fmt.Errorf("%w: %s", errProtocol, msg)
+}
+
+func (c *framedConn) closeWith(code int) {
+	_ = c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, ""), time.Now().Add(controlWriteWait))
+}
+
+func parseClose(payload []byte) (int, string) {
+	if len(payload) < 2 {
+		return websocket.CloseNoStatusReceived, ""
+	}
+	return int(binary.BigEndian.Uint16(payload)), string(payload[2:])
+}
+
+func (c *framedConn) ReadJSON(v interface{}) error {
+	_, p, err := c.ReadMessage()
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(p, v)
+}
+
+func (c *framedConn) WriteMessage(messageType int, data []byte) error {
+	if messageType != websocket.TextMessage && messageType != websocket.BinaryMessage {
+		return fmt.Errorf("transport: invalid message type %d", messageType)
+	}
+	return c.writeFrame(messageType, true, data)
+}
+
+// WriteJSON 与 websocket 一样使用 json.Encoder, 消息以换行结尾
+func (c *framedConn) WriteJSON(v interface{}) error {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(v); err != nil {
+		return err
+	}
+	return c.WriteMessage(websocket.TextMessage, buf.Bytes())
+}
+
+// WriteControl 写入一个控制帧, deadline 只对本次写入生效
+func (c *framedConn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	switch messageType {
+	case websocket.PingMessage, websocket.PongMessage, websocket.CloseMessage:
+	default:
+		return fmt.Errorf("transport: invalid control message type %d", messageType)
+	}
+	if len(data) > maxControlPayload {
+		return errors.New("transport: control frame too large")
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.closeSent {
+		return websocket.ErrCloseSent
+	}
+	_ = c.s.SetWriteDeadline(deadline)
+	err := c.write(messageType, true, data)
+	c.deadlineMu.Lock()
+	_ = c.s.SetWriteDeadline(c.writeDeadline)
+	c.deadlineMu.Unlock()
+	if messageType == websocket.CloseMessage {
+		c.closeSent = true
+	}
+
+	return err
+}
+
+// NextWriter 每次 Write 发送一个分片, Close 时发送结束帧, 限速写入时对端仍按一个消息读取
+func (c *framedConn) NextWriter(messageType int) (io.WriteCloser, error) {
+	if messageType != websocket.TextMessage && messageType != websocket.BinaryMessage {
+		return nil, fmt.Errorf("transport: invalid message type %d", messageType)
+	}
+	return &messageWriter{c: c, op: messageType}, nil
+}
+
+type messageWriter struct {
+	c      *framedConn
+	op     int
+	closed bool
+}
+
+func (w *messageWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("transport: write to closed writer")
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if err := w.c.writeFrame(w.op, false, p); err != nil {
+		return 0, err
+	}
+	w.op = continuationFrame
+
+	return len(p), nil
+}
+
+func (w *messageWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	return w.c.writeFrame(w.op, true, nil)
+}
+
+func (c *framedConn) writeFrame(op int, fin bool, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.closeSent {
+		return websocket.ErrCloseSent
+	}
+	return c.write(op, fin, payload)
+}
+
+// write 头部和负载一次写入, HTTP/2 下每次写入都会 flush
+func (c *framedConn) write(op int, fin bool, payload []byte) error {
+	frame := make([]byte, frameHeaderSize+len(payload))
+	frame[0] = byte(op)
+	if fin {
+		frame[0] |= finalBit
+	}
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(payload)))
+	copy(frame[frameHeaderSize:], payload)
+
+	_, err := c.s.Write(frame)
+	return err
+}
+
+func (c *framedConn) SetReadDeadline(t time.Time) error {
+	return c.s.SetReadDeadline(t)
+}
+
+func (c *framedConn) SetWriteDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+
+	c.writeDeadline = t
+	return c.s.SetWriteDeadline(t)
+}
+
+func (c *framedConn) SetReadLimit(limit int64) {
+	c.readLimit = limit
+}
+
+// SetPingHandler h 为空时回复 pong
+func (c *framedConn) SetPingHandler(h func(appData string) error) {
+	if h == nil {
+		h = func(appData string) error {
+			err := c.WriteControl(websocket.PongMessage, []byte(appData), time.Now().Add(controlWriteWait))
+			if err == websocket.ErrCloseSent {
+				return nil
+			}
+			return err
+		}
+	}
+	c.handlePing = h
+}
+
+func (c *framedConn) SetPongHandler(h func(appData string) error) {
+	if h == nil {
+		h = func(string) error { return nil }
+	}
+	c.handlePong = h
+}
+
+// SetCloseHandler h 为空时回复相同的关闭码
+func (c *framedConn) SetCloseHandler(h func(code int, text string) error) {
+	if h == nil {
+		h = func(code int, text string) error {
+			c.closeWith(code)
+			return nil
+		}
+	}
+	c.handleClose = h
+}
+
+func (c *framedConn) EnableWriteCompression(bool) {}
+
+func (c *framedConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *framedConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// Close 直接关闭底层连接, 不发送 close 帧
+func (c *framedConn) Close() error {
+	return c.s.Close()
+}
@@ -0,0 +1,128 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Upgrader 按请求选择传输方式, 接管 agent 的连接
+type Upgrader struct {
+	// Transports 允许的传输方式, 为空时允许 Supported 中的全部
+	Transports []Name
+	// WebSocket websocket 传输方式的配置
+	WebSocket websocket.Upgrader
+}
+
+// Requested 请求使用的传输方式, 不是任何一种时返回 false
+func Requested(r *http.Request) (Name, bool) {
+	switch {
+	case websocket.IsWebSocketUpgrade(r):
+		return WebSocket, true
+	case r.ProtoMajor == 2 && Name(r.Header.Get(Header)) == HTTP2:
+		return HTTP2, true
+	case r.ProtoMajor == 1 && strings.EqualFold(r.Header.Get("Upgrade"), RawProtocol) &&
+		strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade"):
+		return Raw, true
+	}
+	return "", false
+}
+
+// Upgrade 不允许请求的传输方式时回复 426, 并在 AcceptHeader 中列出允许的传输方式, agent 据此降级.
+// 不是 tls 连接时不允许 Raw. HTTP/2 的连接依附于请求, handler 需要调用 Wait 直到连接关闭
+func (u *Upgrader) Upgrade(w http.ResponseWriter, r *http.Request) (Conn, error) {
+	allowed := u.Transports
+	if len(allowed) == 0 {
+		allowed = Supported
+	}
+	if r.TLS == nil {
+		allowed = without(allowed, Raw)
+	}
+	name, ok := Requested(r)
+	if !ok || !Allowed(allowed, name) {
+		w.Header().Set(AcceptHeader, join(allowed))
+		http.Error(w, fmt.Sprintf("transport %q is not allowed, expect one of %s", name, join(allowed)), http.StatusUpgradeRequired)
+		return nil, fmt.Errorf("%w: %q", ErrUnsupported, name)
+	}
+
+	switch name {
+	case WebSocket:
+		return u.WebSocket.Upgrade(w, r, nil)
+	case HTTP2:
+		return upgradeHTTP2(w, r)
+	default:
+		return upgradeRaw(w, r)
+	}
+}
+
+func without(names []Name, name Name) []Name {
+	ret := make([]Name, 0, len(names))
+	for _, n := range names {
+		if n != name {
+			ret = append(ret, n)
+		}
+	}
+	return ret
+}
+
+func upgradeHTTP2(w http.ResponseWriter, r *http.Request) (Conn, error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return nil, errors.New("transport: response writer does not implement http.Flusher")
+	}
+
+	// 先回复响应头, agent 收到后开始双向读写
+	w.Header().Set(Header, string(HTTP2))
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	var local net.Addr = addr("")
+	if a, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		local = a
+	}
+	return newFramedConn(HTTP2, newServerStream(w, flusher, r.Body), nil, local, addr(r.RemoteAddr)), nil
+}
+
+func upgradeRaw(w http.ResponseWriter, r *http.Request) (Conn, error) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "upgrade is not supported", http.StatusInternalServerError)
+		return nil, errors.New("transport: response writer does not implement http.Hijacker")
+	}
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	// 与 websocket 一样, 握手完成前客户端不应发送数据
+	if brw.Reader.Buffered() > 0 {
+		_ = conn.Close()
+		return nil, errors.New("transport: client sent data before handshake is complete")
+	}
+
+	// 清除 http server 设置的超时
+	_ = conn.SetDeadline(time.Time{})
+	_ = conn.SetWriteDeadline(time.Now().Add(controlWriteWait * 10))
+	_, err = conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: " + RawProtocol + "\r\nConnection: Upgrade\r\n\r\n"))
+	_ = conn.SetWriteDeadline(time.Time{})
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return newFramedConn(Raw, conn, nil, conn.LocalAddr(), conn.RemoteAddr()), nil
+}
+
+// Wait 在 handler 中调用, 阻塞到 conn 关闭. HTTP/2 的连接依附于请求, handler 返回后不能再写响应;
+// 其他传输方式已经接管了底层连接, 直接返回
+func Wait(conn Conn) {
+	if c, ok := conn.(*framedConn); ok {
+		if s, ok := c.s.(*serverStream); ok {
+			s.wait()
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package transport
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// deadlines HTTP/2 的流没有 tcp 连接的读写超时, 读写期间超过 deadline 时关闭整个流
+type deadlines struct {
+	mu    sync.Mutex
+	read  time.Time
+	write time.Time
+}
+
+func (d *deadlines) SetReadDeadline(t time.Time) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.read = t
+	return nil
+}
+
+func (d *deadlines) SetWriteDeadline(t time.Time) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.write = t
+	return nil
+}
+
+// guard 在 deadline 前完成 op, 否则调用 closeFn 打断 op 并返回超时错误
+func (d *deadlines) guard(write bool, closeFn func(), op func() (int, error)) (int, error) {
+	d.mu.Lock()
+	deadline := d.read
+	if write {
+		deadline = d.write
+	}
+	d.mu.Unlock()
+
+	if deadline.IsZero() {
+		return op()
+	}
+	wait := time.Until(deadline)
+	if wait <= 0 {
+		return 0, os.ErrDeadlineExceeded
+	}
+
+	var expired int32
+	timer := time.AfterFunc(wait, func() {
+		atomic.StoreInt32(&expired, 1)
+		closeFn()
+	})
+	n, err := op()
+	if !timer.Stop() && atomic.LoadInt32(&expired) == 1 {
+		return n, os.ErrDeadlineExceeded
+	}
+	return n, err
+}
+
+// serverStream gateway 一端: 读请求体, 写响应体
+type serverStream struct {
+	deadlines
+	body io.ReadCloser
+
+	mu       sync.Mutex // 保护 w, handler 返回后不能再写
+	w        http.ResponseWriter
+	flusher  http.Flusher
+	finished bool
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func newServerStream(w http.ResponseWriter, flusher http.Flusher, body io.ReadCloser) *serverStream {
+	return &serverStream{body: body, w: w, flusher: flusher, done: make(chan struct{})}
+}
+
+func (s *serverStream) Read(p []byte) (int, error) {
+	return s.guard(false, s.close, func() (int, error) { return s.body.Read(p) })
+}
+
+func (s *serverStream) Write(p []byte) (int, error) {
+	return s.guard(true, s.close, func() (int, error) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		if s.finished {
+			return 0, net.ErrClosed
+		}
+		n, err := s.w.Write(p)
+		if err == nil {
+			s.flusher.Flush()
+		}
+		return n, err
+	})
+}
+
+func (s *serverStream) Close() error {
+	s.close()
+	return nil
+}
+
+// close 打断进行中的读, handler 随后返回并结束响应
+func (s *serverStream) close() {
+	s.closeOnce.Do(func() {
+		_ = s.body.Close()
+		close(s.done)
+	})
+}
+
+// wait 等待关闭, 之后不再写 ResponseWriter. 对端不再读取时, 进行中的写会阻塞到 HTTP/2 连接断开
+func (s *serverStream) wait() {
+	<-s.done
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.finished = true
+}
+
+// clientStream agent 一端: 写请求体, 读响应体
+type clientStream struct {
+	deadlines
+	body    io.ReadCloser
+	pw      *io.PipeWriter
+	cancel  func()
+	onClose func()
+
+	closeOnce sync.Once
+}
+
+func (s *clientStream) Read(p []byte) (int, error) {
+	return s.guard(false, s.close, func() (int, error) { return s.body.Read(p) })
+}
+
+func (s *clientStream) Write(p []byte) (int, error) {
+	return s.guard(true, s.close, func() (int, error) { return s.pw.Write(p) })
+}
+
+func (s *clientStream) Close() error {
+	s.close()
+	return nil
+}
+
+func (s *clientStream) close() {
+	s.closeOnce.Do(func() {
+		_ = s.pw.CloseWithError(net.ErrClosed)
+		_ = s.body.Close()
+		s.cancel()
+		s.onClose()
+	})
+}
+
+// addr HTTP/2 的流没有独立的 tcp 连接, 只记录对端的地址
+type addr string
+
+func (a addr) Network() string { return "tcp" }
+func (a addr) String() string  { return string(a) }
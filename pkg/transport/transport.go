@@ -0,0 +1,112 @@
+// Package transport 抽象 agent 与 gateway 之间的消息连接.
+// 除 websocket 外, 还支持在 HTTP/2 双向流和 tls 连接上使用自定义分帧,
+// 用于 websocket 被中间设备破坏的网络. raw 不加密分帧, 只能在 tls 连接上使用
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// Name 传输方式
+type Name string
+
+const (
+	// WebSocket 默认的传输方式
+	WebSocket Name = "websocket"
+	// HTTP2 一个 HTTP/2 请求的请求体和响应体组成双向流, 未开启 CA 时使用 h2c
+	HTTP2 Name = "http2"
+	// Raw HTTP/1.1 Upgrade 后直接在 tls 连接上分帧, 未开启 tls 时不可用
+	Raw Name = "raw"
+)
+
+// Supported 支持的传输方式, 也是 agent 默认的尝试顺序
+var Supported = []Name{WebSocket, HTTP2, Raw}
+
+const (
+	// Header HTTP/2 请求中声明使用的传输方式
+	Header = "X-K8s-Tunnel-Transport"
+	// AcceptHeader 拒绝不支持的传输方式时, 列出 gateway 允许的传输方式
+	AcceptHeader = "X-K8s-Tunnel-Accept-Transports"
+	// RawProtocol Raw 传输方式的 Upgrade 协议名
+	RawProtocol = "k8s-tunnel"
+)
+
+// ErrUnsupported 对端不支持或不允许该传输方式
+var ErrUnsupported = errors.New("transport not supported")
+
+// Conn 消息连接, 方法与 *websocket.Conn 一致, 消息类型和关闭码使用 websocket 包的定义.
+// 与 websocket 一样, 同一时间只能有一个读和一个写, WriteControl 可以与其他方法并发
+type Conn interface {
+	ReadMessage() (messageType int, p []byte, err error)
+	ReadJSON(v interface{}) error
+	WriteMessage(messageType int, data []byte) error
+	WriteJSON(v interface{}) error
+	WriteControl(messageType int, data []byte, deadline time.Time) error
+	NextWriter(messageType int) (io.WriteCloser, error)
+
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+	SetReadLimit(limit int64)
+	SetPingHandler(h func(appData string) error)
+	SetPongHandler(h func(appData string) error)
+	SetCloseHandler(h func(code int, text string) error)
+	// EnableWriteCompression 只有 websocket 支持压缩, 其他传输方式忽略
+	EnableWriteCompression(enable bool)
+
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+	Close() error
+}
+
+var _ Conn = (*websocket.Conn)(nil)
+
+// ParseNames 解析逗号分隔的传输方式, 如 websocket,http2
+func ParseNames(s string) ([]Name, error) {
+	var names []Name
+	for _, part := range strings.Split(s, ",") {
+		name := Name(strings.TrimSpace(part))
+		if name == "" {
+			continue
+		}
+		if !Allowed(Supported, name) {
+			return nil, fmt.Errorf("unknown transport %q, expect one of %v", name, Supported)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// Of conn 使用的传输方式
+func Of(conn Conn) Name {
+	if c, ok := conn.(*framedConn); ok {
+		return c.name
+	}
+	return WebSocket
+}
+
+// Allowed name 是否在 names 中, names 为空时允许 Supported 中的全部
+func Allowed(names []Name, name Name) bool {
+	if len(names) == 0 {
+		names = Supported
+	}
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func join(names []Name) string {
+	s := make([]string, 0, len(names))
+	for _, n := range names {
+		s = append(s, string(n))
+	}
+	return strings.Join(s, ", ")
+}
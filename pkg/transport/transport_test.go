@@ -0,0 +1,256 @@
+package transport_test
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"github.com/gorilla/websocket"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"io"
+	"k8s-tunnel/pkg/transport"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// echoServer 原样返回收到的消息, 收到 close 时以 1001 关闭
+func echoServer(t *testing.T, secure bool, upgrader *transport.Upgrader) (string, *transport.Dialer) {
+	t.Helper()
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		defer transport.Wait(conn)
+		defer conn.Close()
+
+		for {
+			typ, p, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if string(p) == "close" {
+				_ = conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseGoingAway, "bye"), time.Now().Add(time.Second))
+				continue
+			}
+			if err = conn.WriteMessage(typ, p); err != nil {
+				return
+			}
+		}
+	})
+
+	server := httptest.NewUnstartedServer(h2c.NewHandler(handler, &http2.Server{}))
+	t.Cleanup(server.Close)
+	if !secure {
+		server.Start()
+		return "ws://" + server.Listener.Addr().String(), &transport.Dialer{}
+	}
+
+	server.TLS = &tls.Config{NextProtos: []string{http2.NextProtoTLS, "http/1.1"}}
+	server.StartTLS()
+	roots := server.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	return "wss://" + server.Listener.Addr().String(), &transport.Dialer{TLSClientConfig: &tls.Config{RootCAs: roots}}
+}
+
+func dial(t *testing.T, dialer *transport.Dialer, name transport.Name, u string) transport.Conn {
+	t.Helper()
+
+	conn, _, err := dialer.DialContext(context.Background(), name, u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	if got := transport.Of(conn); got != name {
+		t.Fatalf("expect transport %s, got %s", name, got)
+	}
+	return conn
+}
+
+func expectMessage(t *testing.T, conn transport.Conn, typ int, msg string) {
+	t.Helper()
+
+	gotType, p, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotType != typ || string(p) != msg {
+		t.Fatalf("expect %d %q, got %d %q", typ, msg, gotType, p)
+	}
+}
+
+func TestTransport(t *testing.T) {
+	for _, secure := range []bool{false, true} {
+		for _, name := range transport.Supported {
+			name, secure := name, secure
+			t.Run("#"+string(name)+map[bool]string{true: " tls"}[secure], func(t *testing.T) {
+				u, dialer := echoServer(t, secure, &transport.Upgrader{})
+				if name == transport.Raw && !secure {
+					// raw 不加密, 没有 tls 时不可用
+					if _, _, err := dialer.DialContext(context.Background(), name, u, nil); !errors.Is(err, transport.ErrUnsupported) {
+						t.Fatalf("expect unsupported, got %v", err)
+					}
+					return
+				}
+				conn := dial(t, dialer, name, u)
+
+				if err := conn.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+					t.Fatal(err)
+				}
+				expectMessage(t, conn, websocket.TextMessage, "hello")
+
+				// 分片写入, 对端按一个消息读取
+				w, err := conn.NextWriter(websocket.BinaryMessage)
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, _ = w.Write([]byte("ab"))
+				_, _ = w.Write([]byte("cd"))
+				if err = w.Close(); err != nil {
+					t.Fatal(err)
+				}
+				expectMessage(t, conn, websocket.BinaryMessage, "abcd")
+
+				// ping 由对端默认的 handler 回复
+				pong := make(chan string, 1)
+				conn.SetPongHandler(func(appData string) error {
+					pong <- appData
+					return nil
+				})
+				if err = conn.WriteControl(websocket.PingMessage, []byte("ping"), time.Now().Add(time.Second)); err != nil {
+					t.Fatal(err)
+				}
+				if err = conn.WriteJSON(map[string]string{"a": "b"}); err != nil {
+					t.Fatal(err)
+				}
+				expectMessage(t, conn, websocket.TextMessage, `{"a":"b"}`+"\n")
+				if got := <-pong; got != "ping" {
+					t.Fatalf("pong %q", got)
+				}
+
+				conn.SetReadLimit(4)
+				_ = conn.WriteMessage(websocket.BinaryMessage, []byte("too long"))
+				if _, _, err = conn.ReadMessage(); err != websocket.ErrReadLimit {
+					t.Fatalf("expect read limit error, got %v", err)
+				}
+			})
+		}
+	}
+}
+
+// 没有调用 SetReadLimit 时, 对端声明的超长帧也会被拒绝, 不会按声明的长度分配内存
+func TestFramedDefaultReadLimit(t *testing.T) {
+	u, dialer := echoServer(t, true, &transport.Upgrader{})
+	conn, err := tls.Dial("tcp", strings.TrimPrefix(u, "wss://"), dialer.TLSClientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	_, _ = conn.Write([]byte("GET / HTTP/1.1\r\nHost: test\r\nUpgrade: " + transport.RawProtocol + "\r\nConnection: Upgrade\r\n\r\n"))
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("upgrade failed, resp %+v, err %v", resp, err)
+	}
+
+	// 二进制帧, 声明 4GB 的负载
+	_, _ = conn.Write([]byte{0x80 | websocket.BinaryMessage, 0xff, 0xff, 0xff, 0xff})
+	frame := make([]byte, 7)
+	if _, err = io.ReadFull(br, frame); err != nil {
+		t.Fatal(err)
+	}
+	if frame[0] != 0x80|websocket.CloseMessage || binary.BigEndian.Uint16(frame[5:]) != websocket.CloseMessageTooBig {
+		t.Fatalf("expect close 1009, got %v", frame)
+	}
+}
+
+func TestTransportClose(t *testing.T) {
+	for _, name := range transport.Supported {
+		name := name
+		t.Run("#"+string(name), func(t *testing.T) {
+			u, dialer := echoServer(t, name == transport.Raw, &transport.Upgrader{})
+			conn := dial(t, dialer, name, u)
+
+			_ = conn.WriteMessage(websocket.TextMessage, []byte("close"))
+			_, _, err := conn.ReadMessage()
+			if !websocket.IsCloseError(err, websocket.CloseGoingAway) || !strings.Contains(err.Error(), "bye") {
+				t.Fatalf("expect going away, got %v", err)
+			}
+		})
+	}
+}
+
+func TestTransportDeadline(t *testing.T) {
+	for _, name := range transport.Supported {
+		name := name
+		t.Run("#"+string(name), func(t *testing.T) {
+			u, dialer := echoServer(t, name == transport.Raw, &transport.Upgrader{})
+			conn := dial(t, dialer, name, u)
+
+			start := time.Now()
+			_ = conn.SetReadDeadline(start.Add(100 * time.Millisecond))
+			_, _, err := conn.ReadMessage()
+			var netErr net.Error
+			if !errors.As(err, &netErr) || !netErr.Timeout() {
+				t.Fatalf("expect timeout, got %v", err)
+			}
+			if since := time.Since(start); since > time.Second {
+				t.Fatalf("read returned after %s", since)
+			}
+		})
+	}
+}
+
+func TestNegotiation(t *testing.T) {
+	t.Run("#not allowed", func(t *testing.T) {
+		u, dialer := echoServer(t, true, &transport.Upgrader{Transports: []transport.Name{transport.Raw}})
+
+		_, resp, err := dialer.DialContext(context.Background(), transport.WebSocket, u, nil)
+		if err == nil || resp == nil || resp.StatusCode != http.StatusUpgradeRequired {
+			t.Fatalf("expect 426, got %v %v", resp, err)
+		}
+		if accept := resp.Header.Get(transport.AcceptHeader); accept != "raw" {
+			t.Fatalf("accept %q", accept)
+		}
+
+		dial(t, dialer, transport.Raw, u)
+	})
+
+	t.Run("#raw without tls", func(t *testing.T) {
+		u, _ := echoServer(t, false, &transport.Upgrader{Transports: []transport.Name{transport.WebSocket, transport.Raw}})
+		conn, err := net.Dial("tcp", strings.TrimPrefix(u, "ws://"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		_, _ = conn.Write([]byte("GET / HTTP/1.1\r\nHost: test\r\nUpgrade: " + transport.RawProtocol + "\r\nConnection: Upgrade\r\n\r\n"))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil || resp.StatusCode != http.StatusUpgradeRequired {
+			t.Fatalf("expect 426, got %+v %v", resp, err)
+		}
+		if accept := resp.Header.Get(transport.AcceptHeader); accept != "websocket" {
+			t.Fatalf("accept %q", accept)
+		}
+	})
+
+	t.Run("#parse", func(t *testing.T) {
+		names, err := transport.ParseNames("http2, raw")
+		if err != nil || len(names) != 2 || names[0] != transport.HTTP2 || names[1] != transport.Raw {
+			t.Fatalf("%v %v", names, err)
+		}
+		if _, err = transport.ParseNames("quic"); err == nil {
+			t.Fatal("expect unknown transport error")
+		}
+	})
+}
@@ -0,0 +1,179 @@
+package fakeapiserver
+
+import (
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/version"
+	"net/http"
+	"strings"
+)
+
+var versionInfo = version.Info{
+	Major:      "1",
+	Minor:      "23",
+	GitVersion: "v1.23.5-fake",
+	Platform:   "linux/amd64",
+}
+
+type resource struct {
+	group      string
+	version    string
+	name       string
+	kind       string
+	namespaced bool
+}
+
+func (r *resource) groupResource() schema.GroupResource {
+	return schema.GroupResource{Group: r.group, Resource: r.name}
+}
+
+func (r *resource) apiVersion() string {
+	if r.group == "" {
+		return r.version
+	}
+	return r.group + "/" + r.version
+}
+
+// 支持的资源
+var resources = []*resource{
+	{group: "", version: "v1", name: "namespaces", kind: "Namespace"},
+	{group: "", version: "v1", name: "nodes", kind: "Node"},
+	{group: "", version: "v1", name: "pods", kind: "Pod", namespaced: true},
+	{group: "", version: "v1", name: "configmaps", kind: "ConfigMap", namespaced: true},
+	{group: "", version: "v1", name: "secrets", kind: "Secret", namespaced: true},
+	{group: "", version: "v1", name: "services", kind: "Service", namespaced: true},
+	{group: "apps", version: "v1", name: "deployments", kind: "Deployment", namespaced: true},
+}
+
+func findResource(group, version, name string) *resource {
+	for _, r := range resources {
+		if r.group == group && r.version == version && r.name == name {
+			return r
+		}
+	}
+	return nil
+}
+
+func findKind(apiVersion, kind string) *resource {
+	for _, r := range resources {
+		if r.apiVersion() == apiVersion && r.kind == kind {
+			return r
+		}
+	}
+	return nil
+}
+
+func coreVersions() *metav1.APIVersions {
+	return &metav1.APIVersions{
+		TypeMeta: metav1.TypeMeta{Kind: "APIVersions"},
+		Versions: []string{"v1"},
+		ServerAddressByClientCIDRs: []metav1.ServerAddressByClientCIDR{
+			{ClientCIDR: "0.0.0.0/0", ServerAddress: "127.0.0.1"},
+		},
+	}
+}
+
+func groupList() *metav1.APIGroupList {
+	list := &metav1.APIGroupList{TypeMeta: metav1.TypeMeta{Kind: "APIGroupList", APIVersion: "v1"}}
+	seen := map[string]bool{}
+	for _, r := range resources {
+		if r.group == "" || seen[r.group] {
+			continue
+		}
+		seen[r.group] = true
+		gv := metav1.GroupVersionForDiscovery{GroupVersion: r.apiVersion(), Version: r.version}
+		list.Groups = append(list.Groups, metav1.APIGroup{
+			Name:             r.group,
+			Versions:         []metav1.GroupVersionForDiscovery{gv},
+			PreferredVersion: gv,
+		})
+	}
+	return list
+}
+
+func resourceList(group, version string) *metav1.APIResourceList {
+	list := &metav1.APIResourceList{
+		TypeMeta:     metav1.TypeMeta{Kind: "APIResourceList", APIVersion: "v1"},
+		GroupVersion: schema.GroupVersion{Group: group, Version: version}.String(),
+	}
+	for _, r := range resources {
+		if r.group != group || r.version != version {
+			continue
+		}
+		list.APIResources = append(list.APIResources, metav1.APIResource{
+			Name:       r.name,
+			Namespaced: r.namespaced,
+			Kind:       r.kind,
+			Verbs:      metav1.Verbs{"create", "delete", "get", "list", "update", "watch"},
+		})
+		if r.name == "pods" {
+			list.APIResources = append(list.APIResources, metav1.APIResource{
+				Name:       "pods/exec",
+				Namespaced: true,
+				Kind:       "PodExecOptions",
+				Verbs:      metav1.Verbs{"create", "get"},
+			})
+		}
+	}
+	return list
+}
+
+type resourceRequest struct {
+	group       string
+	version     string
+	namespace   string
+	resource    *resource // 为空表示请求 group version 的 discovery
+	name        string
+	subresource string
+}
+
+// 解析 /api/v1/... 和 /apis/{group}/{version}/...
+func parseRequest(r *http.Request) (*resourceRequest, error) {
+	notFound := apierrors.NewNotFound(schema.GroupResource{}, r.URL.Path)
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	req := &resourceRequest{}
+	switch {
+	case len(parts) >= 2 && parts[0] == "api":
+		req.version, parts = parts[1], parts[2:]
+	case len(parts) >= 3 && parts[0] == "apis":
+		req.group, req.version, parts = parts[1], parts[2], parts[3:]
+	default:
+		return nil, notFound
+	}
+	if req.group == "" && req.version != "v1" {
+		return nil, notFound
+	}
+	if len(parts) == 0 {
+		if findGroupVersion(req.group, req.version) {
+			return req, nil
+		}
+		return nil, notFound
+	}
+
+	if parts[0] == "namespaces" && len(parts) >= 3 {
+		req.namespace, parts = parts[1], parts[2:]
+	}
+	req.resource = findResource(req.group, req.version, parts[0])
+	if req.resource == nil || (req.namespace != "" && !req.resource.namespaced) {
+		return nil, notFound
+	}
+	if len(parts) > 1 {
+		req.name = parts[1]
+	}
+	if len(parts) > 2 {
+		req.subresource = strings.Join(parts[2:], "/")
+	}
+
+	return req, nil
+}
+
+func findGroupVersion(group, version string) bool {
+	for _, r := range resources {
+		if r.group == group && r.version == version {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,298 @@
+// Package fakeapiserver 一个轻量的 kubernetes apiserver 替身,
+// 支持 TLS, bearer token, discovery, 少量资源的增删改查, watch 和 exec upgrade,
+// 用于在没有集群的情况下测试 agent
+package fakeapiserver
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const DefaultToken = "fake-token"
+
+type Option struct {
+	// Token 客户端需要携带的 bearer token, 为空时使用 DefaultToken
+	Token string
+	// Anonymous 为 true 时不校验 token
+	Anonymous bool
+}
+
+type Server struct {
+	*httptest.Server
+
+	opt   Option
+	store *store
+
+	mu       sync.Mutex
+	requests []*http.Request
+}
+
+// RecordedRequest apiserver 收到的请求, 只保留用于断言的部分
+type RecordedRequest struct {
+	Method string
+	Path   string
+	Query  string
+	Header http.Header
+}
+
+func New(opt *Option) *Server {
+	s := &Server{
+		store: newStore(),
+	}
+	if opt != nil {
+		s.opt = *opt
+	}
+	if s.opt.Token == "" {
+		s.opt.Token = DefaultToken
+	}
+
+	// 和真实集群一样预置 default 和 kube-system
+	for _, ns := range []string{metav1.NamespaceDefault, metav1.NamespaceSystem} {
+		_ = s.Add(Object("v1", "Namespace", "", ns))
+	}
+
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(s.serveHTTP))
+
+	return s
+}
+
+// Config 指向 fake apiserver 的 rest.Config
+func (s *Server) Config() *rest.Config {
+	return &rest.Config{
+		Host:        s.URL,
+		BearerToken: s.opt.Token,
+		TLSClientConfig: rest.TLSClientConfig{
+			CAData: s.CAData(),
+		},
+	}
+}
+
+// CAData PEM 格式的服务端证书
+func (s *Server) CAData() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.Certificate().Raw})
+}
+
+// WriteKubeconfig 在 dir 下写入指向 fake apiserver 的 kubeconfig, 返回文件路径
+func (s *Server) WriteKubeconfig(dir string) (string, error) {
+	config := clientcmdapi.NewConfig()
+	config.Clusters["fake"] = &clientcmdapi.Cluster{
+		Server:                   s.URL,
+		CertificateAuthorityData: s.CAData(),
+	}
+	config.AuthInfos["fake"] = &clientcmdapi.AuthInfo{Token: s.opt.Token}
+	config.Contexts["fake"] = &clientcmdapi.Context{Cluster: "fake", AuthInfo: "fake"}
+	config.CurrentContext = "fake"
+
+	path := filepath.Join(dir, "kubeconfig")
+	if err := clientcmd.WriteToFile(*config, path); err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
+
+// Requests 返回收到的所有请求
+func (s *Server) Requests() []RecordedRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := make([]RecordedRequest, 0, len(s.requests))
+	for _, r := range s.requests {
+		list = append(list, RecordedRequest{
+			Method: r.Method,
+			Path:   r.URL.Path,
+			Query:  r.URL.RawQuery,
+			Header: r.Header,
+		})
+	}
+
+	return list
+}
+
+// LastRequest 返回最近一次请求
+func (s *Server) LastRequest() (RecordedRequest, bool) {
+	list := s.Requests()
+	if len(list) == 0 {
+		return RecordedRequest{}, false
+	}
+
+	return list[len(list)-1], true
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests = append(s.requests, r.Clone(r.Context()))
+	s.mu.Unlock()
+
+	if !s.opt.Anonymous && r.Header.Get("Authorization") != "Bearer "+s.opt.Token {
+		writeErr(w, apierrors.NewUnauthorized("Unauthorized"))
+		return
+	}
+
+	switch r.URL.Path {
+	case "/version":
+		writeJSON(w, http.StatusOK, versionInfo)
+		return
+	case "/api":
+		writeJSON(w, http.StatusOK, coreVersions())
+		return
+	case "/apis":
+		writeJSON(w, http.StatusOK, groupList())
+		return
+	case "/healthz", "/readyz", "/livez":
+		_, _ = w.Write([]byte("ok"))
+		return
+	}
+
+	req, err := parseRequest(r)
+	if err != nil {
+		writeErr(w, err)
+		return
+	}
+	if req.resource == nil {
+		// /api/v1, /apis/{group}/{version}
+		writeJSON(w, http.StatusOK, resourceList(req.group, req.version))
+		return
+	}
+
+	s.serveResource(w, r, req)
+}
+
+func (s *Server) serveResource(w http.ResponseWriter, r *http.Request, req *resourceRequest) {
+	switch req.subresource {
+	case "":
+	case "exec", "attach", "portforward":
+		s.serveUpgrade(w, r, req)
+		return
+	default:
+		writeErr(w, apierrors.NewNotFound(req.resource.groupResource(), req.name+"/"+req.subresource))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		switch {
+		case req.name != "":
+			obj, err := s.store.get(req)
+			if err != nil {
+				writeErr(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, obj)
+		case r.URL.Query().Get("watch") == "true" || r.URL.Query().Get("watch") == "1":
+			s.serveWatch(w, r, req)
+		default:
+			list, err := s.store.list(req, r.URL.Query().Get("labelSelector"))
+			if err != nil {
+				writeErr(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, list)
+		}
+	case http.MethodPost:
+		obj, err := decodeObject(r)
+		if err != nil {
+			writeErr(w, err)
+			return
+		}
+		created, err := s.store.create(req, obj)
+		if err != nil {
+			writeErr(w, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, created)
+	case http.MethodPut:
+		obj, err := decodeObject(r)
+		if err != nil {
+			writeErr(w, err)
+			return
+		}
+		updated, err := s.store.update(req, obj)
+		if err != nil {
+			writeErr(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, updated)
+	case http.MethodDelete:
+		deleted, err := s.store.delete(req)
+		if err != nil {
+			writeErr(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, deleted)
+	default:
+		writeErr(w, apierrors.NewMethodNotSupported(req.resource.groupResource(), strings.ToLower(r.Method)))
+	}
+}
+
+// serveUpgrade 模拟 exec/attach: 完成协议升级后原样回显客户端数据
+func (s *Server) serveUpgrade(w http.ResponseWriter, r *http.Request, req *resourceRequest) {
+	if req.resource.name != "pods" {
+		writeErr(w, apierrors.NewNotFound(req.resource.groupResource(), req.name+"/"+req.subresource))
+		return
+	}
+	if _, err := s.store.get(req); err != nil {
+		writeErr(w, err)
+		return
+	}
+	protocol := r.Header.Get("Upgrade")
+	if protocol == "" {
+		writeErr(w, apierrors.NewBadRequest("Upgrade request required"))
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		writeErr(w, apierrors.NewInternalError(fmt.Errorf("hijack not supported")))
+		return
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	_, _ = fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: %s\r\n\r\n", protocol)
+	if err = rw.Flush(); err != nil {
+		return
+	}
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := rw.Read(buf)
+		if n > 0 {
+			if _, werr := conn.Write(buf[:n]); werr != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeErr(w http.ResponseWriter, err error) {
+	status := apierrors.NewInternalError(err).ErrStatus
+	if se, ok := err.(apierrors.APIStatus); ok {
+		status = se.Status()
+	}
+	status.TypeMeta = metav1.TypeMeta{Kind: "Status", APIVersion: "v1"}
+	writeJSON(w, int(status.Code), &status)
+}
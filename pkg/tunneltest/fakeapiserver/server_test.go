@@ -0,0 +1,191 @@
+package fakeapiserver
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+	"net/http"
+	"testing"
+	"time"
+)
+
+var podGVR = schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+
+func newPod(namespace, name string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion("v1")
+	obj.SetKind("Pod")
+	obj.SetNamespace(namespace)
+	obj.SetName(name)
+	return obj
+}
+
+func TestServer(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("#discovery", func(t *testing.T) {
+		s := New(nil)
+		defer s.Close()
+
+		dc, err := discovery.NewDiscoveryClientForConfig(s.Config())
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := dc.ServerVersion()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.GitVersion != versionInfo.GitVersion {
+			t.Fatalf("unexpected version %+v", v)
+		}
+
+		list, err := dc.ServerResourcesForGroupVersion("apps/v1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(list.APIResources) != 1 || list.APIResources[0].Name != "deployments" {
+			t.Fatalf("unexpected resources %+v", list.APIResources)
+		}
+	})
+
+	t.Run("#unauthorized", func(t *testing.T) {
+		s := New(nil)
+		defer s.Close()
+
+		config := s.Config()
+		config.BearerToken = "wrong"
+		client := dynamic.NewForConfigOrDie(config)
+
+		_, err := client.Resource(podGVR).Namespace("default").List(ctx, metav1.ListOptions{})
+		if !apierrors.IsUnauthorized(err) {
+			t.Fatalf("expect unauthorized, got %v", err)
+		}
+	})
+
+	t.Run("#crud", func(t *testing.T) {
+		s := New(nil)
+		defer s.Close()
+		pods := dynamic.NewForConfigOrDie(s.Config()).Resource(podGVR).Namespace("default")
+
+		created, err := pods.Create(ctx, newPod("default", "nginx"), metav1.CreateOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = pods.Create(ctx, newPod("default", "nginx"), metav1.CreateOptions{}); !apierrors.IsAlreadyExists(err) {
+			t.Fatalf("expect already exists, got %v", err)
+		}
+
+		created.SetLabels(map[string]string{"app": "nginx"})
+		if _, err = pods.Update(ctx, created, metav1.UpdateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = pods.Update(ctx, created, metav1.UpdateOptions{}); !apierrors.IsConflict(err) {
+			t.Fatalf("expect conflict, got %v", err)
+		}
+
+		list, err := pods.List(ctx, metav1.ListOptions{LabelSelector: "app=nginx"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(list.Items) != 1 {
+			t.Fatalf("expect 1 pod, got %d", len(list.Items))
+		}
+
+		if err = pods.Delete(ctx, "nginx", metav1.DeleteOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = pods.Get(ctx, "nginx", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+			t.Fatalf("expect not found, got %v", err)
+		}
+	})
+
+	t.Run("#watch", func(t *testing.T) {
+		s := New(nil)
+		defer s.Close()
+		if err := s.Add(newPod("default", "a")); err != nil {
+			t.Fatal(err)
+		}
+		pods := dynamic.NewForConfigOrDie(s.Config()).Resource(podGVR).Namespace("default")
+
+		w, err := pods.Watch(ctx, metav1.ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer w.Stop()
+
+		if _, err = pods.Create(ctx, newPod("default", "b"), metav1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, name := range []string{"a", "b"} {
+			select {
+			case e := <-w.ResultChan():
+				obj := e.Object.(*unstructured.Unstructured)
+				if e.Type != watch.Added || obj.GetName() != name {
+					t.Fatalf("unexpected event %s %s", e.Type, obj.GetName())
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("wait event for %s timeout", name)
+			}
+		}
+	})
+
+	t.Run("#exec upgrade", func(t *testing.T) {
+		s := New(&Option{Anonymous: true})
+		defer s.Close()
+		if err := s.Add(newPod("default", "a")); err != nil {
+			t.Fatal(err)
+		}
+
+		client, err := rest.HTTPClientFor(s.Config())
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Post(s.URL+"/api/v1/namespaces/default/pods/a/exec", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+
+		// 没有 Upgrade 头时返回 BadRequest
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("status %d, body %s", resp.StatusCode, b)
+		}
+
+		conn, err := tls.Dial("tcp", s.Listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		_, _ = io.WriteString(conn, "POST /api/v1/namespaces/default/pods/a/exec HTTP/1.1\r\nHost: fake\r\nConnection: Upgrade\r\nUpgrade: SPDY/3.1\r\n\r\n")
+		br := bufio.NewReader(conn)
+		upgradeResp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if upgradeResp.StatusCode != http.StatusSwitchingProtocols {
+			t.Fatalf("expect 101, got %d", upgradeResp.StatusCode)
+		}
+
+		_, _ = io.WriteString(conn, "hello")
+		echo := make([]byte, 5)
+		if _, err = io.ReadFull(br, echo); err != nil {
+			t.Fatal(err)
+		}
+		if string(echo) != "hello" {
+			t.Fatalf("unexpected echo %q", echo)
+		}
+	})
+}
@@ -0,0 +1,326 @@
+package fakeapiserver
+
+import (
+	"encoding/json"
+	"fmt"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/apimachinery/pkg/watch"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type store struct {
+	mu              sync.RWMutex
+	resourceVersion int64
+	objects         map[string]*unstructured.Unstructured // key: resource/namespace/name
+	watchers        map[*watcher]struct{}
+}
+
+type watcher struct {
+	resource  *resource
+	namespace string
+	events    chan watch.Event
+}
+
+func newStore() *store {
+	return &store{
+		objects:  map[string]*unstructured.Unstructured{},
+		watchers: map[*watcher]struct{}{},
+	}
+}
+
+func objectKey(r *resource, namespace, name string) string {
+	return r.apiVersion() + "/" + r.name + "/" + namespace + "/" + name
+}
+
+// Object 构造一个只有基本字段的对象
+func Object(apiVersion, kind, namespace, name string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion(apiVersion)
+	obj.SetKind(kind)
+	obj.SetNamespace(namespace)
+	obj.SetName(name)
+	return obj
+}
+
+// Add 直接写入一个对象, 用于准备测试数据
+func (s *Server) Add(obj *unstructured.Unstructured) error {
+	r := findKind(obj.GetAPIVersion(), obj.GetKind())
+	if r == nil {
+		return fmt.Errorf("unsupported kind %s %s", obj.GetAPIVersion(), obj.GetKind())
+	}
+
+	_, err := s.store.create(&resourceRequest{
+		group:     r.group,
+		version:   r.version,
+		namespace: obj.GetNamespace(),
+		resource:  r,
+	}, obj.DeepCopy())
+	return err
+}
+
+// ResourceVersion 当前最新的 resourceVersion
+func (s *Server) ResourceVersion() string {
+	s.store.mu.RLock()
+	defer s.store.mu.RUnlock()
+
+	return strconv.FormatInt(s.store.resourceVersion, 10)
+}
+
+func (st *store) get(req *resourceRequest) (*unstructured.Unstructured, error) {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	obj, ok := st.objects[objectKey(req.resource, req.namespace, req.name)]
+	if !ok {
+		return nil, apierrors.NewNotFound(req.resource.groupResource(), req.name)
+	}
+
+	return obj.DeepCopy(), nil
+}
+
+func (st *store) list(req *resourceRequest, labelSelector string) (*unstructured.UnstructuredList, error) {
+	selector, err := labels.Parse(labelSelector)
+	if err != nil {
+		return nil, apierrors.NewBadRequest(err.Error())
+	}
+
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	list := &unstructured.UnstructuredList{}
+	list.SetAPIVersion(req.resource.apiVersion())
+	list.SetKind(req.resource.kind + "List")
+	list.SetResourceVersion(strconv.FormatInt(st.resourceVersion, 10))
+
+	for _, obj := range st.objects {
+		if !st.match(req.resource, req.namespace, obj) {
+			continue
+		}
+		if !selector.Matches(labels.Set(obj.GetLabels())) {
+			continue
+		}
+		// 与 apiserver 一样, List 中的元素不带 apiVersion 和 kind
+		item := obj.DeepCopy()
+		delete(item.Object, "apiVersion")
+		delete(item.Object, "kind")
+		list.Items = append(list.Items, *item)
+	}
+	sort.Slice(list.Items, func(i, j int) bool {
+		a, b := list.Items[i], list.Items[j]
+		if a.GetNamespace() != b.GetNamespace() {
+			return a.GetNamespace() < b.GetNamespace()
+		}
+		return a.GetName() < b.GetName()
+	})
+
+	return list, nil
+}
+
+func (st *store) create(req *resourceRequest, obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	if obj.GetName() == "" {
+		if obj.GetGenerateName() == "" {
+			return nil, apierrors.NewBadRequest("name or generateName is required")
+		}
+		obj.SetName(obj.GetGenerateName() + string(uuid.NewUUID())[:5])
+	}
+	if req.resource.namespaced {
+		if req.namespace == "" {
+			req.namespace = obj.GetNamespace()
+		}
+		if req.namespace == "" {
+			req.namespace = metav1.NamespaceDefault
+		}
+		obj.SetNamespace(req.namespace)
+	}
+	obj.SetAPIVersion(req.resource.apiVersion())
+	obj.SetKind(req.resource.kind)
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	key := objectKey(req.resource, req.namespace, obj.GetName())
+	if _, ok := st.objects[key]; ok {
+		return nil, apierrors.NewAlreadyExists(req.resource.groupResource(), obj.GetName())
+	}
+
+	obj.SetUID(uuid.NewUUID())
+	obj.SetCreationTimestamp(metav1.NewTime(time.Now()))
+	st.resourceVersion++
+	obj.SetResourceVersion(strconv.FormatInt(st.resourceVersion, 10))
+	st.objects[key] = obj
+	st.notify(req.resource, watch.Added, obj)
+
+	return obj.DeepCopy(), nil
+}
+
+func (st *store) update(req *resourceRequest, obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	if obj.GetName() != req.name {
+		return nil, apierrors.NewBadRequest("the name of the object does not match the name on the URL")
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	key := objectKey(req.resource, req.namespace, req.name)
+	old, ok := st.objects[key]
+	if !ok {
+		return nil, apierrors.NewNotFound(req.resource.groupResource(), req.name)
+	}
+	if rv := obj.GetResourceVersion(); rv != "" && rv != old.GetResourceVersion() {
+		return nil, apierrors.NewConflict(req.resource.groupResource(), req.name,
+			fmt.Errorf("the object has been modified; please apply your changes to the latest version and try again"))
+	}
+
+	obj.SetAPIVersion(req.resource.apiVersion())
+	obj.SetKind(req.resource.kind)
+	obj.SetNamespace(req.namespace)
+	obj.SetUID(old.GetUID())
+	obj.SetCreationTimestamp(old.GetCreationTimestamp())
+	st.resourceVersion++
+	obj.SetResourceVersion(strconv.FormatInt(st.resourceVersion, 10))
+	st.objects[key] = obj
+	st.notify(req.resource, watch.Modified, obj)
+
+	return obj.DeepCopy(), nil
+}
+
+func (st *store) delete(req *resourceRequest) (*unstructured.Unstructured, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	key := objectKey(req.resource, req.namespace, req.name)
+	obj, ok := st.objects[key]
+	if !ok {
+		return nil, apierrors.NewNotFound(req.resource.groupResource(), req.name)
+	}
+	delete(st.objects, key)
+	st.resourceVersion++
+	obj.SetResourceVersion(strconv.FormatInt(st.resourceVersion, 10))
+	st.notify(req.resource, watch.Deleted, obj)
+
+	return obj.DeepCopy(), nil
+}
+
+func (st *store) match(r *resource, namespace string, obj *unstructured.Unstructured) bool {
+	if obj.GetAPIVersion() != r.apiVersion() || obj.GetKind() != r.kind {
+		return false
+	}
+	return namespace == "" || obj.GetNamespace() == namespace
+}
+
+// 调用方需持有写锁
+func (st *store) notify(r *resource, typ watch.EventType, obj *unstructured.Unstructured) {
+	for w := range st.watchers {
+		if w.resource != r || !st.match(r, w.namespace, obj) {
+			continue
+		}
+		select {
+		case w.events <- watch.Event{Type: typ, Object: obj.DeepCopy()}:
+		default:
+			// watcher 太慢, 丢弃事件
+		}
+	}
+}
+
+func (st *store) watch(req *resourceRequest, sendInitial bool) (*watcher, []watch.Event) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	w := &watcher{
+		resource:  req.resource,
+		namespace: req.namespace,
+		events:    make(chan watch.Event, 100),
+	}
+	st.watchers[w] = struct{}{}
+
+	var initial []watch.Event
+	if sendInitial {
+		for _, obj := range st.objects {
+			if st.match(req.resource, req.namespace, obj) {
+				initial = append(initial, watch.Event{Type: watch.Added, Object: obj.DeepCopy()})
+			}
+		}
+	}
+
+	return w, initial
+}
+
+func (st *store) stopWatch(w *watcher) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	delete(st.watchers, w)
+}
+
+// serveWatch 以 json 流的方式输出事件, 直到客户端断开或 timeoutSeconds 到期
+func (s *Server) serveWatch(w http.ResponseWriter, r *http.Request, req *resourceRequest) {
+	rv := r.URL.Query().Get("resourceVersion")
+	watcher, initial := s.store.watch(req, rv == "" || rv == "0")
+	defer s.store.stopWatch(watcher)
+
+	var timeout <-chan time.Time
+	if seconds, err := strconv.Atoi(r.URL.Query().Get("timeoutSeconds")); err == nil && seconds > 0 {
+		timer := time.NewTimer(time.Duration(seconds) * time.Second)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+
+	enc := json.NewEncoder(w)
+	send := func(e watch.Event) bool {
+		if err := enc.Encode(&metav1.WatchEvent{Type: string(e.Type), Object: runtimeRaw(e)}); err != nil {
+			return false
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return true
+	}
+
+	for _, e := range initial {
+		if !send(e) {
+			return
+		}
+	}
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	for {
+		select {
+		case e := <-watcher.events:
+			if !send(e) {
+				return
+			}
+		case <-timeout:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func runtimeRaw(e watch.Event) runtime.RawExtension {
+	b, _ := json.Marshal(e.Object)
+	return runtime.RawExtension{Raw: b}
+}
+
+func decodeObject(r *http.Request) (*unstructured.Unstructured, error) {
+	obj := &unstructured.Unstructured{}
+	if err := json.NewDecoder(r.Body).Decode(&obj.Object); err != nil {
+		return nil, apierrors.NewBadRequest(fmt.Sprintf("decode body: %v", err))
+	}
+	return obj, nil
+}
@@ -0,0 +1,127 @@
+package tunneltest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+type ProxyOption struct {
+	// Authenticate 不为空时校验每个 CONNECT 请求, 返回的 challenge 不为空时回复 407.
+	// round 是该请求在同一个 tcp 连接上的序号, 用于模拟 NTLM 这类基于连接的多轮认证
+	Authenticate func(req *http.Request, round int) (challenge string)
+
+	// Hosts 把 CONNECT 的目标改写为实际地址, 如 gateway.test:80 -> 127.0.0.1:1234,
+	// 代理对 localhost 和回环地址不生效, 测试时使用不经过 DNS 的域名
+	Hosts map[string]string
+}
+
+// Proxy 本地的 HTTP CONNECT 代理, 记录收到的 CONNECT 请求
+type Proxy struct {
+	opt ProxyOption
+	ln  net.Listener
+
+	mu       sync.Mutex
+	requests []*http.Request
+	wg       sync.WaitGroup
+}
+
+// NewProxy 在随机端口上启动代理, 并通过 t.Cleanup 关闭
+func NewProxy(t testing.TB, opt *ProxyOption) *Proxy {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen proxy: %v", err)
+	}
+	p := &Proxy{ln: ln}
+	if opt != nil {
+		p.opt = *opt
+	}
+
+	p.wg.Add(1)
+	go p.serve()
+	t.Cleanup(p.Close)
+
+	return p
+}
+
+// URL 代理地址, 如 http://127.0.0.1:1234
+func (p *Proxy) URL() string {
+	return "http://" + p.ln.Addr().String()
+}
+
+// Requests 已收到的 CONNECT 请求, 包括认证失败的
+func (p *Proxy) Requests() []*http.Request {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return append([]*http.Request(nil), p.requests...)
+}
+
+func (p *Proxy) Close() {
+	_ = p.ln.Close()
+	p.wg.Wait()
+}
+
+func (p *Proxy) serve() {
+	defer p.wg.Done()
+	for {
+		conn, err := p.ln.Accept()
+		if err != nil {
+			return
+		}
+		go p.handle(conn)
+	}
+}
+
+func (p *Proxy) handle(conn net.Conn) {
+	defer conn.Close()
+
+	br := bufio.NewReader(conn)
+	for round := 0; ; round++ {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		p.mu.Lock()
+		p.requests = append(p.requests, req)
+		p.mu.Unlock()
+
+		if req.Method != http.MethodConnect {
+			fmt.Fprint(conn, "HTTP/1.1 405 Method Not Allowed\r\nContent-Length: 0\r\n\r\n")
+			continue
+		}
+		if p.opt.Authenticate != nil {
+			if challenge := p.opt.Authenticate(req, round); challenge != "" {
+				fmt.Fprintf(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: %s\r\nContent-Length: 0\r\n\r\n", challenge)
+				continue
+			}
+		}
+
+		target := req.Host
+		if addr, ok := p.opt.Hosts[target]; ok {
+			target = addr
+		}
+		upstream, err := net.DialTimeout("tcp", target, 5*time.Second)
+		if err != nil {
+			fmt.Fprintf(conn, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n")
+			return
+		}
+		defer upstream.Close()
+		fmt.Fprint(conn, "HTTP/1.1 200 Connection Established\r\n\r\n")
+
+		// 任意一端关闭后两端都关闭
+		go func() {
+			_, _ = io.Copy(upstream, br)
+			_ = upstream.Close()
+		}()
+		_, _ = io.Copy(conn, upstream)
+		return
+	}
+}
@@ -0,0 +1,284 @@
+// Package tunneltest 在同一进程内启动 gateway 和若干 agent, 用于端到端测试
+package tunneltest
+
+import (
+	"context"
+	"fmt"
+	"k8s-tunnel/pkg/agent"
+	"k8s-tunnel/pkg/gateway"
+	"k8s-tunnel/pkg/tunneltest/fakeapiserver"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	DefaultReconnectInterval = 100 * time.Millisecond
+	DefaultWaitTimeout       = 5 * time.Second
+)
+
+type Option struct {
+	// Gateway 为空时使用默认配置
+	Gateway *gateway.Option
+
+	// Upstream 为 agent 创建上游服务, 为空时每个 agent 使用 EchoHandler
+	Upstream func(agentName string) http.Handler
+
+	// APIServer 不为空时 agent 通过 K8sReverseProxyHandler 代理到该 fake apiserver, 忽略 Upstream
+	APIServer *fakeapiserver.Server
+
+	// AgentOption 可以在启动前修改 agent 的配置
+	AgentOption func(opt *agent.Option)
+}
+
+type Harness struct {
+	t   testing.TB
+	opt Option
+
+	Gateway *gateway.Gateway
+	server  *httptest.Server
+	addr    string
+
+	mu     sync.Mutex
+	agents map[string]*Agent
+}
+
+type Agent struct {
+	*agent.Agent
+	Upstream *httptest.Server
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// New 在随机端口上启动 gateway, 并通过 t.Cleanup 关闭所有服务
+func New(t testing.TB, opt *Option) *Harness {
+	t.Helper()
+
+	h := &Harness{
+		t:      t,
+		agents: map[string]*Agent{},
+	}
+	if opt != nil {
+		h.opt = *opt
+	}
+	if h.opt.Upstream == nil {
+		h.opt.Upstream = func(string) http.Handler { return EchoHandler() }
+	}
+
+	h.StartGateway()
+	t.Cleanup(h.Close)
+
+	return h
+}
+
+// GatewayHost gateway 的 host:port, 重启后保持不变
+func (h *Harness) GatewayHost() string {
+	return h.addr
+}
+
+// URL 返回通过 gateway 访问 agent 上游 path 的地址, path 可以带 query, 开启 CA 时为 https
+func (h *Harness) URL(agentName, path string) string {
+	scheme := "http"
+	if h.opt.Gateway != nil && h.opt.Gateway.CA != nil {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s/proxies/%s%s", scheme, h.addr, agentName, path)
+}
+
+// StartGateway 启动 gateway, 重启时复用之前的端口
+func (h *Harness) StartGateway() {
+	h.t.Helper()
+
+	addr := h.addr
+	if addr == "" {
+		addr = "127.0.0.1:0"
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		h.t.Fatalf("listen gateway: %v", err)
+	}
+
+	var gwOpt gateway.Option
+	if h.opt.Gateway != nil {
+		gwOpt = *h.opt.Gateway
+	}
+	gw := gateway.NewGateway(&gwOpt)
+
+	tlsConfig, err := gw.TLSConfig()
+	if err != nil {
+		h.t.Fatalf("gateway tls config: %v", err)
+	}
+
+	server := httptest.NewUnstartedServer(gw.Handler())
+	_ = server.Listener.Close()
+	server.Listener = ln
+	if tlsConfig != nil {
+		server.TLS = tlsConfig
+		server.StartTLS()
+	} else {
+		server.Start()
+	}
+
+	h.mu.Lock()
+	h.Gateway = gw
+	h.server = server
+	h.addr = ln.Addr().String()
+	h.mu.Unlock()
+}
+
+// StopGateway 关闭 gateway 及其上的所有 tunnel
+func (h *Harness) StopGateway() {
+	h.mu.Lock()
+	gw, server := h.Gateway, h.server
+	h.server = nil
+	h.mu.Unlock()
+
+	if server == nil {
+		return
+	}
+	for _, tunnel := range gw.Tunnels() {
+		tunnel.Close()
+	}
+	// HTTP/2 的连接一直处于活跃状态, Close 不会关闭
+	server.CloseClientConnections()
+	server.Close()
+}
+
+// StartAgent 启动名为 name 的 agent, 并等待其注册成功
+func (h *Harness) StartAgent(name string) *Agent {
+	h.t.Helper()
+
+	h.mu.Lock()
+	a, ok := h.agents[name]
+	h.mu.Unlock()
+	if ok && a.done != nil {
+		h.t.Fatalf("agent %s already running", name)
+	}
+	if !ok {
+		a = &Agent{Upstream: httptest.NewServer(h.opt.Upstream(name))}
+	}
+
+	u, _ := url.Parse(a.Upstream.URL)
+	opt := &agent.Option{
+		AgentName:         name,
+		GatewayHost:       h.addr,
+		Handler:           agent.ReverseProxyHandler(u.Scheme, u.Host),
+		ReconnectInterval: DefaultReconnectInterval,
+	}
+	if h.opt.APIServer != nil {
+		handler, err := agent.K8sReverseProxyHandler(h.opt.APIServer.Config())
+		if err != nil {
+			h.t.Fatal(err)
+		}
+		opt.Handler = handler
+	}
+	if h.opt.AgentOption != nil {
+		h.opt.AgentOption(opt)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	a.Agent = agent.NewAgent(opt)
+	a.cancel = cancel
+	a.done = make(chan struct{})
+	go func(done chan struct{}) {
+		defer close(done)
+		_ = a.Serve(ctx)
+	}(a.done)
+
+	h.mu.Lock()
+	h.agents[name] = a
+	h.mu.Unlock()
+
+	if err := h.WaitForAgent(name, DefaultWaitTimeout); err != nil {
+		h.t.Fatal(err)
+	}
+
+	return a
+}
+
+// StopAgent 停止 agent 并等待 gateway 感知到断开
+func (h *Harness) StopAgent(name string) {
+	h.t.Helper()
+
+	h.mu.Lock()
+	a, ok := h.agents[name]
+	h.mu.Unlock()
+	if !ok || a.done == nil {
+		return
+	}
+
+	a.cancel()
+	<-a.done
+	a.done = nil
+
+	if err := h.WaitForAgentGone(name, DefaultWaitTimeout); err != nil {
+		h.t.Fatal(err)
+	}
+}
+
+// WaitForAgent 等待 agent 注册到当前 gateway
+func (h *Harness) WaitForAgent(name string, timeout time.Duration) error {
+	return poll(timeout, func() bool {
+		_, ok := h.gateway().Tunnel(name)
+		return ok
+	}, fmt.Sprintf("agent %s not registered", name))
+}
+
+// WaitForMetadata 等待 agent 上报元数据
+func (h *Harness) WaitForMetadata(name string, timeout time.Duration) error {
+	return poll(timeout, func() bool {
+		tunnel, ok := h.gateway().Tunnel(name)
+		return ok && !tunnel.Metadata().UpdatedAt.IsZero()
+	}, fmt.Sprintf("agent %s metadata not reported", name))
+}
+
+// WaitForAgentGone 等待 gateway 上 agent 的 tunnel 关闭
+func (h *Harness) WaitForAgentGone(name string, timeout time.Duration) error {
+	return poll(timeout, func() bool {
+		_, ok := h.gateway().Tunnel(name)
+		return !ok
+	}, fmt.Sprintf("agent %s still registered", name))
+}
+
+func (h *Harness) Close() {
+	h.mu.Lock()
+	agents := make([]*Agent, 0, len(h.agents))
+	for _, a := range h.agents {
+		agents = append(agents, a)
+	}
+	h.mu.Unlock()
+
+	for _, a := range agents {
+		if a.done != nil {
+			a.cancel()
+			<-a.done
+			a.done = nil
+		}
+		a.Upstream.Close()
+	}
+	h.StopGateway()
+}
+
+func (h *Harness) gateway() *gateway.Gateway {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.Gateway
+}
+
+func poll(timeout time.Duration, cond func() bool, msg string) error {
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s after %s", msg, timeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return nil
+}
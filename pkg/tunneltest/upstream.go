@@ -0,0 +1,32 @@
+package tunneltest
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+)
+
+// EchoResponse EchoHandler 返回的内容
+type EchoResponse struct {
+	Method string      `json:"method"`
+	Path   string      `json:"path"`
+	Query  string      `json:"query"`
+	Header http.Header `json:"header"`
+	Body   string      `json:"body"`
+}
+
+// EchoHandler 把收到的请求以 json 原样返回, 便于断言代理结果
+func EchoHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(&EchoResponse{
+			Method: r.Method,
+			Path:   r.URL.Path,
+			Query:  r.URL.RawQuery,
+			Header: r.Header,
+			Body:   string(body),
+		})
+	})
+}
@@ -0,0 +1,57 @@
+package utils
+
+import (
+	"context"
+	"sync"
+)
+
+// Inflight 进行中的请求数, 归零时唤醒 Wait. 零值可用
+type Inflight struct {
+	mu   sync.Mutex
+	n    int64
+	idle chan struct{} // 从 0 开始计数时创建, 归零时关闭
+}
+
+func (c *Inflight) Add() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.n == 0 {
+		c.idle = make(chan struct{})
+	}
+	c.n++
+}
+
+func (c *Inflight) Done() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.n--
+	if c.n == 0 {
+		close(c.idle)
+	}
+}
+
+func (c *Inflight) Count() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.n
+}
+
+// Wait 等待进行中的请求全部完成, ctx 先结束时返回 false
+func (c *Inflight) Wait(ctx context.Context) bool {
+	c.mu.Lock()
+	n, idle := c.n, c.idle
+	c.mu.Unlock()
+	if n == 0 {
+		return true
+	}
+
+	select {
+	case <-idle:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -1,10 +1,12 @@
 package utils
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net/url"
 	"testing"
+	"time"
 )
 
 func Test(t *testing.T) {
@@ -24,4 +26,27 @@ func Test(t *testing.T) {
 		u, _ := url.Parse("https://www.baidu.com")
 		fmt.Println(u)
 	})
+
+	t.Run("#Inflight", func(t *testing.T) {
+		c := &Inflight{}
+		if !c.Wait(context.Background()) {
+			t.Fatal("expect idle")
+		}
+
+		c.Add()
+		c.Add()
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		if c.Wait(ctx) || c.Count() != 2 {
+			t.Fatalf("expect timeout with 2 in flight, got %d", c.Count())
+		}
+
+		go func() {
+			c.Done()
+			c.Done()
+		}()
+		if !c.Wait(context.Background()) || c.Count() != 0 {
+			t.Fatalf("expect idle, got %d", c.Count())
+		}
+	})
 }
@@ -0,0 +1,4 @@
+package version
+
+// Version 编译时通过 -ldflags "-X k8s-tunnel/pkg/version.Version=v0.1.0" 设置
+var Version = "dev"